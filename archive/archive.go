@@ -0,0 +1,344 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DAY_FORMAT = "2006-01-02"
+
+// Archive appends records to one gzipped JSONL file per day (UTC), and
+// deletes the days that fall out of the retention period
+type Archive struct {
+	mu            sync.Mutex
+	dir           string
+	retentionDays int
+	day           string
+	file          *os.File
+	writer        *gzip.Writer
+}
+
+// Open creates the archive folder if needed. A retention of 0 days keeps
+// everything.
+func Open(dir string, retentionDays int) (*Archive, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	a := &Archive{dir: dir, retentionDays: retentionDays}
+	a.purge(time.Now().UTC())
+	return a, nil
+}
+
+// Write appends a record to the file of the day it happened. Each write is
+// flushed, so a crash loses nothing that was written before it.
+func (a *Archive) Write(t time.Time, record interface{}) error {
+	if a == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	day := t.UTC().Format(DAY_FORMAT)
+	if day != a.day {
+		if err := a.rotate(day); err != nil {
+			return err
+		}
+		a.purge(t.UTC())
+	}
+
+	if _, err := a.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return a.writer.Flush()
+}
+
+// rotate closes the current file and starts a new one for the day. A day that
+// already has a file from an earlier run gets another part, since appending to
+// a gzip stream that wasn't closed properly would corrupt it.
+func (a *Archive) rotate(day string) error {
+	if err := a.closeFile(); err != nil {
+		log.Printf("WARNING: [ARCHIVE] Couldn't close %s: %v", a.day, err)
+	}
+
+	name := filepath.Join(a.dir, day+".jsonl.gz")
+	for part := 1; ; part++ {
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = filepath.Join(a.dir, fmt.Sprintf("%s.%d.jsonl.gz", day, part))
+	}
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	a.day = day
+	a.file = file
+	a.writer = gzip.NewWriter(file)
+	return nil
+}
+
+func (a *Archive) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+
+	err := errors.Join(a.writer.Close(), a.file.Close())
+	a.file = nil
+	a.writer = nil
+	a.day = ""
+	return err
+}
+
+// purge deletes the files of days older than the retention period
+func (a *Archive) purge(now time.Time) {
+	if a.retentionDays <= 0 {
+		return
+	}
+
+	cutoff := now.AddDate(0, 0, -a.retentionDays).Format(DAY_FORMAT)
+
+	files, _ := filepath.Glob(filepath.Join(a.dir, "*.jsonl.gz"))
+	for _, file := range files {
+		if fileDay(file) >= cutoff {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("WARNING: [ARCHIVE] Couldn't delete %s: %v", file, err)
+			continue
+		}
+		log.Printf("[ARCHIVE] Deleted %s, past the %d day retention", filepath.Base(file), a.retentionDays)
+	}
+}
+
+func (a *Archive) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeFile()
+}
+
+func fileDay(file string) string {
+	name := filepath.Base(file)
+	if len(name) < len(DAY_FORMAT) {
+		return ""
+	}
+	return name[:len(DAY_FORMAT)]
+}
+
+// dayFiles returns the files of a day, oldest part first
+func dayFiles(dir string, day string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, day+"*.jsonl.gz"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		// "day.jsonl.gz" comes before "day.1.jsonl.gz", then by part number
+		pi, pj := partNumber(files[i]), partNumber(files[j])
+		return pi < pj
+	})
+
+	return files, nil
+}
+
+func partNumber(file string) int {
+	name := strings.TrimSuffix(filepath.Base(file), ".jsonl.gz")
+	var part int
+	fmt.Sscanf(strings.TrimPrefix(name[len(DAY_FORMAT):], "."), "%d", &part)
+	return part
+}
+
+// MissingDays lists the days between from and to (inclusive) that have no
+// archive file
+func MissingDays(dir string, from time.Time, to time.Time) ([]string, error) {
+	missing := make([]string, 0)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		files, err := dayFiles(dir, day.Format(DAY_FORMAT))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			missing = append(missing, day.Format(DAY_FORMAT))
+		}
+	}
+	return missing, nil
+}
+
+// ReadDay calls fn with every record archived on the day. A file cut short
+// by a crash is read up to the last complete record.
+func ReadDay(dir string, day time.Time, fn func(record []byte) error) error {
+	files, err := dayFiles(dir, day.UTC().Format(DAY_FORMAT))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := readFile(file, fn); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+
+	return nil
+}
+
+func readFile(file string, fn func(record []byte) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, err := gzip.NewReader(f)
+	if errors.Is(err, io.EOF) {
+		// Created but never written to
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return nil
+}
+
+// files returns every archive file, oldest day and part first
+func files(dir string) ([]string, error) {
+	all, err := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if di, dj := fileDay(all[i]), fileDay(all[j]); di != dj {
+			return di < dj
+		}
+		return partNumber(all[i]) < partNumber(all[j])
+	})
+
+	return all, nil
+}
+
+// ReadAll calls fn with every archived record, oldest day first
+func ReadAll(dir string, fn func(record []byte) error) error {
+	all, err := files(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range all {
+		if err := readFile(file, fn); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+
+	return nil
+}
+
+// Erase removes the records match returns true for from the archive, and
+// returns how many there were. The file being written to is closed first,
+// the next write starts another part.
+func (a *Archive) Erase(match func(record []byte) bool) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.closeFile(); err != nil {
+		log.Printf("WARNING: [ARCHIVE] Couldn't close %s: %v", a.day, err)
+	}
+	return Erase(a.dir, match)
+}
+
+// Erase removes the records match returns true for from the archive in dir,
+// which nothing may be writing to, and returns how many there were. Only the
+// files that have such records are rewritten.
+func Erase(dir string, match func(record []byte) bool) (int, error) {
+	all, err := files(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	erased := 0
+	for _, file := range all {
+		count, err := eraseFile(file, match)
+		erased += count
+		if err != nil {
+			return erased, fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+
+	return erased, nil
+}
+
+// eraseFile rewrites a file without the matching records, through a
+// temporary file that replaces it once it's complete
+func eraseFile(file string, match func(record []byte) bool) (int, error) {
+	matches := 0
+	err := readFile(file, func(record []byte) error {
+		if match(record) {
+			matches++
+		}
+		return nil
+	})
+	if err != nil || matches == 0 {
+		return 0, err
+	}
+
+	rewritten := file + ".erase"
+	out, err := os.OpenFile(rewritten, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	writer := gzip.NewWriter(out)
+
+	err = readFile(file, func(record []byte) error {
+		if match(record) {
+			return nil
+		}
+		_, err := writer.Write(append(record, '\n'))
+		return err
+	})
+	err = errors.Join(err, writer.Close(), out.Sync(), out.Close())
+	if err != nil {
+		os.Remove(rewritten)
+		return 0, err
+	}
+
+	if err := os.Rename(rewritten, file); err != nil {
+		os.Remove(rewritten)
+		return 0, err
+	}
+	return matches, nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"tinylytics/archive"
+	"tinylytics/config"
+	"tinylytics/constants"
+	"tinylytics/db"
+	"tinylytics/event"
+	"tinylytics/helpers"
+	"tinylytics/routes"
+)
+
+// runCommand runs one of the maintenance commands instead of the server. They
+// open the databases themselves, so the server has to be stopped first.
+func runCommand(name string, args []string) {
+	switch name {
+	case "reprocess":
+		reprocessCommand(args)
+	case "convert":
+		convertCommand(args)
+	case "check":
+		checkCommand(args)
+	case "migrate":
+		migrateCommand(args)
+	case "backup":
+		backupCommand(args)
+	case "restore":
+		restoreCommand(args)
+	case "export":
+		exportCommand(args)
+	case "privacy":
+		privacyCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\nCommands:\n  reprocess  rebuild a site's sessions from the event archive\n  convert    copy a site's data to the other storage backend\n  check      compare a site's SQLite and DuckDB databases\n  migrate    show (status) or apply (up) schema migrations\n  backup     take a snapshot of a site's database\n  restore    replace a site's database with a snapshot\n  export     write a site's raw sessions or events to Parquet or CSV\n  privacy    export (access) or delete (erase) everything kept about a visitor\n", name)
+		os.Exit(2)
+	}
+}
+
+// commandSites returns the site given with -site, or every site when empty
+func commandSites(site string) []string {
+	if site != "" {
+		if _, err := helpers.FindWebsite(site); err != nil {
+			log.Fatalf("%s isn't a configured site", site)
+		}
+		return []string{site}
+	}
+
+	sites := make([]string, 0, len(config.Config.Websites))
+	for _, website := range config.Config.Websites {
+		sites = append(sites, website.Domain)
+	}
+	return sites
+}
+
+func parseDay(value string) (time.Time, error) {
+	return time.Parse(archive.DAY_FORMAT, value)
+}
+
+func reprocessCommand(args []string) {
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site to reprocess")
+	fromFlag := flags.String("from", "", "first day to reprocess (YYYY-MM-DD, UTC)")
+	toFlag := flags.String("to", "", "last day to reprocess (YYYY-MM-DD, UTC), defaults to -from")
+	flags.Parse(args)
+
+	if *site == "" || *fromFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *toFlag == "" {
+		*toFlag = *fromFlag
+	}
+
+	from, err := parseDay(*fromFlag)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	to, err := parseDay(*toFlag)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+	if to.Before(from) {
+		log.Fatalf("-to is before -from")
+	}
+
+	if _, err := helpers.FindWebsite(*site); err != nil {
+		log.Fatalf("%s isn't a configured site", *site)
+	}
+	log.Printf("Reprocessing %s from %s to %s...", *site, *fromFlag, *toFlag)
+
+	result, err := event.Reprocess(helpers.GetDataPath(constants.ARCHIVE_FOLDER_NAME), *site, from, to)
+	db.CloseAll()
+	if err != nil {
+		log.Fatalf("Reprocessing failed: %v", err)
+	}
+
+	log.Printf("Done: replaced %d sessions with %d sessions and %d events (%d bot events skipped)", result.DeletedSessions, result.Sessions, result.Events, result.Bots)
+}
+
+func convertCommand(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site to convert")
+	toFlag := flags.String("to", "", "storage to convert to (duckdb or sqlite)")
+	flags.Parse(args)
+
+	if *site == "" || (*toFlag != db.STORE_DUCKDB && *toFlag != db.STORE_SQLITE) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fromKind := db.STORE_DUCKDB
+	if *toFlag == db.STORE_DUCKDB {
+		fromKind = db.STORE_SQLITE
+	}
+
+	file, err := helpers.GetDatabaseFileName(*site)
+	if err != nil {
+		log.Fatalf("%s isn't a configured site", *site)
+	}
+	if _, err := os.Stat(db.StoreFileName(fromKind, file)); err != nil {
+		log.Fatalf("%s has no %s data to convert: %v", *site, fromKind, err)
+	}
+
+	from, err := db.OpenStore(fromKind, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer from.Close()
+
+	to, err := db.OpenStore(*toFlag, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer to.Close()
+
+	// Older SQLite files have no funnels table, bring both schemas up to date
+	for _, store := range []db.Store{from, to} {
+		if _, err := db.Migrate(store); err != nil {
+			log.Fatalf("Failed to prepare the %s database: %v", store.Kind(), err)
+		}
+	}
+
+	log.Printf("Converting %s from %s to %s...", *site, fromKind, *toFlag)
+	if err := db.Convert(from, to); err != nil {
+		log.Fatalf("Conversion failed: %v", err)
+	}
+
+	log.Printf("Done: set `storage: %s` in config.yaml to use the converted data", *toFlag)
+}
+
+func checkCommand(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site to check, defaults to every site")
+	fromFlag := flags.String("from", "", "first day to check (YYYY-MM-DD, UTC), defaults to the beginning")
+	toFlag := flags.String("to", "", "last day to check (YYYY-MM-DD, UTC), defaults to today")
+	repair := flags.Bool("repair", false, "copy missing and stale rows from SQLite into DuckDB")
+	flags.Parse(args)
+
+	from := time.Unix(0, 0).UTC()
+	to := time.Now().UTC()
+	var err error
+	if *fromFlag != "" {
+		if from, err = parseDay(*fromFlag); err != nil {
+			log.Fatalf("Invalid -from: %v", err)
+		}
+	}
+	if *toFlag != "" {
+		if to, err = parseDay(*toFlag); err != nil {
+			log.Fatalf("Invalid -to: %v", err)
+		}
+	}
+	to = to.Truncate(24*time.Hour).AddDate(0, 0, 1)
+
+	sites := commandSites(*site)
+
+	unrepaired := 0
+	for _, domain := range sites {
+		report, err := db.CheckSite(domain, from, to, *repair)
+		if errors.Is(err, db.ErrNoCopy) {
+			log.Printf("%s: skipped, %v", domain, err)
+			continue
+		}
+		if err != nil {
+			db.CloseAll()
+			log.Fatalf("%s: %v", domain, err)
+		}
+
+		for _, discrepancy := range report.Discrepancies {
+			fmt.Printf("%s: %s\n", domain, discrepancy)
+			if !discrepancy.Repaired {
+				unrepaired++
+			}
+		}
+		if report.RepairSkipped != "" {
+			log.Printf("%s: not repaired, %s", domain, report.RepairSkipped)
+		}
+		log.Printf("%s: %d days checked, %d with discrepancies", domain, report.Days, len(report.Discrepancies))
+	}
+	db.CloseAll()
+
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
+
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site to migrate, defaults to every site")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tinylytics migrate status|up [-site example.com]\n")
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 || (args[0] != "status" && args[0] != "up") {
+		flags.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	flags.Parse(args[1:])
+
+	sites := commandSites(*site)
+
+	for _, domain := range sites {
+		file, _ := helpers.GetDatabaseFileName(domain)
+
+		// Opened directly, the server would apply pending migrations itself
+		store, err := db.OpenStore(config.Config.Storage, file)
+		if err != nil {
+			log.Fatalf("%s: %v", domain, err)
+		}
+
+		if action == "up" {
+			applied, err := db.Migrate(store)
+			for _, migration := range applied {
+				fmt.Printf("%s: applied %04d_%s\n", domain, migration.Version, migration.Name)
+			}
+			store.Close()
+			if err != nil {
+				log.Fatalf("%s: %v", domain, err)
+			}
+			if len(applied) == 0 {
+				fmt.Printf("%s: up to date\n", domain)
+			}
+			continue
+		}
+
+		migrations, err := db.MigrationStatus(store)
+		store.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", domain, err)
+		}
+
+		fmt.Printf("%s (%s)\n", domain, config.Config.Storage)
+		for _, migration := range migrations {
+			status := "pending"
+			if migration.AppliedAt != nil {
+				status = "applied " + migration.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("  %04d_%-30s %s\n", migration.Version, migration.Name, status)
+		}
+	}
+}
+
+func backupCommand(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site to back up, defaults to every site")
+	out := flags.String("out", helpers.GetDataPath(constants.BACKUP_FOLDER_NAME), "folder to write the snapshots to")
+	flags.Parse(args)
+
+	sites := commandSites(*site)
+
+	for _, domain := range sites {
+		manifest, err := db.BackupSite(domain, *out)
+		if err != nil {
+			db.CloseAll()
+			log.Fatalf("%s: %v", domain, err)
+		}
+		fmt.Printf("%s: %d sessions and %d events saved to %s\n", domain, manifest.Sessions, manifest.Events, manifest.Path)
+	}
+	db.CloseAll()
+}
+
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "snapshot folder, as written by backup")
+	force := flags.Bool("force", false, "replace the site's existing data")
+	flags.Parse(args)
+
+	if *from == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	manifest, err := db.RestoreSite(*from, *force)
+	if err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+
+	log.Printf("Done: restored %s with %d sessions and %d events from %s", manifest.Domain, manifest.Sessions, manifest.Events, manifest.CreatedAt.Format(time.RFC3339))
+	if manifest.Storage != config.Config.Storage {
+		log.Printf("The snapshot is %s data, set `storage: %s` in config.yaml or convert it to use it", manifest.Storage, manifest.Storage)
+	}
+}
+
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site to export")
+	table := flags.String("table", db.EXPORT_SESSIONS, "what to export (sessions or events)")
+	format := flags.String("format", db.EXPORT_PARQUET, "file format (parquet or csv)")
+	columns := flags.String("columns", "", "comma separated columns to export, defaults to all of them")
+	fromFlag := flags.String("from", "", "first day of sessions to export (YYYY-MM-DD, UTC), defaults to the beginning")
+	toFlag := flags.String("to", "", "last day of sessions to export (YYYY-MM-DD, UTC), defaults to today")
+	filters := flags.String("filters", "", "dashboard filters as a query string, e.g. b=Chrome&c=AU")
+	out := flags.String("out", "", "file to write, defaults to <site>-<table>.<format>")
+	flags.Parse(args)
+
+	if *site == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, err := helpers.FindWebsite(*site); err != nil {
+		log.Fatalf("%s isn't a configured site", *site)
+	}
+
+	from := time.Unix(0, 0).UTC()
+	to := time.Now().UTC()
+	var err error
+	if *fromFlag != "" {
+		if from, err = parseDay(*fromFlag); err != nil {
+			log.Fatalf("Invalid -from: %v", err)
+		}
+	}
+	if *toFlag != "" {
+		if to, err = parseDay(*toFlag); err != nil {
+			log.Fatalf("Invalid -to: %v", err)
+		}
+	}
+	to = to.Truncate(24*time.Hour).AddDate(0, 0, 1).Add(-time.Second)
+
+	values, err := url.ParseQuery(*filters)
+	if err != nil {
+		log.Fatalf("Invalid -filters: %v", err)
+	}
+	values.Set("p", fmt.Sprintf("%d,%d", from.Unix(), to.Unix()))
+
+	export := db.Export{Table: *table, Format: *format, Query: routes.QueryFromValues(values)}
+	if *columns != "" {
+		export.Columns = strings.Split(*columns, ",")
+	}
+	if *out == "" {
+		*out = db.ExportFileName(*site, export)
+	}
+
+	database, err := db.GetDatabaseByDomain(*site)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rows, err := database.Export(context.Background(), export, *out)
+	db.CloseAll()
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+
+	log.Printf("Done: wrote %d %s to %s", rows, *table, *out)
+}
+
+func privacyCommand(args []string) {
+	flags := flag.NewFlagSet("privacy", flag.ExitOnError)
+	site := flags.String("site", "", "domain of the site the request is for")
+	ident := flags.String("ident", "", "user_ident of the visitor's sessions")
+	ip := flags.String("ip", "", "IP address the visitor's events were sent from")
+	userAgent := flags.String("ua", "", "user agent the visitor's events were sent with")
+	host := flags.String("host", "", "host name the tracking script sends events to, used with -ip and -ua (default: the site)")
+	reference := flags.String("ref", "", "reference kept in the audit log, e.g. a ticket number")
+	out := flags.String("out", "", "file to write an access request's data to, defaults to stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tinylytics privacy access|erase -site example.com (-ident <ident> | -ip <ip> -ua <user agent>)\n")
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 || (args[0] != "access" && args[0] != "erase") {
+		flags.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	flags.Parse(args[1:])
+
+	if *site == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, err := helpers.FindWebsite(*site); err != nil {
+		log.Fatalf("%s isn't a configured site", *site)
+	}
+
+	visitor := event.Visitor{UserIdent: *ident, IP: *ip, UserAgent: *userAgent, Host: *host}
+	if err := visitor.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	dir := helpers.GetDataPath(constants.ARCHIVE_FOLDER_NAME)
+
+	if action == "erase" {
+		deadLetters, err := event.OpenDeadLetterQueue(helpers.GetDataPath(constants.EVENT_DEAD_LETTER_NAME))
+		if err != nil {
+			log.Fatalf("Couldn't open the dead letters: %v", err)
+		}
+
+		result, err := event.EraseVisitor(nil, deadLetters, dir, *site, visitor, *reference)
+		db.CloseAll()
+		if err != nil {
+			log.Fatalf("Erasure failed: %v", err)
+		}
+		for _, store := range result.Stores {
+			log.Printf("%s: deleted %d sessions and %d events", store.Store, store.Sessions, store.Events)
+		}
+		log.Printf("Done: erased %d identities, %d archived events and %d dead letters", result.UserIdents, result.Archived, result.DeadLetters)
+		return
+	}
+
+	report, err := event.AccessVisitor(dir, *site, visitor, *reference)
+	db.CloseAll()
+	if err != nil {
+		log.Fatalf("Access request failed: %v", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := os.WriteFile(*out, data, 0o600); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Done: wrote %d sessions, %d events and %d archived events to %s", len(report.Sessions), len(report.Events), len(report.Archived), *out)
+}
@@ -11,20 +11,117 @@ type UserConfig struct {
 	Password string `yaml:"password"`
 }
 
+// WebsiteConfig is a tracked site. Sessions and events older than
+// RetentionDays are purged, 0 keeps them forever. With KeepDailyTotals, the
+// totals of each purged day are saved first. TimeZone is the IANA name of the
+// zone its days and weeks are counted in, unless the viewer picks another.
 type WebsiteConfig struct {
-	Domain string `yaml:"domain" json:"domain"`
-	Title  string `yaml:"title" json:"title"`
+	Domain          string `yaml:"domain" json:"domain"`
+	Title           string `yaml:"title" json:"title"`
+	TimeZone        string `yaml:"timezone" json:"timezone,omitempty"`
+	RetentionDays   int    `yaml:"retention-days" json:"-"`
+	KeepDailyTotals bool   `yaml:"keep-daily-totals" json:"-"`
+}
+
+// QueueConfig sets how many workers process events. Each visitor's events
+// always go to the same worker, so they're processed in order. Workers write
+// up to BatchSize events at a time, waiting at most BatchWait milliseconds
+// for a batch to fill up.
+//
+// Once the queue holds MaxSize events or the data disk is MaxDiskUsage
+// percent full, new events are either rejected (Overload "reject", clients
+// are told to retry after RetryAfter seconds) or only SampleRate of them are
+// kept (Overload "sample"). A zero high-water mark is never reached.
+type QueueConfig struct {
+	Workers      int     `yaml:"workers" env-default:"4"`
+	BatchSize    int     `yaml:"batch-size" env-default:"100"`
+	BatchWait    int     `yaml:"batch-wait" env-default:"200"`
+	MaxSize      int     `yaml:"max-size"`       // See defaults
+	MaxDiskUsage float64 `yaml:"max-disk-usage"` // See defaults
+	Overload     string  `yaml:"overload" env-default:"reject"`
+	SampleRate   float64 `yaml:"sample-rate" env-default:"0.1"`
+	RetryAfter   int     `yaml:"retry-after" env-default:"30"`
+}
+
+// ArchiveConfig keeps every accepted event as received, so history can be
+// reprocessed. Days older than RetentionDays are deleted, 0 keeps everything.
+type ArchiveConfig struct {
+	Enabled       bool `yaml:"enabled"`        // See defaults
+	RetentionDays int  `yaml:"retention-days"` // See defaults
+}
+
+// CheckConfig compares the SQLite and DuckDB databases of sites that have
+// both every Interval hours, over the last Days days. With Repair, rows
+// missing from DuckDB or different there are copied over from SQLite, while
+// SQLite is still the file written last.
+type CheckConfig struct {
+	Enabled  bool `yaml:"enabled" env-default:"false"`
+	Interval int  `yaml:"interval" env-default:"24"`
+	Days     int  `yaml:"days" env-default:"7"`
+	Repair   bool `yaml:"repair" env-default:"false"`
+}
+
+// RetentionConfig sets how often, in hours, sites with a retention period
+// have their old sessions and events purged
+type RetentionConfig struct {
+	Interval int `yaml:"interval" env-default:"24"`
+}
+
+// ConsoleConfig limits the queries administrators run from the SQL console:
+// each one is cancelled after Timeout seconds and returns at most MaxRows
+// rows
+type ConsoleConfig struct {
+	Timeout int `yaml:"timeout" env-default:"10"`
+	MaxRows int `yaml:"max-rows" env-default:"1000"`
+}
+
+// CacheConfig keeps the results of dashboard queries for TTL seconds, at most
+// MaxEntries of them per site. Once new events are written to a period, its
+// results are only reused for Freshness seconds after they were computed.
+type CacheConfig struct {
+	Enabled    bool `yaml:"enabled"` // See defaults
+	TTL        int  `yaml:"ttl" env-default:"300"`
+	Freshness  int  `yaml:"freshness"` // See defaults
+	MaxEntries int  `yaml:"max-entries" env-default:"1000"`
 }
 
 type TinylyticsConfig struct {
 	User       UserConfig      `yaml:"user"`
 	Websites   []WebsiteConfig `yaml:"websites"`
 	DataFolder string          `yaml:"data-folder"`
+	Storage    string          `yaml:"storage" env-default:"duckdb"` // "duckdb" or "sqlite"
+	Queue      QueueConfig     `yaml:"queue"`
+	Archive    ArchiveConfig   `yaml:"archive"`
+	Check      CheckConfig     `yaml:"check"`
+	Retention  RetentionConfig `yaml:"retention"`
+	Console    ConsoleConfig   `yaml:"console"`
+	Cache      CacheConfig     `yaml:"cache"`
 }
 
 var Config TinylyticsConfig
 
+// defaults returns the settings whose zero value turns something off. cleanenv
+// applies env-default whenever the file has the zero value, so those are set
+// before the file is read instead.
+func defaults() TinylyticsConfig {
+	return TinylyticsConfig{
+		Queue: QueueConfig{
+			MaxSize:      100000,
+			MaxDiskUsage: 95,
+		},
+		Archive: ArchiveConfig{
+			Enabled:       true,
+			RetentionDays: 365,
+		},
+		Cache: CacheConfig{
+			Enabled:   true,
+			Freshness: 10,
+		},
+	}
+}
+
 func LoadConfig(path string) {
+	Config = defaults()
 	err := cleanenv.ReadConfig(path, &Config)
 	if err != nil {
 		fmt.Println("Error loading config", err)
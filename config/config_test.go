@@ -0,0 +1,67 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, content string) TinylyticsConfig {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	LoadConfig(path)
+	return Config
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config := loadTestConfig(t, "data-folder: ./data\n")
+
+	if config.Queue.MaxSize != 100000 || config.Queue.MaxDiskUsage != 95 {
+		t.Errorf("Queue high-water marks were incorrect, got: %d, %v, want: 100000, 95.", config.Queue.MaxSize, config.Queue.MaxDiskUsage)
+	}
+	if !config.Archive.Enabled || config.Archive.RetentionDays != 365 {
+		t.Errorf("Archive was incorrect, got: %+v, want: enabled for 365 days.", config.Archive)
+	}
+	if !config.Cache.Enabled || config.Cache.Freshness != 10 {
+		t.Errorf("Cache was incorrect, got: %+v, want: enabled, 10 seconds fresh.", config.Cache)
+	}
+	if config.Check.Repair {
+		t.Error("Check repair was incorrect, got: true, want: false.")
+	}
+	if config.Queue.Workers != 4 {
+		t.Errorf("Queue workers was incorrect, got: %d, want: 4.", config.Queue.Workers)
+	}
+}
+
+func TestLoadConfigZeroValues(t *testing.T) {
+	config := loadTestConfig(t, `
+queue:
+  workers: 2
+  max-size: 0
+  max-disk-usage: 0
+archive:
+  enabled: false
+  retention-days: 0
+cache:
+  enabled: false
+  freshness: 0
+`)
+
+	if config.Queue.MaxSize != 0 || config.Queue.MaxDiskUsage != 0 {
+		t.Errorf("Queue high-water marks were incorrect, got: %d, %v, want: 0, 0.", config.Queue.MaxSize, config.Queue.MaxDiskUsage)
+	}
+	if config.Archive.Enabled || config.Archive.RetentionDays != 0 {
+		t.Errorf("Archive was incorrect, got: %+v, want: disabled, kept forever.", config.Archive)
+	}
+	if config.Cache.Enabled || config.Cache.Freshness != 0 {
+		t.Errorf("Cache was incorrect, got: %+v, want: disabled, 0 seconds fresh.", config.Cache)
+	}
+	if config.Queue.Workers != 2 {
+		t.Errorf("Queue workers was incorrect, got: %d, want: 2.", config.Queue.Workers)
+	}
+}
@@ -6,3 +6,10 @@ const GEOLITE_DB_FILE_NAME = "GeoLite2-Country.mmdb"
 const GEOLITE_ZIPPED_FILE_NAME = "GeoLite2-Country.tar.gz"
 const GEOLITE_DOWNLOAD_URL = "https://raw.githubusercontent.com/GitSquared/node-geolite2-redist/master/redist/GeoLite2-Country.tar.gz"
 const EVENT_QUEUE_NAME = "events-queue"
+const EVENT_DEAD_LETTER_NAME = "events-dead-letter"
+const EVENT_MAX_ATTEMPTS = 5
+const ARCHIVE_FOLDER_NAME = "archive"
+const BACKUP_FOLDER_NAME = "backups"
+const PRIVACY_AUDIT_FILE_NAME = "privacy-audit.jsonl"
+const PRIVACY_ERASED_FILE_NAME = "privacy-erased.jsonl"
+const DEFAULT_TIMEZONE = "Australia/Sydney"
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"tinylytics/helpers"
+)
+
+// BACKUP_MANIFEST is the file in a snapshot that says what it holds. It's
+// written last, a folder without one is an unfinished snapshot.
+const BACKUP_MANIFEST = "manifest.json"
+
+// BackupManifest describes a site's snapshot, the database files themselves
+// are named after a hash of the domain
+type BackupManifest struct {
+	Domain        string    `json:"domain"`
+	Storage       string    `json:"storage"`
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Sessions      int64     `json:"sessions"`
+	Events        int64     `json:"events"`
+	Path          string    `json:"path,omitempty"` // Where the snapshot is, not saved
+}
+
+var ErrNotSnapshot = errors.New("no " + BACKUP_MANIFEST + ", not a complete snapshot")
+
+// BackupSite takes a snapshot of a site's database into a new folder in
+// folder, named after the domain and the time, while the server keeps
+// running
+func BackupSite(domain string, folder string) (*BackupManifest, error) {
+	d, err := GetDatabaseByDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	dir := filepath.Join(folder, domain+"-"+now.Format("20060102T150405Z"))
+	partial := dir + ".partial"
+	if err := os.RemoveAll(partial); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return nil, err
+	}
+
+	manifest, err := d.Backup(partial)
+	if err != nil {
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	manifest.Domain = domain
+	manifest.CreatedAt = now
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(partial, BACKUP_MANIFEST), content, 0644); err != nil {
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	if err := os.Rename(partial, dir); err != nil {
+		return nil, err
+	}
+
+	manifest.Path = dir
+	return manifest, nil
+}
+
+// Backup writes a snapshot of the store into dir and returns what's in it.
+// Writes wait until it's done, so the counts match the snapshot.
+func (d *Database) Backup(dir string) (*BackupManifest, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	manifest := &BackupManifest{Storage: d.store.Kind()}
+	if err := countRows(d.store, manifest); err != nil {
+		return nil, err
+	}
+	if err := d.store.DB().QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&manifest.SchemaVersion); err != nil {
+		return nil, err
+	}
+
+	if err := d.store.Backup(dir); err != nil {
+		return nil, fmt.Errorf("%s backup: %w", d.store.Kind(), err)
+	}
+	return manifest, nil
+}
+
+func countRows(store Store, manifest *BackupManifest) error {
+	return store.DB().QueryRow("SELECT (SELECT COUNT(*) FROM user_sessions), (SELECT COUNT(*) FROM user_events)").Scan(&manifest.Sessions, &manifest.Events)
+}
+
+// ReadBackupManifest reads the manifest of the snapshot in dir
+func ReadBackupManifest(dir string) (*BackupManifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, BACKUP_MANIFEST))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", BACKUP_MANIFEST, err)
+	}
+	manifest.Path = dir
+	return &manifest, nil
+}
+
+// RestoreSite replaces the database of the snapshot's site with the snapshot,
+// in the storage it was taken from. A site that has data in that storage is
+// only replaced with force. The server must be stopped, the restored database
+// is migrated to the current schema the way it would be when it starts.
+func RestoreSite(dir string, force bool) (*BackupManifest, error) {
+	manifest, err := ReadBackupManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := helpers.GetDatabaseFileName(manifest.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a configured site", manifest.Domain)
+	}
+	target := StoreFileName(manifest.Storage, file)
+	if _, err := os.Stat(target); err == nil && !force {
+		return nil, fmt.Errorf("%s already has %s data in %s, restore with force to replace it", manifest.Domain, manifest.Storage, target)
+	}
+
+	// Restored next to the site's file, and only moved in place once it's
+	// complete and checked
+	restored := target + ".restore"
+	removeStoreFiles(restored)
+
+	if err := restoreStore(manifest, restored); err != nil {
+		removeStoreFiles(restored)
+		return nil, err
+	}
+
+	removeStoreFiles(target)
+	if err := os.Rename(restored, target); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// restoreStore creates file from the snapshot, brings it up to date and
+// checks it has all of the snapshot's rows
+func restoreStore(manifest *BackupManifest, file string) error {
+	var err error
+	var store Store
+	switch manifest.Storage {
+	case STORE_SQLITE:
+		if err = restoreSQLite(manifest.Path, file); err == nil {
+			store, err = openSQLiteStore(file)
+		}
+	case STORE_DUCKDB:
+		if err = restoreDuckDB(manifest.Path, file); err == nil {
+			store, err = openDuckDBStore(file)
+		}
+	default:
+		return fmt.Errorf("unknown storage %q in %s", manifest.Storage, BACKUP_MANIFEST)
+	}
+	if err != nil {
+		return fmt.Errorf("%s restore: %w", manifest.Storage, err)
+	}
+	defer store.Close()
+
+	if _, err := Migrate(store); err != nil {
+		return err
+	}
+
+	restored := &BackupManifest{}
+	if err := countRows(store, restored); err != nil {
+		return err
+	}
+	if restored.Sessions != manifest.Sessions || restored.Events != manifest.Events {
+		return fmt.Errorf("restored %d sessions and %d events, the snapshot has %d and %d", restored.Sessions, restored.Events, manifest.Sessions, manifest.Events)
+	}
+	return nil
+}
+
+// removeStoreFiles deletes a store's file along with its write-ahead log, a
+// log left behind would be applied to the file that replaces it
+func removeStoreFiles(file string) {
+	for _, name := range []string{file, file + "-wal", file + "-shm", file + ".wal"} {
+		os.Remove(name)
+	}
+}
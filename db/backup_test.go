@@ -0,0 +1,128 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// schemaVersion returns the latest migration applied to a store
+func schemaVersion(t *testing.T, store Store) int {
+	t.Helper()
+
+	var version int
+	if err := store.DB().QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// A snapshot is restored with the store's rows and schema
+func TestBackupRestore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d,
+			&UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1},
+			&UserSession{ID: "s2", UserIdent: "u2", SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 2},
+		)
+
+		dir := t.TempDir()
+		manifest, err := d.Backup(dir)
+		if err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+		if manifest.Storage != d.store.Kind() || manifest.Sessions != 2 || manifest.Events != 3 || manifest.SchemaVersion != schemaVersion(t, d.store) {
+			t.Errorf("Manifest was incorrect, got: %+v, want: 2 sessions, 3 events.", manifest)
+		}
+
+		// Written after the snapshot, so not restored
+		writeSessions(t, d, &UserSession{ID: "s3", UserIdent: "u3", SessionStart: parseTime("2024-01-02T12:00:00Z"), Events: 1})
+
+		manifest.Path = dir
+		file := filepath.Join(t.TempDir(), "restored.db")
+		if err := restoreStore(manifest, StoreFileName(d.store.Kind(), file)); err != nil {
+			t.Fatalf("restoreStore failed: %v", err)
+		}
+
+		store, err := OpenStore(d.store.Kind(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		restored := &Database{store: store}
+
+		if ids := storedIDs(t, restored, "user_sessions"); ids != "s1 s2" {
+			t.Errorf("Restored sessions were incorrect, got: %s, want: s1 s2.", ids)
+		}
+		if ids := storedIDs(t, restored, "user_events"); ids != "s1-0 s2-0 s2-1" {
+			t.Errorf("Restored events were incorrect, got: %s, want: s1-0 s2-0 s2-1.", ids)
+		}
+		if got := schemaVersion(t, store); got != manifest.SchemaVersion {
+			t.Errorf("Restored schema version was incorrect, got: %d, want: %d.", got, manifest.SchemaVersion)
+		}
+	})
+}
+
+// A snapshot missing rows isn't restored
+func TestRestoreStoreIncomplete(t *testing.T) {
+	d := openTestDatabase(t, STORE_SQLITE)
+	writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1})
+
+	dir := t.TempDir()
+	manifest, err := d.Backup(dir)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	manifest.Path = dir
+	manifest.Sessions++
+
+	if err := restoreStore(manifest, filepath.Join(t.TempDir(), "restored.db")); err == nil {
+		t.Error("restoreStore was incorrect, got: nil, want: an error.")
+	}
+}
+
+// A site that has data is only replaced with force
+func TestRestoreSite(t *testing.T) {
+	for _, kind := range []string{STORE_SQLITE, STORE_DUCKDB} {
+		t.Run(kind, func(t *testing.T) {
+			file := setupSite(t, kind)
+			d, err := GetDatabase(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1})
+
+			manifest, err := BackupSite("a.com", t.TempDir())
+			if err != nil {
+				t.Fatalf("BackupSite failed: %v", err)
+			}
+			writeSessions(t, d, &UserSession{ID: "s2", UserIdent: "u2", SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 1})
+			CloseAll()
+
+			if _, err := RestoreSite(manifest.Path, false); err == nil {
+				t.Error("RestoreSite without force was incorrect, got: nil, want: an error.")
+			}
+			if _, err := os.Stat(StoreFileName(kind, file) + ".restore"); !os.IsNotExist(err) {
+				t.Errorf("Restore file was incorrect, got: %v, want: none.", err)
+			}
+			d, err = GetDatabase(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := storedIDs(t, d, "user_sessions"); ids != "s1 s2" {
+				t.Errorf("Sessions without force were incorrect, got: %s, want: s1 s2.", ids)
+			}
+			CloseAll()
+
+			if _, err := RestoreSite(manifest.Path, true); err != nil {
+				t.Fatalf("RestoreSite failed: %v", err)
+			}
+			d, err = GetDatabase(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := storedIDs(t, d, "user_sessions"); ids != "s1" {
+				t.Errorf("Restored sessions were incorrect, got: %s, want: s1.", ids)
+			}
+		})
+	}
+}
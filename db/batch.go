@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"tinylytics/metrics"
+)
+
+// Batch collects the session and event writes of several queued events so
+// they're written in one transaction
+type Batch struct {
+	db       *Database
+	sessions []*UserSession
+	touched  map[string]*UserSession
+	created  map[string]bool
+	visitors map[string][]*UserSession // The sessions of each visitor
+	events   []*UserEvent
+	// Recompute the rollups of the hours of its sessions in the transaction
+	// writing it. Conversions and repairs recompute them afterwards instead.
+	rollups bool
+	// Replaces the sessions that started between replaceFrom and replaceTo,
+	// see NewReplacingBatch
+	replacing   bool
+	replaceFrom time.Time
+	replaceTo   time.Time
+}
+
+func (d *Database) NewBatch() *Batch {
+	return &Batch{
+		db:       d,
+		touched:  make(map[string]*UserSession),
+		created:  make(map[string]bool),
+		visitors: make(map[string][]*UserSession),
+		rollups:  true,
+	}
+}
+
+// NewReplacingBatch returns a batch that replaces the sessions that started
+// between from and to, and their events, when it's committed. Until then they
+// stay stored, but the batch doesn't see them, as if they were deleted.
+func (d *Database) NewReplacingBatch(from time.Time, to time.Time) *Batch {
+	b := d.NewBatch()
+	b.replacing = true
+	b.replaceFrom = from.UTC()
+	b.replaceTo = to.UTC()
+	return b
+}
+
+// Size is the number of events in the batch
+func (b *Batch) Size() int {
+	return len(b.events)
+}
+
+// GetUserSessionAtTime works like Database.GetUserSessionAtTime, but also
+// sees the sessions started or updated earlier in the batch
+func (b *Batch) GetUserSessionAtTime(userIdent string, eventTime time.Time) *UserSession {
+	cutoffTime := eventTime.Add(-30 * time.Minute)
+
+	var latest *UserSession
+	for _, session := range b.visitors[userIdent] {
+		if session.SessionEnd.Before(cutoffTime) {
+			continue
+		}
+		if latest == nil || session.SessionEnd.After(latest.SessionEnd) {
+			latest = session
+		}
+	}
+	if latest != nil {
+		return latest
+	}
+
+	session := b.db.GetUserSessionAtTime(userIdent, eventTime)
+	if session == nil {
+		return nil
+	}
+	if touched, exists := b.touched[session.ID]; exists {
+		return touched
+	}
+	if b.replaces(session) {
+		return nil
+	}
+	return session
+}
+
+// replaces tells if the session is one the batch replaces
+func (b *Batch) replaces(session *UserSession) bool {
+	return b.replacing && !session.SessionStart.Before(b.replaceFrom) && session.SessionStart.Before(b.replaceTo)
+}
+
+func (b *Batch) StartUserSession(item *UserSession) *UserSession {
+	b.created[item.ID] = true
+	b.touch(item)
+	return item
+}
+
+func (b *Batch) UpdateUserSession(item *UserSession) {
+	b.touch(item)
+}
+
+func (b *Batch) SaveEvent(item *UserEvent, sessionId string) *UserEvent {
+	item.SessionID = sessionId
+	b.events = append(b.events, item)
+	return item
+}
+
+func (b *Batch) touch(item *UserSession) {
+	if _, exists := b.touched[item.ID]; !exists {
+		b.sessions = append(b.sessions, item)
+		if b.visitors != nil {
+			b.visitors[item.UserIdent] = append(b.visitors[item.UserIdent], item)
+		}
+	}
+	b.touched[item.ID] = item
+}
+
+// period returns the earliest and latest times of the batch's sessions and
+// events, the periods whose reports it changes
+func (b *Batch) period() (time.Time, time.Time) {
+	var from, to time.Time
+	add := func(t time.Time) {
+		if from.IsZero() || t.Before(from) {
+			from = t
+		}
+		if t.After(to) {
+			to = t
+		}
+	}
+
+	for _, session := range b.sessions {
+		add(session.SessionStart)
+		add(session.SessionEnd)
+	}
+	for _, event := range b.events {
+		add(event.EventTime)
+	}
+	return from, to
+}
+
+// writeRollups recomputes the rollups of the hours the batch's sessions
+// started in. Stores call it in the transaction writing the batch, once its
+// rows are written, so the rollups are never behind the raw tables.
+func (b *Batch) writeRollups(tx execer) error {
+	if !b.rollups || len(b.sessions) == 0 {
+		return nil
+	}
+	if err := refreshHourRollups(tx, sessionHours(b.sessions)); err != nil {
+		return fmt.Errorf("update rollups: %w", err)
+	}
+	return nil
+}
+
+// statement is a query to run with its args
+type statement struct {
+	query string
+	args  []interface{}
+}
+
+// replaceRows replaces the rows of the batch's period with its sessions and
+// events, once the stores have written those to the rebuilt_sessions and
+// rebuilt_events temporary tables of the transaction. Rows rebuilt with the
+// same id are updated rather than deleted and inserted again, DuckDB can't
+// insert a key deleted in the same transaction.
+func (b *Batch) replaceRows(tx execer) error {
+	inPeriod := "session_start >= ? AND session_start < ?"
+	statements := []statement{
+		{"DELETE FROM user_events WHERE session_id IN (SELECT id FROM user_sessions WHERE " + inPeriod + ") AND id NOT IN (SELECT id FROM rebuilt_events)", []interface{}{b.replaceFrom, b.replaceTo}},
+		{"DELETE FROM user_sessions WHERE " + inPeriod + " AND id NOT IN (SELECT id FROM rebuilt_sessions)", []interface{}{b.replaceFrom, b.replaceTo}},
+	}
+	statements = append(statements, rebuildStatements("user_sessions", "rebuilt_sessions", columnNames(sessionColumns))...)
+	statements = append(statements, rebuildStatements("user_events", "rebuilt_events", eventColumns)...)
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(context.Background(), statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+
+	if err := refreshRollups(tx, b.replaceFrom, b.replaceTo); err != nil {
+		return fmt.Errorf("update rollups: %w", err)
+	}
+	return b.writeRollups(tx)
+}
+
+// rebuildStatements update a table's rows from the rebuilt ones with the same
+// id, insert the others, and drop the rebuilt table
+func rebuildStatements(table string, rebuilt string, columns string) []statement {
+	set := make([]string, 0)
+	for _, column := range strings.Split(columns, ", ") {
+		if column != "id" {
+			set = append(set, fmt.Sprintf("%s = %s.%s", column, rebuilt, column))
+		}
+	}
+
+	return []statement{
+		{fmt.Sprintf("UPDATE %[1]s SET %[3]s FROM %[2]s WHERE %[1]s.id = %[2]s.id", table, rebuilt, strings.Join(set, ", ")), nil},
+		{fmt.Sprintf("INSERT INTO %[1]s (%[3]s) SELECT %[3]s FROM %[2]s WHERE id NOT IN (SELECT id FROM %[1]s)", table, rebuilt, columns), nil},
+		{"DROP TABLE " + rebuilt, nil},
+	}
+}
+
+// GetExistingEventIDs returns which of the given event ids are already stored,
+// so an event that is processed twice is only counted once
+func (d *Database) GetExistingEventIDs(ids []string) (map[string]bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	existing := make(map[string]bool)
+	if len(ids) == 0 {
+		return existing, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := d.store.DB().Query(fmt.Sprintf("SELECT id FROM user_events WHERE id IN (%s)", placeholders(len(ids))), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+
+	return existing, rows.Err()
+}
+
+// Commit writes the batch and the rollups of its hours in one transaction,
+// replacing the rows of its period if it's a replacing batch
+func (b *Batch) Commit() error {
+	// A replacing batch without rows still deletes its period's
+	if !b.replacing && len(b.sessions) == 0 && len(b.events) == 0 {
+		return nil
+	}
+
+	d := b.db
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, session := range b.sessions {
+		if session.CreatedAt.IsZero() {
+			session.CreatedAt = now
+		}
+		session.UpdatedAt = now
+	}
+	for _, event := range b.events {
+		event.CreatedAt = now
+		event.UpdatedAt = now
+	}
+
+	start := time.Now()
+	var err error
+	if b.replacing {
+		err = d.store.ReplaceSessions(b)
+	} else {
+		err = d.store.WriteBatch(b)
+	}
+	metrics.DBWriteDuration.Observe(time.Since(start).Seconds(), d.store.Kind())
+	if err != nil {
+		log.Printf("ERROR: Failed to write batch to %s: %v", d.store.Kind(), err)
+		return err
+	}
+
+	if b.replacing {
+		d.cache.clear()
+	} else {
+		d.cache.changed(b.period())
+	}
+
+	log.Printf("[DB] Batch written successfully: sessions=%d events=%d (%s)", len(b.sessions), len(b.events), d.store.Kind())
+	return nil
+}
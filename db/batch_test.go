@@ -0,0 +1,191 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storedIDs returns the ids of a table's rows, sorted
+func storedIDs(t *testing.T, d *Database, table string) string {
+	t.Helper()
+
+	rows, err := d.store.DB().Query("SELECT id FROM " + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+func TestReplacingBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		from, to := day("2024-01-02"), day("2024-01-03")
+
+		writeSessions(t, d,
+			&UserSession{ID: "before", UserIdent: "u0", Browser: "Chrome", SessionStart: parseTime("2024-01-01T23:50:00Z"), Events: 1},
+			&UserSession{ID: "rebuilt", UserIdent: "u1", Browser: "Chrome", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 2},
+			&UserSession{ID: "dropped", UserIdent: "u2", Browser: "Chrome", SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 1},
+			&UserSession{ID: "after", UserIdent: "u3", Browser: "Chrome", SessionStart: parseTime("2024-01-03T00:00:00Z"), Events: 1},
+		)
+
+		batch := d.NewReplacingBatch(from, to)
+
+		// The replaced sessions aren't seen, the others are
+		if session := batch.GetUserSessionAtTime("u1", parseTime("2024-01-02T10:05:00Z")); session != nil {
+			t.Errorf("GetUserSessionAtTime found a replaced session, got: %s, want: nil.", session.ID)
+		}
+		if session := batch.GetUserSessionAtTime("u0", parseTime("2024-01-02T00:05:00Z")); session == nil || session.ID != "before" {
+			t.Errorf("GetUserSessionAtTime didn't find the session before the period, got: %v.", session)
+		}
+
+		// Rebuilt with another browser, its second event in a new session
+		start := parseTime("2024-01-02T10:00:00Z")
+		batch.StartUserSession(&UserSession{ID: "rebuilt", UserIdent: "u1", Browser: "Firefox", SessionStart: start, SessionEnd: start, Events: 1})
+		batch.SaveEvent(&UserEvent{ID: "rebuilt-0", Name: "pageview", Page: "a.com/", EventTime: start}, "rebuilt")
+		batch.StartUserSession(&UserSession{ID: "new", UserIdent: "u1", Browser: "Firefox", SessionStart: start.Add(time.Hour), SessionEnd: start.Add(time.Hour), Events: 1})
+		batch.SaveEvent(&UserEvent{ID: "rebuilt-1", Name: "pageview", Page: "a.com/", EventTime: start.Add(time.Hour)}, "new")
+
+		if session := batch.GetUserSessionAtTime("u1", start.Add(time.Hour+time.Minute)); session == nil || session.ID != "new" {
+			t.Errorf("GetUserSessionAtTime didn't find the batch's session, got: %v.", session)
+		}
+
+		if err := batch.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+
+		if ids := storedIDs(t, d, "user_sessions"); ids != "after before new rebuilt" {
+			t.Errorf("Sessions were incorrect, got: %s, want: after before new rebuilt.", ids)
+		}
+		if ids := storedIDs(t, d, "user_events"); ids != "after-0 before-0 rebuilt-0 rebuilt-1" {
+			t.Errorf("Events were incorrect, got: %s, want: after-0 before-0 rebuilt-0 rebuilt-1.", ids)
+		}
+
+		var browser, sessionID string
+		if err := d.store.DB().QueryRow("SELECT browser FROM user_sessions WHERE id = 'rebuilt'").Scan(&browser); err != nil || browser != "Firefox" {
+			t.Errorf("Rebuilt session was incorrect, got: %s (%v), want: Firefox.", browser, err)
+		}
+		if err := d.store.DB().QueryRow("SELECT session_id FROM user_events WHERE id = 'rebuilt-1'").Scan(&sessionID); err != nil || sessionID != "new" {
+			t.Errorf("Rebuilt event was incorrect, got: %s (%v), want: new.", sessionID, err)
+		}
+
+		var chrome, firefox int64
+		err := d.store.DB().QueryRow(`
+			SELECT
+				CAST(SUM(CASE WHEN browser = 'Chrome' THEN sessions ELSE 0 END) AS BIGINT),
+				CAST(SUM(CASE WHEN browser = 'Firefox' THEN sessions ELSE 0 END) AS BIGINT)
+			FROM daily_sessions
+		`).Scan(&chrome, &firefox)
+		if err != nil || chrome != 2 || firefox != 2 {
+			t.Errorf("Rollups were incorrect, got: %d Chrome, %d Firefox (%v), want: 2, 2.", chrome, firefox, err)
+		}
+	})
+}
+
+// A replacing batch that fails leaves the period as it was
+func TestReplacingBatchFailure(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 2})
+
+		if _, err := d.store.DB().Exec("DROP TABLE daily_pages"); err != nil {
+			t.Fatal(err)
+		}
+
+		batch := d.NewReplacingBatch(day("2024-01-02"), day("2024-01-03"))
+		if err := batch.Commit(); err == nil {
+			t.Fatal("Commit was incorrect, got: nil, want: an error.")
+		}
+
+		if ids := storedIDs(t, d, "user_sessions"); ids != "s1" {
+			t.Errorf("Sessions were incorrect, got: %s, want: s1.", ids)
+		}
+		if ids := storedIDs(t, d, "user_events"); ids != "s1-0 s1-1" {
+			t.Errorf("Events were incorrect, got: %s, want: s1-0 s1-1.", ids)
+		}
+
+		// The temporary tables went away with the transaction
+		if err := d.NewReplacingBatch(day("2024-01-05"), day("2024-01-06")).Commit(); err == nil || strings.Contains(err.Error(), "rebuilt_") {
+			t.Errorf("Commit was incorrect, got: %v, want: the daily_pages error.", err)
+		}
+	})
+}
+
+func TestGetExistingEventIDs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 2})
+
+		existing, err := d.GetExistingEventIDs([]string{"s1-0", "s1-1", "s1-2", "other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(existing) != 2 || !existing["s1-0"] || !existing["s1-1"] {
+			t.Errorf("GetExistingEventIDs was incorrect, got: %v, want: s1-0 and s1-1.", existing)
+		}
+
+		if existing, err := d.GetExistingEventIDs(nil); err != nil || len(existing) != 0 {
+			t.Errorf("GetExistingEventIDs without ids was incorrect, got: %v (%v), want: none.", existing, err)
+		}
+	})
+}
+
+// A session started and updated in the same batch is written once, with its
+// last values, and a stored session updated in a batch is seen by its later
+// events
+func TestBatchSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		stored := &UserSession{ID: "stored", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1}
+		writeSessions(t, d, stored)
+
+		batch := d.NewBatch()
+
+		session := batch.GetUserSessionAtTime("u1", parseTime("2024-01-02T10:05:00Z"))
+		if session == nil || session.ID != "stored" {
+			t.Fatalf("GetUserSessionAtTime was incorrect, got: %v, want: the stored session.", session)
+		}
+		session.Events++
+		session.SessionEnd = parseTime("2024-01-02T10:05:00Z")
+		batch.UpdateUserSession(session)
+		batch.SaveEvent(&UserEvent{ID: "stored-1", Name: "pageview", Page: "a.com/", EventTime: session.SessionEnd}, session.ID)
+
+		start := parseTime("2024-01-02T12:00:00Z")
+		batch.StartUserSession(&UserSession{ID: "new", UserIdent: "u2", SessionStart: start, SessionEnd: start, Events: 1})
+		batch.SaveEvent(&UserEvent{ID: "new-0", Name: "pageview", Page: "a.com/", EventTime: start}, "new")
+
+		session = batch.GetUserSessionAtTime("u2", start.Add(time.Minute))
+		if session == nil || session.ID != "new" {
+			t.Fatalf("GetUserSessionAtTime was incorrect, got: %v, want: the batch's session.", session)
+		}
+		session.Events++
+		session.SessionEnd = start.Add(time.Minute)
+		batch.UpdateUserSession(session)
+		batch.SaveEvent(&UserEvent{ID: "new-1", Name: "pageview", Page: "a.com/about", EventTime: session.SessionEnd}, "new")
+
+		if batch.Size() != 3 {
+			t.Errorf("Size was incorrect, got: %d, want: 3.", batch.Size())
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+
+		if ids := storedIDs(t, d, "user_sessions"); ids != "new stored" {
+			t.Errorf("Sessions were incorrect, got: %s, want: new stored.", ids)
+		}
+		for _, id := range []string{"stored", "new"} {
+			var events int64
+			if err := d.store.DB().QueryRow("SELECT events FROM user_sessions WHERE id = ?", id).Scan(&events); err != nil || events != 2 {
+				t.Errorf("Events of %s were incorrect, got: %d (%v), want: 2.", id, events, err)
+			}
+		}
+	})
+}
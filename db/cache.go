@@ -0,0 +1,193 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"tinylytics/config"
+	"tinylytics/metrics"
+)
+
+// queryCache keeps the results of a site's dashboard queries, keyed by the
+// report, the query and its period resolved to the minute. When events are
+// written, the results of the periods they fall in are changed, and those are
+// only served for the freshness window after they were computed, so refreshing
+// a busy site's dashboard doesn't query it every time.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	stored  time.Time
+	start   time.Time
+	end     *time.Time // nil for periods that are still going on
+	changed bool       // Events were written to the period after it was stored
+}
+
+// covers tells if events at times between from and to fall in the entry's
+// period
+func (e *cacheEntry) covers(from time.Time, to time.Time) bool {
+	return !to.Before(e.start) && (e.end == nil || !from.After(*e.end))
+}
+
+// fresh tells if the entry can still be served
+func (e *cacheEntry) fresh(now time.Time) bool {
+	age := now.Sub(e.stored)
+	if e.changed {
+		return age < time.Duration(config.Config.Cache.Freshness)*time.Second
+	}
+	return age < time.Duration(config.Config.Cache.TTL)*time.Second
+}
+
+// cacheKey identifies a report over a query. The period is replaced by the
+// times it resolves to, truncated to the minute, so a rolling period is
+// computed at most once a minute and periods that resolve to the same times
+// share results.
+func cacheKey(report string, q Query) (string, time.Time, *time.Time, error) {
+	start, end := q.TimeRange()
+	start = start.Truncate(time.Minute)
+
+	q.Period = fmt.Sprintf("%d,", start.Unix())
+	if end != nil {
+		q.Period += fmt.Sprint(end.Unix())
+	}
+	q.TimeZone = ""
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		return "", start, end, err
+	}
+	return report + " " + string(data), start, end, nil
+}
+
+// cached returns the report's result for the query from the cache, or
+// computes and stores it. Failed and cancelled queries aren't stored.
+func cached[T any](d *Database, report string, q Query, compute func() (T, error)) (T, error) {
+	if !config.Config.Cache.Enabled {
+		return compute()
+	}
+
+	key, start, end, err := cacheKey(report, q)
+	if err != nil {
+		return compute()
+	}
+
+	if value, ok := d.cache.get(key); ok {
+		metrics.QueryCacheRequests.Inc("hit")
+		return value.(T), nil
+	}
+	metrics.QueryCacheRequests.Inc("miss")
+
+	// Events written while the query runs mark the entry as changed
+	entry := &cacheEntry{stored: time.Now(), start: start, end: end}
+	d.cache.reserve(key, entry)
+
+	value, err := compute()
+	if err != nil {
+		d.cache.remove(key, entry)
+		return value, err
+	}
+
+	d.cache.set(key, entry, value)
+	return value, nil
+}
+
+func (c *queryCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.value == nil {
+		return nil, false
+	}
+	if !entry.fresh(time.Now()) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// reserve adds an entry whose value is being computed. Requests for it
+// compute their own until it's set.
+func (c *queryCache) reserve(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= config.Config.Cache.MaxEntries {
+		c.evict()
+	}
+	c.entries[key] = entry
+}
+
+func (c *queryCache) set(key string, entry *cacheEntry, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Cleared or replaced by another request while computing
+	if c.entries[key] != entry {
+		return
+	}
+	entry.value = value
+}
+
+func (c *queryCache) remove(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+}
+
+// evict makes room for an entry, by deleting the ones that can't be served
+// anymore, or the oldest one if they all can
+// Must be called while holding the cache lock
+func (c *queryCache) evict() {
+	now := time.Now()
+	var oldest string
+	for key, entry := range c.entries {
+		if entry.value != nil && !entry.fresh(now) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || entry.stored.Before(c.entries[oldest].stored) {
+			oldest = key
+		}
+	}
+
+	if len(c.entries) >= config.Config.Cache.MaxEntries && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// changed marks the entries whose periods have events between from and to as
+// changed, and deletes the ones that are already past their freshness window
+func (c *queryCache) changed(from time.Time, to time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !entry.covers(from, to) {
+			continue
+		}
+		entry.changed = true
+		if entry.value != nil && !entry.fresh(now) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear deletes every entry, after rows were deleted or rewritten
+func (c *queryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = nil
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"tinylytics/config"
+)
+
+// setCacheConfig sets the cache settings for a test
+func setCacheConfig(t *testing.T, cache config.CacheConfig) {
+	previous := config.Config.Cache
+	config.Config.Cache = cache
+	t.Cleanup(func() { config.Config.Cache = previous })
+}
+
+func TestCacheKey(t *testing.T) {
+	browser := "Chrome"
+	day := Query{Period: "2024-01-01", TimeZone: "UTC"}
+
+	tests := []struct {
+		name string
+		a, b Query
+		same bool
+	}{
+		{"same query", day, day, true},
+		{"same times", day, Query{Period: "2024-01-01T00:00:00Z..2024-01-01T23:59:59Z", TimeZone: "UTC"}, true},
+		{"resolved the same", day, Query{Period: "1704067200,1704153599", TimeZone: "UTC"}, true},
+		{"other zone", day, Query{Period: "2024-01-01", TimeZone: "Australia/Sydney"}, false},
+		{"filters", day, Query{Period: "2024-01-01", TimeZone: "UTC", Filters: Filters{Browser: &browser}}, false},
+		{"page", day, Query{Period: "2024-01-01", TimeZone: "UTC", Limit: 20, Offset: 20}, false},
+	}
+
+	for _, test := range tests {
+		a, _, _, err := cacheKey("sessions", test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _, _, err := cacheKey("sessions", test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (a == b) != test.same {
+			t.Errorf("cacheKey(%s) was incorrect, got: %s and %s, want the same: %v.", test.name, a, b, test.same)
+		}
+	}
+
+	a, _, _, _ := cacheKey("sessions", day)
+	b, _, _, _ := cacheKey("pageviews", day)
+	if a == b {
+		t.Errorf("cacheKey was incorrect, got the same key for two reports: %s.", a)
+	}
+}
+
+// A rolling period starts on a whole minute, so it's computed at most once a
+// minute, and goes on until now
+func TestCacheKeyRollingPeriod(t *testing.T) {
+	_, start, end, err := cacheKey("sessions", Query{Period: "last-12h", TimeZone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start.Second() != 0 || start.Nanosecond() != 0 {
+		t.Errorf("cacheKey start was incorrect, got: %s, want: a whole minute.", start)
+	}
+	if end != nil {
+		t.Errorf("cacheKey end was incorrect, got: %s, want: nil.", end)
+	}
+}
+
+// counter is a report that counts how often it's computed
+type counter struct {
+	computed int
+	err      error
+}
+
+func (c *counter) report(d *Database, q Query) (int, error) {
+	return cached(d, "counter", q, func() (int, error) {
+		c.computed++
+		return c.computed, c.err
+	})
+}
+
+func TestCached(t *testing.T) {
+	setCacheConfig(t, config.CacheConfig{Enabled: true, TTL: 300, Freshness: 300, MaxEntries: 10})
+
+	d := &Database{}
+	q := Query{Period: "2024-01-01", TimeZone: "UTC"}
+	c := &counter{}
+
+	if value, _ := c.report(d, q); value != 1 {
+		t.Errorf("First result was incorrect, got: %d, want: 1.", value)
+	}
+	if value, _ := c.report(d, q); value != 1 {
+		t.Errorf("Cached result was incorrect, got: %d, want: 1.", value)
+	}
+
+	// Events outside the period don't change it
+	d.cache.changed(day("2024-01-03"), day("2024-01-03"))
+	if value, _ := c.report(d, q); value != 1 {
+		t.Errorf("Result after events outside the period was incorrect, got: %d, want: 1.", value)
+	}
+
+	// Events in the period are served for the freshness window
+	d.cache.changed(parseTime("2024-01-01T10:00:00Z"), parseTime("2024-01-01T10:00:00Z"))
+	if value, _ := c.report(d, q); value != 1 {
+		t.Errorf("Result within the freshness window was incorrect, got: %d, want: 1.", value)
+	}
+
+	config.Config.Cache.Freshness = 0
+	if value, _ := c.report(d, q); value != 2 {
+		t.Errorf("Result past the freshness window was incorrect, got: %d, want: 2.", value)
+	}
+	if value, _ := c.report(d, q); value != 2 {
+		t.Errorf("Recomputed result was incorrect, got: %d, want: 2.", value)
+	}
+
+	d.cache.clear()
+	if value, _ := c.report(d, q); value != 3 {
+		t.Errorf("Result after clear was incorrect, got: %d, want: 3.", value)
+	}
+
+	config.Config.Cache.TTL = 0
+	if value, _ := c.report(d, q); value != 4 {
+		t.Errorf("Result past the TTL was incorrect, got: %d, want: 4.", value)
+	}
+}
+
+// Events written while a query runs mark its result as changed
+func TestCachedChangedWhileComputing(t *testing.T) {
+	setCacheConfig(t, config.CacheConfig{Enabled: true, TTL: 300, Freshness: 0, MaxEntries: 10})
+
+	d := &Database{}
+	q := Query{Period: "2024-01-01", TimeZone: "UTC"}
+
+	computed := 0
+	report := func() int {
+		value, _ := cached(d, "counter", q, func() (int, error) {
+			computed++
+			if computed == 1 {
+				d.cache.changed(parseTime("2024-01-01T10:00:00Z"), parseTime("2024-01-01T10:00:00Z"))
+			}
+			return computed, nil
+		})
+		return value
+	}
+
+	report()
+	if value := report(); value != 2 {
+		t.Errorf("Result was incorrect, got: %d, want: 2.", value)
+	}
+}
+
+func TestCachedErrors(t *testing.T) {
+	setCacheConfig(t, config.CacheConfig{Enabled: true, TTL: 300, Freshness: 10, MaxEntries: 10})
+
+	d := &Database{}
+	q := Query{Period: "2024-01-01", TimeZone: "UTC"}
+	c := &counter{err: errors.New("failed")}
+
+	if _, err := c.report(d, q); err == nil {
+		t.Error("Error was incorrect, got: nil, want: failed.")
+	}
+	c.err = nil
+	if value, err := c.report(d, q); err != nil || value != 2 {
+		t.Errorf("Result after an error was incorrect, got: %d (%v), want: 2.", value, err)
+	}
+}
+
+func TestCachedDisabled(t *testing.T) {
+	setCacheConfig(t, config.CacheConfig{Enabled: false, TTL: 300, Freshness: 10, MaxEntries: 10})
+
+	d := &Database{}
+	q := Query{Period: "2024-01-01", TimeZone: "UTC"}
+	c := &counter{}
+
+	c.report(d, q)
+	if value, _ := c.report(d, q); value != 2 {
+		t.Errorf("Result was incorrect, got: %d, want: 2.", value)
+	}
+	if len(d.cache.entries) != 0 {
+		t.Errorf("Entries were incorrect, got: %d, want: 0.", len(d.cache.entries))
+	}
+}
+
+// The oldest entry makes room for a new one
+func TestCacheEviction(t *testing.T) {
+	setCacheConfig(t, config.CacheConfig{Enabled: true, TTL: 300, Freshness: 10, MaxEntries: 2})
+
+	d := &Database{}
+	c := &counter{}
+	for _, period := range []string{"2024-01-01", "2024-01-02", "2024-01-03"} {
+		c.report(d, Query{Period: period, TimeZone: "UTC"})
+	}
+
+	if len(d.cache.entries) != 2 {
+		t.Errorf("Entries were incorrect, got: %d, want: 2.", len(d.cache.entries))
+	}
+	if value, _ := c.report(d, Query{Period: "2024-01-03", TimeZone: "UTC"}); value != 3 {
+		t.Errorf("Newest result was incorrect, got: %d, want: 3.", value)
+	}
+	if value, _ := c.report(d, Query{Period: "2024-01-01", TimeZone: "UTC"}); value != 4 {
+		t.Errorf("Evicted result was incorrect, got: %d, want: 4.", value)
+	}
+}
@@ -0,0 +1,480 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"tinylytics/helpers"
+)
+
+// ErrNoCopy is returned when a site doesn't have both a SQLite and a DuckDB
+// file, so there's nothing to compare
+var ErrNoCopy = errors.New("the site doesn't have both a SQLite and a DuckDB database")
+
+// DayTotals is how many rows a store has for a day, and a checksum of them
+// that doesn't depend on the order they're read in
+type DayTotals struct {
+	Count    int64  `json:"count"`
+	Checksum string `json:"checksum"`
+}
+
+// CheckDay is a day whose rows differ between SQLite and DuckDB. Missing rows
+// are only in SQLite, stale rows are in both but differ, newer rows differ
+// but were updated later in DuckDB, and extra rows are only in DuckDB.
+type CheckDay struct {
+	Table    string    `json:"table"`
+	Day      string    `json:"day"`
+	SQLite   DayTotals `json:"sqlite"`
+	DuckDB   DayTotals `json:"duckdb"`
+	Missing  int       `json:"missing"`
+	Stale    int       `json:"stale"`
+	Newer    int       `json:"newer"`
+	Extra    int       `json:"extra"`
+	Repaired bool      `json:"repaired"`
+}
+
+// CheckReport is what a check found. RepairSkipped says why a repair that was
+// asked for wasn't made.
+type CheckReport struct {
+	From          time.Time   `json:"from"`
+	To            time.Time   `json:"to"`
+	Days          int         `json:"days"`
+	Discrepancies []*CheckDay `json:"discrepancies"`
+	RepairSkipped string      `json:"repairSkipped,omitempty"`
+}
+
+// checkRow is a row's hash, along with the times that tell which of two
+// versions of it is the newer one
+type checkRow struct {
+	id        string
+	day       time.Time
+	hash      uint64
+	updatedAt time.Time
+	end       time.Time
+}
+
+// newer tells if the row was updated after other. Times are compared to the
+// microsecond because that's all DuckDB keeps.
+func (r checkRow) newer(other checkRow) bool {
+	return r.updatedAt.Truncate(time.Microsecond).After(other.updatedAt.Truncate(time.Microsecond)) ||
+		r.end.Truncate(time.Microsecond).After(other.end.Truncate(time.Microsecond))
+}
+
+// checkTable describes how a table's rows are split into days and hashed. The
+// hash leaves out created_at and updated_at, and uses microseconds because
+// that's all DuckDB keeps.
+type checkTable struct {
+	name    string
+	day     string
+	columns string
+	hash    func(scanner interface{ Scan(...interface{}) error }) (checkRow, error)
+}
+
+var checkTables = []checkTable{
+	{
+		name:    "user_sessions",
+		day:     "session_start",
+		columns: sessionColumns,
+		hash: func(scanner interface{ Scan(...interface{}) error }) (checkRow, error) {
+			s, err := scanSession(scanner)
+			if err != nil {
+				return checkRow{}, err
+			}
+			return checkRow{
+				id:  s.ID,
+				day: s.SessionStart,
+				hash: hashRow(
+					s.ID, s.UserIdent, s.Browser, s.BrowserMajor, s.BrowserMinor, s.BrowserPatch,
+					s.OS, s.OSMajor, s.OSMinor, s.OSPatch, s.Country, s.UserAgent, s.Referer, s.RefererFullPath,
+					s.SessionStart.UnixMicro(), s.SessionEnd.UnixMicro(), s.ScreenWidth, s.Events,
+				),
+				updatedAt: s.UpdatedAt,
+				end:       s.SessionEnd,
+			}, nil
+		},
+	},
+	{
+		name:    "user_events",
+		day:     "event_time",
+		columns: eventColumns,
+		hash: func(scanner interface{ Scan(...interface{}) error }) (checkRow, error) {
+			e, err := scanEvent(scanner)
+			if err != nil {
+				return checkRow{}, err
+			}
+			return checkRow{
+				id:        e.ID,
+				day:       e.EventTime,
+				hash:      hashRow(e.ID, e.Name, e.Page, e.EventTime.UnixMicro(), e.SessionID),
+				updatedAt: e.UpdatedAt,
+			}, nil
+		},
+	},
+}
+
+func hashRow(values ...interface{}) uint64 {
+	h := fnv.New64a()
+	for _, value := range values {
+		fmt.Fprintf(h, "%v\x00", value)
+	}
+	return h.Sum64()
+}
+
+func scanEvent(scanner interface{ Scan(...interface{}) error }) (*UserEvent, error) {
+	var event UserEvent
+	err := scanner.Scan(&event.ID, &event.CreatedAt, &event.UpdatedAt, &event.Name, &event.Page, &event.EventTime, &event.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// CheckSite compares a site's SQLite and DuckDB databases day by day between
+// from and to. With repair, missing and stale rows are copied from SQLite into
+// DuckDB, but only while SQLite is still the file written last, as it was
+// when every event was written to both. Once the site only writes to DuckDB,
+// SQLite is a frozen copy and nothing is repaired. Rows only DuckDB has, or
+// that were updated later there, are reported but left alone.
+func CheckSite(domain string, from time.Time, to time.Time, repair bool) (*CheckReport, error) {
+	file, err := helpers.GetDatabaseFileName(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range []string{STORE_SQLITE, STORE_DUCKDB} {
+		if _, err := os.Stat(StoreFileName(kind, file)); err != nil {
+			return nil, ErrNoCopy
+		}
+	}
+
+	d, err := GetDatabase(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// The site's own store is already open, the other one is only needed here
+	otherKind := STORE_SQLITE
+	if d.store.Kind() == STORE_SQLITE {
+		otherKind = STORE_DUCKDB
+	}
+	other, err := OpenStore(otherKind, file)
+	if err != nil {
+		return nil, err
+	}
+	defer other.Close()
+
+	if _, err := Migrate(other); err != nil {
+		return nil, err
+	}
+
+	sqlite, duckdb := other, d.store
+	if otherKind == STORE_DUCKDB {
+		sqlite, duckdb = d.store, other
+	}
+
+	return d.check(sqlite, duckdb, from.UTC(), to.UTC(), repair)
+}
+
+func (d *Database) check(sqlite Store, duckdb Store, from time.Time, to time.Time, repair bool) (*CheckReport, error) {
+	report := &CheckReport{From: from, To: to, Discrepancies: make([]*CheckDay, 0)}
+	days := make(map[string]bool)
+
+	if repair {
+		sqliteWritten, err := lastWritten(sqlite)
+		if err != nil {
+			return nil, fmt.Errorf("read SQLite: %w", err)
+		}
+		duckdbWritten, err := lastWritten(duckdb)
+		if err != nil {
+			return nil, fmt.Errorf("read DuckDB: %w", err)
+		}
+		if duckdbWritten.Truncate(time.Microsecond).After(sqliteWritten.Truncate(time.Microsecond)) {
+			repair = false
+			report.RepairSkipped = fmt.Sprintf("DuckDB was written to last, at %s, after SQLite at %s", duckdbWritten.Format(time.RFC3339), sqliteWritten.Format(time.RFC3339))
+		}
+	}
+
+	for _, table := range checkTables {
+		source, err := dayTotals(sqlite, table, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("read %s from SQLite: %w", table.name, err)
+		}
+		target, err := dayTotals(duckdb, table, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("read %s from DuckDB: %w", table.name, err)
+		}
+
+		for day := range source {
+			days[day] = true
+		}
+		for day := range target {
+			days[day] = true
+		}
+
+		for _, day := range sortedDays(source, target) {
+			if source[day] == target[day] {
+				continue
+			}
+
+			discrepancy := &CheckDay{
+				Table:  table.name,
+				Day:    day,
+				SQLite: source[day].totals(),
+				DuckDB: target[day].totals(),
+			}
+			if err := d.compareDay(sqlite, duckdb, table, discrepancy, repair); err != nil {
+				return report, fmt.Errorf("%s on %s: %w", table.name, day, err)
+			}
+			report.Discrepancies = append(report.Discrepancies, discrepancy)
+		}
+	}
+
+	report.Days = len(days)
+	return report, nil
+}
+
+// lastWritten returns when a store's sessions were last written to. Events
+// are written along with their session, so that's when the store was.
+func lastWritten(store Store) (time.Time, error) {
+	var updatedAt sql.NullTime
+	err := store.DB().QueryRow("SELECT updated_at FROM user_sessions ORDER BY updated_at DESC LIMIT 1").Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return updatedAt.Time, err
+}
+
+type dayTotal struct {
+	count    int64
+	checksum uint64
+}
+
+func (t dayTotal) totals() DayTotals {
+	return DayTotals{Count: t.count, Checksum: fmt.Sprintf("%016x", t.checksum)}
+}
+
+// dayTotals counts and sums the row hashes of a table per UTC day
+func dayTotals(store Store, table checkTable, from time.Time, to time.Time) (map[string]dayTotal, error) {
+	rows, err := store.DB().Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s >= ? AND %s < ?", table.columns, table.name, table.day, table.day), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]dayTotal)
+	for rows.Next() {
+		row, err := table.hash(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		day := row.day.UTC().Format(time.DateOnly)
+		total := totals[day]
+		total.count++
+		total.checksum += row.hash
+		totals[day] = total
+	}
+
+	return totals, rows.Err()
+}
+
+func sortedDays(maps ...map[string]dayTotal) []string {
+	seen := make(map[string]bool)
+	days := make([]string, 0)
+	for _, m := range maps {
+		for day := range m {
+			if !seen[day] {
+				seen[day] = true
+				days = append(days, day)
+			}
+		}
+	}
+	sort.Strings(days)
+	return days
+}
+
+// dayRows returns the hash of each of the table's rows on a day
+func dayRows(store Store, table checkTable, day time.Time) (map[string]checkRow, error) {
+	rows, err := store.DB().Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s >= ? AND %s < ?", table.columns, table.name, table.day, table.day), day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]checkRow)
+	for rows.Next() {
+		row, err := table.hash(rows)
+		if err != nil {
+			return nil, err
+		}
+		hashes[row.id] = row
+	}
+
+	return hashes, rows.Err()
+}
+
+// compareDay finds the rows that differ on a day and, with repair, copies
+// them from SQLite into DuckDB. A row DuckDB updated later is never
+// overwritten.
+func (d *Database) compareDay(sqlite Store, duckdb Store, table checkTable, discrepancy *CheckDay, repair bool) error {
+	day, err := time.Parse(time.DateOnly, discrepancy.Day)
+	if err != nil {
+		return err
+	}
+
+	source, err := dayRows(sqlite, table, day)
+	if err != nil {
+		return err
+	}
+	target, err := dayRows(duckdb, table, day)
+	if err != nil {
+		return err
+	}
+
+	missing := make([]string, 0)
+	stale := make([]string, 0)
+	for id, row := range source {
+		targetRow, exists := target[id]
+		if !exists {
+			missing = append(missing, id)
+		} else if targetRow.hash != row.hash {
+			if targetRow.newer(row) {
+				discrepancy.Newer++
+			} else {
+				stale = append(stale, id)
+			}
+		}
+	}
+	for id := range target {
+		if _, exists := source[id]; !exists {
+			discrepancy.Extra++
+		}
+	}
+	discrepancy.Missing = len(missing)
+	discrepancy.Stale = len(stale)
+
+	if !repair || len(missing)+len(stale) == 0 {
+		return nil
+	}
+
+	if err := d.copyRows(sqlite, duckdb, table, missing, stale); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	err = refreshStoreRollups(duckdb, day, day.AddDate(0, 0, 1))
+	d.cache.clear()
+	d.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("update rollups: %w", err)
+	}
+
+	discrepancy.Repaired = true
+	return nil
+}
+
+// copyRows writes the given rows of the source into the target, creating the
+// missing ones and overwriting the stale ones. The site's lock is held, as the
+// target can be the store the queue writes to.
+func (d *Database) copyRows(source Store, target Store, table checkTable, missing []string, stale []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	isStale := make(map[string]bool, len(stale))
+	for _, id := range stale {
+		isStale[id] = true
+	}
+
+	// Events never change once written, a stale one is replaced
+	if table.name == "user_events" {
+		for _, ids := range chunk(stale, CONVERT_BATCH_SIZE) {
+			if _, err := target.DB().Exec(fmt.Sprintf("DELETE FROM user_events WHERE id IN (%s)", placeholders(len(ids))), idArgs(ids)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ids := range chunk(append(missing, stale...), CONVERT_BATCH_SIZE) {
+		rows, err := source.DB().Query(fmt.Sprintf("SELECT %s FROM %s WHERE id IN (%s)", table.columns, table.name, placeholders(len(ids))), idArgs(ids)...)
+		if err != nil {
+			return err
+		}
+
+		batch := &Batch{touched: make(map[string]*UserSession), created: make(map[string]bool)}
+		for rows.Next() {
+			if table.name == "user_sessions" {
+				session, err := scanSession(rows)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				batch.created[session.ID] = !isStale[session.ID]
+				batch.touch(session.UserSession())
+				continue
+			}
+
+			event, err := scanEvent(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			batch.SaveEvent(event, event.SessionID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if err := target.WriteBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func idArgs(ids []string) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+func chunk(ids []string, size int) [][]string {
+	chunks := make([][]string, 0, len(ids)/size+1)
+	for len(ids) > size {
+		chunks = append(chunks, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// String summarises a discrepancy for the logs
+func (c *CheckDay) String() string {
+	parts := []string{fmt.Sprintf("%s %s: SQLite has %d rows, DuckDB %d", c.Table, c.Day, c.SQLite.Count, c.DuckDB.Count)}
+	if c.Missing > 0 {
+		parts = append(parts, fmt.Sprintf("%d missing", c.Missing))
+	}
+	if c.Stale > 0 {
+		parts = append(parts, fmt.Sprintf("%d stale", c.Stale))
+	}
+	if c.Newer > 0 {
+		parts = append(parts, fmt.Sprintf("%d newer in DuckDB", c.Newer))
+	}
+	if c.Extra > 0 {
+		parts = append(parts, fmt.Sprintf("%d only in DuckDB", c.Extra))
+	}
+	if c.Repaired {
+		parts = append(parts, "repaired")
+	}
+	return strings.Join(parts, ", ")
+}
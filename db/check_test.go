@@ -0,0 +1,152 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// addEvent adds a pageview to a written session, a minute after its end
+func addEvent(t *testing.T, d *Database, session *UserSession) {
+	t.Helper()
+
+	batch := d.NewBatch()
+	session.SessionEnd = session.SessionEnd.Add(time.Minute)
+	batch.UpdateUserSession(session)
+	batch.SaveEvent(&UserEvent{ID: fmt.Sprintf("%s-%d", session.ID, session.Events), Name: "pageview", Page: "a.com/", EventTime: session.SessionEnd}, session.ID)
+	session.Events++
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("Couldn't add an event: %v", err)
+	}
+}
+
+// openCheckDatabases opens a SQLite and a DuckDB database with the same two
+// sessions, "s" and "n"
+func openCheckDatabases(t *testing.T) (*Database, *Database, map[string]*UserSession, map[string]*UserSession) {
+	sqlite, duckdb := openTestDatabase(t, STORE_SQLITE), openTestDatabase(t, STORE_DUCKDB)
+
+	sessions := func() map[string]*UserSession {
+		return map[string]*UserSession{
+			"s": {ID: "s", UserIdent: "u1", Browser: "Chrome", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1},
+			"n": {ID: "n", UserIdent: "u2", Browser: "Chrome", SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 1},
+		}
+	}
+	sqliteSessions, duckdbSessions := sessions(), sessions()
+	writeSessions(t, sqlite, sqliteSessions["s"], sqliteSessions["n"])
+	writeSessions(t, duckdb, duckdbSessions["s"], duckdbSessions["n"])
+
+	return sqlite, duckdb, sqliteSessions, duckdbSessions
+}
+
+func findDiscrepancy(report *CheckReport, table string) *CheckDay {
+	for _, discrepancy := range report.Discrepancies {
+		if discrepancy.Table == table {
+			return discrepancy
+		}
+	}
+	return nil
+}
+
+// While SQLite is written last, missing and stale rows are copied into
+// DuckDB but the rows DuckDB updated later are kept
+func TestCheckRepair(t *testing.T) {
+	sqlite, duckdb, sqliteSessions, duckdbSessions := openCheckDatabases(t)
+
+	writeSessions(t, duckdb, &UserSession{ID: "x", UserIdent: "u3", SessionStart: parseTime("2024-01-02T12:00:00Z"), Events: 1})
+	addEvent(t, duckdb, duckdbSessions["n"])
+	addEvent(t, sqlite, sqliteSessions["s"])
+	writeSessions(t, sqlite, &UserSession{ID: "m", UserIdent: "u4", SessionStart: parseTime("2024-01-02T13:00:00Z"), Events: 1})
+
+	report, err := duckdb.check(sqlite.store, duckdb.store, day("2024-01-01"), day("2024-01-04"), true)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if report.RepairSkipped != "" || report.Days != 1 {
+		t.Errorf("Report was incorrect, got: %d days, skipped: %q, want: 1 day, not skipped.", report.Days, report.RepairSkipped)
+	}
+
+	sessions := findDiscrepancy(report, "user_sessions")
+	if sessions == nil || sessions.Missing != 1 || sessions.Stale != 1 || sessions.Newer != 1 || sessions.Extra != 1 || !sessions.Repaired {
+		t.Errorf("Sessions discrepancy was incorrect, got: %v, want: 1 missing, 1 stale, 1 newer, 1 only in DuckDB, repaired.", sessions)
+	}
+	events := findDiscrepancy(report, "user_events")
+	if events == nil || events.Missing != 2 || events.Stale != 0 || events.Extra != 2 || !events.Repaired {
+		t.Errorf("Events discrepancy was incorrect, got: %v, want: 2 missing, 2 only in DuckDB, repaired.", events)
+	}
+
+	if ids := storedIDs(t, duckdb, "user_sessions"); ids != "m n s x" {
+		t.Errorf("DuckDB sessions were incorrect, got: %s, want: m n s x.", ids)
+	}
+	if ids := storedIDs(t, duckdb, "user_events"); ids != "m-0 n-0 n-1 s-0 s-1 x-0" {
+		t.Errorf("DuckDB events were incorrect, got: %s, want: m-0 n-0 n-1 s-0 s-1 x-0.", ids)
+	}
+
+	var events1, events2 int64
+	err = duckdb.store.DB().QueryRow("SELECT (SELECT events FROM user_sessions WHERE id = 's'), (SELECT events FROM user_sessions WHERE id = 'n')").Scan(&events1, &events2)
+	if err != nil || events1 != 2 || events2 != 2 {
+		t.Errorf("DuckDB session events were incorrect, got: s %d, n %d (%v), want: 2, 2.", events1, events2, err)
+	}
+
+	var sessionCount int64
+	err = duckdb.store.DB().QueryRow("SELECT CAST(SUM(sessions) AS BIGINT) FROM hourly_sessions").Scan(&sessionCount)
+	if err != nil || sessionCount != 4 {
+		t.Errorf("DuckDB rollups were incorrect, got: %d sessions (%v), want: 4.", sessionCount, err)
+	}
+
+	// Only the rows DuckDB updated later are left
+	report, err = duckdb.check(sqlite.store, duckdb.store, day("2024-01-01"), day("2024-01-04"), true)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	sessions = findDiscrepancy(report, "user_sessions")
+	if sessions == nil || sessions.Missing != 0 || sessions.Stale != 0 || sessions.Newer != 1 {
+		t.Errorf("Sessions discrepancy after the repair was incorrect, got: %v, want: 1 newer.", sessions)
+	}
+}
+
+// Once DuckDB is written last, SQLite is an old copy and nothing is repaired
+func TestCheckRepairSkipped(t *testing.T) {
+	sqlite, duckdb, sqliteSessions, duckdbSessions := openCheckDatabases(t)
+
+	addEvent(t, sqlite, sqliteSessions["s"])
+	writeSessions(t, sqlite, &UserSession{ID: "m", UserIdent: "u4", SessionStart: parseTime("2024-01-02T13:00:00Z"), Events: 1})
+	addEvent(t, duckdb, duckdbSessions["n"])
+
+	report, err := duckdb.check(sqlite.store, duckdb.store, day("2024-01-01"), day("2024-01-04"), true)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if report.RepairSkipped == "" {
+		t.Error("RepairSkipped was incorrect, got: empty, want: why.")
+	}
+
+	sessions := findDiscrepancy(report, "user_sessions")
+	if sessions == nil || sessions.Missing != 1 || sessions.Stale != 1 || sessions.Newer != 1 || sessions.Repaired {
+		t.Errorf("Sessions discrepancy was incorrect, got: %v, want: 1 missing, 1 stale, 1 newer, not repaired.", sessions)
+	}
+
+	if ids := storedIDs(t, duckdb, "user_sessions"); ids != "n s" {
+		t.Errorf("DuckDB sessions were incorrect, got: %s, want: n s.", ids)
+	}
+	if ids := storedIDs(t, duckdb, "user_events"); ids != "n-0 n-1 s-0" {
+		t.Errorf("DuckDB events were incorrect, got: %s, want: n-0 n-1 s-0.", ids)
+	}
+}
+
+// Without repair, nothing is written
+func TestCheckReportOnly(t *testing.T) {
+	sqlite, duckdb, _, _ := openCheckDatabases(t)
+
+	writeSessions(t, sqlite, &UserSession{ID: "m", UserIdent: "u4", SessionStart: parseTime("2024-01-02T13:00:00Z"), Events: 1})
+
+	report, err := duckdb.check(sqlite.store, duckdb.store, day("2024-01-01"), day("2024-01-04"), false)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if len(report.Discrepancies) != 2 || report.Discrepancies[0].Repaired {
+		t.Errorf("Discrepancies were incorrect, got: %v, want: sessions and events, not repaired.", report.Discrepancies)
+	}
+	if ids := storedIDs(t, duckdb, "user_sessions"); ids != "n s" {
+		t.Errorf("DuckDB sessions were incorrect, got: %s, want: n s.", ids)
+	}
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	COHORT_WEEK  = "week"
+	COHORT_MONTH = "month"
+)
+
+// Cohort is a group of visitors whose first session fell in the same period.
+// Returning[i] is how many of them had a session i periods later, so
+// Returning[0] always equals Visitors.
+type Cohort struct {
+	Period    time.Time `json:"period"`
+	Visitors  int64     `json:"visitors"`
+	Returning []int64   `json:"returning"`
+	Retention []float64 `json:"retention"`
+}
+
+type CohortReport struct {
+	Granularity string    `json:"granularity"`
+	Periods     int       `json:"periods"`
+	Cohorts     []*Cohort `json:"cohorts"`
+}
+
+// GetCohorts groups visitors (by user_ident) into cohorts by the week or
+// month of their first session and counts how many came back in each later
+// period. The dashboard filters and period apply to the first session only,
+// so a visitor that arrived from a referrer stays in the cohort whatever
+// brought them back. Weeks and months are the query's time zone's.
+func (d *Database) GetCohorts(ctx context.Context, q Query, granularity string, periods int) (*CohortReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if granularity != COHORT_MONTH {
+		granularity = COHORT_WEEK
+	}
+
+	conditions, args := buildFilters(q, false)
+
+	// local_time is a Go function on DuckDB, called once per row, so it's
+	// only applied to the first sessions in the period and to the sessions
+	// that can fall in one of their cohort's periods
+	from, until := cohortActivityRange(q, granularity, periods)
+
+	query := fmt.Sprintf(`
+		WITH first_sessions AS (
+			SELECT user_sessions.user_ident, user_sessions.session_start
+			FROM (
+				SELECT *, ROW_NUMBER() OVER (PARTITION BY user_ident ORDER BY session_start) AS visit
+				FROM user_sessions
+			) AS user_sessions
+			WHERE user_sessions.visit = 1 AND %[2]s
+		),
+		firsts AS (
+			SELECT user_ident, DATE_TRUNC('%[1]s', local_time(session_start, ?)) AS cohort
+			FROM first_sessions
+		),
+		activity AS (
+			SELECT DISTINCT user_ident, DATE_TRUNC('%[1]s', local_time(session_start, ?)) AS period
+			FROM user_sessions
+			WHERE session_start >= ? AND session_start < ?
+				AND user_ident IN (SELECT user_ident FROM first_sessions)
+		)
+		SELECT
+			firsts.cohort,
+			DATEDIFF('%[1]s', firsts.cohort, activity.period) AS period_offset,
+			COUNT(*) AS visitors
+		FROM firsts
+		JOIN activity ON activity.user_ident = firsts.user_ident
+		WHERE DATEDIFF('%[1]s', firsts.cohort, activity.period) BETWEEN 0 AND ?
+		GROUP BY firsts.cohort, period_offset
+		ORDER BY firsts.cohort, period_offset
+	`, granularity, strings.Join(conditions, " AND "))
+
+	zone := q.Zone()
+	rows, err := d.store.DB().QueryContext(ctx, query, append(args, zone, zone, from, until, periods-1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &CohortReport{
+		Granularity: granularity,
+		Periods:     periods,
+		Cohorts:     make([]*Cohort, 0),
+	}
+
+	var current *Cohort
+	for rows.Next() {
+		var period timestamp
+		var offset int
+		var visitors int64
+
+		if err := rows.Scan(&period, &offset, &visitors); err != nil {
+			return nil, err
+		}
+
+		if current == nil || !current.Period.Equal(period.Time) {
+			current = &Cohort{Period: period.Time, Returning: make([]int64, periods)}
+			report.Cohorts = append(report.Cohorts, current)
+		}
+
+		current.Returning[offset] = visitors
+		if offset == 0 {
+			current.Visitors = visitors
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now, err := localTime(time.Now(), zone)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := q.Location()
+	for _, cohort := range report.Cohorts {
+		// Periods that haven't happened yet are left out instead of showing 0%
+		elapsed := periodsBetween(granularity, cohort.Period, now) + 1
+		cohort.Period = zonedTime(cohort.Period, loc)
+
+		if elapsed < periods {
+			cohort.Returning = cohort.Returning[:elapsed]
+		}
+
+		cohort.Retention = make([]float64, len(cohort.Returning))
+		for i, returning := range cohort.Returning {
+			if cohort.Visitors > 0 {
+				cohort.Retention[i] = float64(returning) / float64(cohort.Visitors) * 100
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// cohortActivityRange returns the UTC times the sessions of a cohort can be
+// in: from the start of the period until the last of the cohorts has had its
+// periods. A day is added for the time zone the periods are counted in.
+func cohortActivityRange(q Query, granularity string, periods int) (time.Time, time.Time) {
+	start, end := q.TimeRange()
+	last := time.Now()
+	if end != nil {
+		last = *end
+	}
+
+	if granularity == COHORT_MONTH {
+		last = last.AddDate(0, periods, 1)
+	} else {
+		last = last.AddDate(0, 0, 7*periods+1)
+	}
+	return start.UTC(), last.UTC()
+}
+
+func periodsBetween(granularity string, start time.Time, end time.Time) int {
+	if granularity == COHORT_MONTH {
+		return (end.Year()-start.Year())*12 + int(end.Month()) - int(start.Month())
+	}
+	return int(end.Sub(start).Hours() / (24 * 7))
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetCohorts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		at := func(value string, hour int) time.Time {
+			return day(value).Add(time.Duration(hour) * time.Hour)
+		}
+
+		writeSessions(t, d,
+			// Cohort of Monday 2024-01-01
+			&UserSession{ID: "s1", UserIdent: "u1", SessionStart: at("2024-01-01", 10), Events: 1},
+			&UserSession{ID: "s2", UserIdent: "u1", SessionStart: at("2024-01-09", 10), Events: 1},
+			&UserSession{ID: "s3", UserIdent: "u1", SessionStart: at("2024-01-23", 10), Events: 1},
+			&UserSession{ID: "s4", UserIdent: "u2", SessionStart: at("2024-01-02", 10), Events: 1},
+			// First came before the period, so in no cohort
+			&UserSession{ID: "s5", UserIdent: "u3", SessionStart: at("2023-12-28", 10), Events: 1},
+			&UserSession{ID: "s6", UserIdent: "u3", SessionStart: at("2024-01-03", 10), Events: 1},
+			// Cohort of Monday 2024-01-08, coming back after the periods
+			&UserSession{ID: "s7", UserIdent: "u4", SessionStart: at("2024-01-08", 10), Events: 1},
+			&UserSession{ID: "s8", UserIdent: "u4", SessionStart: at("2024-01-15", 10), Events: 1},
+			&UserSession{ID: "s9", UserIdent: "u5", SessionStart: at("2024-01-14", 23), Events: 1},
+			&UserSession{ID: "s10", UserIdent: "u5", SessionStart: at("2024-03-01", 10), Events: 1},
+		)
+
+		q := Query{Period: "2024-01-01..2024-01-14", TimeZone: "UTC"}
+		report, err := d.GetCohorts(context.Background(), q, COHORT_WEEK, 4)
+		if err != nil {
+			t.Fatalf("GetCohorts failed: %v", err)
+		}
+
+		expected := []Cohort{
+			{Period: day("2024-01-01"), Visitors: 2, Returning: []int64{2, 1, 0, 1}},
+			{Period: day("2024-01-08"), Visitors: 2, Returning: []int64{2, 1, 0, 0}},
+		}
+		if len(report.Cohorts) != len(expected) {
+			t.Fatalf("Cohorts were incorrect, got: %d, want: %d.", len(report.Cohorts), len(expected))
+		}
+		for i, cohort := range report.Cohorts {
+			if !cohort.Period.Equal(expected[i].Period) || cohort.Visitors != expected[i].Visitors || !reflect.DeepEqual(cohort.Returning, expected[i].Returning) {
+				t.Errorf("Cohort %d was incorrect, got: %v %d %v, want: %v %d %v.", i, cohort.Period, cohort.Visitors, cohort.Returning, expected[i].Period, expected[i].Visitors, expected[i].Returning)
+			}
+		}
+
+		// u5's Sunday night session is on Monday in Sydney, after the period
+		q.TimeZone = "Australia/Sydney"
+		report, err = d.GetCohorts(context.Background(), q, COHORT_WEEK, 4)
+		if err != nil {
+			t.Fatalf("GetCohorts failed: %v", err)
+		}
+		if len(report.Cohorts) != 2 || report.Cohorts[1].Visitors != 1 {
+			t.Errorf("Sydney cohorts were incorrect, got: %d cohorts.", len(report.Cohorts))
+		}
+	})
+}
@@ -0,0 +1,403 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ConsoleTables are the tables SQL console queries can read
+var ConsoleTables = []string{
+	"user_sessions", "user_events", "funnels", "daily_totals",
+	"hourly_sessions", "daily_sessions", "hourly_pages", "daily_pages",
+}
+
+// ErrConsoleQuery is returned for a console query that isn't a single SELECT
+// of the site's tables
+var ErrConsoleQuery = errors.New("invalid query")
+
+// ConsoleResult is what a console query returned, at most the row limit
+type ConsoleResult struct {
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated"` // There were more rows than the limit
+	Duration  float64         `json:"duration"`  // Seconds
+}
+
+// ConsoleQuery is a query saved from the console
+type ConsoleQuery struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Validate checks a console query before it is saved
+func (q *ConsoleQuery) Validate() error {
+	if strings.TrimSpace(q.Name) == "" {
+		return fmt.Errorf("query name is required")
+	}
+	if strings.TrimSpace(q.Query) == "" {
+		return fmt.Errorf("query is required")
+	}
+	return nil
+}
+
+// RunConsoleQuery runs a SELECT written by an administrator on a read only
+// connection. It's cancelled after timeout, and only the first maxRows rows
+// are read. The site's lock isn't held, the read only connection keeps the
+// query apart from the batches written meanwhile.
+func (d *Database) RunConsoleQuery(ctx context.Context, query string, maxRows int, timeout time.Duration) (*ConsoleResult, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	if query == "" {
+		return nil, fmt.Errorf("%w: the query is empty", ErrConsoleQuery)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, release, err := d.store.ReadOnly(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	authorizer := newConsoleAuthorizer()
+	if d.store.Kind() == STORE_DUCKDB {
+		if err := checkDuckDBSelect(ctx, conn, query); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := authorizer.register(ctx, conn); err != nil {
+			return nil, err
+		}
+		defer authorizer.unregister(conn)
+	}
+
+	// As a subquery it can only be a single SELECT on either store. The
+	// newline ends a trailing comment.
+	start := time.Now()
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT * FROM (%s\n) AS console LIMIT ?", query), maxRows+1)
+	if authorizer.denied != nil {
+		return nil, authorizer.denied
+	}
+	if err != nil {
+		return nil, consoleError(ctx, timeout, err)
+	}
+	defer rows.Close()
+
+	result := &ConsoleResult{Rows: make([][]interface{}, 0)}
+	if result.Columns, err = rows.Columns(); err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(result.Columns))
+		targets := make([]interface{}, len(values))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			values[i] = consoleValue(value)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, consoleError(ctx, timeout, err)
+	}
+
+	result.Duration = time.Since(start).Seconds()
+	return result, nil
+}
+
+// consoleError explains a query that was cancelled by the timeout
+func consoleError(ctx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: cancelled after %s", ErrConsoleQuery, timeout)
+	}
+	return fmt.Errorf("%w: %v", ErrConsoleQuery, err)
+}
+
+// consoleValue converts the values the drivers return into ones that encode
+// as JSON
+func consoleValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case duckdb.Decimal:
+		return v.Float64()
+	case duckdb.UUID:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// checkDuckDBSelect has DuckDB parse the query, which it only serializes when
+// it's made of SELECTs, and checks it reads nothing but the site's tables.
+// Table functions like read_csv and selecting from a file path could read
+// anything on the server.
+func checkDuckDBSelect(ctx context.Context, conn *sql.Conn, query string) error {
+	var serialized string
+	if err := conn.QueryRowContext(ctx, "SELECT CAST(json_serialize_sql(CAST(? AS VARCHAR)) AS VARCHAR)", query).Scan(&serialized); err != nil {
+		return err
+	}
+
+	var parsed struct {
+		Error        bool              `json:"error"`
+		ErrorMessage string            `json:"error_message"`
+		Statements   []json.RawMessage `json:"statements"`
+	}
+	if err := json.Unmarshal([]byte(serialized), &parsed); err != nil {
+		return err
+	}
+	if parsed.Error {
+		return fmt.Errorf("%w: %s", ErrConsoleQuery, parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 {
+		return fmt.Errorf("%w: run one statement at a time", ErrConsoleQuery)
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(parsed.Statements[0], &tree); err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool)
+	for _, table := range ConsoleTables {
+		allowed[table] = true
+	}
+	collectCTENames(tree, allowed)
+
+	return checkTableRefs(tree, allowed)
+}
+
+// collectCTENames adds the names of the query's common table expressions,
+// they're referred to like tables
+func collectCTENames(node interface{}, names map[string]bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if cteMap, isMap := v["cte_map"].(map[string]interface{}); isMap {
+			entries, _ := cteMap["map"].([]interface{})
+			for _, entry := range entries {
+				if e, isMap := entry.(map[string]interface{}); isMap {
+					if key, isString := e["key"].(string); isString {
+						names[strings.ToLower(key)] = true
+					}
+				}
+			}
+		}
+		for _, child := range v {
+			collectCTENames(child, names)
+		}
+	case []interface{}:
+		for _, child := range v {
+			collectCTENames(child, names)
+		}
+	}
+}
+
+func checkTableRefs(node interface{}, allowed map[string]bool) error {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		switch v["type"] {
+		case "TABLE_FUNCTION":
+			name := "table functions"
+			if function, isMap := v["function"].(map[string]interface{}); isMap {
+				name, _ = function["function_name"].(string)
+			}
+			return fmt.Errorf("%w: %s can't be used, only the site's tables can be read", ErrConsoleQuery, name)
+		case "BASE_TABLE":
+			table, _ := v["table_name"].(string)
+			schema, _ := v["schema_name"].(string)
+			catalog, _ := v["catalog_name"].(string)
+			if catalog != "" || (schema != "" && schema != "main") || !allowed[strings.ToLower(table)] {
+				return fmt.Errorf("%w: %q isn't one of the site's tables (%s)", ErrConsoleQuery, table, strings.Join(ConsoleTables, ", "))
+			}
+		}
+		for _, child := range v {
+			if err := checkTableRefs(child, allowed); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := checkTableRefs(child, allowed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sqliteRecursive is SQLITE_RECURSIVE, which the driver doesn't export
+const sqliteRecursive = 33
+
+// consoleAuthorizer only lets SQLite run a SELECT of the site's tables, like
+// checkDuckDBSelect does for DuckDB. SQLite asks it about every table the
+// query reads while preparing it, so schema_version, console_queries or
+// sqlite_master are refused wherever they're referred to.
+type consoleAuthorizer struct {
+	allowed map[string]bool
+	schema  map[string]bool // The file's tables and views, see register
+	denied  error           // Why the query was refused
+}
+
+func newConsoleAuthorizer() *consoleAuthorizer {
+	allowed := make(map[string]bool)
+	for _, table := range ConsoleTables {
+		allowed[table] = true
+	}
+	return &consoleAuthorizer{allowed: allowed}
+}
+
+func (a *consoleAuthorizer) authorize(op int, arg1 string, arg2 string, database string) int {
+	switch op {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_FUNCTION, sqliteRecursive:
+		return sqlite3.SQLITE_OK
+	case sqlite3.SQLITE_READ:
+		table := strings.ToLower(arg1)
+		if (database == "main" || database == "") && a.allowed[table] {
+			return sqlite3.SQLITE_OK
+		}
+		// COUNT(*) of a whole table is asked about without the database, and
+		// so is COUNT(*) of a CTE, which isn't one of the file's tables
+		if database == "" && !a.schema[table] && !strings.HasPrefix(table, "sqlite_") {
+			return sqlite3.SQLITE_OK
+		}
+		if a.denied == nil {
+			a.denied = fmt.Errorf("%w: %q isn't one of the site's tables (%s)", ErrConsoleQuery, arg1, strings.Join(ConsoleTables, ", "))
+		}
+	default:
+		if a.denied == nil {
+			a.denied = fmt.Errorf("%w: only SELECT queries can be run", ErrConsoleQuery)
+		}
+	}
+	return sqlite3.SQLITE_DENY
+}
+
+// register reads the names of the file's tables and views, then sets the
+// authorizer on the connection
+func (a *consoleAuthorizer) register(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM sqlite_master")
+	if err != nil {
+		return err
+	}
+	a.schema = make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		a.schema[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return conn.Raw(func(driverConn interface{}) error {
+		driverConn.(*sqlite3.SQLiteConn).RegisterAuthorizer(a.authorize)
+		return nil
+	})
+}
+
+// unregister removes the authorizer before the connection goes back to the
+// pool
+func (a *consoleAuthorizer) unregister(conn *sql.Conn) {
+	conn.Raw(func(driverConn interface{}) error {
+		driverConn.(*sqlite3.SQLiteConn).RegisterAuthorizer(nil)
+		return nil
+	})
+}
+
+func scanConsoleQuery(scanner interface{ Scan(...interface{}) error }) (*ConsoleQuery, error) {
+	var query ConsoleQuery
+	var createdAt, updatedAt timestamp
+	if err := scanner.Scan(&query.ID, &query.Name, &query.Query, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	query.CreatedAt, query.UpdatedAt = createdAt.Time, updatedAt.Time
+	return &query, nil
+}
+
+// GetConsoleQueries returns the saved console queries, most recently saved
+// first
+func (d *Database) GetConsoleQueries() ([]*ConsoleQuery, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.store.DB().Query(`
+		SELECT id, name, query, created_at, updated_at
+		FROM console_queries
+		ORDER BY updated_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := make([]*ConsoleQuery, 0)
+	for rows.Next() {
+		query, err := scanConsoleQuery(rows)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+
+	return queries, rows.Err()
+}
+
+// SaveConsoleQuery inserts the query. Saving a query under a name that's
+// already used replaces that one.
+func (d *Database) SaveConsoleQuery(query *ConsoleQuery) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	query.UpdatedAt = now
+
+	var existing timestamp
+	err := d.store.DB().QueryRow("SELECT id, created_at FROM console_queries WHERE name = ?", query.Name).Scan(&query.ID, &existing)
+	if err == nil {
+		query.CreatedAt = existing.Time
+		_, err = d.store.DB().Exec("UPDATE console_queries SET query = ?, updated_at = ? WHERE id = ?", query.Query, now, query.ID)
+		return err
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	query.CreatedAt = now
+	_, err = d.store.DB().Exec(`
+		INSERT INTO console_queries (id, created_at, updated_at, name, query)
+		VALUES (?, ?, ?, ?, ?)
+	`, query.ID, now, now, query.Name, query.Query)
+	return err
+}
+
+func (d *Database) DeleteConsoleQuery(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.store.DB().Exec("DELETE FROM console_queries WHERE id = ?", id)
+	return err
+}
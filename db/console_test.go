@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunConsoleQuery(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d,
+			&UserSession{ID: "s1", UserIdent: "u1", Browser: "Chrome", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1},
+			&UserSession{ID: "s2", UserIdent: "u2", Browser: "Firefox", SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 2},
+		)
+
+		tests := []struct {
+			query string
+			rows  int
+		}{
+			{"SELECT id FROM user_sessions", 2},
+			{"select browser, count(*) from USER_SESSIONS group by browser;", 2},
+			{"WITH pages AS (SELECT page FROM user_events) SELECT * FROM pages", 3},
+			{"SELECT s.id FROM user_sessions s JOIN user_events e ON e.session_id = s.id WHERE s.id IN (SELECT session_id FROM user_events)", 3},
+			{"SELECT COUNT(*) FROM daily_sessions -- a comment", 1},
+			{"SELECT 1", 1},
+			{"WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 5) SELECT COUNT(*) FROM n", 1},
+			{"SELECT COUNT(*) FROM (SELECT id FROM user_sessions)", 1},
+		}
+		for _, test := range tests {
+			result, err := d.RunConsoleQuery(context.Background(), test.query, 10, time.Minute)
+			if err != nil {
+				t.Errorf("RunConsoleQuery(%s) failed: %v", test.query, err)
+				continue
+			}
+			if len(result.Rows) != test.rows || result.Truncated {
+				t.Errorf("RunConsoleQuery(%s) was incorrect, got: %d rows, truncated: %v, want: %d rows.", test.query, len(result.Rows), result.Truncated, test.rows)
+			}
+		}
+
+		result, err := d.RunConsoleQuery(context.Background(), "SELECT id FROM user_events ORDER BY id", 2, time.Minute)
+		if err != nil || len(result.Rows) != 2 || !result.Truncated || result.Rows[0][0] != "s1-0" {
+			t.Errorf("RunConsoleQuery with a limit was incorrect, got: %v (%v), want: s1-0 and s2-0, truncated.", result, err)
+		}
+	})
+}
+
+// Only SELECTs of the site's tables are run, on either store
+func TestRunConsoleQueryRefused(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1})
+		if err := d.SaveConsoleQuery(&ConsoleQuery{ID: "q1", Name: "sessions", Query: "SELECT * FROM user_sessions"}); err != nil {
+			t.Fatal(err)
+		}
+
+		queries := []string{
+			"",
+			"SELECT * FROM schema_version",
+			"SELECT * FROM console_queries",
+			"SELECT name FROM sqlite_master",
+			"SELECT COUNT(*) FROM sqlite_master",
+			"SELECT COUNT(*) FROM schema_version",
+			"SELECT * FROM user_sessions WHERE id IN (SELECT id FROM console_queries)",
+			"WITH q AS (SELECT * FROM console_queries) SELECT * FROM q",
+			"SELECT * FROM user_sessions, schema_version",
+			"SELECT * FROM pragma_table_info('user_sessions')",
+			"SELECT * FROM read_csv('/etc/passwd')",
+			"DELETE FROM user_sessions",
+			"SELECT 1; DELETE FROM user_sessions",
+			"SELECT 1) AS a; DELETE FROM user_sessions; SELECT * FROM (SELECT 1",
+		}
+		for _, query := range queries {
+			result, err := d.RunConsoleQuery(context.Background(), query, 10, time.Minute)
+			if !errors.Is(err, ErrConsoleQuery) {
+				t.Errorf("RunConsoleQuery(%s) was incorrect, got: %v (%v), want: an invalid query.", query, result, err)
+			}
+		}
+
+		// The connection is still good for the site's tables afterwards
+		result, err := d.RunConsoleQuery(context.Background(), "SELECT id FROM user_sessions", 10, time.Minute)
+		if err != nil || len(result.Rows) != 1 {
+			t.Errorf("RunConsoleQuery after refused ones was incorrect, got: %v (%v), want: 1 row.", result, err)
+		}
+		if ids := storedIDs(t, d, "user_sessions"); ids != "s1" {
+			t.Errorf("Sessions were incorrect, got: %s, want: s1.", ids)
+		}
+	})
+}
+
+// A console query doesn't hold up the batches written while it runs
+func TestRunConsoleQueryDoesntBlockWrites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		done := make(chan error)
+		go func() {
+			_, err := d.RunConsoleQuery(context.Background(), "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1000000000) SELECT COUNT(*) FROM n", 10, 2*time.Second)
+			done <- err
+		}()
+
+		time.Sleep(300 * time.Millisecond)
+		start := time.Now()
+		writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1})
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Write was incorrect, got: %s, want: not waiting for the console query.", elapsed)
+		}
+
+		if err := <-done; !errors.Is(err, ErrConsoleQuery) {
+			t.Errorf("RunConsoleQuery was incorrect, got: %v, want: cancelled.", err)
+		}
+	})
+}
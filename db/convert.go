@@ -0,0 +1,274 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// How many rows the converter reads and writes at a time
+const CONVERT_BATCH_SIZE = 1000
+
+// Convert copies a site's sessions, events and funnels from one store to
+// another. Rows the target already has are skipped, so an interrupted
+// conversion can be resumed by running it again.
+func Convert(from Store, to Store) error {
+	// Get counts from both databases
+	var sourceSessionCount, sourceEventCount int64
+	var targetSessionCount, targetEventCount int64
+
+	from.DB().QueryRow("SELECT COUNT(*) FROM user_sessions").Scan(&sourceSessionCount)
+	from.DB().QueryRow("SELECT COUNT(*) FROM user_events").Scan(&sourceEventCount)
+	to.DB().QueryRow("SELECT COUNT(*) FROM user_sessions").Scan(&targetSessionCount)
+	to.DB().QueryRow("SELECT COUNT(*) FROM user_events").Scan(&targetEventCount)
+
+	// Check if conversion is already complete
+	if targetSessionCount == sourceSessionCount && targetEventCount == sourceEventCount {
+		log.Printf("Conversion already complete: %d sessions, %d events", targetSessionCount, targetEventCount)
+		if err := convertFunnels(from, to); err != nil {
+			return err
+		}
+		return convertConsoleQueries(from, to)
+	}
+
+	// Check if there's a partial conversion - continue from where we left off
+	if targetSessionCount > 0 {
+		log.Printf("Partial conversion detected - resuming from session %d/%d", targetSessionCount, sourceSessionCount)
+	}
+
+	log.Printf("Starting conversion of %d sessions and %d events from %s to %s...", sourceSessionCount, sourceEventCount, from.Kind(), to.Kind())
+
+	if err := convertSessions(from, to, sourceSessionCount, targetSessionCount > 0); err != nil {
+		return err
+	}
+	if err := convertEvents(from, to, sourceEventCount, targetEventCount > 0); err != nil {
+		return err
+	}
+	if err := convertFunnels(from, to); err != nil {
+		return err
+	}
+	if err := convertConsoleQueries(from, to); err != nil {
+		return err
+	}
+
+	// Verify conversion completed successfully
+	to.DB().QueryRow("SELECT COUNT(*) FROM user_sessions").Scan(&targetSessionCount)
+	to.DB().QueryRow("SELECT COUNT(*) FROM user_events").Scan(&targetEventCount)
+
+	log.Println("Conversion verification:")
+	log.Printf("  Sessions: %s %d → %s %d", from.Kind(), sourceSessionCount, to.Kind(), targetSessionCount)
+	log.Printf("  Events: %s %d → %s %d", from.Kind(), sourceEventCount, to.Kind(), targetEventCount)
+
+	if targetSessionCount < sourceSessionCount || targetEventCount < sourceEventCount {
+		return fmt.Errorf("conversion incomplete, the %s store has fewer rows than the %s one", to.Kind(), from.Kind())
+	}
+
+	log.Println("Building rollups...")
+	if err := RebuildRollups(to); err != nil {
+		return fmt.Errorf("build rollups: %w", err)
+	}
+
+	log.Println("✓ Conversion completed successfully!")
+	return nil
+}
+
+// existingIDs loads the ids the target already has, only needed when resuming
+func existingIDs(store Store, table string, resuming bool) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	if !resuming {
+		return existing, nil
+	}
+
+	log.Printf("Loading existing %s ids from %s...", table, store.Kind())
+	rows, err := store.DB().Query(fmt.Sprintf("SELECT id FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+	log.Printf("Loaded %d existing %s ids", len(existing), table)
+
+	return existing, rows.Err()
+}
+
+func convertSessions(from Store, to Store, total int64, resuming bool) error {
+	existing, err := existingIDs(to, "user_sessions", resuming)
+	if err != nil {
+		return err
+	}
+
+	converted, skipped := 0, 0
+	lastID := ""
+
+	// Paging by id keeps each read cheap, however far in we are
+	for {
+		rows, err := from.DB().Query(fmt.Sprintf(`
+			SELECT %s FROM user_sessions
+			WHERE user_sessions.id > ?
+			ORDER BY user_sessions.id
+			LIMIT ?
+		`, sessionColumns), lastID, CONVERT_BATCH_SIZE)
+		if err != nil {
+			return fmt.Errorf("read sessions: %w", err)
+		}
+
+		batch := &Batch{touched: make(map[string]*UserSession), created: make(map[string]bool)}
+		read := 0
+		for rows.Next() {
+			session, err := scanSession(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("read sessions: %w", err)
+			}
+			read++
+			lastID = session.ID
+
+			// Skip if already exists
+			if existing[session.ID] {
+				skipped++
+				continue
+			}
+
+			batch.created[session.ID] = true
+			batch.touch(session.UserSession())
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("read sessions: %w", err)
+		}
+
+		if read == 0 {
+			break
+		}
+
+		if err := to.WriteBatch(batch); err != nil {
+			return fmt.Errorf("write sessions: %w", err)
+		}
+		converted += len(batch.sessions)
+
+		log.Printf("Converted %d/%d sessions (skipped: %d)", converted+skipped, total, skipped)
+	}
+
+	return nil
+}
+
+func convertEvents(from Store, to Store, total int64, resuming bool) error {
+	existing, err := existingIDs(to, "user_events", resuming)
+	if err != nil {
+		return err
+	}
+
+	converted, skipped := 0, 0
+	lastID := ""
+
+	for {
+		rows, err := from.DB().Query(`
+			SELECT id, created_at, updated_at, name, page, event_time, session_id
+			FROM user_events
+			WHERE id > ?
+			ORDER BY id
+			LIMIT ?
+		`, lastID, CONVERT_BATCH_SIZE)
+		if err != nil {
+			return fmt.Errorf("read events: %w", err)
+		}
+
+		batch := &Batch{touched: make(map[string]*UserSession), created: make(map[string]bool)}
+		read := 0
+		for rows.Next() {
+			var event UserEvent
+			var sessionID sql.NullString
+			if err := rows.Scan(&event.ID, &event.CreatedAt, &event.UpdatedAt, &event.Name, &event.Page, &event.EventTime, &sessionID); err != nil {
+				rows.Close()
+				return fmt.Errorf("read events: %w", err)
+			}
+			read++
+			lastID = event.ID
+
+			// Skip if already exists
+			if existing[event.ID] {
+				skipped++
+				continue
+			}
+
+			batch.SaveEvent(&event, sessionID.String)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("read events: %w", err)
+		}
+
+		if read == 0 {
+			break
+		}
+
+		if err := to.WriteBatch(batch); err != nil {
+			return fmt.Errorf("write events: %w", err)
+		}
+		converted += batch.Size()
+
+		log.Printf("Converted %d/%d events (skipped: %d)", converted+skipped, total, skipped)
+	}
+
+	return nil
+}
+
+func convertFunnels(from Store, to Store) error {
+	rows, err := from.DB().Query("SELECT id, created_at, updated_at, name, steps FROM funnels")
+	if err != nil {
+		return fmt.Errorf("read funnels: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, name, steps string
+		var createdAt, updatedAt timestamp
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &name, &steps); err != nil {
+			return fmt.Errorf("read funnels: %w", err)
+		}
+
+		_, err := to.DB().Exec(`
+			INSERT INTO funnels (id, created_at, updated_at, name, steps)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING
+		`, id, createdAt.Time, updatedAt.Time, name, steps)
+		if err != nil {
+			return fmt.Errorf("write funnel %s: %w", id, err)
+		}
+	}
+
+	return rows.Err()
+}
+
+func convertConsoleQueries(from Store, to Store) error {
+	rows, err := from.DB().Query("SELECT id, name, query, created_at, updated_at FROM console_queries")
+	if err != nil {
+		return fmt.Errorf("read console queries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		query, err := scanConsoleQuery(rows)
+		if err != nil {
+			return fmt.Errorf("read console queries: %w", err)
+		}
+
+		_, err = to.DB().Exec(`
+			INSERT INTO console_queries (id, created_at, updated_at, name, query)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING
+		`, query.ID, query.CreatedAt, query.UpdatedAt, query.Name, query.Query)
+		if err != nil {
+			return fmt.Errorf("write console query %s: %w", query.ID, err)
+		}
+	}
+
+	return rows.Err()
+}
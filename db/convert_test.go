@@ -0,0 +1,121 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConvertSource fills a store with more sessions than a conversion
+// batch, a funnel and a saved console query
+func writeConvertSource(t *testing.T, d *Database) {
+	t.Helper()
+
+	sessions := make([]*UserSession, 0, CONVERT_BATCH_SIZE+10)
+	for i := 0; i < CONVERT_BATCH_SIZE+10; i++ {
+		sessions = append(sessions, &UserSession{
+			ID:           fmt.Sprintf("s%04d", i),
+			UserIdent:    fmt.Sprintf("u%d", i%7),
+			Browser:      "Firefox",
+			BrowserMajor: "120",
+			OS:           "Linux",
+			Country:      "DE",
+			Referer:      "b.com",
+			ScreenWidth:  1280,
+			SessionStart: parseTime("2024-01-02T10:00:00Z").Add(time.Duration(i) * time.Minute),
+			Events:       int64(1 + i%2),
+		})
+	}
+	writeSessions(t, d, sessions...)
+
+	if err := d.SaveFunnel(&Funnel{ID: "f1", Name: "signup", Steps: []FunnelStep{{Type: "page", Match: "a.com/"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveConsoleQuery(&ConsoleQuery{ID: "q1", Name: "sessions", Query: "SELECT * FROM user_sessions"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rollupTotals returns the sessions and pageviews of the hourly rollups
+func rollupTotals(t *testing.T, d *Database) string {
+	t.Helper()
+
+	var sessions, pageViews int64
+	err := d.store.DB().QueryRow("SELECT CAST(COALESCE(SUM(sessions), 0) AS BIGINT), CAST(COALESCE(SUM(pageviews), 0) AS BIGINT) FROM hourly_sessions").Scan(&sessions, &pageViews)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%d sessions, %d pageviews", sessions, pageViews)
+}
+
+// assertConverted checks that the target has the source's rows and rollups
+func assertConverted(t *testing.T, from *Database, to *Database) {
+	t.Helper()
+
+	for _, table := range []string{"user_sessions", "user_events", "funnels", "console_queries"} {
+		if got, want := storedIDs(t, to, table), storedIDs(t, from, table); got != want {
+			t.Errorf("Converted %s were incorrect, got: %d rows, want: %d.", table, len(strings.Fields(got)), len(strings.Fields(want)))
+		}
+	}
+
+	session, err := to.GetSession("s0001")
+	if err != nil || session == nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	want := parseTime("2024-01-02T10:01:00Z")
+	if session.UserIdent != "u1" || session.Browser != "Firefox" || session.BrowserMajor != "120" || session.OS != "Linux" || session.Country != "DE" ||
+		session.Referer != "b.com" || session.ScreenWidth != 1280 || session.Events != 2 ||
+		!session.SessionStart.Equal(want) || !session.SessionEnd.Equal(want.Add(time.Minute)) {
+		t.Errorf("Converted session was incorrect, got: %+v, want: the written one.", session)
+	}
+
+	if got, want := rollupTotals(t, to), rollupTotals(t, from); got != want {
+		t.Errorf("Converted rollups were incorrect, got: %s, want: %s.", got, want)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	for _, kinds := range [][2]string{{STORE_SQLITE, STORE_DUCKDB}, {STORE_DUCKDB, STORE_SQLITE}} {
+		t.Run(kinds[0]+" to "+kinds[1], func(t *testing.T) {
+			from, to := openTestDatabase(t, kinds[0]), openTestDatabase(t, kinds[1])
+			writeConvertSource(t, from)
+
+			if err := Convert(from.store, to.store); err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			assertConverted(t, from, to)
+
+			// Running it again changes nothing
+			if err := Convert(from.store, to.store); err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			assertConverted(t, from, to)
+		})
+	}
+}
+
+// An interrupted conversion is resumed, copying only the missing rows
+func TestConvertResumes(t *testing.T) {
+	from, to := openTestDatabase(t, STORE_SQLITE), openTestDatabase(t, STORE_DUCKDB)
+	writeConvertSource(t, from)
+
+	if err := Convert(from.store, to.store); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	for _, query := range []string{
+		"DELETE FROM user_events WHERE session_id > 's0500'",
+		"DELETE FROM user_sessions WHERE id > 's0500'",
+		"DELETE FROM console_queries",
+		"DELETE FROM hourly_sessions",
+	} {
+		if _, err := to.store.DB().Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Convert(from.store, to.store); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	assertConverted(t, from, to)
+}
@@ -1,472 +1,221 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"os"
 	"strings"
 	"sync"
 	"time"
-	"tinylytics/constants"
-	"tinylytics/helpers"
+	"tinylytics/config"
 
-	"github.com/gin-gonic/gin"
 	_ "github.com/marcboeker/go-duckdb" // DuckDB driver for database/sql
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 // AnalyticsItem represents a single analytics result item
 // This avoids circular dependency with the analytics package
 type AnalyticsItem struct {
-	Value     string
-	Count     int64
-	Drillable int64
+	Value     string `json:"value"`
+	Count     int64  `json:"count"`
+	Drillable int64  `json:"drillable"`
 }
 
 type Database struct {
-	sqlite *gorm.DB     // SQLite with GORM (stable driver)
-	duckdb *sql.DB      // DuckDB with raw database/sql (no GORM)
-	mu     sync.RWMutex // Mutex for thread-safe operations
+	store Store        // SQLite or DuckDB, chosen in the config
+	file  string       // The file the store keeps its data in
+	mu    sync.RWMutex // Mutex for thread-safe operations
+	cache queryCache   // Results of the dashboard queries
 }
 
-// queryAnalyticsItems executes a query and reads all rows into memory
+// Breakdown is a page of a breakdown's rows, largest first
+type Breakdown struct {
+	Items []*AnalyticsItem `json:"items"`
+	// Other sums up the rows after the page, nil when the page is the last
+	Other *AnalyticsItem `json:"other,omitempty"`
+	Rows  int64          `json:"rows"` // How many rows the whole breakdown has
+}
+
+// HasMore tells if there are rows after the page
+func (b *Breakdown) HasMore() bool {
+	return b.Other != nil
+}
+
+// queryBreakdown pages through the rows of a query grouping by value, and
+// sums up the rest in a single pass. Ties are ordered by value so pages don't
+// overlap.
 // Must be called while holding the database lock
-func (d *Database) queryAnalyticsItems(query string, args ...interface{}) ([]*AnalyticsItem, error) {
-	rows, err := d.duckdb.Query(query, args...)
+func (d *Database) queryBreakdown(ctx context.Context, grouped string, args []interface{}, q Query) (*Breakdown, error) {
+	end := q.Offset + q.LimitOr(BREAKDOWN_LIMIT)
+
+	query := fmt.Sprintf(`
+		WITH breakdown AS (%s),
+		ranked AS (
+			SELECT value, count, drillable,
+				ROW_NUMBER() OVER (ORDER BY count DESC, value) AS position,
+				COUNT(*) OVER () AS total_rows
+			FROM breakdown
+		),
+		summed AS (
+			SELECT *,
+				SUM(CASE WHEN position > ? THEN count ELSE 0 END) OVER () AS other
+			FROM ranked
+		)
+		SELECT value, count, drillable, total_rows, other
+		FROM summed
+		WHERE position > ? AND position <= ?
+		ORDER BY position
+	`, grouped)
+
+	rows, err := d.store.DB().QueryContext(ctx, query, append(args, end, q.Offset, end)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	items := make([]*AnalyticsItem, 0)
+	breakdown := &Breakdown{Items: make([]*AnalyticsItem, 0)}
+	var other sql.NullInt64
 	for rows.Next() {
 		var item AnalyticsItem
-		if err := rows.Scan(&item.Value, &item.Count, &item.Drillable); err != nil {
+		if err := rows.Scan(&item.Value, &item.Count, &item.Drillable, &breakdown.Rows, &other); err != nil {
 			log.Printf("ERROR: Failed to scan row: %v", err)
 			continue
 		}
-		items = append(items, &item)
+		breakdown.Items = append(breakdown.Items, &item)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return items, nil
+	if int64(end) < breakdown.Rows {
+		breakdown.Other = &AnalyticsItem{Count: other.Int64}
+	}
+
+	return breakdown, nil
 }
 
-func getFilterValue(input string) string {
-	if input == "null" {
-		return ""
+// versionFilters adds a condition for each part of a version, major first
+func versionFilters(conditions []string, args []interface{}, columns []string, version []string) ([]string, []interface{}) {
+	for i, part := range version {
+		if i >= len(columns) {
+			break
+		}
+		conditions = append(conditions, columns[i]+" = ?")
+		args = append(args, part)
 	}
-	return input
+	return conditions, args
 }
 
 // buildFilters builds WHERE conditions and args for raw SQL queries
-func buildFilters(c *gin.Context, usePageFilter bool) ([]string, []interface{}) {
+func buildFilters(q Query, usePageFilter bool) ([]string, []interface{}) {
 	var conditions []string
 	var args []interface{}
 
-	browser, hasBrowser := c.GetQuery("b")
-	browserVersion, hasBrowserVersion := c.GetQuery("bv")
-	os, hasOS := c.GetQuery("os")
-	osVersion, hasOSVersion := c.GetQuery("osv")
-	country, hasCountry := c.GetQuery("c")
-	period, hasPeriod := c.GetQuery("p")
-	page, hasPage := c.GetQuery("pg")
-	referer, hasReferer := c.GetQuery("r")
-	refererFullPath, hasRefererFullPath := c.GetQuery("rfp")
-
-	if !hasPeriod {
-		period = constants.DATE_RAGE_24H
-	}
-
-	start, end := helpers.GetTimePeriod(period, "Australia/Sydney")
+	start, end := q.TimeRange()
 
+	// Times are stored in UTC, and SQLite compares them as text
 	conditions = append(conditions, "user_sessions.session_start >= ?")
-	args = append(args, start)
+	args = append(args, start.UTC())
 
 	if end != nil {
 		conditions = append(conditions, "user_sessions.session_start <= ?")
-		args = append(args, end)
+		args = append(args, end.UTC())
 	}
 
-	if hasBrowser {
-		conditions = append(conditions, "user_sessions.browser = ?")
-		args = append(args, getFilterValue(browser))
-
-		if hasBrowserVersion {
-			bver := strings.Split(browserVersion, "/")
-
-			conditions = append(conditions, "user_sessions.browser_major = ?")
-			args = append(args, getFilterValue(bver[0]))
+	filters := q.Filters
 
-			if len(bver) >= 2 {
-				conditions = append(conditions, "user_sessions.browser_minor = ?")
-				args = append(args, getFilterValue(bver[1]))
+	if filters.Browser != nil {
+		conditions = append(conditions, "user_sessions.browser = ?")
+		args = append(args, *filters.Browser)
 
-				if len(bver) >= 3 {
-					conditions = append(conditions, "user_sessions.browser_patch = ?")
-					args = append(args, getFilterValue(bver[2]))
-				}
-			}
-		}
+		conditions, args = versionFilters(conditions, args, []string{
+			"user_sessions.browser_major", "user_sessions.browser_minor", "user_sessions.browser_patch",
+		}, filters.BrowserVersion)
 	}
 
-	if hasOS {
+	if filters.OS != nil {
 		conditions = append(conditions, "user_sessions.os = ?")
-		args = append(args, getFilterValue(os))
-
-		if hasOSVersion {
-			osver := strings.Split(osVersion, "/")
+		args = append(args, *filters.OS)
 
-			conditions = append(conditions, "user_sessions.os_major = ?")
-			args = append(args, getFilterValue(osver[0]))
-
-			if len(osver) >= 2 {
-				conditions = append(conditions, "user_sessions.os_minor = ?")
-				args = append(args, getFilterValue(osver[1]))
-
-				if len(osver) >= 3 {
-					conditions = append(conditions, "user_sessions.os_patch = ?")
-					args = append(args, getFilterValue(osver[2]))
-				}
-			}
-		}
+		conditions, args = versionFilters(conditions, args, []string{
+			"user_sessions.os_major", "user_sessions.os_minor", "user_sessions.os_patch",
+		}, filters.OSVersion)
 	}
 
-	if hasCountry {
+	if filters.Country != nil {
 		conditions = append(conditions, "user_sessions.country = ?")
-		args = append(args, getFilterValue(country))
+		args = append(args, *filters.Country)
 	}
 
-	if hasReferer {
+	if filters.Referer != nil {
 		conditions = append(conditions, "user_sessions.referer = ?")
-		args = append(args, getFilterValue(referer))
+		args = append(args, *filters.Referer)
 
-		if hasRefererFullPath {
+		if filters.RefererFullPath != nil {
 			conditions = append(conditions, "user_sessions.referer_full_path = ?")
-			args = append(args, getFilterValue(refererFullPath))
+			args = append(args, *filters.RefererFullPath)
 		}
 	}
 
-	if hasPage && usePageFilter {
+	if filters.Page != nil && usePageFilter {
 		conditions = append(conditions, "user_events.page = ?")
-		args = append(args, page)
+		args = append(args, *filters.Page)
 	}
 
 	return conditions, args
 }
 
 func (d *Database) Connect(file string) {
-	// Generate DuckDB filename from SQLite filename
-	duckdbFile := strings.Replace(file, ".db", ".duckdb", 1)
-
-	// Connect to SQLite (existing database) with GORM
-	sqliteDB, err := gorm.Open(sqlite.Open("file:"+file+"?cache=shared&mode=rwc&_journal_mode=WAL&_timeout=30000"), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent), // Disable GORM logs
-	})
-
-	if err != nil {
-		panic("failed to connect to SQLite database: " + err.Error())
+	kind := config.Config.Storage
+	other := STORE_SQLITE
+	if kind == STORE_SQLITE {
+		other = STORE_DUCKDB
 	}
 
-	// Set SQLite connection pool settings
-	sqliteSQLDB, _ := sqliteDB.DB()
-	sqliteSQLDB.SetMaxOpenConns(10)
-	sqliteSQLDB.SetMaxIdleConns(5)
-	sqliteSQLDB.SetConnMaxLifetime(time.Hour)
+	// A site that only has data in the other store would look empty
+	if _, err := os.Stat(StoreFileName(kind, file)); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(StoreFileName(other, file)); err == nil {
+			log.Printf("WARNING: %s only has %s data, run the convert command to use it with %s storage", file, other, kind)
+		}
+	}
 
-	// Connect to DuckDB using raw database/sql (no GORM)
-	duckdbDB, err := sql.Open("duckdb", duckdbFile)
+	store, err := OpenStore(kind, file)
 	if err != nil {
-		panic("failed to connect to DuckDB database: " + err.Error())
+		panic(err.Error())
 	}
 
-	// Set DuckDB connection pool settings
-	duckdbDB.SetMaxOpenConns(10)
-	duckdbDB.SetMaxIdleConns(5)
-	duckdbDB.SetConnMaxLifetime(time.Hour)
-
-	d.sqlite = sqliteDB
-	d.duckdb = duckdbDB
+	d.store = store
+	d.file = StoreFileName(kind, file)
 }
 
 func (d *Database) Close() {
-	if d.sqlite != nil {
-		sqliteDB, _ := d.sqlite.DB()
-		sqliteDB.Close()
-	}
-	if d.duckdb != nil {
-		d.duckdb.Close()
+	if d.store != nil {
+		d.store.Close()
 	}
 }
 
 func (d *Database) Initialize() {
-	// Migrate SQLite schema (row-based with full indexing)
-	err := d.sqlite.AutoMigrate(&UserSession{}, &UserEvent{})
-	if err != nil {
-		log.Printf("SQLite migration failed: %v", err)
-		panic("failed to migrate SQLite database")
-	}
-
-	// Migrate DuckDB schema using raw SQL
-	_, err = d.duckdb.Exec(`
-		CREATE TABLE IF NOT EXISTS user_sessions (
-			id VARCHAR PRIMARY KEY,
-			created_at TIMESTAMP,
-			updated_at TIMESTAMP,
-			user_ident VARCHAR,
-			browser VARCHAR,
-			browser_major VARCHAR,
-			browser_minor VARCHAR,
-			browser_patch VARCHAR,
-			os VARCHAR,
-			os_major VARCHAR,
-			os_minor VARCHAR,
-			os_patch VARCHAR,
-			country VARCHAR,
-			user_agent VARCHAR,
-			referer VARCHAR,
-			referer_full_path VARCHAR,
-			session_start TIMESTAMP,
-			session_end TIMESTAMP,
-			screen_width BIGINT,
-			events BIGINT
-		)
-	`)
-	if err != nil {
-		log.Printf("DuckDB user_sessions table creation failed: %v", err)
-		panic("failed to create DuckDB user_sessions table")
-	}
-
-	_, err = d.duckdb.Exec(`
-		CREATE TABLE IF NOT EXISTS user_events (
-			id VARCHAR PRIMARY KEY,
-			created_at TIMESTAMP,
-			updated_at TIMESTAMP,
-			name VARCHAR,
-			page VARCHAR,
-			event_time TIMESTAMP,
-			session_id VARCHAR
-		)
-	`)
-	if err != nil {
-		log.Printf("DuckDB user_events table creation failed: %v", err)
-		panic("failed to create DuckDB user_events table")
-	}
-
-	// Migrate data from SQLite to DuckDB (one-time operation)
-	// d.migrateDataToDuckDB()
-
-	// Data cleanup on both databases
-	d.sqlite.Exec("update user_sessions set referer = '(none)' where referer = ''")
-	d.duckdb.Exec("update user_sessions set referer = '(none)' where referer = ''")
-}
-
-func (d *Database) migrateDataToDuckDB() {
-	// Get counts from both databases
-	var sqliteSessionCount, sqliteEventCount int64
-	var duckdbSessionCount, duckdbEventCount int64
-
-	d.sqlite.Model(&UserSession{}).Count(&sqliteSessionCount)
-	d.sqlite.Model(&UserEvent{}).Count(&sqliteEventCount)
-	d.duckdb.QueryRow("SELECT COUNT(*) FROM user_sessions").Scan(&duckdbSessionCount)
-	d.duckdb.QueryRow("SELECT COUNT(*) FROM user_events").Scan(&duckdbEventCount)
-
-	// Check if migration is already complete
-	if duckdbSessionCount == sqliteSessionCount && duckdbEventCount == sqliteEventCount {
-		log.Printf("Migration already complete: %d sessions, %d events", duckdbSessionCount, duckdbEventCount)
-		return
-	}
-
-	// Check if there's a partial migration - continue from where we left off
-	if duckdbSessionCount > 0 {
-		log.Printf("Partial migration detected - resuming from session %d/%d", duckdbSessionCount, sqliteSessionCount)
-	}
-
-	// Check if SQLite has any data to migrate
-	if sqliteSessionCount == 0 {
-		log.Println("No data in SQLite to migrate")
-		return
+	applied, err := Migrate(d.store)
+	for _, migration := range applied {
+		log.Printf("Applied %s migration %04d_%s", d.store.Kind(), migration.Version, migration.Name)
 	}
-
-	log.Printf("Starting migration of %d sessions and %d events from SQLite to DuckDB...", sqliteSessionCount, sqliteEventCount)
-
-	// Get list of already-migrated session IDs to skip them
-	var existingSessionIDs []string
-	if duckdbSessionCount > 0 {
-		log.Printf("Loading existing session IDs from DuckDB...")
-		rows, err := d.duckdb.Query("SELECT id FROM user_sessions")
-		if err != nil {
-			log.Printf("ERROR: Failed to query existing IDs: %v", err)
-		} else {
-			defer rows.Close()
-			for rows.Next() {
-				var id string
-				rows.Scan(&id)
-				existingSessionIDs = append(existingSessionIDs, id)
-			}
-			log.Printf("Loaded %d existing session IDs (approx %d MB in memory)",
-				len(existingSessionIDs),
-				len(existingSessionIDs)*36/1024/1024)
-		}
-	}
-	existingSessionMap := make(map[string]bool, len(existingSessionIDs))
-	for _, id := range existingSessionIDs {
-		existingSessionMap[id] = true
-	}
-
-	// Migrate sessions in batches
-	batchSize := 1000
-	offset := 0
-	totalMigrated := int(duckdbSessionCount)
-	failedSessions := 0
-	skipped := 0
-
-	insertSQL := `
-		INSERT INTO user_sessions (
-			id, created_at, updated_at, user_ident, browser, browser_major, browser_minor,
-			browser_patch, os, os_major, os_minor, os_patch, country, user_agent,
-			referer, referer_full_path, session_start, session_end, screen_width, events
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-
-	for {
-		var sessions []UserSession
-		result := d.sqlite.Offset(offset).Limit(batchSize).Find(&sessions)
-
-		if result.Error != nil {
-			log.Printf("Error reading sessions from SQLite: %v", result.Error)
-			panic("Failed to migrate sessions")
-		}
-
-		if len(sessions) == 0 {
-			break
-		}
-
-		for _, s := range sessions {
-			// Skip if already exists
-			if existingSessionMap[s.ID] {
-				skipped++
-				continue
-			}
-
-			_, err := d.duckdb.Exec(insertSQL,
-				s.ID, s.CreatedAt, s.UpdatedAt, s.UserIdent, s.Browser, s.BrowserMajor, s.BrowserMinor,
-				s.BrowserPatch, s.OS, s.OSMajor, s.OSMinor, s.OSPatch, s.Country, s.UserAgent,
-				s.Referer, s.RefererFullPath, s.SessionStart, s.SessionEnd, s.ScreenWidth, s.Events,
-			)
-
-			if err != nil {
-				log.Printf("WARNING: Failed to insert session %s: %v - SKIPPING", s.ID, err)
-				failedSessions++
-				continue
-			}
-			totalMigrated++
-		}
-
-		if totalMigrated%10000 == 0 {
-			log.Printf("Migrated %d/%d sessions (skipped: %d, failed: %d)", totalMigrated, sqliteSessionCount, skipped, failedSessions)
-		}
-		offset += batchSize
-	}
-
-	log.Printf("Migrated %d/%d sessions (skipped: %d, failed: %d)", totalMigrated, sqliteSessionCount, skipped, failedSessions)
-
-	// Get list of already-migrated event IDs to skip them
-	var existingEventIDs []string
-	if duckdbEventCount > 0 {
-		log.Printf("Loading existing event IDs from DuckDB...")
-		rows, err := d.duckdb.Query("SELECT id FROM user_events")
-		if err != nil {
-			log.Printf("ERROR: Failed to query existing IDs: %v", err)
-		} else {
-			defer rows.Close()
-			for rows.Next() {
-				var id string
-				rows.Scan(&id)
-				existingEventIDs = append(existingEventIDs, id)
-			}
-			log.Printf("Loaded %d existing event IDs", len(existingEventIDs))
-		}
+	if err != nil {
+		log.Printf("%s migration failed: %v", d.store.Kind(), err)
+		panic("failed to migrate " + d.store.Kind() + " database")
 	}
-	existingEventMap := make(map[string]bool, len(existingEventIDs))
-	for _, id := range existingEventIDs {
-		existingEventMap[id] = true
-	}
-
-	// Migrate events in batches
-	if sqliteEventCount > 0 {
-		log.Printf("Starting event migration...")
-		offset = 0
-		totalMigrated = int(duckdbEventCount)
-		failedEvents := 0
-		skipped = 0
-
-		insertSQL := `
-			INSERT INTO user_events (
-				id, created_at, updated_at, name, page, event_time, session_id
-			) VALUES (?, ?, ?, ?, ?, ?, ?)
-		`
-
-		for {
-			var events []UserEvent
-			result := d.sqlite.Offset(offset).Limit(batchSize).Find(&events)
-
-			if result.Error != nil {
-				log.Printf("Error reading events from SQLite: %v", result.Error)
-				panic("Failed to migrate events")
-			}
-
-			if len(events) == 0 {
-				break
-			}
-
-			for _, e := range events {
-				// Skip if already exists
-				if existingEventMap[e.ID] {
-					skipped++
-					continue
-				}
-
-				_, err := d.duckdb.Exec(insertSQL,
-					e.ID, e.CreatedAt, e.UpdatedAt, e.Name, e.Page, e.EventTime, e.SessionID,
-				)
-
-				if err != nil {
-					log.Printf("WARNING: Failed to insert event %s: %v - SKIPPING", e.ID, err)
-					failedEvents++
-					continue
-				}
-				totalMigrated++
-			}
-
-			if totalMigrated%10000 == 0 {
-				log.Printf("Migrated %d/%d events (skipped: %d, failed: %d)", totalMigrated, sqliteEventCount, skipped, failedEvents)
-			}
-			offset += batchSize
-		}
 
-		log.Printf("Migrated %d/%d events (skipped: %d, failed: %d)", totalMigrated, sqliteEventCount, skipped, failedEvents)
+	if err := d.backfillRollups(); err != nil {
+		log.Printf("ERROR: Failed to build the rollups of %s: %v", d.file, err)
 	}
+}
 
-	// Verify migration completed successfully
-	d.duckdb.QueryRow("SELECT COUNT(*) FROM user_sessions").Scan(&duckdbSessionCount)
-	d.duckdb.QueryRow("SELECT COUNT(*) FROM user_events").Scan(&duckdbEventCount)
-
-	log.Println("Migration verification:")
-	log.Printf("  Sessions: SQLite %d → DuckDB %d", sqliteSessionCount, duckdbSessionCount)
-	log.Printf("  Events: SQLite %d → DuckDB %d", sqliteEventCount, duckdbEventCount)
-
-	if duckdbSessionCount == sqliteSessionCount && duckdbEventCount == sqliteEventCount {
-		log.Println("✓ Migration completed successfully!")
-	} else {
-		log.Printf("⚠ Migration incomplete - some records may have failed")
-	}
+// Store returns the store the site's data is kept in
+func (d *Database) Store() Store {
+	return d.store
 }
 
 func (d *Database) GetUserSession(userIdent string) *UserSession {
@@ -480,20 +229,23 @@ func (d *Database) GetUserSessionAtTime(userIdent string, eventTime time.Time) *
 	// Find sessions where the last event (session_end) was within 30 minutes of the current event time
 	// If session_end >= (eventTime - 30 minutes), then the gap is <= 30 minutes, so it's the same session
 	// If session_end < (eventTime - 30 minutes), then the gap is > 30 minutes, so it's a new session
+	eventTime = eventTime.UTC()
 	cutoffTime := eventTime.Add(-30 * time.Minute)
 
-	// Use raw SQL for DuckDB
 	query := `
 		SELECT id, created_at, updated_at, user_ident, browser, browser_major, browser_minor, 
 		       browser_patch, os, os_major, os_minor, os_patch, country, user_agent, 
 		       referer, referer_full_path, session_start, session_end, screen_width, events
 		FROM user_sessions 
-		WHERE user_ident = ? AND session_end >= ?
+		WHERE user_ident = ? AND session_end >= ? AND session_start <= ?
+		ORDER BY session_end DESC
 		LIMIT 1
 	`
 
+	// Sessions that started after the event can exist when older events are
+	// reprocessed, the event never belongs to those
 	var session UserSessionDuckDB
-	err := d.duckdb.QueryRow(query, userIdent, cutoffTime).Scan(
+	err := d.store.DB().QueryRow(query, userIdent, cutoffTime, eventTime).Scan(
 		&session.ID, &session.CreatedAt, &session.UpdatedAt, &session.UserIdent,
 		&session.Browser, &session.BrowserMajor, &session.BrowserMinor, &session.BrowserPatch,
 		&session.OS, &session.OSMajor, &session.OSMinor, &session.OSPatch,
@@ -509,144 +261,33 @@ func (d *Database) GetUserSessionAtTime(userIdent string, eventTime time.Time) *
 		return nil
 	}
 
-	// Convert to SQLite schema for return (maintains compatibility)
-	return &UserSession{
-		Model: gorm.Model{
-			ID:        0,
-			CreatedAt: session.CreatedAt,
-			UpdatedAt: session.UpdatedAt,
-		},
-		ID:              session.ID,
-		UserIdent:       session.UserIdent,
-		Browser:         session.Browser,
-		BrowserMajor:    session.BrowserMajor,
-		BrowserMinor:    session.BrowserMinor,
-		BrowserPatch:    session.BrowserPatch,
-		OS:              session.OS,
-		OSMajor:         session.OSMajor,
-		OSMinor:         session.OSMinor,
-		OSPatch:         session.OSPatch,
-		Country:         session.Country,
-		UserAgent:       session.UserAgent,
-		Referer:         session.Referer,
-		RefererFullPath: session.RefererFullPath,
-		SessionStart:    session.SessionStart,
-		SessionEnd:      session.SessionEnd,
-		ScreenWidth:     session.ScreenWidth,
-		Events:          session.Events,
-	}
-}
-
-func (d *Database) StartUserSession(item *UserSession) *UserSession {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	// Dual write: SQLite first (more reliable for writes), then DuckDB
-	if err := d.sqlite.Create(&item).Error; err != nil {
-		log.Printf("ERROR: Failed to write session to SQLite: %v", err)
-		panic(err)
-	}
-
-	// Insert into DuckDB using raw SQL
-	insertSQL := `
-		INSERT INTO user_sessions (
-			id, created_at, updated_at, user_ident, browser, browser_major, browser_minor,
-			browser_patch, os, os_major, os_minor, os_patch, country, user_agent,
-			referer, referer_full_path, session_start, session_end, screen_width, events
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-
-	_, err := d.duckdb.Exec(insertSQL,
-		item.ID, item.CreatedAt, item.UpdatedAt, item.UserIdent, item.Browser, item.BrowserMajor, item.BrowserMinor,
-		item.BrowserPatch, item.OS, item.OSMajor, item.OSMinor, item.OSPatch, item.Country, item.UserAgent,
-		item.Referer, item.RefererFullPath, item.SessionStart, item.SessionEnd, item.ScreenWidth, item.Events,
-	)
-
-	if err != nil {
-		log.Printf("WARNING: Session %s saved to SQLite but failed to write to DuckDB: %v", item.ID, err)
-		// Don't panic - data is in SQLite, can be synced later
-		return item
-	}
-
-	log.Printf("[DB] Session written successfully: id=%s domain=%s events=%d (SQLite + DuckDB)", item.ID, item.UserIdent, item.Events)
-	return item
-}
-
-func (d *Database) UpdateUserSession(item *UserSession) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	// Dual update: SQLite first, then DuckDB
-	if err := d.sqlite.Save(&item).Error; err != nil {
-		log.Printf("ERROR: Failed to update session in SQLite: %v", err)
-		panic(err)
-	}
-
-	// Update in DuckDB using raw SQL
-	updateSQL := `
-		UPDATE user_sessions SET
-			created_at = ?, updated_at = ?, user_ident = ?, browser = ?, browser_major = ?,
-			browser_minor = ?, browser_patch = ?, os = ?, os_major = ?, os_minor = ?,
-			os_patch = ?, country = ?, user_agent = ?, referer = ?, referer_full_path = ?,
-			session_start = ?, session_end = ?, screen_width = ?, events = ?
-		WHERE id = ?
-	`
-
-	_, err := d.duckdb.Exec(updateSQL,
-		item.CreatedAt, item.UpdatedAt, item.UserIdent, item.Browser, item.BrowserMajor,
-		item.BrowserMinor, item.BrowserPatch, item.OS, item.OSMajor, item.OSMinor,
-		item.OSPatch, item.Country, item.UserAgent, item.Referer, item.RefererFullPath,
-		item.SessionStart, item.SessionEnd, item.ScreenWidth, item.Events,
-		item.ID,
-	)
-
-	if err != nil {
-		log.Printf("WARNING: Session %s updated in SQLite but failed to update in DuckDB: %v", item.ID, err)
-		// Don't panic - data is in SQLite
-		return
-	}
-
-	log.Printf("[DB] Session updated successfully: id=%s events=%d session_end=%s (SQLite + DuckDB)", item.ID, item.Events, item.SessionEnd.Format("2006-01-02 15:04:05"))
+	return session.UserSession()
 }
 
-func (d *Database) SaveEvent(item *UserEvent, sessionId string) *UserEvent {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	item.Session = UserSession{ID: sessionId}
-
-	// Dual write: SQLite first, then DuckDB
-	if err := d.sqlite.Create(&item).Error; err != nil {
-		log.Printf("ERROR: Failed to write event to SQLite: %v", err)
-		panic(err)
-	}
-
-	// Insert into DuckDB using raw SQL
-	insertSQL := `
-		INSERT INTO user_events (
-			id, created_at, updated_at, name, page, event_time, session_id
-		) VALUES (?, ?, ?, ?, ?, ?, ?)
-	`
-
-	_, err := d.duckdb.Exec(insertSQL,
-		item.ID, item.CreatedAt, item.UpdatedAt, item.Name, item.Page, item.EventTime, sessionId,
-	)
-
+func (d *Database) GetSessions(ctx context.Context, q Query) int64 {
+	value, err := cached(d, "sessions", q, func() (int64, error) {
+		return d.countSessions(ctx, q)
+	})
 	if err != nil {
-		log.Printf("WARNING: Event %s saved to SQLite but failed to write to DuckDB: %v", item.ID, err)
-		// Don't panic - data is in SQLite
-		return item
+		log.Printf("ERROR: Failed to get sessions count: %v", err)
+		return 0
 	}
-
-	log.Printf("[DB] Event written successfully: id=%s session_id=%s page=%s (SQLite + DuckDB)", item.ID, sessionId, item.Page)
-	return item
+	return value
 }
 
-func (d *Database) GetSessions(c *gin.Context) int64 {
+func (d *Database) countSessions(ctx context.Context, q Query) (int64, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	if plan := planRollups(q, rollupSessions); plan != nil {
+		sessions, _, err := d.rollupTotals(ctx, plan, "sessions", "0")
+		if err != nil {
+			return 0, fmt.Errorf("rollups: %w", err)
+		}
+		return int64(sessions), nil
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
 	query := fmt.Sprintf(`
 		SELECT COUNT(*) 
@@ -655,30 +296,52 @@ func (d *Database) GetSessions(c *gin.Context) int64 {
 	`, strings.Join(conditions, " AND "))
 
 	var count int64
-	err := d.duckdb.QueryRow(query, args...).Scan(&count)
+	err := d.store.DB().QueryRowContext(ctx, query, args...).Scan(&count)
 	if err != nil {
-		log.Printf("ERROR: Failed to get sessions count: %v", err)
-		return 0
+		return 0, err
 	}
 
-	return count
+	return count, nil
+}
+
+func (d *Database) GetPageViews(ctx context.Context, q Query) int64 {
+	value, err := cached(d, "pageviews", q, func() (int64, error) {
+		return d.countPageViews(ctx, q)
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to get page views count: %v", err)
+		return 0
+	}
+	return value
 }
 
-func (d *Database) GetPageViews(c *gin.Context) int64 {
+func (d *Database) countPageViews(ctx context.Context, q Query) (int64, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false)
+	// Only the pages rollups know which page was viewed
+	plan := planRollups(q, rollupSessions)
+	if q.Filters.Page != nil {
+		plan = planRollups(q, rollupPages)
+	}
+	if plan != nil {
+		pageViews, _, err := d.rollupTotals(ctx, plan, "pageviews", "0")
+		if err != nil {
+			return 0, fmt.Errorf("rollups: %w", err)
+		}
+		return int64(pageViews), nil
+	}
+
+	conditions, args := buildFilters(q, false)
 
 	// Add pageview condition
 	allConditions := append([]string{"user_events.name = ?"}, conditions...)
 	allArgs := append([]interface{}{"pageview"}, args...)
 
 	// Add page filter if present
-	page, hasPage := c.GetQuery("pg")
-	if hasPage {
+	if q.Filters.Page != nil {
 		allConditions = append(allConditions, "user_events.page = ?")
-		allArgs = append(allArgs, page)
+		allArgs = append(allArgs, *q.Filters.Page)
 	}
 
 	query := fmt.Sprintf(`
@@ -689,77 +352,132 @@ func (d *Database) GetPageViews(c *gin.Context) int64 {
 	`, strings.Join(allConditions, " AND "))
 
 	var count int64
-	err := d.duckdb.QueryRow(query, allArgs...).Scan(&count)
+	err := d.store.DB().QueryRowContext(ctx, query, allArgs...).Scan(&count)
 	if err != nil {
-		log.Printf("ERROR: Failed to get page views count: %v", err)
-		return 0
+		return 0, err
 	}
 
-	return count
+	return count, nil
+}
+
+func (d *Database) GetAvgSessionDuration(ctx context.Context, q Query) float64 {
+	value, err := cached(d, "duration", q, func() (float64, error) {
+		return d.avgSessionDuration(ctx, q)
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to get avg session duration: %v", err)
+		return 0
+	}
+	return value
 }
 
-func (d *Database) GetAvgSessionDuration(c *gin.Context) float64 {
+func (d *Database) avgSessionDuration(ctx context.Context, q Query) (float64, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	if plan := planRollups(q, rollupSessions); plan != nil {
+		duration, sessions, err := d.rollupTotals(ctx, plan, "duration", "sessions")
+		if err != nil {
+			return 0, fmt.Errorf("rollups: %w", err)
+		}
+		if sessions == 0 {
+			return 0, nil
+		}
+		return duration / sessions, nil
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
 	query := fmt.Sprintf(`
-		SELECT AVG(EXTRACT(EPOCH FROM (session_end - session_start)))
+		SELECT AVG((epoch(session_end) - epoch(session_start)))
 		FROM user_sessions 
 		WHERE %s
 	`, strings.Join(conditions, " AND "))
 
 	var duration sql.NullFloat64
-	err := d.duckdb.QueryRow(query, args...).Scan(&duration)
+	err := d.store.DB().QueryRowContext(ctx, query, args...).Scan(&duration)
 	if err != nil {
-		log.Printf("ERROR: Failed to get avg session duration: %v", err)
-		return 0
+		return 0, err
 	}
 
 	if !duration.Valid {
-		return 0
+		return 0, nil
 	}
 
-	return duration.Float64
+	return duration.Float64, nil
 }
 
-func (d *Database) GetBounceRate(c *gin.Context) int64 {
+func (d *Database) GetBounceRate(ctx context.Context, q Query) int64 {
+	value, err := cached(d, "bounces", q, func() (int64, error) {
+		return d.bounceRate(ctx, q)
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to get bounce rate: %v", err)
+		return 0
+	}
+	return value
+}
+
+func (d *Database) bounceRate(ctx context.Context, q Query) (int64, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	if plan := planRollups(q, rollupSessions); plan != nil {
+		bounces, sessions, err := d.rollupTotals(ctx, plan, "bounces", "sessions")
+		if err != nil {
+			return 0, fmt.Errorf("rollups: %w", err)
+		}
+		if sessions == 0 {
+			return 0, nil
+		}
+		return int64(math.Round((bounces / sessions) * 100)), nil
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
 	query := fmt.Sprintf(`
 		SELECT 
-			SUM(CASE WHEN EXTRACT(EPOCH FROM (session_end - session_start)) = 0.0 THEN 1 ELSE 0 END) as bounces,
+			SUM(CASE WHEN (epoch(session_end) - epoch(session_start)) = 0.0 THEN 1 ELSE 0 END) as bounces,
 			COUNT(*) as total
 		FROM user_sessions 
 		WHERE %s
 	`, strings.Join(conditions, " AND "))
 
 	var bounces, total sql.NullFloat64
-	err := d.duckdb.QueryRow(query, args...).Scan(&bounces, &total)
+	err := d.store.DB().QueryRowContext(ctx, query, args...).Scan(&bounces, &total)
 	if err != nil {
-		log.Printf("ERROR: Failed to get bounce rate: %v", err)
-		return 0
+		return 0, err
 	}
 
 	if !bounces.Valid || !total.Valid || total.Float64 == 0 {
-		return 0
+		return 0, nil
 	}
 
-	return int64(math.Round((bounces.Float64 / total.Float64) * 100))
+	return int64(math.Round((bounces.Float64 / total.Float64) * 100)), nil
+}
+
+func (d *Database) GetBrowsers(ctx context.Context, q Query) (*Breakdown, error) {
+	return cached(d, "browsers", q, func() (*Breakdown, error) {
+		return d.browsers(ctx, q)
+	})
 }
 
-func (d *Database) GetBrowsers(c *gin.Context) ([]*AnalyticsItem, error) {
+func (d *Database) browsers(ctx context.Context, q Query) (*Breakdown, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	// The rollups go down to major versions
+	if plan := planRollups(q, rollupSessions); plan != nil && len(q.Filters.BrowserVersion) == 0 {
+		if q.Filters.Browser == nil {
+			return d.rollupBreakdown(ctx, plan, "browser", "sessions", "SUM(CASE WHEN browser_major <> '' AND browser_major <> '0' THEN sessions ELSE 0 END)", q)
+		}
+		return d.rollupBreakdown(ctx, plan, "browser_major", "sessions", "SUM(browser_drillable)", q)
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
-	_, hasBrowser := c.GetQuery("b")
-	browserVersion, hasBrowserVersion := c.GetQuery("bv")
+	hasBrowser := q.Filters.Browser != nil
+	hasBrowserVersion := len(q.Filters.BrowserVersion) > 0
 
 	var query string
 
@@ -773,8 +491,6 @@ func (d *Database) GetBrowsers(c *gin.Context) ([]*AnalyticsItem, error) {
 			FROM user_sessions 
 			WHERE %s
 			GROUP BY user_sessions.browser
-			ORDER BY count DESC
-			LIMIT 20
 		`, strings.Join(conditions, " AND "))
 	} else if !hasBrowserVersion {
 		// Browser major version
@@ -786,12 +502,9 @@ func (d *Database) GetBrowsers(c *gin.Context) ([]*AnalyticsItem, error) {
 			FROM user_sessions 
 			WHERE %s
 			GROUP BY user_sessions.browser_major
-			ORDER BY count DESC
-			LIMIT 20
 		`, strings.Join(conditions, " AND "))
 	} else {
-		bver := strings.Split(browserVersion, "/")
-		if len(bver) < 2 {
+		if len(q.Filters.BrowserVersion) < 2 {
 			// Browser minor version
 			query = fmt.Sprintf(`
 				SELECT 
@@ -801,8 +514,6 @@ func (d *Database) GetBrowsers(c *gin.Context) ([]*AnalyticsItem, error) {
 				FROM user_sessions 
 				WHERE %s
 				GROUP BY user_sessions.browser_minor
-				ORDER BY count DESC
-				LIMIT 20
 			`, strings.Join(conditions, " AND "))
 		} else {
 			// Browser patch version
@@ -814,23 +525,35 @@ func (d *Database) GetBrowsers(c *gin.Context) ([]*AnalyticsItem, error) {
 				FROM user_sessions 
 				WHERE %s
 				GROUP BY user_sessions.browser_patch
-				ORDER BY count DESC
-				LIMIT 20
 			`, strings.Join(conditions, " AND "))
 		}
 	}
 
-	return d.queryAnalyticsItems(query, args...)
+	return d.queryBreakdown(ctx, query, args, q)
+}
+
+func (d *Database) GetOSs(ctx context.Context, q Query) (*Breakdown, error) {
+	return cached(d, "os", q, func() (*Breakdown, error) {
+		return d.oss(ctx, q)
+	})
 }
 
-func (d *Database) GetOSs(c *gin.Context) ([]*AnalyticsItem, error) {
+func (d *Database) oss(ctx context.Context, q Query) (*Breakdown, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	// The rollups go down to major versions
+	if plan := planRollups(q, rollupSessions); plan != nil && len(q.Filters.OSVersion) == 0 {
+		if q.Filters.OS == nil {
+			return d.rollupBreakdown(ctx, plan, "os", "sessions", "SUM(CASE WHEN os_major <> '' AND os_major <> '0' THEN sessions ELSE 0 END)", q)
+		}
+		return d.rollupBreakdown(ctx, plan, "os_major", "sessions", "SUM(os_drillable)", q)
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
-	_, hasOS := c.GetQuery("os")
-	osVersion, hasOSVersion := c.GetQuery("osv")
+	hasOS := q.Filters.OS != nil
+	hasOSVersion := len(q.Filters.OSVersion) > 0
 
 	var query string
 
@@ -844,8 +567,6 @@ func (d *Database) GetOSs(c *gin.Context) ([]*AnalyticsItem, error) {
 			FROM user_sessions 
 			WHERE %s
 			GROUP BY user_sessions.os
-			ORDER BY count DESC
-			LIMIT 20
 		`, strings.Join(conditions, " AND "))
 	} else if !hasOSVersion {
 		// OS major version
@@ -857,12 +578,9 @@ func (d *Database) GetOSs(c *gin.Context) ([]*AnalyticsItem, error) {
 			FROM user_sessions 
 			WHERE %s
 			GROUP BY user_sessions.os_major
-			ORDER BY count DESC
-			LIMIT 20
 		`, strings.Join(conditions, " AND "))
 	} else {
-		osver := strings.Split(osVersion, "/")
-		if len(osver) < 2 {
+		if len(q.Filters.OSVersion) < 2 {
 			// OS minor version
 			query = fmt.Sprintf(`
 				SELECT 
@@ -872,8 +590,6 @@ func (d *Database) GetOSs(c *gin.Context) ([]*AnalyticsItem, error) {
 				FROM user_sessions 
 				WHERE %s
 				GROUP BY user_sessions.os_minor
-				ORDER BY count DESC
-				LIMIT 20
 			`, strings.Join(conditions, " AND "))
 		} else {
 			// OS patch version
@@ -885,20 +601,28 @@ func (d *Database) GetOSs(c *gin.Context) ([]*AnalyticsItem, error) {
 				FROM user_sessions 
 				WHERE %s
 				GROUP BY user_sessions.os_patch
-				ORDER BY count DESC
-				LIMIT 20
 			`, strings.Join(conditions, " AND "))
 		}
 	}
 
-	return d.queryAnalyticsItems(query, args...)
+	return d.queryBreakdown(ctx, query, args, q)
+}
+
+func (d *Database) GetCountries(ctx context.Context, q Query) (*Breakdown, error) {
+	return cached(d, "countries", q, func() (*Breakdown, error) {
+		return d.countries(ctx, q)
+	})
 }
 
-func (d *Database) GetCountries(c *gin.Context) ([]*AnalyticsItem, error) {
+func (d *Database) countries(ctx context.Context, q Query) (*Breakdown, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	if plan := planRollups(q, rollupSessions); plan != nil {
+		return d.rollupBreakdown(ctx, plan, "country", "sessions", "0", q)
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
 	query := fmt.Sprintf(`
 		SELECT 
@@ -908,19 +632,29 @@ func (d *Database) GetCountries(c *gin.Context) ([]*AnalyticsItem, error) {
 		FROM user_sessions 
 		WHERE %s
 		GROUP BY user_sessions.country
-		ORDER BY count DESC
 	`, strings.Join(conditions, " AND "))
 
-	return d.queryAnalyticsItems(query, args...)
+	return d.queryBreakdown(ctx, query, args, q)
+}
+
+func (d *Database) GetReferrers(ctx context.Context, q Query) (*Breakdown, error) {
+	return cached(d, "referrers", q, func() (*Breakdown, error) {
+		return d.referrers(ctx, q)
+	})
 }
 
-func (d *Database) GetReferrers(c *gin.Context) ([]*AnalyticsItem, error) {
+func (d *Database) referrers(ctx context.Context, q Query) (*Breakdown, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false) // No user_events table, so no page filter
+	// Referrer paths aren't kept in the rollups
+	if plan := planRollups(q, rollupSessions); plan != nil && q.Filters.Referer == nil {
+		return d.rollupBreakdown(ctx, plan, "referer", "sessions", "SUM(referer_drillable)", q)
+	}
+
+	conditions, args := buildFilters(q, false) // No user_events table, so no page filter
 
-	_, hasReferrer := c.GetQuery("r")
+	hasReferrer := q.Filters.Referer != nil
 
 	var query string
 
@@ -934,8 +668,6 @@ func (d *Database) GetReferrers(c *gin.Context) ([]*AnalyticsItem, error) {
 			FROM user_sessions 
 			WHERE %s
 			GROUP BY user_sessions.referer
-			ORDER BY count DESC
-			LIMIT 20
 		`, strings.Join(conditions, " AND "))
 	} else {
 		// Referrer full path
@@ -947,29 +679,36 @@ func (d *Database) GetReferrers(c *gin.Context) ([]*AnalyticsItem, error) {
 			FROM user_sessions 
 			WHERE %s
 			GROUP BY user_sessions.referer_full_path
-			ORDER BY count DESC
-			LIMIT 20
 		`, strings.Join(conditions, " AND "))
 	}
 
-	return d.queryAnalyticsItems(query, args...)
+	return d.queryBreakdown(ctx, query, args, q)
+}
+
+func (d *Database) GetPages(ctx context.Context, q Query) (*Breakdown, error) {
+	return cached(d, "pages", q, func() (*Breakdown, error) {
+		return d.pages(ctx, q)
+	})
 }
 
-func (d *Database) GetPages(c *gin.Context) ([]*AnalyticsItem, error) {
+func (d *Database) pages(ctx context.Context, q Query) (*Breakdown, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	conditions, args := buildFilters(c, false)
+	if plan := planRollups(q, rollupPages); plan != nil {
+		return d.rollupBreakdown(ctx, plan, "page", "pageviews", "0", q)
+	}
+
+	conditions, args := buildFilters(q, false)
 
 	// Add pageview condition
 	allConditions := append([]string{"user_events.name = ?"}, conditions...)
 	allArgs := append([]interface{}{"pageview"}, args...)
 
 	// Add page filter if present
-	page, hasPage := c.GetQuery("pg")
-	if hasPage {
+	if q.Filters.Page != nil {
 		allConditions = append(allConditions, "user_events.page = ?")
-		allArgs = append(allArgs, page)
+		allArgs = append(allArgs, *q.Filters.Page)
 	}
 
 	query := fmt.Sprintf(`
@@ -981,9 +720,7 @@ func (d *Database) GetPages(c *gin.Context) ([]*AnalyticsItem, error) {
 		LEFT JOIN user_sessions ON user_sessions.id = user_events.session_id 
 		WHERE %s
 		GROUP BY user_events.page
-		ORDER BY count DESC
-		LIMIT 20
 	`, strings.Join(allConditions, " AND "))
 
-	return d.queryAnalyticsItems(query, allArgs...)
+	return d.queryBreakdown(ctx, query, allArgs, q)
 }
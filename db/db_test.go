@@ -0,0 +1,98 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+	"tinylytics/config"
+	"tinylytics/helpers"
+)
+
+// openTestDatabase opens an empty, migrated store of the given kind in a
+// temporary folder
+func openTestDatabase(t *testing.T, kind string) *Database {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "test.db")
+	store, err := OpenStore(kind, file)
+	if err != nil {
+		t.Fatalf("Couldn't open %s store: %v", kind, err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if _, err := Migrate(store); err != nil {
+		t.Fatalf("Couldn't migrate %s store: %v", kind, err)
+	}
+
+	return &Database{store: store, file: StoreFileName(kind, file)}
+}
+
+// forEachStore runs a test against an empty database of each kind
+func forEachStore(t *testing.T, test func(t *testing.T, d *Database)) {
+	for _, kind := range []string{STORE_SQLITE, STORE_DUCKDB} {
+		t.Run(kind, func(t *testing.T) {
+			test(t, openTestDatabase(t, kind))
+		})
+	}
+}
+
+// setupSite configures a site, a.com, stored in the given kind with its data
+// in a temporary folder, and returns its database file name
+func setupSite(t *testing.T, kind string) string {
+	t.Helper()
+
+	previous := config.Config
+	config.Config = config.TinylyticsConfig{
+		DataFolder: t.TempDir(),
+		Storage:    kind,
+		Websites:   []config.WebsiteConfig{{Domain: "a.com"}},
+	}
+	t.Cleanup(func() {
+		CloseAll()
+		config.Config = previous
+	})
+
+	file, err := helpers.GetDatabaseFileName("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// writeSessions writes new sessions, with as many pageviews of "a.com/" as
+// their Events, a minute apart from their start
+func writeSessions(t *testing.T, d *Database, sessions ...*UserSession) {
+	t.Helper()
+
+	batch := d.NewBatch()
+	for _, session := range sessions {
+		session.SessionStart = session.SessionStart.UTC()
+		session.SessionEnd = session.SessionStart
+		batch.StartUserSession(session)
+
+		for i := int64(0); i < session.Events; i++ {
+			event := &UserEvent{
+				ID:        fmt.Sprintf("%s-%d", session.ID, i),
+				Name:      "pageview",
+				Page:      "a.com/",
+				EventTime: session.SessionStart.Add(time.Duration(i) * time.Minute),
+			}
+			session.SessionEnd = event.EventTime
+			batch.SaveEvent(event, session.ID)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("Couldn't write sessions: %v", err)
+	}
+}
+
+// day returns midnight UTC of a YYYY-MM-DD day
+func day(value string) time.Time {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// registerDuckDBFunctions adds the functions DuckDB doesn't have without
+// extensions that would have to be downloaded. Functions are registered with
+// the database, every connection of the pool can use them.
+func registerDuckDBFunctions(db *sql.DB) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return duckdb.RegisterScalarUDF(conn, "local_time", &duckdbLocalTime{})
+}
+
+// duckdbLocalTime is local_time(timestamp, zone), see localTime. DuckDB's own
+// time zone functions need the ICU extension.
+type duckdbLocalTime struct{}
+
+func (f *duckdbLocalTime) Config() duckdb.ScalarFuncConfig {
+	timestampType, _ := duckdb.NewTypeInfo(duckdb.TYPE_TIMESTAMP)
+	zoneType, _ := duckdb.NewTypeInfo(duckdb.TYPE_VARCHAR)
+	return duckdb.ScalarFuncConfig{
+		InputTypeInfos: []duckdb.TypeInfo{timestampType, zoneType},
+		ResultTypeInfo: timestampType,
+	}
+}
+
+func (f *duckdbLocalTime) Executor() duckdb.ScalarFuncExecutor {
+	return duckdb.ScalarFuncExecutor{RowExecutor: func(values []driver.Value) (any, error) {
+		t, ok := values[0].(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("local_time: invalid timestamp %v", values[0])
+		}
+		zone, ok := values[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("local_time: invalid time zone %v", values[1])
+		}
+		return localTime(t, zone)
+	}}
+}
@@ -0,0 +1,286 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+const (
+	EXPORT_SESSIONS = "sessions"
+	EXPORT_EVENTS   = "events"
+	EXPORT_PARQUET  = "parquet"
+	EXPORT_CSV      = "csv"
+)
+
+// ErrInvalidExport is returned for an unknown table, format or column
+var ErrInvalidExport = errors.New("invalid export")
+
+type exportColumn struct {
+	name string
+	kind string // The column's DuckDB type
+}
+
+// exportTables are the raw tables that can be exported and their columns
+var exportTables = map[string]struct {
+	table   string
+	columns []exportColumn
+}{
+	EXPORT_SESSIONS: {"user_sessions", []exportColumn{
+		{"id", "VARCHAR"}, {"created_at", "TIMESTAMP"}, {"updated_at", "TIMESTAMP"}, {"user_ident", "VARCHAR"},
+		{"browser", "VARCHAR"}, {"browser_major", "VARCHAR"}, {"browser_minor", "VARCHAR"}, {"browser_patch", "VARCHAR"},
+		{"os", "VARCHAR"}, {"os_major", "VARCHAR"}, {"os_minor", "VARCHAR"}, {"os_patch", "VARCHAR"},
+		{"country", "VARCHAR"}, {"user_agent", "VARCHAR"}, {"referer", "VARCHAR"}, {"referer_full_path", "VARCHAR"},
+		{"session_start", "TIMESTAMP"}, {"session_end", "TIMESTAMP"}, {"screen_width", "BIGINT"}, {"events", "BIGINT"},
+	}},
+	EXPORT_EVENTS: {"user_events", []exportColumn{
+		{"id", "VARCHAR"}, {"created_at", "TIMESTAMP"}, {"updated_at", "TIMESTAMP"}, {"name", "VARCHAR"},
+		{"page", "VARCHAR"}, {"event_time", "TIMESTAMP"}, {"session_id", "VARCHAR"},
+	}},
+}
+
+// Export is a bulk export of one of the raw tables. Sessions are picked by
+// the query's period and filters like on the dashboard, events are the ones
+// of those sessions.
+type Export struct {
+	Table   string   // EXPORT_SESSIONS or EXPORT_EVENTS
+	Format  string   // EXPORT_PARQUET or EXPORT_CSV
+	Columns []string // Every column when empty
+	Query   Query
+}
+
+// ExportColumns returns the columns of an exportable table, nil for any other
+// table
+func ExportColumns(table string) []string {
+	columns := make([]string, 0, len(exportTables[table].columns))
+	for _, column := range exportTables[table].columns {
+		columns = append(columns, column.name)
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	return columns
+}
+
+// columns returns the export's columns in the order they were asked for
+func (e Export) columns() ([]exportColumn, error) {
+	table, exists := exportTables[e.Table]
+	if !exists {
+		return nil, fmt.Errorf("%w: can't export %q, expected %q or %q", ErrInvalidExport, e.Table, EXPORT_SESSIONS, EXPORT_EVENTS)
+	}
+	if e.Format != EXPORT_PARQUET && e.Format != EXPORT_CSV {
+		return nil, fmt.Errorf("%w: unknown format %q, expected %q or %q", ErrInvalidExport, e.Format, EXPORT_PARQUET, EXPORT_CSV)
+	}
+	if len(e.Columns) == 0 {
+		return table.columns, nil
+	}
+
+	columns := make([]exportColumn, 0, len(e.Columns))
+	for _, name := range e.Columns {
+		found := false
+		for _, column := range table.columns {
+			if column.name == name {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s has no column %q", ErrInvalidExport, e.Table, name)
+		}
+	}
+	return columns, nil
+}
+
+// selectQuery is the query reading the export's rows from the store
+func (e Export) selectQuery(columns []exportColumn) (string, []interface{}) {
+	table := exportTables[e.Table].table
+
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		names = append(names, table+"."+column.name)
+	}
+
+	if e.Table == EXPORT_EVENTS {
+		conditions, args := buildFilters(e.Query, true)
+		return fmt.Sprintf(`
+			SELECT %s
+			FROM user_events
+			JOIN user_sessions ON user_sessions.id = user_events.session_id
+			WHERE %s
+			ORDER BY user_events.event_time, user_events.id
+		`, strings.Join(names, ", "), strings.Join(conditions, " AND ")), args
+	}
+
+	// A session matches the page filter when it has an event on the page
+	conditions, args := buildFilters(e.Query, false)
+	if e.Query.Filters.Page != nil {
+		conditions = append(conditions, "user_sessions.id IN (SELECT session_id FROM user_events WHERE user_events.page = ?)")
+		args = append(args, *e.Query.Filters.Page)
+	}
+	return fmt.Sprintf(`
+		SELECT %s
+		FROM user_sessions
+		WHERE %s
+		ORDER BY user_sessions.session_start, user_sessions.id
+	`, strings.Join(names, ", "), strings.Join(conditions, " AND ")), args
+}
+
+// copyTo is the COPY statement writing query's rows to file
+func (e Export) copyTo(query string, file string) string {
+	options := "FORMAT PARQUET"
+	if e.Format == EXPORT_CSV {
+		options = "FORMAT CSV, HEADER"
+	}
+	return fmt.Sprintf("COPY (%s) TO '%s' (%s)", query, strings.ReplaceAll(file, "'", "''"), options)
+}
+
+// Export writes the export's rows to file with DuckDB's COPY, and returns how
+// many there were. SQLite rows are copied into a temporary DuckDB database
+// next to the file first.
+func (d *Database) Export(ctx context.Context, e Export, file string) (int64, error) {
+	columns, err := e.columns()
+	if err != nil {
+		return 0, err
+	}
+	query, args := e.selectQuery(columns)
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.store.Kind() == STORE_DUCKDB {
+		result, err := d.store.DB().ExecContext(ctx, e.copyTo(query, file), args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	staging := file + ".duckdb"
+	removeStoreFiles(staging)
+	defer removeStoreFiles(staging)
+
+	duck, err := openDuckDB(staging)
+	if err != nil {
+		return 0, err
+	}
+	defer duck.Close()
+
+	count, err := stageRows(ctx, d.store.DB(), duck, columns, query, args)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := duck.ExecContext(ctx, e.copyTo("SELECT * FROM export", file)); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// stageRows appends the rows of a SQLite query to an export table in duck
+func stageRows(ctx context.Context, source *sql.DB, duck *sql.DB, columns []exportColumn, query string, args []interface{}) (int64, error) {
+	definitions := make([]string, 0, len(columns))
+	for _, column := range columns {
+		definitions = append(definitions, column.name+" "+column.kind)
+	}
+	if _, err := duck.ExecContext(ctx, fmt.Sprintf("CREATE TABLE export (%s)", strings.Join(definitions, ", "))); err != nil {
+		return 0, err
+	}
+
+	rows, err := source.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	conn, err := duck.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var count int64
+	err = conn.Raw(func(driverConn interface{}) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", "export")
+		if err != nil {
+			return err
+		}
+
+		// Scanned into the types the appender takes, SQLite keeps times as text
+		values := make([]driver.Value, len(columns))
+		targets := make([]interface{}, len(columns))
+		for i, column := range columns {
+			switch column.kind {
+			case "TIMESTAMP":
+				targets[i] = &nullTimestamp{}
+			case "BIGINT":
+				targets[i] = &sql.NullInt64{}
+			default:
+				targets[i] = &sql.NullString{}
+			}
+		}
+
+		for rows.Next() {
+			if err := rows.Scan(targets...); err != nil {
+				appender.Close()
+				return err
+			}
+			for i, target := range targets {
+				values[i] = exportValue(target)
+			}
+			if err := appender.AppendRow(values...); err != nil {
+				appender.Close()
+				return err
+			}
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			appender.Close()
+			return err
+		}
+		return appender.Close()
+	})
+	return count, err
+}
+
+// nullTimestamp is a timestamp that can be NULL
+type nullTimestamp struct {
+	timestamp
+	Valid bool
+}
+
+func (t *nullTimestamp) Scan(value interface{}) error {
+	t.Valid = value != nil
+	if !t.Valid {
+		return nil
+	}
+	return t.timestamp.Scan(value)
+}
+
+func exportValue(target interface{}) driver.Value {
+	switch v := target.(type) {
+	case *nullTimestamp:
+		if v.Valid {
+			return v.Time
+		}
+	case *sql.NullInt64:
+		if v.Valid {
+			return v.Int64
+		}
+	case *sql.NullString:
+		if v.Valid {
+			return v.String
+		}
+	}
+	return nil
+}
+
+// ExportFileName is a name for the export's file, for downloads
+func ExportFileName(domain string, e Export) string {
+	return fmt.Sprintf("%s-%s.%s", domain, e.Table, e.Format)
+}
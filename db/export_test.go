@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readExport returns the rows of an exported CSV file, header first, one line
+// per row with its values separated by commas
+func readExport(t *testing.T, file string) string {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		lines = append(lines, strings.Join(record, ","))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func writeExportSessions(t *testing.T, d *Database) {
+	writeSessions(t, d,
+		&UserSession{ID: "s1", UserIdent: "u1", Browser: "Firefox", ScreenWidth: 1280, SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 2},
+		&UserSession{ID: "s2", UserIdent: "u2", Browser: "Chrome", ScreenWidth: 800, SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 1},
+		&UserSession{ID: "s3", UserIdent: "u3", Browser: "Firefox", ScreenWidth: 1920, SessionStart: parseTime("2024-01-02T12:00:00Z"), Events: 1},
+		&UserSession{ID: "s4", UserIdent: "u4", Browser: "Firefox", ScreenWidth: 1920, SessionStart: parseTime("2024-01-03T10:00:00Z"), Events: 1},
+	)
+}
+
+// The sessions of the period that match the filters are exported, with the
+// columns in the order they were asked for
+func TestExportSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeExportSessions(t, d)
+
+		firefox := "Firefox"
+		file := filepath.Join(t.TempDir(), "sessions.csv")
+		e := Export{
+			Table:   EXPORT_SESSIONS,
+			Format:  EXPORT_CSV,
+			Columns: []string{"screen_width", "id", "session_start", "browser"},
+			Query:   Query{Period: "2024-01-02", TimeZone: "UTC", Filters: Filters{Browser: &firefox}},
+		}
+		count, err := d.Export(context.Background(), e, file)
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+
+		want := "screen_width,id,session_start,browser\n1280,s1,2024-01-02 10:00:00,Firefox\n1920,s3,2024-01-02 12:00:00,Firefox"
+		if got := readExport(t, file); count != 2 || got != want {
+			t.Errorf("Export was incorrect, got: %d rows\n%s\nwant: 2 rows\n%s", count, got, want)
+		}
+	})
+}
+
+// Events are the ones of the matching sessions, the page filter keeps only
+// the page's events
+func TestExportEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeExportSessions(t, d)
+
+		file := filepath.Join(t.TempDir(), "events.csv")
+		e := Export{
+			Table:   EXPORT_EVENTS,
+			Format:  EXPORT_CSV,
+			Columns: []string{"session_id", "id", "page"},
+			Query:   Query{Period: "2024-01-02", TimeZone: "UTC"},
+		}
+		count, err := d.Export(context.Background(), e, file)
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+
+		want := "session_id,id,page\ns1,s1-0,a.com/\ns1,s1-1,a.com/\ns2,s2-0,a.com/\ns3,s3-0,a.com/"
+		if got := readExport(t, file); count != 4 || got != want {
+			t.Errorf("Export was incorrect, got: %d rows\n%s\nwant: 4 rows\n%s", count, got, want)
+		}
+
+		// Every column when none are asked for
+		e.Columns = nil
+		if _, err := d.Export(context.Background(), e, file); err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		header := strings.SplitN(readExport(t, file), "\n", 2)[0]
+		if want := strings.Join(ExportColumns(EXPORT_EVENTS), ","); header != want {
+			t.Errorf("Export header was incorrect, got: %s, want: %s.", header, want)
+		}
+	})
+}
+
+func TestExportInvalid(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeExportSessions(t, d)
+
+		exports := []Export{
+			{Table: "console_queries", Format: EXPORT_CSV},
+			{Table: EXPORT_SESSIONS, Format: "json"},
+			{Table: EXPORT_SESSIONS, Format: EXPORT_CSV, Columns: []string{"id", "password"}},
+			{Table: EXPORT_EVENTS, Format: EXPORT_PARQUET, Columns: []string{"browser"}},
+		}
+		for _, e := range exports {
+			file := filepath.Join(t.TempDir(), "export")
+			if _, err := d.Export(context.Background(), e, file); !errors.Is(err, ErrInvalidExport) {
+				t.Errorf("Export(%+v) was incorrect, got: %v, want: %v.", e, err, ErrInvalidExport)
+			}
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				t.Errorf("Export(%+v) file was incorrect, got: %v, want: none.", e, err)
+			}
+		}
+	})
+}
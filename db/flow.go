@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// FLOW_LIMIT is how many pages each step keeps when the query has no limit
+const FLOW_LIMIT = 10
+
+// FlowStep holds the most common pages seen a number of steps away from the
+// entry page, along with how many sessions got that far
+type FlowStep struct {
+	Step    int              `json:"step"`
+	Items   []*AnalyticsItem `json:"items"`
+	Reached int64            `json:"reached"`
+	DropOff int64            `json:"dropOff"`
+}
+
+// FlowResult is the navigation path around a single entry page
+type FlowResult struct {
+	Page     string      `json:"page"`
+	Sessions int64       `json:"sessions"`
+	Next     []*FlowStep `json:"next"`
+	Previous []*FlowStep `json:"previous"`
+}
+
+// GetFlow walks the ordered pageviews of every session that visited page and
+// returns the most common pages before and after it, up to depth steps away.
+// Only the first visit to the page within a session is used as the anchor,
+// and each step keeps the query's limit of pages.
+func (d *Database) GetFlow(ctx context.Context, q Query, page string, depth int) (*FlowResult, error) {
+	return cached(d, fmt.Sprintf("flow %q %d", page, depth), q, func() (*FlowResult, error) {
+		return d.flow(ctx, q, page, depth)
+	})
+}
+
+func (d *Database) flow(ctx context.Context, q Query, page string, depth int) (*FlowResult, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	conditions, args := buildFilters(q, false) // The page filter is the anchor, not a condition
+
+	allConditions := append([]string{"user_events.name = ?"}, conditions...)
+	allArgs := append([]interface{}{"pageview"}, args...)
+	allArgs = append(allArgs, page, depth)
+
+	query := fmt.Sprintf(`
+		WITH events AS (
+			SELECT
+				user_events.session_id,
+				user_events.page,
+				ROW_NUMBER() OVER (PARTITION BY user_events.session_id ORDER BY user_events.event_time) AS pos
+			FROM user_events
+			LEFT JOIN user_sessions ON user_sessions.id = user_events.session_id
+			WHERE %s
+		),
+		anchors AS (
+			SELECT session_id, MIN(pos) AS anchor
+			FROM events
+			WHERE page = ?
+			GROUP BY session_id
+		)
+		SELECT
+			CAST(events.pos - anchors.anchor AS BIGINT) AS step,
+			events.page AS value,
+			COUNT(*) AS count
+		FROM events
+		JOIN anchors ON anchors.session_id = events.session_id
+		WHERE ABS(events.pos - anchors.anchor) <= ?
+		GROUP BY step, events.page
+		ORDER BY step, count DESC
+	`, strings.Join(allConditions, " AND "))
+
+	rows, err := d.store.DB().QueryContext(ctx, query, allArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limit := q.LimitOr(FLOW_LIMIT)
+	result := &FlowResult{Page: page}
+	steps := make(map[int]*FlowStep)
+
+	for rows.Next() {
+		var step int
+		var item AnalyticsItem
+		if err := rows.Scan(&step, &item.Value, &item.Count); err != nil {
+			return nil, err
+		}
+
+		if step == 0 {
+			result.Sessions += item.Count
+			continue
+		}
+
+		s, exists := steps[step]
+		if !exists {
+			s = &FlowStep{Step: step}
+			steps[step] = s
+		}
+
+		s.Reached += item.Count
+		if len(s.Items) < limit {
+			s.Items = append(s.Items, &item)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.Next = buildFlowSteps(steps, result.Sessions, depth, 1)
+	result.Previous = buildFlowSteps(steps, result.Sessions, depth, -1)
+
+	return result, nil
+}
+
+// buildFlowSteps orders the steps in one direction and works out how many
+// sessions stopped before reaching each of them
+func buildFlowSteps(steps map[int]*FlowStep, sessions int64, depth int, direction int) []*FlowStep {
+	result := make([]*FlowStep, 0, depth)
+	previous := sessions
+
+	for i := 1; i <= depth; i++ {
+		s, exists := steps[i*direction]
+		if !exists {
+			s = &FlowStep{Step: i * direction, Items: make([]*AnalyticsItem, 0)}
+		}
+
+		s.DropOff = previous - s.Reached
+		previous = s.Reached
+		result = append(result, s)
+
+		if s.Reached == 0 {
+			break
+		}
+	}
+
+	return result
+}
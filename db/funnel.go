@@ -0,0 +1,294 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"tinylytics/helpers"
+)
+
+const (
+	FUNNEL_STEP_PAGE  = "page"
+	FUNNEL_STEP_EVENT = "event"
+)
+
+// MAX_FUNNEL_STEPS caps the steps of a funnel, each one joins the events again
+const MAX_FUNNEL_STEPS = 10
+
+// FunnelStep matches either a page pattern (e.g. "/blog/*") or an event name
+type FunnelStep struct {
+	Type  string `json:"type"`
+	Match string `json:"match"`
+}
+
+type Funnel struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Steps     []FunnelStep `json:"steps"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+// FunnelStepResult is how many sessions reached a step, relative to the
+// previous step and to the first one
+type FunnelStepResult struct {
+	FunnelStep
+	Sessions          int64    `json:"sessions"`
+	Conversion        float64  `json:"conversion"`
+	OverallConversion float64  `json:"overallConversion"`
+	MedianSeconds     *float64 `json:"medianSeconds"`
+}
+
+type FunnelReport struct {
+	Funnel *Funnel             `json:"funnel"`
+	Steps  []*FunnelStepResult `json:"steps"`
+}
+
+// Validate checks a funnel definition before it is saved
+func (f *Funnel) Validate() error {
+	if strings.TrimSpace(f.Name) == "" {
+		return fmt.Errorf("funnel name is required")
+	}
+
+	if len(f.Steps) == 0 {
+		return fmt.Errorf("funnel needs at least one step")
+	}
+
+	if len(f.Steps) > MAX_FUNNEL_STEPS {
+		return fmt.Errorf("funnel can have at most %d steps", MAX_FUNNEL_STEPS)
+	}
+
+	for i, step := range f.Steps {
+		if step.Type != FUNNEL_STEP_PAGE && step.Type != FUNNEL_STEP_EVENT {
+			return fmt.Errorf("step %d: type must be %q or %q", i+1, FUNNEL_STEP_PAGE, FUNNEL_STEP_EVENT)
+		}
+		if strings.TrimSpace(step.Match) == "" {
+			return fmt.Errorf("step %d: match is required", i+1)
+		}
+	}
+
+	return nil
+}
+
+func scanFunnel(scanner interface{ Scan(...interface{}) error }) (*Funnel, error) {
+	var funnel Funnel
+	var steps string
+
+	if err := scanner.Scan(&funnel.ID, &funnel.Name, &steps, &funnel.CreatedAt, &funnel.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(steps), &funnel.Steps); err != nil {
+		return nil, err
+	}
+
+	return &funnel, nil
+}
+
+func (d *Database) GetFunnels() ([]*Funnel, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.store.DB().Query(`
+		SELECT id, name, steps, created_at, updated_at
+		FROM funnels
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	funnels := make([]*Funnel, 0)
+	for rows.Next() {
+		funnel, err := scanFunnel(rows)
+		if err != nil {
+			return nil, err
+		}
+		funnels = append(funnels, funnel)
+	}
+
+	return funnels, rows.Err()
+}
+
+// GetFunnel returns nil when there is no funnel with the given id
+func (d *Database) GetFunnel(id string) (*Funnel, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	row := d.store.DB().QueryRow(`
+		SELECT id, name, steps, created_at, updated_at
+		FROM funnels
+		WHERE id = ?
+	`, id)
+
+	funnel, err := scanFunnel(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return funnel, err
+}
+
+// SaveFunnel inserts the funnel, or replaces the definition if it already exists
+func (d *Database) SaveFunnel(funnel *Funnel) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	steps, err := json.Marshal(funnel.Steps)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if funnel.CreatedAt.IsZero() {
+		funnel.CreatedAt = now
+	}
+	funnel.UpdatedAt = now
+
+	_, err = d.store.DB().Exec(`
+		INSERT INTO funnels (id, created_at, updated_at, name, steps)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			updated_at = excluded.updated_at,
+			name = excluded.name,
+			steps = excluded.steps
+	`, funnel.ID, funnel.CreatedAt, funnel.UpdatedAt, funnel.Name, string(steps))
+
+	return err
+}
+
+func (d *Database) DeleteFunnel(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.store.DB().Exec("DELETE FROM funnels WHERE id = ?", id)
+	return err
+}
+
+// funnelStepCondition builds the condition an event must meet to count for a step
+func funnelStepCondition(step FunnelStep, domain string) (string, interface{}) {
+	if step.Type == FUNNEL_STEP_EVENT {
+		return "events.name = ?", step.Match
+	}
+	return `events.name = 'pageview' AND events.page LIKE ? ESCAPE '\'`, helpers.PagePatternToLike(domain, step.Match)
+}
+
+// GetFunnelReport counts the sessions that completed each step of the funnel
+// in order. A step only counts if it happened after the previous step within
+// the same session. The page filter limits the report to sessions that viewed
+// that page at some point.
+func (d *Database) GetFunnelReport(ctx context.Context, q Query, funnel *Funnel, domain string) (*FunnelReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	conditions, args := buildFilters(q, false)
+
+	if q.Filters.Page != nil {
+		conditions = append(conditions, "user_sessions.id IN (SELECT session_id FROM user_events WHERE page = ?)")
+		args = append(args, *q.Filters.Page)
+	}
+
+	ctes := []string{fmt.Sprintf(`
+		events AS (
+			SELECT
+				user_events.session_id,
+				user_events.name,
+				user_events.page,
+				user_events.event_time,
+				ROW_NUMBER() OVER (PARTITION BY user_events.session_id ORDER BY user_events.event_time) AS pos
+			FROM user_events
+			LEFT JOIN user_sessions ON user_sessions.id = user_events.session_id
+			WHERE %s
+		)`, strings.Join(conditions, " AND "))}
+
+	selects := make([]string, 0, len(funnel.Steps))
+
+	for i, step := range funnel.Steps {
+		condition, arg := funnelStepCondition(step, domain)
+		args = append(args, arg)
+
+		if i == 0 {
+			ctes = append(ctes, fmt.Sprintf(`
+		step_1 AS (
+			SELECT events.session_id, MIN(events.pos) AS pos, ARG_MIN(events.event_time, events.pos) AS t
+			FROM events
+			WHERE %s
+			GROUP BY events.session_id
+		)`, condition))
+			selects = append(selects, "SELECT 1 AS step, COUNT(*) AS sessions, NULL AS median FROM step_1")
+			continue
+		}
+
+		ctes = append(ctes, fmt.Sprintf(`
+		step_%[1]d AS (
+			SELECT events.session_id, MIN(events.pos) AS pos, ARG_MIN(events.event_time, events.pos) AS t
+			FROM events
+			JOIN step_%[2]d ON step_%[2]d.session_id = events.session_id AND events.pos > step_%[2]d.pos
+			WHERE %[3]s
+			GROUP BY events.session_id
+		)`, i+1, i, condition))
+		selects = append(selects, fmt.Sprintf(`
+		SELECT %[1]d AS step, COUNT(*) AS sessions, MEDIAN(epoch(step_%[1]d.t) - epoch(step_%[2]d.t)) AS median
+		FROM step_%[1]d
+		JOIN step_%[2]d ON step_%[2]d.session_id = step_%[1]d.session_id`, i+1, i))
+	}
+
+	query := "WITH " + strings.Join(ctes, ",") + "\n" + strings.Join(selects, "\nUNION ALL\n") + "\nORDER BY step"
+
+	rows, err := d.store.DB().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &FunnelReport{
+		Funnel: funnel,
+		Steps:  make([]*FunnelStepResult, 0, len(funnel.Steps)),
+	}
+
+	for rows.Next() {
+		var step int
+		var sessions int64
+		var median sql.NullFloat64
+
+		if err := rows.Scan(&step, &sessions, &median); err != nil {
+			return nil, err
+		}
+
+		result := &FunnelStepResult{
+			FunnelStep: funnel.Steps[step-1],
+			Sessions:   sessions,
+		}
+		if median.Valid {
+			result.MedianSeconds = &median.Float64
+		}
+		report.Steps = append(report.Steps, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, result := range report.Steps {
+		if i == 0 {
+			if result.Sessions > 0 {
+				result.Conversion = 100
+				result.OverallConversion = 100
+			}
+			continue
+		}
+
+		if previous := report.Steps[i-1].Sessions; previous > 0 {
+			result.Conversion = float64(result.Sessions) / float64(previous) * 100
+		}
+		if first := report.Steps[0].Sessions; first > 0 {
+			result.OverallConversion = float64(result.Sessions) / float64(first) * 100
+		}
+	}
+
+	return report, nil
+}
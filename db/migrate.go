@@ -0,0 +1,163 @@
+package db
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each store has its own folder of migrations, named
+// <version>_<name>.up.sql and applied in version order
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+const createSchemaVersionTable = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR,
+		applied_at TIMESTAMP
+	)
+`
+
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt"`
+	sql       string
+}
+
+// Migrations returns the migrations of a kind of store, in the order they're
+// applied
+func Migrations(kind string) ([]*Migration, error) {
+	dir := path.Join("migrations", kind)
+
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", kind, err)
+	}
+
+	migrations := make([]*Migration, 0, len(entries))
+	for _, entry := range entries {
+		name, isUp := strings.CutSuffix(entry.Name(), ".up.sql")
+		if !isUp {
+			continue
+		}
+
+		number, name, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(number)
+		if !found || err != nil {
+			return nil, fmt.Errorf("migration %s isn't named <version>_<name>.up.sql", entry.Name())
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, &Migration{Version: version, Name: name, sql: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("%s has two migrations numbered %d", kind, migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// MigrationStatus returns the store's migrations, with when each one was
+// applied, nil if it's still pending
+func MigrationStatus(store Store) ([]*Migration, error) {
+	migrations, err := Migrations(store.Kind())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := store.DB().Exec(createSchemaVersionTable); err != nil {
+		return nil, fmt.Errorf("create schema_version table: %w", err)
+	}
+
+	rows, err := store.DB().Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt timestamp
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt.Time
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, migration := range migrations {
+		if appliedAt, exists := applied[migration.Version]; exists {
+			migration.AppliedAt = &appliedAt
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies the store's pending migrations in order, each in its own
+// transaction, and returns the ones it applied
+func Migrate(store Store) ([]*Migration, error) {
+	migrations, err := MigrationStatus(store)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]*Migration, 0)
+	for _, migration := range migrations {
+		if migration.AppliedAt != nil {
+			continue
+		}
+
+		if err := applyMigration(store, migration); err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+func applyMigration(store Store, migration *Migration) error {
+	tx, err := store.DB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(migration.sql); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Name, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	migration.AppliedAt = &now
+	return nil
+}
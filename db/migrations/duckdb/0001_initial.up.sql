@@ -0,0 +1,42 @@
+-- Columnar storage, no soft deletes and minimal indexing (DuckDB uses
+-- automatic zone maps for analytics)
+CREATE TABLE IF NOT EXISTS user_sessions (
+	id VARCHAR PRIMARY KEY,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP,
+	user_ident VARCHAR,
+	browser VARCHAR,
+	browser_major VARCHAR,
+	browser_minor VARCHAR,
+	browser_patch VARCHAR,
+	os VARCHAR,
+	os_major VARCHAR,
+	os_minor VARCHAR,
+	os_patch VARCHAR,
+	country VARCHAR,
+	user_agent VARCHAR,
+	referer VARCHAR,
+	referer_full_path VARCHAR,
+	session_start TIMESTAMP,
+	session_end TIMESTAMP,
+	screen_width BIGINT,
+	events BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS user_events (
+	id VARCHAR PRIMARY KEY,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP,
+	name VARCHAR,
+	page VARCHAR,
+	event_time TIMESTAMP,
+	session_id VARCHAR
+);
+
+CREATE TABLE IF NOT EXISTS funnels (
+	id VARCHAR PRIMARY KEY,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP,
+	name VARCHAR,
+	steps VARCHAR
+);
@@ -0,0 +1,2 @@
+-- Sessions without a referrer used to be stored with an empty one
+UPDATE user_sessions SET referer = '(none)' WHERE referer = '';
@@ -0,0 +1,10 @@
+-- Totals of the days whose sessions and events were purged by the retention
+-- policy, so long-term trends survive
+CREATE TABLE IF NOT EXISTS daily_totals (
+	day TIMESTAMP PRIMARY KEY,
+	sessions BIGINT,
+	visitors BIGINT,
+	pageviews BIGINT,
+	bounces BIGINT,
+	duration DOUBLE
+);
@@ -0,0 +1,48 @@
+-- Sessions and pageviews summed per hour and per day of session_start, see
+-- db/rollup.go. The *_drillable columns count the sessions that have a value
+-- one level down (browser and OS minor version, referrer path).
+CREATE TABLE IF NOT EXISTS hourly_sessions (
+	period TIMESTAMP,
+	browser VARCHAR,
+	browser_major VARCHAR,
+	os VARCHAR,
+	os_major VARCHAR,
+	country VARCHAR,
+	referer VARCHAR,
+	sessions BIGINT,
+	bounces BIGINT,
+	duration DOUBLE,
+	pageviews BIGINT,
+	browser_drillable BIGINT,
+	os_drillable BIGINT,
+	referer_drillable BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS daily_sessions (
+	period TIMESTAMP,
+	browser VARCHAR,
+	browser_major VARCHAR,
+	os VARCHAR,
+	os_major VARCHAR,
+	country VARCHAR,
+	referer VARCHAR,
+	sessions BIGINT,
+	bounces BIGINT,
+	duration DOUBLE,
+	pageviews BIGINT,
+	browser_drillable BIGINT,
+	os_drillable BIGINT,
+	referer_drillable BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS hourly_pages (
+	period TIMESTAMP,
+	page VARCHAR,
+	pageviews BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS daily_pages (
+	period TIMESTAMP,
+	page VARCHAR,
+	pageviews BIGINT
+);
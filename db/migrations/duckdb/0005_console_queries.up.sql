@@ -0,0 +1,8 @@
+-- Queries saved from the SQL console
+CREATE TABLE IF NOT EXISTS console_queries (
+	id VARCHAR PRIMARY KEY,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP,
+	name VARCHAR,
+	query VARCHAR
+);
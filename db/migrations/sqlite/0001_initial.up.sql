@@ -0,0 +1,34 @@
+-- The schema GORM created before migrations were versioned, so existing
+-- databases are left as they are
+CREATE TABLE IF NOT EXISTS `user_sessions` (`id` text,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`user_ident` text,`browser` text,`browser_major` text,`browser_minor` text,`browser_patch` text,`os` text,`os_major` text,`os_minor` text,`os_patch` text,`country` text,`user_agent` text,`referer` text,`referer_full_path` text,`session_start` datetime,`session_end` datetime,`screen_width` integer,`events` integer,PRIMARY KEY (`id`));
+CREATE INDEX IF NOT EXISTS `idx_sessions_start_end` ON `user_sessions`(`session_start`,`session_end`);
+CREATE INDEX IF NOT EXISTS `idx_user_sessions_session_start` ON `user_sessions`(`session_start`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_referer_path` ON `user_sessions`(`referer`,`referer_full_path`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_start_referer` ON `user_sessions`(`session_start`,`referer`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_start_country` ON `user_sessions`(`session_start`,`country`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_os_patch` ON `user_sessions`(`os_minor`,`os_patch`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_os_minor` ON `user_sessions`(`os_major`,`os_minor`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_os_major` ON `user_sessions`(`os`,`os_major`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_start_os` ON `user_sessions`(`session_start`,`os`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_browser_patch` ON `user_sessions`(`browser_minor`,`browser_patch`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_browser_minor` ON `user_sessions`(`browser_major`,`browser_minor`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_browser_major` ON `user_sessions`(`browser`,`browser_major`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_start_browser` ON `user_sessions`(`session_start`,`browser`);
+CREATE INDEX IF NOT EXISTS `idx_user_ident_session_end` ON `user_sessions`(`user_ident`,`session_end`);
+CREATE INDEX IF NOT EXISTS `idx_sessions_id_start` ON `user_sessions`(`id`,`session_start`);
+CREATE INDEX IF NOT EXISTS `idx_user_sessions_deleted_at` ON `user_sessions`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `user_events` (`id` text,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`page` text,`event_time` datetime,`session_id` text,PRIMARY KEY (`id`),CONSTRAINT `fk_user_events_session` FOREIGN KEY (`session_id`) REFERENCES `user_sessions`(`id`));
+CREATE INDEX IF NOT EXISTS `idx_events_pageview_page` ON `user_events`(`page`);
+CREATE INDEX IF NOT EXISTS `idx_events_session_page` ON `user_events`(`session_id`,`page`);
+CREATE INDEX IF NOT EXISTS `idx_events_name_session_page` ON `user_events`(`name`,`session_id`,`page`);
+CREATE INDEX IF NOT EXISTS `idx_events_session_name` ON `user_events`(`session_id`,`name`);
+CREATE INDEX IF NOT EXISTS `idx_user_events_deleted_at` ON `user_events`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS funnels (
+	id VARCHAR PRIMARY KEY,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP,
+	name VARCHAR,
+	steps VARCHAR
+);
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ROLLUP_MIN_PERIOD is the shortest period answered from the rollups, shorter
+// ones are cheap enough to count from the raw tables
+const ROLLUP_MIN_PERIOD = 48 * time.Hour
+
+const (
+	rollupSessions = iota
+	rollupPages
+)
+
+// rollupSegment is a part of a query's period read from one place: a rollup
+// table, or the raw tables when table is empty. A nil to is open ended.
+type rollupSegment struct {
+	table     string
+	from      time.Time
+	to        *time.Time
+	inclusive bool
+}
+
+// rollupPlan answers a query from the daily rollups for the whole UTC days of
+// its period, the hourly rollups for the whole hours around them, and the raw
+// tables for what's left at either end. Raw rows are summed into the same
+// shape as the rollups, so the filters and grouping apply to all of them.
+type rollupPlan struct {
+	kind       int
+	segments   []rollupSegment
+	conditions []string
+	args       []interface{}
+}
+
+// planRollups returns how to answer the query from the rollups, or nil when
+// it has to read the raw tables: the period is short, or it's filtered on
+// something the rollups don't keep. Pages rollups have no session dimensions.
+func planRollups(q Query, kind int) *rollupPlan {
+	filters := q.Filters
+	plan := &rollupPlan{kind: kind}
+
+	switch kind {
+	case rollupSessions:
+		if len(filters.BrowserVersion) > 1 || len(filters.OSVersion) > 1 || filters.RefererFullPath != nil {
+			return nil
+		}
+
+		plan.addCondition(filters.Browser != nil, "browser = ?", filters.Browser)
+		plan.addCondition(filters.Browser != nil && len(filters.BrowserVersion) == 1, "browser_major = ?", firstOf(filters.BrowserVersion))
+		plan.addCondition(filters.OS != nil, "os = ?", filters.OS)
+		plan.addCondition(filters.OS != nil && len(filters.OSVersion) == 1, "os_major = ?", firstOf(filters.OSVersion))
+		plan.addCondition(filters.Country != nil, "country = ?", filters.Country)
+		plan.addCondition(filters.Referer != nil, "referer = ?", filters.Referer)
+	case rollupPages:
+		if filters.Browser != nil || filters.OS != nil || filters.Country != nil || filters.Referer != nil {
+			return nil
+		}
+
+		plan.addCondition(filters.Page != nil, "page = ?", filters.Page)
+	}
+
+	start, end := q.TimeRange()
+	plan.segments = rollupSegments(start, end, time.Now().UTC())
+	if plan.segments == nil {
+		return nil
+	}
+
+	return plan
+}
+
+func (p *rollupPlan) addCondition(add bool, condition string, value interface{}) {
+	if !add {
+		return
+	}
+	if s, isPointer := value.(*string); isPointer {
+		value = *s
+	}
+	p.conditions = append(p.conditions, condition)
+	p.args = append(p.args, value)
+}
+
+func firstOf(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// rollupSegments splits the period between the rollups and the raw tables, nil
+// when it's too short to be worth it
+func rollupSegments(start time.Time, end *time.Time, now time.Time) []rollupSegment {
+	start = start.UTC()
+	last := now
+	if end != nil {
+		last = end.UTC()
+	}
+	if last.Sub(start) < ROLLUP_MIN_PERIOD {
+		return nil
+	}
+
+	hourFrom := ceilTime(start, time.Hour)
+	hourTo := last.Truncate(time.Hour)
+	if !hourFrom.Before(hourTo) {
+		return nil
+	}
+	dayFrom := ceilTime(hourFrom, 24*time.Hour)
+	dayTo := hourTo.Truncate(24 * time.Hour)
+
+	segments := make([]rollupSegment, 0, 5)
+	add := func(table string, from time.Time, to time.Time) {
+		if from.Before(to) {
+			segments = append(segments, rollupSegment{table: table, from: from, to: &to})
+		}
+	}
+
+	add("", start, hourFrom)
+	if dayFrom.Before(dayTo) {
+		add("hourly", hourFrom, dayFrom)
+		add("daily", dayFrom, dayTo)
+		add("hourly", dayTo, hourTo)
+	} else {
+		add("hourly", hourFrom, hourTo)
+	}
+
+	// The raw tables' periods include their end
+	tail := rollupSegment{from: hourTo, inclusive: true}
+	if end != nil {
+		to := end.UTC()
+		tail.to = &to
+	}
+	return append(segments, tail)
+}
+
+// query fills in format's %[1]s with the plan's rows and %[2]s with its
+// conditions, and returns the query's args
+func (p *rollupPlan) query(format string) (string, []interface{}) {
+	table, columns, rawRows := "sessions", sessionRollupColumns, sessionRollupRows
+	if p.kind == rollupPages {
+		table, columns, rawRows = "pages", pageRollupColumns, pageRollupRows
+	}
+
+	parts := make([]string, 0, len(p.segments))
+	args := make([]interface{}, 0, len(p.segments)*2+len(p.args))
+
+	for _, segment := range p.segments {
+		if segment.table != "" {
+			parts = append(parts, fmt.Sprintf("SELECT %s FROM %s_%s WHERE period >= ? AND period < ?", columns, segment.table, table))
+			args = append(args, segment.from, *segment.to)
+			continue
+		}
+
+		// Times are stored in UTC, and SQLite compares them as text
+		where := "user_sessions.session_start >= ?"
+		args = append(args, segment.from)
+		if segment.to != nil {
+			if segment.inclusive {
+				where += " AND user_sessions.session_start <= ?"
+			} else {
+				where += " AND user_sessions.session_start < ?"
+			}
+			args = append(args, *segment.to)
+		}
+		parts = append(parts, rawRows(where))
+	}
+
+	conditions := "1 = 1"
+	if len(p.conditions) > 0 {
+		conditions = strings.Join(p.conditions, " AND ")
+	}
+
+	rows := "(" + strings.Join(parts, "\nUNION ALL\n") + ") AS rollup"
+	return fmt.Sprintf(format, rows, conditions), append(args, p.args...)
+}
+
+// rollupTotals sums two columns of the plan's rows
+func (d *Database) rollupTotals(ctx context.Context, plan *rollupPlan, a string, b string) (float64, float64, error) {
+	query, args := plan.query(fmt.Sprintf("SELECT SUM(%s), SUM(%s) FROM %%[1]s WHERE %%[2]s", a, b))
+
+	var first, second sql.NullFloat64
+	if err := d.store.DB().QueryRowContext(ctx, query, args...).Scan(&first, &second); err != nil {
+		return 0, 0, err
+	}
+	return first.Float64, second.Float64, nil
+}
+
+// rollupBreakdown groups the plan's rows by column, like the raw breakdowns.
+// drillable sums the sessions that have a value one level down.
+func (d *Database) rollupBreakdown(ctx context.Context, plan *rollupPlan, column string, count string, drillable string, q Query) (*Breakdown, error) {
+	format := `
+		SELECT ` + column + ` AS value, CAST(SUM(` + count + `) AS BIGINT) AS count, CAST(` + drillable + ` AS BIGINT) AS drillable
+		FROM %[1]s
+		WHERE %[2]s
+		GROUP BY ` + column + `
+	`
+
+	query, args := plan.query(format)
+	return d.queryBreakdown(ctx, query, args, q)
+}
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+var rollupSegmentsTests = []struct {
+	start, end string // RFC 3339, empty end for open ended
+	now        string
+	expected   []string // table from to, "raw" for the raw tables, "]" when the end is included
+}{
+	{
+		"2024-01-01T10:30:00Z", "2024-01-05T14:20:00Z", "2024-02-01T00:00:00Z",
+		[]string{
+			"raw 2024-01-01T10:30:00Z 2024-01-01T11:00:00Z",
+			"hourly 2024-01-01T11:00:00Z 2024-01-02T00:00:00Z",
+			"daily 2024-01-02T00:00:00Z 2024-01-05T00:00:00Z",
+			"hourly 2024-01-05T00:00:00Z 2024-01-05T14:00:00Z",
+			"raw 2024-01-05T14:00:00Z 2024-01-05T14:20:00Z]",
+		},
+	},
+	// Whole days
+	{
+		"2024-01-01T00:00:00Z", "2024-01-04T00:00:00Z", "2024-02-01T00:00:00Z",
+		[]string{
+			"daily 2024-01-01T00:00:00Z 2024-01-04T00:00:00Z",
+			"raw 2024-01-04T00:00:00Z 2024-01-04T00:00:00Z]",
+		},
+	},
+	// A single whole day
+	{
+		"2024-01-01T10:30:00Z", "2024-01-03T11:00:00Z", "2024-02-01T00:00:00Z",
+		[]string{
+			"raw 2024-01-01T10:30:00Z 2024-01-01T11:00:00Z",
+			"hourly 2024-01-01T11:00:00Z 2024-01-02T00:00:00Z",
+			"daily 2024-01-02T00:00:00Z 2024-01-03T00:00:00Z",
+			"hourly 2024-01-03T00:00:00Z 2024-01-03T11:00:00Z",
+			"raw 2024-01-03T11:00:00Z 2024-01-03T11:00:00Z]",
+		},
+	},
+	// Open ended, up to now
+	{
+		"2024-01-01T00:00:00Z", "", "2024-01-03T10:15:00Z",
+		[]string{
+			"daily 2024-01-01T00:00:00Z 2024-01-03T00:00:00Z",
+			"hourly 2024-01-03T00:00:00Z 2024-01-03T10:00:00Z",
+			"raw 2024-01-03T10:00:00Z",
+		},
+	},
+	// Too short
+	{"2024-01-01T00:00:00Z", "2024-01-02T23:59:59Z", "2024-02-01T00:00:00Z", nil},
+	{"2024-01-01T00:00:00Z", "", "2024-01-02T12:00:00Z", nil},
+}
+
+func TestRollupSegments(t *testing.T) {
+	for _, test := range rollupSegmentsTests {
+		var end *time.Time
+		if test.end != "" {
+			value := parseTime(test.end)
+			end = &value
+		}
+
+		segments := rollupSegments(parseTime(test.start), end, parseTime(test.now))
+
+		result := make([]string, 0, len(segments))
+		for _, segment := range segments {
+			table := segment.table
+			if table == "" {
+				table = "raw"
+			}
+			value := table + " " + segment.from.Format(time.RFC3339)
+			if segment.to != nil {
+				value += " " + segment.to.Format(time.RFC3339)
+			}
+			if segment.inclusive && segment.to != nil {
+				value += "]"
+			}
+			result = append(result, value)
+		}
+
+		if test.expected == nil && segments != nil {
+			t.Errorf("rollupSegments(%s, %s) was incorrect, got: %v, want: nil.", test.start, test.end, result)
+			continue
+		}
+		if len(result) != len(test.expected) {
+			t.Errorf("rollupSegments(%s, %s) was incorrect, got: %v, want: %v.", test.start, test.end, result, test.expected)
+			continue
+		}
+		for i := range result {
+			if result[i] != test.expected[i] {
+				t.Errorf("rollupSegments(%s, %s)[%d] was incorrect, got: %s, want: %s.", test.start, test.end, i, result[i], test.expected[i])
+			}
+		}
+	}
+}
+
+func TestPlanRollups(t *testing.T) {
+	chrome, page, path := "Chrome", "a.com/", "/search"
+	period := "2024-01-01..2024-01-31"
+
+	tests := []struct {
+		name       string
+		q          Query
+		kind       int
+		planned    bool
+		conditions int
+	}{
+		{"no filters", Query{Period: period}, rollupSessions, true, 0},
+		{"short period", Query{Period: "2024-01-01"}, rollupSessions, false, 0},
+		{"browser", Query{Period: period, Filters: Filters{Browser: &chrome}}, rollupSessions, true, 1},
+		{"major version", Query{Period: period, Filters: Filters{Browser: &chrome, BrowserVersion: []string{"120"}}}, rollupSessions, true, 2},
+		{"minor version", Query{Period: period, Filters: Filters{Browser: &chrome, BrowserVersion: []string{"120", "1"}}}, rollupSessions, false, 0},
+		{"referrer path", Query{Period: period, Filters: Filters{RefererFullPath: &path}}, rollupSessions, false, 0},
+		{"page", Query{Period: period, Filters: Filters{Page: &page}}, rollupPages, true, 1},
+		{"page and browser", Query{Period: period, Filters: Filters{Page: &page, Browser: &chrome}}, rollupPages, false, 0},
+	}
+
+	for _, test := range tests {
+		test.q.TimeZone = "UTC"
+		plan := planRollups(test.q, test.kind)
+		if (plan != nil) != test.planned {
+			t.Errorf("planRollups(%s) was incorrect, got a plan: %v, want: %v.", test.name, plan != nil, test.planned)
+			continue
+		}
+		if plan != nil && len(plan.conditions) != test.conditions {
+			t.Errorf("planRollups(%s) conditions were incorrect, got: %v, want: %d.", test.name, plan.conditions, test.conditions)
+		}
+	}
+}
+
+// The rollup plans count the same as the raw tables, with sessions in each of
+// their segments and outside the period
+func TestRollupQueries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		ctx := context.Background()
+
+		writeSessions(t, d,
+			&UserSession{ID: "before", Browser: "Chrome", SessionStart: parseTime("2024-01-01T10:00:00Z"), Events: 1},
+			&UserSession{ID: "raw-head", Browser: "Chrome", SessionStart: parseTime("2024-01-01T10:45:00Z"), Events: 2},
+			&UserSession{ID: "hourly-head", Browser: "Firefox", SessionStart: parseTime("2024-01-01T15:00:00Z"), Events: 1},
+			&UserSession{ID: "daily", Browser: "Chrome", SessionStart: parseTime("2024-01-03T12:00:00Z"), Events: 3},
+			&UserSession{ID: "hourly-tail", Browser: "Safari", SessionStart: parseTime("2024-01-05T09:00:00Z"), Events: 1},
+			&UserSession{ID: "raw-tail", Browser: "Chrome", SessionStart: parseTime("2024-01-05T14:10:00Z"), Events: 1},
+			&UserSession{ID: "after", Browser: "Chrome", SessionStart: parseTime("2024-01-05T14:30:00Z"), Events: 1},
+		)
+
+		q := Query{Period: "2024-01-01T10:30:00Z..2024-01-05T14:20:00Z", TimeZone: "UTC"}
+		if planRollups(q, rollupSessions) == nil {
+			t.Fatal("The query wasn't planned on the rollups")
+		}
+
+		sessions, err := d.countSessions(ctx, q)
+		if err != nil || sessions != 5 {
+			t.Errorf("countSessions was incorrect, got: %d (%v), want: 5.", sessions, err)
+		}
+
+		pageViews, err := d.countPageViews(ctx, q)
+		if err != nil || pageViews != 8 {
+			t.Errorf("countPageViews was incorrect, got: %d (%v), want: 8.", pageViews, err)
+		}
+
+		browsers, err := d.browsers(ctx, q)
+		if err != nil {
+			t.Fatalf("browsers failed: %v", err)
+		}
+		expected := map[string]int64{"Chrome": 3, "Firefox": 1, "Safari": 1}
+		if len(browsers.Items) != len(expected) {
+			t.Errorf("browsers was incorrect, got: %d rows, want: %d.", len(browsers.Items), len(expected))
+		}
+		for _, item := range browsers.Items {
+			if item.Count != expected[item.Value] {
+				t.Errorf("browsers[%s] was incorrect, got: %d, want: %d.", item.Value, item.Count, expected[item.Value])
+			}
+		}
+	})
+}
+
+// A batch updates the rollups of its sessions' hours in its transaction
+func TestBatchUpdatesRollups(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		session := &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-03T12:00:00Z"), Events: 1}
+		writeSessions(t, d, session)
+
+		batch := d.NewBatch()
+		session.Events++
+		session.SessionEnd = session.SessionEnd.Add(time.Minute)
+		batch.UpdateUserSession(session)
+		batch.SaveEvent(&UserEvent{ID: "s1-new", Name: "pageview", Page: "a.com/about", EventTime: session.SessionEnd}, session.ID)
+		if err := batch.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+
+		var sessions, pageViews int64
+		err := d.store.DB().QueryRow("SELECT CAST(SUM(sessions) AS BIGINT), CAST(SUM(pageviews) AS BIGINT) FROM hourly_sessions").Scan(&sessions, &pageViews)
+		if err != nil || sessions != 1 || pageViews != 2 {
+			t.Errorf("hourly_sessions was incorrect, got: %d sessions, %d pageviews (%v), want: 1, 2.", sessions, pageViews, err)
+		}
+
+		err = d.store.DB().QueryRow("SELECT CAST(SUM(pageviews) AS BIGINT) FROM daily_pages WHERE page = ?", "a.com/about").Scan(&pageViews)
+		if err != nil || pageViews != 1 {
+			t.Errorf("daily_pages was incorrect, got: %d pageviews (%v), want: 1.", pageViews, err)
+		}
+	})
+}
+
+// A batch whose rollups can't be updated isn't written, so it's retried
+func TestBatchRollupsFailure(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		if _, err := d.store.DB().Exec("DROP TABLE daily_pages"); err != nil {
+			t.Fatal(err)
+		}
+
+		batch := d.NewBatch()
+		batch.StartUserSession(&UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-03T12:00:00Z"), SessionEnd: parseTime("2024-01-03T12:00:00Z"), Events: 1})
+		batch.SaveEvent(&UserEvent{ID: "e1", Name: "pageview", Page: "a.com/", EventTime: parseTime("2024-01-03T12:00:00Z")}, "s1")
+		if err := batch.Commit(); err == nil {
+			t.Fatal("Commit was incorrect, got: nil, want: an error.")
+		}
+
+		var sessions, events int64
+		err := d.store.DB().QueryRow("SELECT (SELECT COUNT(*) FROM user_sessions), (SELECT COUNT(*) FROM user_events)").Scan(&sessions, &events)
+		if err != nil || sessions != 0 || events != 0 {
+			t.Errorf("Rows were incorrect, got: %d sessions, %d events (%v), want: 0, 0.", sessions, events, err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"time"
+	"tinylytics/constants"
+	"tinylytics/helpers"
+)
+
+// BREAKDOWN_LIMIT is how many rows the breakdowns return when the query has
+// no limit
+const BREAKDOWN_LIMIT = 20
+
+// Filters narrows a query down to matching sessions. A nil field isn't
+// filtered on, an empty string matches sessions without a value. Versions go
+// from the major version down, so []string{"120", "0"} is 120.0.x.
+type Filters struct {
+	Browser         *string  `json:"browser,omitempty"`
+	BrowserVersion  []string `json:"browserVersion,omitempty"`
+	OS              *string  `json:"os,omitempty"`
+	OSVersion       []string `json:"osVersion,omitempty"`
+	Country         *string  `json:"country,omitempty"`
+	Referer         *string  `json:"referer,omitempty"`
+	RefererFullPath *string  `json:"refererFullPath,omitempty"`
+	// Page keeps the sessions that viewed the page, or only the page's events
+	// in the page reports
+	Page *string `json:"page,omitempty"`
+}
+
+// Query is what a report is run over: the period in a time zone, the
+// filters, and for lists how many rows to return and in which order
+type Query struct {
+	// Period is one of the constants.DATE_RAGE_* names, a day such as
+	// "2024-01-01", a range of days such as "2024-01-01..2024-03-31" or
+	// "2024-01-01.." until now (either end can also be an RFC 3339 time), a
+	// relative period such as "last-14d" (h, d, w, m or y), or
+	// "<start>,<end>" in Unix seconds. See helpers.ParsePeriod.
+	Period string `json:"period"`
+	// TimeZone is the IANA name of the zone periods and reports count days,
+	// weeks and months in
+	TimeZone string  `json:"timeZone"`
+	Filters  Filters `json:"filters"`
+	Limit    int     `json:"limit,omitempty"`
+	Offset   int     `json:"offset,omitempty"`
+	Sort     string  `json:"sort,omitempty"`
+}
+
+// TimeRange returns the UTC start of the query's period, and its end if it
+// isn't open ended
+func (q Query) TimeRange() (time.Time, *time.Time) {
+	period := q.Period
+	if period == "" {
+		period = constants.DATE_RAGE_24H
+	}
+
+	return helpers.GetTimePeriod(period, q.Zone())
+}
+
+// Validate checks that the query's period and time zone can be read, so
+// TimeRange doesn't have to fall back to the last 24 hours
+func (q Query) Validate() error {
+	if q.Period == "" {
+		return nil
+	}
+	_, _, err := helpers.ParsePeriod(q.Period, q.Zone())
+	return err
+}
+
+// Zone returns the name of the time zone the query's days are counted in
+func (q Query) Zone() string {
+	if q.TimeZone == "" {
+		return constants.DEFAULT_TIMEZONE
+	}
+	return q.TimeZone
+}
+
+// Location returns the time zone the query's days are counted in
+func (q Query) Location() *time.Location {
+	loc, err := loadLocation(q.Zone())
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// LimitOr returns the query's limit, or def when it has none
+func (q Query) LimitOr(def int) int {
+	if q.Limit > 0 {
+		return q.Limit
+	}
+	return def
+}
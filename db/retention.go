@@ -0,0 +1,232 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"tinylytics/helpers"
+)
+
+// PurgeResult is what a retention purge removed from one store, and how big
+// its file was before and after compaction
+type PurgeResult struct {
+	Store      string    `json:"store"`
+	Before     time.Time `json:"before"`
+	Sessions   int64     `json:"sessions"`
+	Events     int64     `json:"events"`
+	Days       int64     `json:"days"`
+	SizeBefore int64     `json:"sizeBefore"`
+	SizeAfter  int64     `json:"sizeAfter"`
+}
+
+// DailyTotals is a day of a site's sessions that was purged, see
+// KeepDailyTotals in the website config
+type DailyTotals struct {
+	Day       time.Time `json:"day"`
+	Sessions  int64     `json:"sessions"`
+	Visitors  int64     `json:"visitors"`
+	PageViews int64     `json:"pageViews"`
+	Bounces   int64     `json:"bounces"`
+	Duration  float64   `json:"duration"`
+}
+
+// saveDailyTotals adds the totals of the sessions that started before the
+// cutoff to daily_totals. A day that was already partly purged is added to,
+// except for its visitors: distinct counts can't be added up, the larger one
+// is kept.
+const saveDailyTotals = `
+	INSERT INTO daily_totals (day, sessions, visitors, pageviews, bounces, duration)
+	SELECT
+		DATE_TRUNC('day', user_sessions.session_start) AS day,
+		COUNT(*),
+		COUNT(DISTINCT user_sessions.user_ident),
+		COALESCE(SUM(pageviews.count), 0),
+		SUM(CASE WHEN (epoch(user_sessions.session_end) - epoch(user_sessions.session_start)) = 0.0 THEN 1 ELSE 0 END),
+		COALESCE(SUM(epoch(user_sessions.session_end) - epoch(user_sessions.session_start)), 0)
+	FROM user_sessions
+	LEFT JOIN (
+		SELECT session_id, COUNT(*) AS count
+		FROM user_events
+		WHERE name = 'pageview'
+		GROUP BY session_id
+	) AS pageviews ON pageviews.session_id = user_sessions.id
+	WHERE user_sessions.session_start < ?
+	GROUP BY DATE_TRUNC('day', user_sessions.session_start)
+	ON CONFLICT (day) DO UPDATE SET
+		sessions = daily_totals.sessions + excluded.sessions,
+		visitors = CASE WHEN excluded.visitors > daily_totals.visitors THEN excluded.visitors ELSE daily_totals.visitors END,
+		pageviews = daily_totals.pageviews + excluded.pageviews,
+		bounces = daily_totals.bounces + excluded.bounces,
+		duration = daily_totals.duration + excluded.duration
+`
+
+// PurgeSite deletes a site's sessions that started before the cutoff, along
+// with their events, and compacts the file. With keepTotals, the totals of
+// each purged day are saved to daily_totals first and the rollups of the
+// purged days are kept, otherwise they're deleted too. A site that still has
+// a file of the other storage is purged there too.
+func PurgeSite(domain string, before time.Time, keepTotals bool) ([]*PurgeResult, error) {
+	file, err := helpers.GetDatabaseFileName(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := GetDatabase(file)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*PurgeResult, 0, 2)
+
+	result, err := d.Purge(before, keepTotals)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, result)
+
+	otherKind := STORE_SQLITE
+	if d.store.Kind() == STORE_SQLITE {
+		otherKind = STORE_DUCKDB
+	}
+	if _, err := os.Stat(StoreFileName(otherKind, file)); err != nil {
+		return results, nil
+	}
+
+	other, err := OpenStore(otherKind, file)
+	if err != nil {
+		return results, err
+	}
+	defer other.Close()
+
+	if _, err := Migrate(other); err != nil {
+		return results, err
+	}
+
+	result, err = purge(other, StoreFileName(otherKind, file), before, keepTotals)
+	if err != nil {
+		return results, fmt.Errorf("%s: %w", otherKind, err)
+	}
+	return append(results, result), nil
+}
+
+// Purge deletes the sessions that started before the cutoff and their events
+// from the site's store, then compacts it
+func (d *Database) Purge(before time.Time, keepTotals bool) (*PurgeResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.cache.clear()
+
+	return purge(d.store, d.file, before, keepTotals)
+}
+
+func purge(store Store, file string, before time.Time, keepTotals bool) (*PurgeResult, error) {
+	result := &PurgeResult{Store: store.Kind(), Before: before.UTC(), SizeBefore: fileSize(file)}
+
+	tx, err := store.DB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Times are stored in UTC, and SQLite compares them as text
+	cutoff := before.UTC()
+
+	if keepTotals {
+		if err := tx.QueryRow("SELECT COUNT(DISTINCT DATE_TRUNC('day', session_start)) FROM user_sessions WHERE session_start < ?", cutoff).Scan(&result.Days); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(saveDailyTotals, cutoff); err != nil {
+			return nil, fmt.Errorf("save daily totals: %w", err)
+		}
+	}
+
+	events, err := tx.Exec(`
+		DELETE FROM user_events
+		WHERE session_id IN (SELECT id FROM user_sessions WHERE session_start < ?)
+	`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	if result.Events, err = events.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	sessions, err := tx.Exec("DELETE FROM user_sessions WHERE session_start < ?", cutoff)
+	if err != nil {
+		return nil, err
+	}
+	if result.Sessions, err = sessions.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	if !keepTotals {
+		for _, table := range []string{"hourly_sessions", "hourly_pages", "daily_sessions", "daily_pages"} {
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE period < ?", table), cutoff); err != nil {
+				return nil, err
+			}
+		}
+		// The hour and day the cutoff falls in are only partly purged
+		if err := refreshRollups(tx, cutoff, cutoff); err != nil {
+			return nil, fmt.Errorf("update rollups: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// Nothing was freed, the file wouldn't get any smaller
+	if result.Sessions == 0 && result.Events == 0 {
+		result.SizeAfter = result.SizeBefore
+		return result, nil
+	}
+
+	if err := store.Compact(); err != nil {
+		return result, fmt.Errorf("compact: %w", err)
+	}
+	result.SizeAfter = fileSize(file)
+
+	return result, nil
+}
+
+// GetDailyTotals returns the saved totals of the purged days between from and
+// to
+func (d *Database) GetDailyTotals(from time.Time, to time.Time) ([]*DailyTotals, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.store.DB().Query(`
+		SELECT day, sessions, visitors, pageviews, bounces, duration
+		FROM daily_totals
+		WHERE day >= ? AND day < ?
+		ORDER BY day
+	`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make([]*DailyTotals, 0)
+	for rows.Next() {
+		var day timestamp
+		var t DailyTotals
+		if err := rows.Scan(&day, &t.Sessions, &t.Visitors, &t.PageViews, &t.Bounces, &t.Duration); err != nil {
+			return nil, err
+		}
+		t.Day = day.Time
+		totals = append(totals, &t)
+	}
+
+	return totals, rows.Err()
+}
+
+// fileSize is the size of a store's file, including its write-ahead log
+func fileSize(file string) int64 {
+	var size int64
+	for _, name := range []string{file, file + "-wal", file + ".wal"} {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
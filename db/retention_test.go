@@ -0,0 +1,187 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+// sessionsByPeriod returns the sessions of a rollup table, by period
+func sessionsByPeriod(t *testing.T, d *Database, table string) string {
+	t.Helper()
+
+	rows, err := d.store.DB().Query(fmt.Sprintf("SELECT period, CAST(SUM(sessions) AS BIGINT) FROM %s GROUP BY period ORDER BY period", table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	periods := ""
+	for rows.Next() {
+		var period timestamp
+		var sessions int64
+		if err := rows.Scan(&period, &sessions); err != nil {
+			t.Fatal(err)
+		}
+		periods += fmt.Sprintf("%s=%d ", period.Time.UTC().Format("2006-01-02T15"), sessions)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return periods
+}
+
+// writePurgeSessions writes a session the day before the cutoff, one right on
+// it and one after it
+func writePurgeSessions(t *testing.T, d *Database) {
+	writeSessions(t, d,
+		&UserSession{ID: "before", UserIdent: "u1", SessionStart: parseTime("2024-01-01T10:00:00Z"), Events: 2},
+		&UserSession{ID: "cutoff", UserIdent: "u2", SessionStart: parseTime("2024-01-02T00:00:00Z"), Events: 1},
+		&UserSession{ID: "after", UserIdent: "u3", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1},
+	)
+}
+
+// Sessions that started before the cutoff are purged with their events and
+// their rollups, those starting on it are kept
+func TestPurge(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writePurgeSessions(t, d)
+
+		result, err := d.Purge(day("2024-01-02"), false)
+		if err != nil {
+			t.Fatalf("Purge failed: %v", err)
+		}
+		if result.Sessions != 1 || result.Events != 2 || result.Days != 0 {
+			t.Errorf("Purge result was incorrect, got: %+v, want: 1 session, 2 events.", result)
+		}
+
+		if ids := storedIDs(t, d, "user_sessions"); ids != "after cutoff" {
+			t.Errorf("Sessions were incorrect, got: %s, want: after cutoff.", ids)
+		}
+		if ids := storedIDs(t, d, "user_events"); ids != "after-0 cutoff-0" {
+			t.Errorf("Events were incorrect, got: %s, want: after-0 cutoff-0.", ids)
+		}
+		if got, want := sessionsByPeriod(t, d, "hourly_sessions"), "2024-01-02T00=1 2024-01-02T10=1 "; got != want {
+			t.Errorf("hourly_sessions was incorrect, got: %s, want: %s.", got, want)
+		}
+		if got, want := sessionsByPeriod(t, d, "daily_sessions"), "2024-01-02T00=2 "; got != want {
+			t.Errorf("daily_sessions was incorrect, got: %s, want: %s.", got, want)
+		}
+	})
+}
+
+// With keepTotals, the purged days' totals are saved and their rollups kept
+func TestPurgeKeepTotals(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writePurgeSessions(t, d)
+
+		result, err := d.Purge(day("2024-01-02"), true)
+		if err != nil {
+			t.Fatalf("Purge failed: %v", err)
+		}
+		if result.Sessions != 1 || result.Days != 1 {
+			t.Errorf("Purge result was incorrect, got: %+v, want: 1 session, 1 day.", result)
+		}
+
+		if got, want := sessionsByPeriod(t, d, "daily_sessions"), "2024-01-01T00=1 2024-01-02T00=2 "; got != want {
+			t.Errorf("daily_sessions was incorrect, got: %s, want: %s.", got, want)
+		}
+
+		totals, err := d.GetDailyTotals(day("2024-01-01"), day("2024-01-03"))
+		if err != nil {
+			t.Fatalf("GetDailyTotals failed: %v", err)
+		}
+		if len(totals) != 1 || !totals[0].Day.Equal(day("2024-01-01")) || totals[0].Sessions != 1 || totals[0].Visitors != 1 ||
+			totals[0].PageViews != 2 || totals[0].Bounces != 0 || totals[0].Duration != 60 {
+			t.Errorf("Daily totals were incorrect, got: %+v, want: 2024-01-01 with 1 session, 1 visitor, 2 pageviews, 60s.", totals)
+		}
+	})
+}
+
+// A day purged in two passes adds up its sessions but keeps the larger count
+// of its distinct visitors
+func TestPurgeKeepTotalsTwice(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d,
+			&UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-01T08:00:00Z"), Events: 1},
+			&UserSession{ID: "s2", UserIdent: "u1", SessionStart: parseTime("2024-01-01T16:00:00Z"), Events: 1},
+		)
+
+		for _, before := range []string{"2024-01-01T12:00:00Z", "2024-01-02T00:00:00Z"} {
+			if _, err := d.Purge(parseTime(before), true); err != nil {
+				t.Fatalf("Purge failed: %v", err)
+			}
+		}
+
+		totals, err := d.GetDailyTotals(day("2024-01-01"), day("2024-01-02"))
+		if err != nil {
+			t.Fatalf("GetDailyTotals failed: %v", err)
+		}
+		if len(totals) != 1 || totals[0].Sessions != 2 || totals[0].Visitors != 1 || totals[0].PageViews != 2 {
+			t.Errorf("Daily totals were incorrect, got: %+v, want: 2 sessions, 1 visitor, 2 pageviews.", totals)
+		}
+	})
+}
+
+// The hour and the day the cutoff falls in are recomputed from the sessions
+// that are left
+func TestPurgePartialHour(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d,
+			&UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:10:00Z"), Events: 1},
+			&UserSession{ID: "s2", UserIdent: "u2", SessionStart: parseTime("2024-01-02T10:50:00Z"), Events: 1},
+			&UserSession{ID: "s3", UserIdent: "u3", SessionStart: parseTime("2024-01-02T12:00:00Z"), Events: 1},
+		)
+
+		if _, err := d.Purge(parseTime("2024-01-02T10:30:00Z"), false); err != nil {
+			t.Fatalf("Purge failed: %v", err)
+		}
+
+		if got, want := sessionsByPeriod(t, d, "hourly_sessions"), "2024-01-02T10=1 2024-01-02T12=1 "; got != want {
+			t.Errorf("hourly_sessions was incorrect, got: %s, want: %s.", got, want)
+		}
+		if got, want := sessionsByPeriod(t, d, "daily_sessions"), "2024-01-02T00=2 "; got != want {
+			t.Errorf("daily_sessions was incorrect, got: %s, want: %s.", got, want)
+		}
+	})
+}
+
+// A site that still has a file of the other storage is purged there too
+func TestPurgeSite(t *testing.T) {
+	file := setupSite(t, STORE_SQLITE)
+
+	other, err := OpenStore(STORE_DUCKDB, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(other); err != nil {
+		t.Fatal(err)
+	}
+	writePurgeSessions(t, &Database{store: other})
+	other.Close()
+
+	d, err := GetDatabase(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePurgeSessions(t, d)
+
+	results, err := PurgeSite("a.com", day("2024-01-02"), false)
+	if err != nil {
+		t.Fatalf("PurgeSite failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Store != STORE_SQLITE || results[1].Store != STORE_DUCKDB || results[1].Sessions != 1 {
+		t.Errorf("PurgeSite results were incorrect, got: %d results, want: 1 session purged from sqlite and duckdb.", len(results))
+	}
+
+	other, err = OpenStore(STORE_DUCKDB, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if ids := storedIDs(t, &Database{store: other}, "user_sessions"); ids != "after cutoff" {
+		t.Errorf("DuckDB sessions were incorrect, got: %s, want: after cutoff.", ids)
+	}
+	if ids := storedIDs(t, d, "user_sessions"); ids != "after cutoff" {
+		t.Errorf("SQLite sessions were incorrect, got: %s, want: after cutoff.", ids)
+	}
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// The rollups keep the sessions and pageviews of each hour and day, split by
+// the dimensions the dashboard groups by, so long periods don't have to scan
+// the raw tables. Like the dashboard queries, rows count sessions by the hour
+// they started in. An hour is recomputed from the raw tables whenever one of
+// its sessions changes, and its day is then summed up from the hours.
+
+const sessionRollupColumns = `
+	period, browser, browser_major, os, os_major, country, referer,
+	sessions, bounces, duration, pageviews, browser_drillable, os_drillable, referer_drillable
+`
+
+const pageRollupColumns = "period, page, pageviews"
+
+// sessionRollupRows sums the raw sessions matching where into hourly
+// sessions rollup rows
+func sessionRollupRows(where string) string {
+	return fmt.Sprintf(`
+		SELECT
+			DATE_TRUNC('hour', user_sessions.session_start) AS period,
+			user_sessions.browser, user_sessions.browser_major, user_sessions.os, user_sessions.os_major,
+			user_sessions.country, user_sessions.referer,
+			COUNT(*) AS sessions,
+			SUM(CASE WHEN (epoch(user_sessions.session_end) - epoch(user_sessions.session_start)) = 0.0 THEN 1 ELSE 0 END) AS bounces,
+			SUM(epoch(user_sessions.session_end) - epoch(user_sessions.session_start)) AS duration,
+			SUM(user_sessions.pageviews) AS pageviews,
+			SUM(CASE WHEN user_sessions.browser_minor <> '' AND user_sessions.browser_minor <> '0' THEN 1 ELSE 0 END) AS browser_drillable,
+			SUM(CASE WHEN user_sessions.os_minor <> '' AND user_sessions.os_minor <> '0' THEN 1 ELSE 0 END) AS os_drillable,
+			SUM(CASE WHEN user_sessions.referer_full_path <> '' THEN 1 ELSE 0 END) AS referer_drillable
+		FROM (
+			SELECT
+				user_sessions.*,
+				(SELECT COUNT(*) FROM user_events WHERE user_events.session_id = user_sessions.id AND user_events.name = 'pageview') AS pageviews
+			FROM user_sessions
+			WHERE %s
+		) AS user_sessions
+		GROUP BY
+			DATE_TRUNC('hour', user_sessions.session_start),
+			user_sessions.browser, user_sessions.browser_major, user_sessions.os, user_sessions.os_major,
+			user_sessions.country, user_sessions.referer
+	`, where)
+}
+
+// pageRollupRows sums the pageviews of the raw sessions matching where into
+// hourly pages rollup rows
+func pageRollupRows(where string) string {
+	return fmt.Sprintf(`
+		SELECT
+			DATE_TRUNC('hour', user_sessions.session_start) AS period,
+			user_events.page,
+			COUNT(*) AS pageviews
+		FROM user_events
+		JOIN user_sessions ON user_sessions.id = user_events.session_id
+		WHERE user_events.name = 'pageview' AND %s
+		GROUP BY DATE_TRUNC('hour', user_sessions.session_start), user_events.page
+	`, where)
+}
+
+const dailySessionRollupRows = `
+	SELECT
+		DATE_TRUNC('day', period), browser, browser_major, os, os_major, country, referer,
+		SUM(sessions), SUM(bounces), SUM(duration), SUM(pageviews),
+		SUM(browser_drillable), SUM(os_drillable), SUM(referer_drillable)
+	FROM hourly_sessions
+	WHERE period >= ? AND period < ?
+	GROUP BY DATE_TRUNC('day', period), browser, browser_major, os, os_major, country, referer
+`
+
+const dailyPageRollupRows = `
+	SELECT DATE_TRUNC('day', period), page, SUM(pageviews)
+	FROM hourly_pages
+	WHERE period >= ? AND period < ?
+	GROUP BY DATE_TRUNC('day', period), page
+`
+
+// ceilTime rounds t up to a multiple of d
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	if truncated := t.Truncate(d); !truncated.Equal(t) {
+		return truncated.Add(d)
+	}
+	return t
+}
+
+// execer runs statements in a transaction of either store, a *sql.Tx or a
+// connection a transaction was begun on
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// refreshRollups recomputes the rollups of the hours from from to to from the
+// raw tables, and then the days they're in
+func refreshRollups(tx execer, from time.Time, to time.Time) error {
+	from = from.UTC().Truncate(time.Hour)
+	to = ceilTime(to.UTC(), time.Hour)
+	if !to.After(from) {
+		to = from.Add(time.Hour)
+	}
+	dayFrom := from.Truncate(24 * time.Hour)
+	dayTo := ceilTime(to, 24*time.Hour)
+
+	sessionsInRange := "user_sessions.session_start >= ? AND user_sessions.session_start < ?"
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM hourly_sessions WHERE period >= ? AND period < ?", []interface{}{from, to}},
+		{"INSERT INTO hourly_sessions (" + sessionRollupColumns + ") " + sessionRollupRows(sessionsInRange), []interface{}{from, to}},
+		{"DELETE FROM hourly_pages WHERE period >= ? AND period < ?", []interface{}{from, to}},
+		{"INSERT INTO hourly_pages (" + pageRollupColumns + ") " + pageRollupRows(sessionsInRange), []interface{}{from, to}},
+		{"DELETE FROM daily_sessions WHERE period >= ? AND period < ?", []interface{}{dayFrom, dayTo}},
+		{"INSERT INTO daily_sessions (" + sessionRollupColumns + ") " + dailySessionRollupRows, []interface{}{dayFrom, dayTo}},
+		{"DELETE FROM daily_pages WHERE period >= ? AND period < ?", []interface{}{dayFrom, dayTo}},
+		{"INSERT INTO daily_pages (" + pageRollupColumns + ") " + dailyPageRollupRows, []interface{}{dayFrom, dayTo}},
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(context.Background(), statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshStoreRollups recomputes the rollups between from and to in their
+// own transaction
+func refreshStoreRollups(store Store, from time.Time, to time.Time) error {
+	tx, err := store.DB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := refreshRollups(tx, from, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sessionHours returns the hours the sessions started in
+func sessionHours(sessions []*UserSession) map[time.Time]bool {
+	hours := make(map[time.Time]bool)
+	for _, session := range sessions {
+		hours[session.SessionStart.UTC().Truncate(time.Hour)] = true
+	}
+	return hours
+}
+
+// refreshHourRollups recomputes the rollups of the hours, consecutive hours
+// together
+func refreshHourRollups(tx execer, hours map[time.Time]bool) error {
+	sorted := make([]time.Time, 0, len(hours))
+	for hour := range hours {
+		sorted = append(sorted, hour)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Before(sorted[j])
+	})
+
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && sorted[j].Equal(sorted[j-1].Add(time.Hour)) {
+			j++
+		}
+		if err := refreshRollups(tx, sorted[i], sorted[j-1].Add(time.Hour)); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// RebuildRollups recomputes the rollups of every hour the store has sessions
+// in. Rollups of purged days that were kept are left alone.
+func RebuildRollups(store Store) error {
+	var count int64
+	if err := store.DB().QueryRow("SELECT COUNT(*) FROM user_sessions").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	var first, last timestamp
+	if err := store.DB().QueryRow("SELECT MIN(session_start), MAX(session_start) FROM user_sessions").Scan(&first, &last); err != nil {
+		return err
+	}
+
+	return refreshStoreRollups(store, first.Time, last.Time.Add(time.Hour))
+}
+
+// backfillRollups builds the rollups of a store that has sessions but no
+// rollups yet, because it was created before they existed or converted
+func (d *Database) backfillRollups() error {
+	var sessions, rollups int64
+	err := d.store.DB().QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM (SELECT id FROM user_sessions LIMIT 1) AS s),
+			(SELECT COUNT(*) FROM (SELECT period FROM hourly_sessions LIMIT 1) AS r)
+	`).Scan(&sessions, &rollups)
+	if err != nil {
+		return err
+	}
+	if sessions == 0 || rollups > 0 {
+		return nil
+	}
+
+	log.Printf("Building the rollups of %s...", d.file)
+	return RebuildRollups(d.store)
+}
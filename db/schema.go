@@ -84,6 +84,34 @@ func (UserSessionDuckDB) TableName() string {
 	return "user_sessions"
 }
 
+// UserSession converts a queried session to the model batches write
+func (s *UserSessionDuckDB) UserSession() *UserSession {
+	return &UserSession{
+		Model: gorm.Model{
+			CreatedAt: s.CreatedAt,
+			UpdatedAt: s.UpdatedAt,
+		},
+		ID:              s.ID,
+		UserIdent:       s.UserIdent,
+		Browser:         s.Browser,
+		BrowserMajor:    s.BrowserMajor,
+		BrowserMinor:    s.BrowserMinor,
+		BrowserPatch:    s.BrowserPatch,
+		OS:              s.OS,
+		OSMajor:         s.OSMajor,
+		OSMinor:         s.OSMinor,
+		OSPatch:         s.OSPatch,
+		Country:         s.Country,
+		UserAgent:       s.UserAgent,
+		Referer:         s.Referer,
+		RefererFullPath: s.RefererFullPath,
+		SessionStart:    s.SessionStart,
+		SessionEnd:      s.SessionEnd,
+		ScreenWidth:     s.ScreenWidth,
+		Events:          s.Events,
+	}
+}
+
 type UserEventDuckDB struct {
 	ID        string    `gorm:"primaryKey;column:id"`
 	CreatedAt time.Time `gorm:"column:created_at"`
@@ -97,9 +125,3 @@ type UserEventDuckDB struct {
 func (UserEventDuckDB) TableName() string {
 	return "user_events"
 }
-
-type QueryFilters struct {
-	Browser      *string
-	BrowserMajor *string
-	BrowserMinor *string
-}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SESSION_LIST_LIMIT is how many sessions a page has when the query has no
+// limit
+const SESSION_LIST_LIMIT = 20
+
+// sessionSortOrders maps a query's sort to an ORDER BY clause
+var sessionSortOrders = map[string]string{
+	"newest":   "user_sessions.session_start DESC",
+	"oldest":   "user_sessions.session_start ASC",
+	"duration": "(epoch(user_sessions.session_end) - epoch(user_sessions.session_start)) DESC, user_sessions.session_start DESC",
+	"events":   "user_sessions.events DESC, user_sessions.session_start DESC",
+}
+
+const sessionColumns = `
+	user_sessions.id, user_sessions.created_at, user_sessions.updated_at, user_sessions.user_ident,
+	user_sessions.browser, user_sessions.browser_major, user_sessions.browser_minor, user_sessions.browser_patch,
+	user_sessions.os, user_sessions.os_major, user_sessions.os_minor, user_sessions.os_patch,
+	user_sessions.country, user_sessions.user_agent, user_sessions.referer, user_sessions.referer_full_path,
+	user_sessions.session_start, user_sessions.session_end, user_sessions.screen_width, user_sessions.events
+`
+
+// eventColumns are the columns of user_events, in the order scanEvent reads
+// them
+const eventColumns = "id, created_at, updated_at, name, page, event_time, session_id"
+
+// columnNames strips the table name off columns
+func columnNames(columns string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(columns, "user_sessions.", "")), " ")
+}
+
+func scanSession(scanner interface{ Scan(...interface{}) error }) (*UserSessionDuckDB, error) {
+	var session UserSessionDuckDB
+	err := scanner.Scan(
+		&session.ID, &session.CreatedAt, &session.UpdatedAt, &session.UserIdent,
+		&session.Browser, &session.BrowserMajor, &session.BrowserMinor, &session.BrowserPatch,
+		&session.OS, &session.OSMajor, &session.OSMinor, &session.OSPatch,
+		&session.Country, &session.UserAgent, &session.Referer, &session.RefererFullPath,
+		&session.SessionStart, &session.SessionEnd, &session.ScreenWidth, &session.Events,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetSessionList returns the query's page of matching sessions, along with the
+// total number of matching sessions. The page filter keeps sessions that
+// viewed the page at some point.
+func (d *Database) GetSessionList(ctx context.Context, q Query) ([]*UserSessionDuckDB, int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	conditions, args := buildFilters(q, false)
+
+	if q.Filters.Page != nil {
+		conditions = append(conditions, "user_sessions.id IN (SELECT session_id FROM user_events WHERE page = ?)")
+		args = append(args, *q.Filters.Page)
+	}
+
+	where := strings.Join(conditions, " AND ")
+
+	var total int64
+	err := d.store.DB().QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM user_sessions WHERE %s", where), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	orderBy, exists := sessionSortOrders[q.Sort]
+	if !exists {
+		orderBy = sessionSortOrders["newest"]
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM user_sessions
+		WHERE %s
+		ORDER BY %s
+		LIMIT ? OFFSET ?
+	`, sessionColumns, where, orderBy)
+
+	limit := q.LimitOr(SESSION_LIST_LIMIT)
+	rows, err := d.store.DB().QueryContext(ctx, query, append(args, limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*UserSessionDuckDB, 0, limit)
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, total, rows.Err()
+}
+
+// GetSession returns nil when there is no session with the given id
+func (d *Database) GetSession(id string) (*UserSessionDuckDB, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	row := d.store.DB().QueryRow(fmt.Sprintf("SELECT %s FROM user_sessions WHERE user_sessions.id = ?", sessionColumns), id)
+
+	session, err := scanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+// GetSessionEvents returns the events of a session in the order they happened
+func (d *Database) GetSessionEvents(id string) ([]*UserEventDuckDB, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.store.DB().Query(`
+		SELECT id, created_at, updated_at, name, page, event_time, session_id
+		FROM user_events
+		WHERE session_id = ?
+		ORDER BY event_time
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*UserEventDuckDB, 0)
+	for rows.Next() {
+		var event UserEventDuckDB
+		if err := rows.Scan(&event.ID, &event.CreatedAt, &event.UpdatedAt, &event.Name, &event.Page, &event.EventTime, &event.SessionID); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+func (d *Database) CountSessionsStartedBetween(from time.Time, to time.Time) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var count int64
+	err := d.store.DB().QueryRow("SELECT COUNT(*) FROM user_sessions WHERE session_start >= ? AND session_start < ?", from, to).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// registerSQLiteFunctions adds the DuckDB functions the dashboard queries use
+// to a SQLite connection, so the same SQL runs on both stores. SQLite keeps
+// timestamps as text, the functions parse it the way the driver does.
+func registerSQLiteFunctions(conn *sqlite3.SQLiteConn) error {
+	functions := map[string]interface{}{
+		"epoch":      sqliteEpoch,
+		"date_trunc": sqliteDateTrunc,
+		"datediff":   sqliteDateDiff,
+		"local_time": sqliteLocalTime,
+	}
+	for name, impl := range functions {
+		if err := conn.RegisterFunc(name, impl, true); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.RegisterAggregator("median", newMedianAggregator, true); err != nil {
+		return err
+	}
+	return conn.RegisterAggregator("arg_min", newArgMinAggregator, true)
+}
+
+// parseSQLiteTime reads a timestamp the way the driver stored it
+func parseSQLiteTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case []byte:
+		return parseSQLiteTime(string(v))
+	case string:
+		for _, format := range sqlite3.SQLiteTimestampFormats {
+			if t, err := time.ParseInLocation(format, v, time.UTC); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", v)
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", value)
+	}
+}
+
+// timestamp scans a computed time on either store, SQLite returns the result
+// of its date functions as text
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) Scan(value interface{}) error {
+	parsed, err := parseSQLiteTime(value)
+	t.Time = parsed
+	return err
+}
+
+func formatSQLiteTime(t time.Time) string {
+	return t.UTC().Format(sqlite3.SQLiteTimestampFormats[0])
+}
+
+// sqliteEpoch is epoch(timestamp): seconds since the Unix epoch
+func sqliteEpoch(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	t, err := parseSQLiteTime(value)
+	if err != nil {
+		return nil, err
+	}
+	return float64(t.UnixMicro()) / 1e6, nil
+}
+
+// sqliteDateTrunc is date_trunc(unit, timestamp) for hours, days, weeks
+// (starting on Monday, like DuckDB) and months
+func sqliteDateTrunc(unit string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	t, err := parseSQLiteTime(value)
+	if err != nil {
+		return nil, err
+	}
+
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch unit {
+	case "hour":
+		return formatSQLiteTime(t.Truncate(time.Hour)), nil
+	case "day":
+		return formatSQLiteTime(day), nil
+	case COHORT_WEEK:
+		return formatSQLiteTime(day.AddDate(0, 0, -(int(day.Weekday())+6)%7)), nil
+	case COHORT_MONTH:
+		return formatSQLiteTime(day.AddDate(0, 0, 1-day.Day())), nil
+	default:
+		return nil, fmt.Errorf("date_trunc: unsupported unit %q", unit)
+	}
+}
+
+// sqliteLocalTime is local_time(timestamp, zone), see localTime
+func sqliteLocalTime(value interface{}, zone string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	t, err := parseSQLiteTime(value)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := localTime(t, zone)
+	if err != nil {
+		return nil, err
+	}
+	return formatSQLiteTime(local), nil
+}
+
+// sqliteDateDiff is datediff(unit, start, end) for weeks and months
+func sqliteDateDiff(unit string, startValue interface{}, endValue interface{}) (interface{}, error) {
+	if startValue == nil || endValue == nil {
+		return nil, nil
+	}
+	start, err := parseSQLiteTime(startValue)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseSQLiteTime(endValue)
+	if err != nil {
+		return nil, err
+	}
+
+	switch unit {
+	case COHORT_WEEK:
+		return int64(end.Sub(start).Hours() / (24 * 7)), nil
+	case COHORT_MONTH:
+		return int64((end.Year()-start.Year())*12 + int(end.Month()) - int(start.Month())), nil
+	default:
+		return nil, fmt.Errorf("datediff: unsupported unit %q", unit)
+	}
+}
+
+type medianAggregator struct {
+	values []float64
+}
+
+func newMedianAggregator() *medianAggregator {
+	return &medianAggregator{}
+}
+
+func (m *medianAggregator) Step(value interface{}) {
+	switch v := value.(type) {
+	case int64:
+		m.values = append(m.values, float64(v))
+	case float64:
+		m.values = append(m.values, v)
+	}
+}
+
+func (m *medianAggregator) Done() interface{} {
+	if len(m.values) == 0 {
+		return nil
+	}
+
+	sort.Float64s(m.values)
+	middle := len(m.values) / 2
+	if len(m.values)%2 == 0 {
+		return (m.values[middle-1] + m.values[middle]) / 2
+	}
+	return m.values[middle]
+}
+
+// argMinAggregator is arg_min(value, by): the value of the row with the
+// smallest by
+type argMinAggregator struct {
+	value interface{}
+	by    float64
+	found bool
+}
+
+func newArgMinAggregator() *argMinAggregator {
+	return &argMinAggregator{}
+}
+
+func (a *argMinAggregator) Step(value interface{}, by interface{}) {
+	var key float64
+	switch v := by.(type) {
+	case int64:
+		key = float64(v)
+	case float64:
+		key = v
+	default:
+		return
+	}
+
+	if !a.found || key < a.by {
+		a.value = value
+		a.by = key
+		a.found = true
+	}
+}
+
+func (a *argMinAggregator) Done() interface{} {
+	return a.value
+}
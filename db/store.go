@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	STORE_DUCKDB = "duckdb"
+	STORE_SQLITE = "sqlite"
+)
+
+// Store is the database a site's sessions and events are kept in. Queries are
+// plain SQL run on DB(), written so they work on either engine. The few
+// functions only DuckDB has are registered on the SQLite connections. The
+// schema is kept up to date by Migrate.
+type Store interface {
+	Kind() string
+	DB() *sql.DB
+	// WriteBatch writes the batch's new and updated sessions, its events and
+	// the rollups of their hours in one transaction
+	WriteBatch(b *Batch) error
+	// ReplaceSessions replaces the sessions of a replacing batch's period and
+	// their events with the batch's, in one transaction with their rollups
+	ReplaceSessions(b *Batch) error
+	// Compact gives the space of deleted rows back to the file system. Must
+	// be called while holding the database lock.
+	Compact() error
+	// Backup writes a consistent snapshot of the store into dir while it
+	// stays open for writes, see restoreStore for reading it back
+	Backup(dir string) error
+	// ReadOnly returns a connection that can't write, for queries the app
+	// didn't write itself. release gives it back.
+	ReadOnly(ctx context.Context) (conn *sql.Conn, release func(), err error)
+	Close() error
+}
+
+// OpenStore opens the store of the given kind for a site. file is the site's
+// database file name, DuckDB keeps its data next to it in a .duckdb file.
+func OpenStore(kind string, file string) (Store, error) {
+	switch kind {
+	case STORE_DUCKDB:
+		return openDuckDBStore(StoreFileName(kind, file))
+	case STORE_SQLITE:
+		return openSQLiteStore(StoreFileName(kind, file))
+	default:
+		return nil, fmt.Errorf("unknown storage %q, expected %q or %q", kind, STORE_DUCKDB, STORE_SQLITE)
+	}
+}
+
+// StoreFileName returns the file a store of the given kind keeps its data in
+func StoreFileName(kind string, file string) string {
+	if kind == STORE_DUCKDB {
+		return strings.Replace(file, ".db", ".duckdb", 1)
+	}
+	return file
+}
+
+// placeholders returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
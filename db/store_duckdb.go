@@ -0,0 +1,312 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// duckdbStore keeps everything in a DuckDB file, using raw database/sql (no
+// GORM). Columnar storage makes the dashboard queries fast.
+type duckdbStore struct {
+	db   *sql.DB
+	file string
+
+	// Held by read only connections, which don't take the database lock, so
+	// Compact doesn't swap the file under them
+	readers sync.RWMutex
+}
+
+func openDuckDBStore(file string) (*duckdbStore, error) {
+	db, err := openDuckDB(file)
+	if err != nil {
+		return nil, err
+	}
+	return &duckdbStore{db: db, file: file}, nil
+}
+
+func openDuckDB(file string) (*sql.DB, error) {
+	db, err := sql.Open("duckdb", file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DuckDB database: %w", err)
+	}
+
+	// Set DuckDB connection pool settings
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(time.Hour)
+
+	if err := registerDuckDBFunctions(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to register DuckDB functions: %w", err)
+	}
+
+	return db, nil
+}
+
+func (s *duckdbStore) Kind() string {
+	return STORE_DUCKDB
+}
+
+func (s *duckdbStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *duckdbStore) Close() error {
+	return s.db.Close()
+}
+
+// ReadOnly returns a connection in a read only transaction, which is rolled
+// back when it's released. A second, read only DuckDB instance can't safely
+// open a file this process is writing to.
+func (s *duckdbStore) ReadOnly(ctx context.Context) (*sql.Conn, func(), error) {
+	s.readers.RLock()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		s.readers.RUnlock()
+		return nil, nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN TRANSACTION READ ONLY"); err != nil {
+		conn.Close()
+		s.readers.RUnlock()
+		return nil, nil, err
+	}
+
+	release := func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		s.readers.RUnlock()
+	}
+	return conn, release, nil
+}
+
+// Compact copies the database into a new file and swaps it in. DuckDB reuses
+// the blocks of deleted rows but never shrinks its file.
+func (s *duckdbStore) Compact() error {
+	compacted := s.file + ".compact"
+	os.Remove(compacted)
+
+	var name string
+	if err := s.db.QueryRow("SELECT current_database()").Scan(&name); err != nil {
+		return err
+	}
+
+	// ATTACH and COPY FROM DATABASE have to run on the same connection
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	copyErr := func() error {
+		if _, err := conn.ExecContext(context.Background(), fmt.Sprintf("ATTACH '%s' AS compacted", strings.ReplaceAll(compacted, "'", "''"))); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(context.Background(), fmt.Sprintf(`COPY FROM DATABASE "%s" TO compacted`, strings.ReplaceAll(name, `"`, `""`))); err != nil {
+			conn.ExecContext(context.Background(), "DETACH compacted")
+			return err
+		}
+		_, err := conn.ExecContext(context.Background(), "DETACH compacted")
+		return err
+	}()
+	conn.Close()
+	if copyErr != nil {
+		os.Remove(compacted)
+		return copyErr
+	}
+
+	// Waits for the read only connections still on the old file
+	s.readers.Lock()
+	defer s.readers.Unlock()
+
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(compacted, s.file)
+
+	// Reopened whether or not the new file could be moved in place
+	db, err := openDuckDB(s.file)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return renameErr
+}
+
+// WriteBatch appends the new rows, updates the existing sessions and their
+// rollups on a single connection, inside one transaction. Must be called while
+// holding the database lock.
+func (store *duckdbStore) WriteBatch(b *Batch) (err error) {
+	ctx := context.Background()
+
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN TRANSACTION"); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	created := make([]*UserSession, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		if b.created[s.ID] {
+			created = append(created, s)
+		}
+	}
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		return appendRows(driverConn.(driver.Conn), "user_sessions", created, "user_events", b.events)
+	})
+	if err != nil {
+		return err
+	}
+
+	updateSQL := `
+		UPDATE user_sessions SET
+			created_at = ?, updated_at = ?, user_ident = ?, browser = ?, browser_major = ?,
+			browser_minor = ?, browser_patch = ?, os = ?, os_major = ?, os_minor = ?,
+			os_patch = ?, country = ?, user_agent = ?, referer = ?, referer_full_path = ?,
+			session_start = ?, session_end = ?, screen_width = ?, events = ?
+		WHERE id = ?
+	`
+
+	for _, s := range b.sessions {
+		if b.created[s.ID] {
+			continue
+		}
+		_, err = conn.ExecContext(ctx, updateSQL,
+			s.CreatedAt, s.UpdatedAt, s.UserIdent, s.Browser, s.BrowserMajor,
+			s.BrowserMinor, s.BrowserPatch, s.OS, s.OSMajor, s.OSMinor,
+			s.OSPatch, s.Country, s.UserAgent, s.Referer, s.RefererFullPath,
+			s.SessionStart, s.SessionEnd, s.ScreenWidth, s.Events,
+			s.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("update session %s: %w", s.ID, err)
+		}
+	}
+
+	if err = b.writeRollups(conn); err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+// ReplaceSessions appends the batch's rows to temporary tables, and replaces
+// the rows of its period with them, on a single connection inside one
+// transaction. Must be called while holding the database lock.
+func (store *duckdbStore) ReplaceSessions(b *Batch) (err error) {
+	ctx := context.Background()
+
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN TRANSACTION"); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	for _, create := range []string{
+		fmt.Sprintf("CREATE TEMP TABLE rebuilt_sessions AS SELECT %s FROM user_sessions LIMIT 0", sessionColumns),
+		fmt.Sprintf("CREATE TEMP TABLE rebuilt_events AS SELECT %s FROM user_events LIMIT 0", eventColumns),
+	} {
+		if _, err = conn.ExecContext(ctx, create); err != nil {
+			return err
+		}
+	}
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		return appendRows(driverConn.(driver.Conn), "rebuilt_sessions", b.sessions, "rebuilt_events", b.events)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = b.replaceRows(conn); err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+// appendRows appends sessions and events to the given tables, which have the
+// columns of user_sessions and user_events
+func appendRows(conn driver.Conn, sessionTable string, sessions []*UserSession, eventTable string, events []*UserEvent) error {
+	appender, err := duckdb.NewAppenderFromConn(conn, "", sessionTable)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		err := appender.AppendRow(
+			s.ID, s.CreatedAt, s.UpdatedAt, s.UserIdent, s.Browser, s.BrowserMajor, s.BrowserMinor,
+			s.BrowserPatch, s.OS, s.OSMajor, s.OSMinor, s.OSPatch, s.Country, s.UserAgent,
+			s.Referer, s.RefererFullPath, s.SessionStart, s.SessionEnd, s.ScreenWidth, s.Events,
+		)
+		if err != nil {
+			appender.Close()
+			return fmt.Errorf("append session %s: %w", s.ID, err)
+		}
+	}
+	if err := appender.Close(); err != nil {
+		return err
+	}
+
+	appender, err = duckdb.NewAppenderFromConn(conn, "", eventTable)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := appender.AppendRow(e.ID, e.CreatedAt, e.UpdatedAt, e.Name, e.Page, e.EventTime, e.SessionID); err != nil {
+			appender.Close()
+			return fmt.Errorf("append event %s: %w", e.ID, err)
+		}
+	}
+	return appender.Close()
+}
+
+// DUCKDB_BACKUP_FOLDER is the folder a DuckDB snapshot is exported to
+const DUCKDB_BACKUP_FOLDER = "duckdb"
+
+// Backup exports the database into dir as Parquet files, with the schema to
+// recreate it. The export reads a single transaction's view of the data.
+func (s *duckdbStore) Backup(dir string) error {
+	export := filepath.Join(dir, DUCKDB_BACKUP_FOLDER)
+	_, err := s.db.Exec(fmt.Sprintf("EXPORT DATABASE '%s' (FORMAT PARQUET)", strings.ReplaceAll(export, "'", "''")))
+	return err
+}
+
+// restoreDuckDB creates file from a snapshot's export
+func restoreDuckDB(dir string, file string) error {
+	db, err := openDuckDB(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	export := filepath.Join(dir, DUCKDB_BACKUP_FOLDER)
+	_, err = db.Exec(fmt.Sprintf("IMPORT DATABASE '%s'", strings.ReplaceAll(export, "'", "''")))
+	return err
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// Connections opened with this driver have the DuckDB functions used by the
+// queries registered, see sqlite_functions.go
+const SQLITE_DRIVER_NAME = "sqlite3_tinylytics"
+
+var registerSQLiteDriver sync.Once
+
+// sqliteStore keeps everything in a SQLite file, with GORM for the writes.
+// Row storage with full indexing is slower to query than DuckDB, but it's a
+// single, widely supported file.
+type sqliteStore struct {
+	gorm *gorm.DB
+	db   *sql.DB
+	file string
+
+	// Opened the first time it's needed, see ReadOnly
+	readOnly     *sql.DB
+	readOnlyErr  error
+	readOnlyOnce sync.Once
+}
+
+func openSQLiteStore(file string) (*sqliteStore, error) {
+	registerSQLiteDriver.Do(func() {
+		sql.Register(SQLITE_DRIVER_NAME, &sqlite3.SQLiteDriver{ConnectHook: registerSQLiteFunctions})
+	})
+
+	gormDB, err := gorm.Open(sqlite.Dialector{
+		DriverName: SQLITE_DRIVER_NAME,
+		DSN:        "file:" + file + "?cache=shared&mode=rwc&_journal_mode=WAL&_timeout=30000",
+	}, &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent), // Disable GORM logs
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SQLite database: %w", err)
+	}
+
+	db, err := gormDB.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	// Set SQLite connection pool settings
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(time.Hour)
+
+	return &sqliteStore{gorm: gormDB, db: db, file: file}, nil
+}
+
+func (s *sqliteStore) Kind() string {
+	return STORE_SQLITE
+}
+
+func (s *sqliteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *sqliteStore) Close() error {
+	if s.readOnly != nil {
+		s.readOnly.Close()
+	}
+	return s.db.Close()
+}
+
+// ReadOnly returns a connection of a separate pool that opens the file read
+// only, with writes disabled on top
+func (s *sqliteStore) ReadOnly(ctx context.Context) (*sql.Conn, func(), error) {
+	s.readOnlyOnce.Do(func() {
+		s.readOnly, s.readOnlyErr = sql.Open(SQLITE_DRIVER_NAME, "file:"+s.file+"?mode=ro&_query_only=true&_timeout=30000")
+		if s.readOnlyErr == nil {
+			s.readOnly.SetMaxOpenConns(2)
+			s.readOnly.SetConnMaxLifetime(time.Hour)
+		}
+	})
+	if s.readOnlyErr != nil {
+		return nil, nil, s.readOnlyErr
+	}
+
+	conn, err := s.readOnly.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { conn.Close() }, nil
+}
+
+// Compact rebuilds the file without its free pages, then empties the WAL
+func (s *sqliteStore) Compact() error {
+	if _, err := s.db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// WriteBatch writes the batch and its rollups in one transaction. Must be
+// called while holding the database lock.
+func (s *sqliteStore) WriteBatch(b *Batch) error {
+	return s.gorm.Transaction(func(tx *gorm.DB) error {
+		for _, session := range b.sessions {
+			if b.created[session.ID] {
+				if err := tx.Create(session).Error; err != nil {
+					return fmt.Errorf("create session %s: %w", session.ID, err)
+				}
+				continue
+			}
+			if err := tx.Save(session).Error; err != nil {
+				return fmt.Errorf("update session %s: %w", session.ID, err)
+			}
+		}
+
+		if len(b.events) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&b.events).Error; err != nil {
+				return fmt.Errorf("create events: %w", err)
+			}
+		}
+
+		return b.writeRollups(tx.Statement.ConnPool)
+	})
+}
+
+// ReplaceSessions inserts the batch's rows into temporary tables, and
+// replaces the rows of its period with them, in one transaction. Must be
+// called while holding the database lock.
+func (s *sqliteStore) ReplaceSessions(b *Batch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	columns := columnNames(sessionColumns)
+	for _, create := range []string{
+		fmt.Sprintf("CREATE TEMP TABLE rebuilt_sessions AS SELECT %s FROM user_sessions LIMIT 0", columns),
+		fmt.Sprintf("CREATE TEMP TABLE rebuilt_events AS SELECT %s FROM user_events LIMIT 0", eventColumns),
+	} {
+		if _, err := tx.Exec(create); err != nil {
+			return err
+		}
+	}
+
+	insertSession, err := tx.Prepare(fmt.Sprintf("INSERT INTO rebuilt_sessions (%s) VALUES (%s)", columns, placeholders(20)))
+	if err != nil {
+		return err
+	}
+	defer insertSession.Close()
+
+	for _, session := range b.sessions {
+		_, err := insertSession.Exec(
+			session.ID, session.CreatedAt, session.UpdatedAt, session.UserIdent, session.Browser, session.BrowserMajor, session.BrowserMinor,
+			session.BrowserPatch, session.OS, session.OSMajor, session.OSMinor, session.OSPatch, session.Country, session.UserAgent,
+			session.Referer, session.RefererFullPath, session.SessionStart, session.SessionEnd, session.ScreenWidth, session.Events,
+		)
+		if err != nil {
+			return fmt.Errorf("insert session %s: %w", session.ID, err)
+		}
+	}
+
+	insertEvent, err := tx.Prepare(fmt.Sprintf("INSERT INTO rebuilt_events (%s) VALUES (%s)", eventColumns, placeholders(7)))
+	if err != nil {
+		return err
+	}
+	defer insertEvent.Close()
+
+	for _, event := range b.events {
+		if _, err := insertEvent.Exec(event.ID, event.CreatedAt, event.UpdatedAt, event.Name, event.Page, event.EventTime, event.SessionID); err != nil {
+			return fmt.Errorf("insert event %s: %w", event.ID, err)
+		}
+	}
+
+	if err := b.replaceRows(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQLITE_BACKUP_FILE is the file a SQLite snapshot is kept in
+const SQLITE_BACKUP_FILE = "sqlite.db"
+
+// Backup copies the database into dir with SQLite's online backup API. The
+// copy reads a consistent snapshot while other connections keep writing.
+func (s *sqliteStore) Backup(dir string) error {
+	ctx := context.Background()
+
+	dest, err := sql.Open(SQLITE_DRIVER_NAME, filepath.Join(dir, SQLITE_BACKUP_FILE))
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	sourceConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sourceConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return sourceConn.Raw(func(sourceDriver interface{}) error {
+			backup, err := destDriver.(*sqlite3.SQLiteConn).Backup("main", sourceDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// restoreSQLite copies a snapshot's database to file, it's a complete SQLite
+// file already
+func restoreSQLite(dir string, file string) error {
+	source, err := os.Open(filepath.Join(dir, SQLITE_BACKUP_FILE))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	dest, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.com.db")
+	if store, err := OpenStore("postgres", file); err == nil {
+		store.Close()
+		t.Error("OpenStore(postgres) was incorrect, got: nil, want: an error.")
+	}
+
+	tests := []struct {
+		kind string
+		file string
+	}{
+		{STORE_SQLITE, "data/a.com.db"},
+		{STORE_DUCKDB, "data/a.com.duckdb"},
+	}
+	for _, test := range tests {
+		if got := StoreFileName(test.kind, "data/a.com.db"); got != test.file {
+			t.Errorf("StoreFileName(%s) was incorrect, got: %s, want: %s.", test.kind, got, test.file)
+		}
+	}
+}
+
+// Read only connections see the store's rows but can't write
+func TestReadOnly(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d, &UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1})
+
+		conn, release, err := d.store.ReadOnly(context.Background())
+		if err != nil {
+			t.Fatalf("ReadOnly failed: %v", err)
+		}
+		defer release()
+
+		var sessions int64
+		if err := conn.QueryRowContext(context.Background(), "SELECT COUNT(*) FROM user_sessions").Scan(&sessions); err != nil || sessions != 1 {
+			t.Errorf("Read only sessions were incorrect, got: %d (%v), want: 1.", sessions, err)
+		}
+		if _, err := conn.ExecContext(context.Background(), "DELETE FROM user_sessions"); err == nil {
+			t.Error("Read only DELETE was incorrect, got: nil, want: an error.")
+		}
+		if ids := storedIDs(t, d, "user_sessions"); ids != "s1" {
+			t.Errorf("Sessions were incorrect, got: %s, want: s1.", ids)
+		}
+	})
+}
+
+// Compacting keeps the rows and the store stays usable
+func TestCompact(t *testing.T) {
+	forEachStore(t, func(t *testing.T, d *Database) {
+		writeSessions(t, d,
+			&UserSession{ID: "s1", UserIdent: "u1", SessionStart: parseTime("2024-01-02T10:00:00Z"), Events: 1},
+			&UserSession{ID: "s2", UserIdent: "u2", SessionStart: parseTime("2024-01-02T11:00:00Z"), Events: 2},
+		)
+		if _, err := d.store.DB().Exec("DELETE FROM user_events WHERE session_id = 's1'"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.store.DB().Exec("DELETE FROM user_sessions WHERE id = 's1'"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := d.store.Compact(); err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+		if ids := storedIDs(t, d, "user_events"); ids != "s2-0 s2-1" {
+			t.Errorf("Events were incorrect, got: %s, want: s2-0 s2-1.", ids)
+		}
+
+		writeSessions(t, d, &UserSession{ID: "s3", UserIdent: "u3", SessionStart: parseTime("2024-01-02T12:00:00Z"), Events: 1})
+		if ids := storedIDs(t, d, "user_sessions"); ids != "s2 s3" {
+			t.Errorf("Sessions were incorrect, got: %s, want: s2 s3.", ids)
+		}
+	})
+}
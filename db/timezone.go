@@ -0,0 +1,41 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// Loaded time zones by name, local_time is called for every row
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// localTime returns the wall clock time in the zone at the instant t, as a
+// UTC time, so truncating it to days, weeks or months follows the zone's
+// calendar. It's the local_time(timestamp, zone) SQL function of both stores.
+func localTime(t time.Time, zone string) (time.Time, error) {
+	loc, err := loadLocation(zone)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	local := t.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC), nil
+}
+
+// zonedTime is the reverse of localTime: the instant at which the zone's wall
+// clock showed the time
+func zonedTime(local time.Time, loc *time.Location) time.Time {
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), loc)
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	"tinylytics/helpers"
+)
+
+// VisitorData is what a site's stores keep about a visitor, for an access
+// request
+type VisitorData struct {
+	Sessions []*UserSessionDuckDB `json:"sessions"`
+	Events   []*UserEventDuckDB   `json:"events"`
+}
+
+// VisitorErasure is how many of a visitor's rows were deleted from a store
+type VisitorErasure struct {
+	Store    string `json:"store"`
+	Sessions int64  `json:"sessions"`
+	Events   int64  `json:"events"`
+}
+
+// identsCondition matches the sessions of any of the idents
+func identsCondition(idents []string) (string, []interface{}) {
+	return "user_ident IN (" + placeholders(len(idents)) + ")", idArgs(idents)
+}
+
+// FindVisitor returns the sessions of the visitors with the given idents and
+// their events. A site that still has a file of the other storage is read
+// too, rows both have are only returned once.
+func FindVisitor(domain string, idents []string) (*VisitorData, error) {
+	data := &VisitorData{Sessions: make([]*UserSessionDuckDB, 0), Events: make([]*UserEventDuckDB, 0)}
+	if len(idents) == 0 {
+		return data, nil
+	}
+
+	sessions := make(map[string]*UserSessionDuckDB)
+	events := make(map[string]*UserEventDuckDB)
+
+	err := visitorStores(domain, func(d *Database, store Store) error {
+		if d != nil {
+			d.mu.RLock()
+			defer d.mu.RUnlock()
+		}
+		return readVisitor(store, idents, sessions, events)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, session)
+	}
+	sort.Slice(data.Sessions, func(i, j int) bool {
+		return data.Sessions[i].SessionStart.Before(data.Sessions[j].SessionStart)
+	})
+	for _, event := range events {
+		data.Events = append(data.Events, event)
+	}
+	sort.Slice(data.Events, func(i, j int) bool {
+		return data.Events[i].EventTime.Before(data.Events[j].EventTime)
+	})
+
+	return data, nil
+}
+
+func readVisitor(store Store, idents []string, sessions map[string]*UserSessionDuckDB, events map[string]*UserEventDuckDB) error {
+	condition, args := identsCondition(idents)
+
+	rows, err := store.DB().Query(fmt.Sprintf("SELECT %s FROM user_sessions WHERE %s", sessionColumns, condition), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return err
+		}
+		sessions[session.ID] = session
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = store.DB().Query(fmt.Sprintf(`
+		SELECT id, created_at, updated_at, name, page, event_time, session_id
+		FROM user_events
+		WHERE session_id IN (SELECT id FROM user_sessions WHERE %s)
+	`, condition), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event UserEventDuckDB
+		if err := rows.Scan(&event.ID, &event.CreatedAt, &event.UpdatedAt, &event.Name, &event.Page, &event.EventTime, &event.SessionID); err != nil {
+			return err
+		}
+		events[event.ID] = &event
+	}
+	return rows.Err()
+}
+
+// EraseVisitor deletes the sessions of the visitors with the given idents and
+// their events, updates the rollups of the hours they were in and compacts
+// the file, so the rows aren't left behind in free pages. A site that still
+// has a file of the other storage is erased there too.
+func EraseVisitor(domain string, idents []string) ([]*VisitorErasure, error) {
+	results := make([]*VisitorErasure, 0, 2)
+	if len(idents) == 0 {
+		return results, nil
+	}
+
+	err := visitorStores(domain, func(d *Database, store Store) error {
+		if d != nil {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			defer d.cache.clear()
+		}
+
+		result, err := eraseVisitor(store, idents)
+		if err != nil {
+			return fmt.Errorf("%s: %w", store.Kind(), err)
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, err
+}
+
+func eraseVisitor(store Store, idents []string) (*VisitorErasure, error) {
+	result := &VisitorErasure{Store: store.Kind()}
+	condition, args := identsCondition(idents)
+
+	tx, err := store.DB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT session_start FROM user_sessions WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	hours := make(map[time.Time]bool)
+	for rows.Next() {
+		var start timestamp
+		if err := rows.Scan(&start); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hours[start.Time.UTC().Truncate(time.Hour)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	events, err := tx.Exec("DELETE FROM user_events WHERE session_id IN (SELECT id FROM user_sessions WHERE "+condition+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	if result.Events, err = events.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	sessions, err := tx.Exec("DELETE FROM user_sessions WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	if result.Sessions, err = sessions.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	if err := refreshHourRollups(tx, hours); err != nil {
+		return nil, fmt.Errorf("update rollups: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if result.Sessions == 0 && result.Events == 0 {
+		return result, nil
+	}
+
+	if err := store.Compact(); err != nil {
+		return result, fmt.Errorf("compact: %w", err)
+	}
+	return result, nil
+}
+
+// visitorStores calls fn with the site's store, and then with the file of
+// the other storage if the site still has one. The site's store comes with
+// its database, whose lock fn has to take.
+func visitorStores(domain string, fn func(d *Database, store Store) error) error {
+	file, err := helpers.GetDatabaseFileName(domain)
+	if err != nil {
+		return err
+	}
+
+	d, err := GetDatabase(file)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(d, d.store); err != nil {
+		return err
+	}
+
+	otherKind := STORE_SQLITE
+	if d.store.Kind() == STORE_SQLITE {
+		otherKind = STORE_DUCKDB
+	}
+	if _, err := os.Stat(StoreFileName(otherKind, file)); err != nil {
+		return nil
+	}
+
+	other, err := OpenStore(otherKind, file)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+
+	if _, err := Migrate(other); err != nil {
+		return err
+	}
+
+	return fn(nil, other)
+}
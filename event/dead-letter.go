@@ -0,0 +1,216 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeadLetter is an event that kept failing, with the last error it failed with
+type DeadLetter struct {
+	ID       string      `json:"id"`
+	Item     *ClientInfo `json:"item"`
+	Error    string      `json:"error"`
+	Attempts int         `json:"attempts"`
+	FailedAt time.Time   `json:"failedAt"`
+}
+
+// DeadLetterQueue keeps failed events as one JSON file each, so they can be
+// looked at, replayed or discarded one by one
+type DeadLetterQueue struct {
+	mu  sync.Mutex
+	dir string
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+func OpenDeadLetterQueue(dir string) (*DeadLetterQueue, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &DeadLetterQueue{dir: dir}, nil
+}
+
+func (q *DeadLetterQueue) file(id string) (string, error) {
+	// Ids come from the admin endpoint, make sure they can't point outside the folder
+	if _, err := uuid.Parse(id); err != nil {
+		return "", ErrDeadLetterNotFound
+	}
+	return filepath.Join(q.dir, id+".json"), nil
+}
+
+func (q *DeadLetterQueue) Add(item *ClientInfo, cause error, attempts int) (*DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	letter := &DeadLetter{
+		ID:       uuid.NewString(),
+		Item:     item,
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return nil, err
+	}
+
+	file, _ := q.file(letter.ID)
+
+	// Write to a temp file first so a crash never leaves half a letter behind
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return letter, nil
+}
+
+// List returns the dead letters, oldest first
+func (q *DeadLetterQueue) List() ([]*DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		letter, err := q.read(filepath.Join(q.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", entry.Name(), err)
+		}
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+
+	return letters, nil
+}
+
+func (q *DeadLetterQueue) Size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	matches, _ := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	return len(matches)
+}
+
+func (q *DeadLetterQueue) Get(id string) (*DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, err := q.file(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.read(file)
+}
+
+func (q *DeadLetterQueue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, err := q.file(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(file); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrDeadLetterNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Erase removes the dead letters whose events match, for an erasure request,
+// and returns how many were removed
+func (q *DeadLetterQueue) Erase(match func(item *ClientInfo) bool) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	erased := 0
+	for _, file := range files {
+		letter, err := q.read(file)
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			continue
+		}
+		if err != nil {
+			return erased, fmt.Errorf("read %s: %w", filepath.Base(file), err)
+		}
+		if letter.Item == nil || !match(letter.Item) {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return erased, err
+		}
+		erased++
+	}
+
+	return erased, nil
+}
+
+// Replay puts a dead letter back on the event queue. It's only removed once
+// it's safely queued, so a failed replay can be tried again.
+func (q *DeadLetterQueue) Replay(id string, queue *EventQueue) error {
+	letter, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := queue.Push(letter.Item); err != nil {
+		return err
+	}
+
+	return q.Remove(id)
+}
+
+func (q *DeadLetterQueue) read(file string) (*DeadLetter, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrDeadLetterNotFound
+		}
+		return nil, err
+	}
+
+	var letter DeadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return nil, err
+	}
+
+	return &letter, nil
+}
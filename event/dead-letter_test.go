@@ -0,0 +1,77 @@
+package event
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	dl, err := OpenDeadLetterQueue(filepath.Join(t.TempDir(), "dead-letter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := dl.Add(testEvent("203.0.113.7", "/1", time.Now().UTC()), errors.New("failed"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dl.Add(testEvent("203.0.113.7", "/2", time.Now().UTC()), nil, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := dl.List()
+	if err != nil || len(letters) != 2 || letters[0].ID != first.ID || letters[1].ID != second.ID {
+		t.Fatalf("List was incorrect, got: %v (%v), want: the two letters, oldest first.", letters, err)
+	}
+	if letter, err := dl.Get(first.ID); err != nil || letter.Error != "failed" || letter.Item.Page != "/1" {
+		t.Errorf("Get was incorrect, got: %+v (%v), want: /1 failed.", letter, err)
+	}
+
+	if err := dl.Remove(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := dl.Remove(first.ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Remove was incorrect, got: %v, want: not found.", err)
+	}
+	if dl.Size() != 1 {
+		t.Errorf("Size was incorrect, got: %d, want: 1.", dl.Size())
+	}
+}
+
+// Ids come from the admin endpoint, they can't name another file
+func TestDeadLetterQueueIDs(t *testing.T) {
+	dl, err := OpenDeadLetterQueue(filepath.Join(t.TempDir(), "dead-letter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"../config", "", "not-a-uuid"} {
+		if _, err := dl.Get(id); !errors.Is(err, ErrDeadLetterNotFound) {
+			t.Errorf("Get(%q) was incorrect, got: %v, want: not found.", id, err)
+		}
+		if err := dl.Remove(id); !errors.Is(err, ErrDeadLetterNotFound) {
+			t.Errorf("Remove(%q) was incorrect, got: %v, want: not found.", id, err)
+		}
+	}
+}
+
+// A replayed dead letter is queued again and removed
+func TestDeadLetterReplay(t *testing.T) {
+	q := openTestQueue(t, 1)
+
+	letter, err := q.DeadLetters().Add(testEvent("203.0.113.7", "/1", time.Now().UTC()), errors.New("failed"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DeadLetters().Replay(letter.ID, q); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.GetSize() != 1 || q.DeadLetters().Size() != 0 {
+		t.Errorf("Replay was incorrect, got: %d queued, %d dead letters, want: 1, 0.", q.GetSize(), q.DeadLetters().Size())
+	}
+	q.Close()
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package event
+
+import "syscall"
+
+// diskUsage returns how full the filesystem holding dir is, in percent
+func diskUsage(dir string) (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	total := float64(stat.Blocks) * float64(stat.Bsize)
+	if total == 0 {
+		return 0, nil
+	}
+
+	available := float64(stat.Bavail) * float64(stat.Bsize)
+	return (total - available) / total * 100, nil
+}
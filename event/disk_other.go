@@ -0,0 +1,8 @@
+//go:build !unix
+
+package event
+
+// diskUsage isn't checked on this platform, the disk high-water mark never trips
+func diskUsage(dir string) (float64, error) {
+	return 0, nil
+}
@@ -0,0 +1,150 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+	"tinylytics/constants"
+	"tinylytics/helpers"
+)
+
+// A visitor's events can still be queued, or in a batch being written, when
+// their data is erased, and dque can't take them out of the middle of a
+// partition. The erased idents are kept with the time of the erasure, and
+// ProcessEvents drops their events received before then. They're written to
+// a file in the data folder, for the events queued while the server was
+// stopped, and forgotten once the server starts with an empty queue.
+
+// erasedVisitor is a line of the erased visitors file
+type erasedVisitor struct {
+	Domain    string    `json:"domain"`
+	UserIdent string    `json:"userIdent"`
+	ErasedAt  time.Time `json:"erasedAt"`
+}
+
+// erasures holds the time each visitor was erased, by domain and ident.
+// Batches hold the read lock while they're written, so an erasure waits for
+// the ones that could still write the visitor's events.
+var erasures struct {
+	sync.RWMutex
+	loaded bool
+	erased map[string]time.Time
+}
+
+func erasureKey(domain string, ident string) string {
+	return domain + " " + ident
+}
+
+// loadErasures reads the erased visitors file the first time it's needed
+// Must be called while holding the erasures lock
+func loadErasures() error {
+	if erasures.loaded {
+		return nil
+	}
+
+	erased := make(map[string]time.Time)
+	file, err := os.Open(helpers.GetDataPath(constants.PRIVACY_ERASED_FILE_NAME))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var visitor erasedVisitor
+			// A line cut short by a crash was never acted on
+			if err := json.Unmarshal(scanner.Bytes(), &visitor); err != nil {
+				continue
+			}
+			key := erasureKey(visitor.Domain, visitor.UserIdent)
+			if visitor.ErasedAt.After(erased[key]) {
+				erased[key] = visitor.ErasedAt
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	erasures.erased = erased
+	erasures.loaded = true
+	return nil
+}
+
+// recordErasures keeps the visitors' idents, so their events that are still
+// queued are dropped. It waits for the batches being written.
+func recordErasures(domain string, idents []string, erasedAt time.Time) error {
+	erasures.Lock()
+	defer erasures.Unlock()
+
+	if err := loadErasures(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(helpers.GetDataPath(constants.PRIVACY_ERASED_FILE_NAME), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	for _, ident := range idents {
+		data, err := json.Marshal(&erasedVisitor{Domain: domain, UserIdent: ident, ErasedAt: erasedAt})
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Write(append(data, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	for _, ident := range idents {
+		erasures.erased[erasureKey(domain, ident)] = erasedAt
+	}
+	return nil
+}
+
+// holdErasures read locks the erased visitors, for writing a batch, and
+// returns the function that unlocks them
+func holdErasures() (func(), error) {
+	erasures.Lock()
+	err := loadErasures()
+	erasures.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	erasures.RLock()
+	return erasures.RUnlock, nil
+}
+
+// isErased tells if the event was received before its visitor was erased
+// Must be called while holding the erasures read lock
+func isErased(domain string, ident string, item *ClientInfo) bool {
+	erasedAt, ok := erasures.erased[erasureKey(domain, ident)]
+	return ok && !item.Time.After(erasedAt)
+}
+
+// clearErasures forgets the erased visitors, once none of their events can be
+// queued anymore
+func clearErasures() error {
+	erasures.Lock()
+	defer erasures.Unlock()
+
+	if err := os.Remove(helpers.GetDataPath(constants.PRIVACY_ERASED_FILE_NAME)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	erasures.erased = make(map[string]time.Time)
+	erasures.loaded = true
+	return nil
+}
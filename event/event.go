@@ -1,6 +1,7 @@
 package event
 
 import (
+	"fmt"
 	"log"
 	"net/url"
 	"strings"
@@ -8,9 +9,10 @@ import (
 	"tinylytics/db"
 	"tinylytics/geo"
 	"tinylytics/helpers"
+	"tinylytics/live"
+	"tinylytics/metrics"
 	"tinylytics/ua"
 
-	"github.com/google/uuid"
 	"github.com/x-way/crawlerdetect"
 )
 
@@ -38,18 +40,76 @@ type EventData struct {
 	ScreenWidth int64  `json:"screenWidth"`
 }
 
-func ProcessEvent(item *ClientInfo) {
-	if crawlerdetect.IsCrawler(item.UserAgent) {
-		log.Printf("[QUEUE] Crawler detected - skipping: %s", item.UserAgent)
-		return
+// ProcessEvents stores a batch of queued events for one site in a single
+// transaction. Events that can never be stored (bots, unknown
+// sites) are dropped, any other error is returned so the queue can retry the
+// batch. Events that were already stored are skipped, so a retried batch is
+// only counted once, and so are those of visitors erased since they were
+// received.
+func ProcessEvents(domain string, items []*ClientInfo) error {
+	database, err := db.GetDatabaseByDomain(domain)
+	if err != nil {
+		log.Printf("ERROR: Failed to get database for domain %s: %v", domain, err)
+		return nil
+	}
+
+	release, err := holdErasures()
+	if err != nil {
+		return fmt.Errorf("read erased visitors: %w", err)
+	}
+	defer release()
+
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = GetEventId(item)
 	}
 
-	database, err := db.GetDatabaseByDomain(item.Domain)
+	existing, err := database.GetExistingEventIDs(ids)
 	if err != nil {
-		log.Printf("ERROR: Failed to get database for domain %s: %v", item.Domain, err)
-		return
+		return fmt.Errorf("check stored events: %w", err)
 	}
 
+	batch := database.NewBatch()
+	recorded := make([]*live.Event, 0, len(items))
+
+	for i, item := range items {
+		if existing[ids[i]] {
+			log.Printf("[QUEUE] Event already stored - skipping: id=%s domain=%s page=%s", ids[i], item.Domain, item.Page)
+			continue
+		}
+
+		if isErased(domain, GetSessionUserIdent(item), item) {
+			log.Printf("[QUEUE] Visitor was erased - skipping: id=%s domain=%s", ids[i], item.Domain)
+			continue
+		}
+
+		if crawlerdetect.IsCrawler(item.UserAgent) {
+			log.Printf("[QUEUE] Crawler detected - skipping: %s", item.UserAgent)
+			metrics.EventsBots.Inc(domain)
+			continue
+		}
+
+		recorded = append(recorded, processEvent(batch, ids[i], item))
+	}
+
+	if err := batch.Commit(); err != nil {
+		return fmt.Errorf("write batch: %w", err)
+	}
+
+	now := time.Now().UTC()
+	metrics.EventsProcessed.Add(float64(batch.Size()), domain)
+
+	for _, e := range recorded {
+		metrics.QueueLag.Observe(now.Sub(e.Time).Seconds(), domain)
+		live.Record(domain, e)
+	}
+
+	return nil
+}
+
+// processEvent adds the event and its session to the batch, and returns what
+// the live view should show once the batch is written
+func processEvent(batch *db.Batch, id string, item *ClientInfo) *live.Event {
 	log.Printf("[QUEUE] Processing event: domain=%s page=%s IP=%s", item.Domain, item.Page, item.IP)
 
 	userIdent := GetSessionUserIdent(item)
@@ -59,12 +119,12 @@ func ProcessEvent(item *ClientInfo) {
 	country := geo.GetGeo(item.IP)
 
 	// Use item.Time (event timestamp) instead of processing time to correctly match sessions
-	session := database.GetUserSessionAtTime(userIdent, item.Time)
+	session := batch.GetUserSessionAtTime(userIdent, item.Time)
 
 	if session == nil {
 		referrerDomain, referrerFullPath := helpers.FilterReferrer(item.Referer, item.Domain)
 
-		session = database.StartUserSession(&db.UserSession{
+		session = batch.StartUserSession(&db.UserSession{
 			ID:              GetSessionId(item, item.Time),
 			UserIdent:       userIdent,
 			Browser:         result.Browser,
@@ -89,7 +149,7 @@ func ProcessEvent(item *ClientInfo) {
 	session.SessionEnd = item.Time
 	session.Events++
 
-	database.UpdateUserSession(session)
+	batch.UpdateUserSession(session)
 
 	var page = item.Page
 
@@ -102,10 +162,20 @@ func ProcessEvent(item *ClientInfo) {
 		}, "/")
 	}
 
-	database.SaveEvent(&db.UserEvent{
-		ID:        uuid.NewString(),
+	batch.SaveEvent(&db.UserEvent{
+		ID:        id,
 		Page:      page,
 		Name:      item.Name,
 		EventTime: item.Time,
 	}, session.ID)
+
+	return &live.Event{
+		Time:    item.Time,
+		Visitor: userIdent,
+		Name:    item.Name,
+		Page:    page,
+		Referer: session.Referer,
+		Country: session.Country,
+		Browser: session.Browser,
+	}
 }
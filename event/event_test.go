@@ -0,0 +1,60 @@
+package event
+
+import (
+	"testing"
+	"time"
+	"tinylytics/db"
+)
+
+// A batch that's retried after it was written, or events that are queued
+// twice, are only stored once
+func TestProcessEventsSkipsStoredEvents(t *testing.T) {
+	setupDataFolder(t)
+	now := time.Now().UTC().Add(-time.Hour)
+
+	items := []*ClientInfo{testEvent("203.0.113.7", "/", now), testEvent("203.0.113.7", "/about", now.Add(time.Minute))}
+	for i := 0; i < 2; i++ {
+		if err := ProcessEvents("a.com", items); err != nil {
+			t.Fatalf("ProcessEvents failed: %v", err)
+		}
+	}
+
+	if pages := storedEvents(t, items[0]); pages != "a.com/ a.com/about" {
+		t.Errorf("Events were incorrect, got: %s, want: a.com/ a.com/about.", pages)
+	}
+
+	data, err := db.FindVisitor("a.com", []string{GetSessionUserIdent(items[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Sessions) != 1 || data.Sessions[0].Events != 2 {
+		t.Errorf("Sessions were incorrect, got: %d sessions, want: 1 with 2 events.", len(data.Sessions))
+	}
+}
+
+// A batch is one transaction per site, its events in one session per visitor
+func TestProcessEventsBatch(t *testing.T) {
+	setupDataFolder(t)
+	now := time.Now().UTC().Add(-time.Hour)
+
+	items := []*ClientInfo{
+		testEvent("203.0.113.7", "/", now),
+		testEvent("198.51.100.1", "/", now),
+		testEvent("203.0.113.7", "/about", now.Add(time.Minute)),
+		testEvent("203.0.113.7", "/later", now.Add(2*time.Hour)),
+	}
+	if err := ProcessEvents("a.com", items); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+
+	data, err := db.FindVisitor("a.com", []string{GetSessionUserIdent(items[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Sessions) != 2 || len(data.Events) != 3 {
+		t.Errorf("Visitor was incorrect, got: %d sessions, %d events, want: 2 sessions, 3 events.", len(data.Sessions), len(data.Events))
+	}
+	if pages := storedEvents(t, items[1]); pages != "a.com/" {
+		t.Errorf("Other visitor's events were incorrect, got: %s, want: a.com/.", pages)
+	}
+}
@@ -0,0 +1,81 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// Events are taken off the queue while a batch fills up, since dque can only
+// peek at its head. Until the batch is written they're kept in an in-flight
+// file next to the queue, which is processed first on the next start.
+
+func (p *partition) inflightFile() string {
+	return p.dir + ".inflight"
+}
+
+// loadInflight returns the events of a batch that wasn't written before the
+// server stopped. A line cut short by a crash is ignored, that event was
+// still in the queue.
+func (p *partition) loadInflight() ([]*ClientInfo, error) {
+	file, err := os.Open(p.inflightFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	items := make([]*ClientInfo, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var item ClientInfo
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			break
+		}
+		items = append(items, &item)
+	}
+
+	return items, scanner.Err()
+}
+
+// take moves the event at the head of the queue into the in-flight file
+func (p *partition) take(item *ClientInfo) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(p.inflightFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// If this fails the event is both in the file and the queue, but it's
+	// stored once anyway since event ids are derived from the event
+	_, err = p.pop()
+	return err
+}
+
+// ack forgets the in-flight events once their batch is written
+func (p *partition) ack() error {
+	if err := os.Remove(p.inflightFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package event
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+	"tinylytics/config"
+)
+
+const (
+	OVERLOAD_REJECT = "reject"
+	OVERLOAD_SAMPLE = "sample"
+)
+
+// How long a disk usage check is reused, so ingestion doesn't stat the disk
+// on every request
+const diskCheckInterval = time.Second
+
+// Overload describes whether the queue is above one of its high-water marks
+type Overload struct {
+	Overloaded bool    `json:"overloaded"`
+	Reason     string  `json:"reason,omitempty"`
+	QueueSize  int     `json:"queueSize"`
+	DiskUsage  float64 `json:"diskUsage"`
+	Mode       string  `json:"mode,omitempty"`
+}
+
+type overloadState struct {
+	mu            sync.Mutex
+	diskCheckedAt time.Time
+	diskUsage     float64
+	overloaded    bool
+}
+
+func overloadMode() string {
+	if config.Config.Queue.Overload == OVERLOAD_SAMPLE {
+		return OVERLOAD_SAMPLE
+	}
+	return OVERLOAD_REJECT
+}
+
+// GetOverload checks the queue size and the disk usage of the data folder
+// against the configured high-water marks
+func (q *EventQueue) GetOverload() Overload {
+	q.overload.mu.Lock()
+	defer q.overload.mu.Unlock()
+
+	if time.Since(q.overload.diskCheckedAt) >= diskCheckInterval {
+		usage, err := diskUsage(path.Clean(config.Config.DataFolder))
+		if err != nil {
+			log.Printf("WARNING: [QUEUE] Couldn't check disk usage: %v", err)
+		}
+		q.overload.diskUsage = usage
+		q.overload.diskCheckedAt = time.Now()
+	}
+
+	settings := config.Config.Queue
+	usage := q.overload.diskUsage
+	current := Overload{QueueSize: q.GetSize(), DiskUsage: usage}
+
+	switch {
+	case settings.MaxSize > 0 && current.QueueSize >= settings.MaxSize:
+		current.Reason = fmt.Sprintf("%d events waiting in the queue", current.QueueSize)
+	case settings.MaxDiskUsage > 0 && usage >= settings.MaxDiskUsage:
+		current.Reason = fmt.Sprintf("the data disk is %.0f%% full", usage)
+	}
+
+	if current.Reason != "" {
+		current.Overloaded = true
+		current.Mode = overloadMode()
+	}
+
+	if current.Overloaded != q.overload.overloaded {
+		if current.Overloaded {
+			log.Printf("WARNING: [QUEUE] Overloaded, %s - new events are handled with %q", current.Reason, current.Mode)
+		} else {
+			log.Println("[QUEUE] No longer overloaded, accepting every event")
+		}
+	}
+
+	q.overload.overloaded = current.Overloaded
+	return current
+}
+
+// Admit decides whether an event is queued. It's always queued unless the
+// queue is overloaded, then either nothing or a sample of the events is.
+func (q *EventQueue) Admit() (bool, Overload) {
+	overload := q.GetOverload()
+	if !overload.Overloaded {
+		return true, overload
+	}
+
+	if overload.Mode == OVERLOAD_SAMPLE {
+		return rand.Float64() < config.Config.Queue.SampleRate, overload
+	}
+
+	return false, overload
+}
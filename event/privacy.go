@@ -0,0 +1,298 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"tinylytics/archive"
+	"tinylytics/constants"
+	"tinylytics/db"
+	"tinylytics/helpers"
+)
+
+const (
+	PRIVACY_ACCESS  = "access"
+	PRIVACY_ERASURE = "erasure"
+)
+
+// ErrInvalidVisitor is returned for a request that doesn't say whose data it's
+// for
+var ErrInvalidVisitor = errors.New("a user ident, or an IP address and user agent, are required")
+
+// ErrNoUserIdents is returned for an erasure that found no ident to erase the
+// visitor's sessions by, so nothing would be deleted
+var ErrNoUserIdents = errors.New("no user ident found for the visitor")
+
+// Visitor is who an access or erasure request is for: the visitor whose
+// sessions have the user ident, or whose events were sent with the IP address
+// and user agent. The ident is a hash that includes the host name the events
+// were sent to, the hosts of the visitor's archived events are used, and Host,
+// which defaults to the site's domain.
+type Visitor struct {
+	UserIdent string `json:"userIdent" form:"userIdent"`
+	IP        string `json:"ip" form:"ip"`
+	UserAgent string `json:"userAgent" form:"userAgent"`
+	Host      string `json:"host" form:"host"`
+}
+
+func (v Visitor) Validate() error {
+	if v.UserIdent == "" && (v.IP == "" || v.UserAgent == "") {
+		return ErrInvalidVisitor
+	}
+	return nil
+}
+
+// matches tells if an archived event is the visitor's
+func (v Visitor) matches(item *ClientInfo, domain string, idents map[string]bool) bool {
+	if item.Domain != domain {
+		return false
+	}
+	if v.IP != "" && item.IP == v.IP && item.UserAgent == v.UserAgent {
+		return true
+	}
+	return idents[GetSessionUserIdent(item)]
+}
+
+// VisitorReport is everything a site keeps about a visitor, for an access
+// request
+type VisitorReport struct {
+	Domain     string                  `json:"domain"`
+	CreatedAt  time.Time               `json:"createdAt"`
+	UserIdents []string                `json:"userIdents"`
+	Sessions   []*db.UserSessionDuckDB `json:"sessions"`
+	Events     []*db.UserEventDuckDB   `json:"events"`
+	Archived   []*ClientInfo           `json:"archived"` // The events as they were received
+}
+
+// VisitorErasure is what was deleted for an erasure request
+type VisitorErasure struct {
+	Domain      string               `json:"domain"`
+	UserIdents  int                  `json:"userIdents"`
+	Stores      []*db.VisitorErasure `json:"stores"`
+	Archived    int                  `json:"archived"`
+	DeadLetters int                  `json:"deadLetters"`
+}
+
+// PrivacyAudit is the entry kept for each access or erasure request. It says
+// how much was found or deleted, but nothing about who the visitor was.
+type PrivacyAudit struct {
+	Time        time.Time `json:"time"`
+	Request     string    `json:"request"` // PRIVACY_ACCESS or PRIVACY_ERASURE
+	Domain      string    `json:"domain"`
+	Reference   string    `json:"reference,omitempty"` // e.g. the ticket the request came in with
+	UserIdents  int       `json:"userIdents"`
+	Sessions    int64     `json:"sessions"`
+	Events      int64     `json:"events"`
+	Archived    int       `json:"archived"`
+	DeadLetters int       `json:"deadLetters"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// recordPrivacyAudit appends an entry to the audit log in the data folder
+func recordPrivacyAudit(entry *PrivacyAudit) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(helpers.GetDataPath(constants.PRIVACY_AUDIT_FILE_NAME), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readVisitorArchive returns the visitor's archived events, and the idents of
+// their sessions
+func readVisitorArchive(dir string, domain string, visitor Visitor) ([]*ClientInfo, map[string]bool, error) {
+	idents := make(map[string]bool)
+	if visitor.UserIdent != "" {
+		idents[visitor.UserIdent] = true
+	}
+	if visitor.IP != "" {
+		host := visitor.Host
+		if host == "" {
+			host = domain
+		}
+		idents[GetSessionUserIdent(&ClientInfo{UserAgent: visitor.UserAgent, Domain: domain, HostName: host, IP: visitor.IP})] = true
+	}
+
+	items := make([]*ClientInfo, 0)
+	if _, err := os.Stat(dir); err != nil {
+		return items, idents, nil
+	}
+
+	err := archive.ReadAll(dir, func(record []byte) error {
+		var item ClientInfo
+		if err := json.Unmarshal(record, &item); err != nil {
+			log.Printf("WARNING: [ARCHIVE] Skipping unreadable record: %v", err)
+			return nil
+		}
+		if visitor.matches(&item, domain, idents) {
+			items = append(items, &item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Events sent to another host have another ident
+	for _, item := range items {
+		idents[GetSessionUserIdent(item)] = true
+	}
+
+	return items, idents, nil
+}
+
+func sortedIdents(idents map[string]bool) []string {
+	sorted := make([]string, 0, len(idents))
+	for ident := range idents {
+		sorted = append(sorted, ident)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// AccessVisitor finds everything a site keeps about a visitor, in its stores
+// and in the event archive in dir, and records the request in the audit log
+func AccessVisitor(dir string, domain string, visitor Visitor, reference string) (*VisitorReport, error) {
+	if err := visitor.Validate(); err != nil {
+		return nil, err
+	}
+
+	audit := &PrivacyAudit{Time: time.Now().UTC(), Request: PRIVACY_ACCESS, Domain: domain, Reference: reference}
+	report, err := accessVisitor(dir, domain, visitor)
+	if report != nil {
+		audit.UserIdents = len(report.UserIdents)
+		audit.Sessions = int64(len(report.Sessions))
+		audit.Events = int64(len(report.Events))
+		audit.Archived = len(report.Archived)
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+
+	if auditErr := recordPrivacyAudit(audit); auditErr != nil {
+		return nil, errors.Join(err, fmt.Errorf("record audit entry: %w", auditErr))
+	}
+	return report, err
+}
+
+func accessVisitor(dir string, domain string, visitor Visitor) (*VisitorReport, error) {
+	archived, idents, err := readVisitorArchive(dir, domain, visitor)
+	if err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+
+	report := &VisitorReport{
+		Domain:     domain,
+		CreatedAt:  time.Now().UTC(),
+		UserIdents: sortedIdents(idents),
+		Archived:   archived,
+	}
+
+	data, err := db.FindVisitor(domain, report.UserIdents)
+	if err != nil {
+		return report, err
+	}
+	report.Sessions, report.Events = data.Sessions, data.Events
+
+	return report, nil
+}
+
+// EraseVisitor deletes everything a site keeps about a visitor: their
+// sessions and events in its stores, the rollups are updated, their events in
+// the archive and their dead letters. Their events still in the queue are
+// dropped when they're processed. The server passes its archive, which is
+// being written to, commands pass nil to erase the one in dir. The request is
+// recorded in the audit log, even when it failed partway.
+func EraseVisitor(a *archive.Archive, deadLetters *DeadLetterQueue, dir string, domain string, visitor Visitor, reference string) (*VisitorErasure, error) {
+	if err := visitor.Validate(); err != nil {
+		return nil, err
+	}
+
+	audit := &PrivacyAudit{Time: time.Now().UTC(), Request: PRIVACY_ERASURE, Domain: domain, Reference: reference}
+	result, err := eraseVisitor(a, deadLetters, dir, domain, visitor)
+	if result != nil {
+		audit.UserIdents = result.UserIdents
+		audit.Archived = result.Archived
+		audit.DeadLetters = result.DeadLetters
+		// Stores of the same site hold copies of the same rows
+		for _, store := range result.Stores {
+			audit.Sessions = max(audit.Sessions, store.Sessions)
+			audit.Events = max(audit.Events, store.Events)
+		}
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+
+	if auditErr := recordPrivacyAudit(audit); auditErr != nil {
+		return nil, errors.Join(err, fmt.Errorf("record audit entry: %w", auditErr))
+	}
+	return result, err
+}
+
+func eraseVisitor(a *archive.Archive, deadLetters *DeadLetterQueue, dir string, domain string, visitor Visitor) (*VisitorErasure, error) {
+	_, idents, err := readVisitorArchive(dir, domain, visitor)
+	if err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+	if len(idents) == 0 {
+		return nil, ErrNoUserIdents
+	}
+
+	result := &VisitorErasure{Domain: domain, UserIdents: len(idents)}
+
+	// Before the stores, so the batches written from now on leave the
+	// visitor out
+	if err := recordErasures(domain, sortedIdents(idents), time.Now().UTC()); err != nil {
+		return result, fmt.Errorf("record erasure: %w", err)
+	}
+
+	result.Stores, err = db.EraseVisitor(domain, sortedIdents(idents))
+	if err != nil {
+		return result, err
+	}
+
+	match := func(record []byte) bool {
+		var item ClientInfo
+		if err := json.Unmarshal(record, &item); err != nil {
+			return false
+		}
+		return visitor.matches(&item, domain, idents)
+	}
+
+	if a != nil {
+		result.Archived, err = a.Erase(match)
+	} else if _, statErr := os.Stat(dir); statErr == nil {
+		result.Archived, err = archive.Erase(dir, match)
+	}
+	if err != nil {
+		return result, fmt.Errorf("erase archive: %w", err)
+	}
+
+	result.DeadLetters, err = deadLetters.Erase(func(item *ClientInfo) bool {
+		return visitor.matches(item, domain, idents)
+	})
+	if err != nil {
+		return result, fmt.Errorf("erase dead letters: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,235 @@
+package event
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tinylytics/config"
+	"tinylytics/constants"
+	"tinylytics/db"
+)
+
+const testRegexes = `user_agent_parsers:
+  - regex: '(Firefox)/(\d+)\.(\d+)'
+os_parsers:
+  - regex: '(Linux)'
+device_parsers:
+  - regex: '(Linux)'
+`
+
+// setupDataFolder configures a site, a.com, with its data in a temporary
+// folder
+func setupDataFolder(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, constants.UA_REGEX_FILE_NAME), []byte(testRegexes), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := config.Config
+	config.Config = config.TinylyticsConfig{
+		DataFolder: dir,
+		Storage:    "sqlite",
+		Websites:   []config.WebsiteConfig{{Domain: "a.com"}},
+	}
+	erasures.loaded = false
+	t.Cleanup(func() {
+		db.CloseAll()
+		config.Config = previous
+		erasures.loaded = false
+	})
+
+	return dir
+}
+
+func testEvent(ip string, page string, at time.Time) *ClientInfo {
+	return &ClientInfo{
+		Name:      "pageview",
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0",
+		HostName:  "a.com",
+		Domain:    "a.com",
+		Page:      page,
+		IP:        ip,
+		Time:      at,
+	}
+}
+
+// storedEvents returns the pages of a visitor's stored events
+func storedEvents(t *testing.T, item *ClientInfo) string {
+	t.Helper()
+
+	data, err := db.FindVisitor("a.com", []string{GetSessionUserIdent(item)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := make([]string, 0, len(data.Events))
+	for _, event := range data.Events {
+		pages = append(pages, event.Page)
+	}
+	return strings.Join(pages, " ")
+}
+
+func TestEraseVisitor(t *testing.T) {
+	dir := setupDataFolder(t)
+	now := time.Now().UTC()
+
+	visitor, other := "203.0.113.7", "198.51.100.1"
+	if err := ProcessEvents("a.com", []*ClientInfo{testEvent(visitor, "/", now.Add(-time.Hour)), testEvent(other, "/", now.Add(-time.Hour))}); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+
+	deadLetters, err := OpenDeadLetterQueue(filepath.Join(dir, constants.EVENT_DEAD_LETTER_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters.Add(testEvent(visitor, "/failed", now.Add(-time.Minute)), nil, 5)
+	deadLetters.Add(testEvent(other, "/failed", now.Add(-time.Minute)), nil, 5)
+
+	item := testEvent(visitor, "/", now)
+	result, err := EraseVisitor(nil, deadLetters, filepath.Join(dir, constants.ARCHIVE_FOLDER_NAME), "a.com", Visitor{IP: visitor, UserAgent: item.UserAgent, Host: "a.com"}, "T-1")
+	if err != nil {
+		t.Fatalf("EraseVisitor failed: %v", err)
+	}
+	if result.UserIdents != 1 || len(result.Stores) != 1 || result.Stores[0].Sessions != 1 || result.DeadLetters != 1 {
+		t.Errorf("Erasure was incorrect, got: %+v, want: 1 ident, 1 session, 1 dead letter.", result)
+	}
+
+	if pages := storedEvents(t, item); pages != "" {
+		t.Errorf("Visitor's events were incorrect, got: %s, want: none.", pages)
+	}
+	if pages := storedEvents(t, testEvent(other, "/", now)); pages != "a.com/" {
+		t.Errorf("Other visitor's events were incorrect, got: %s, want: a.com/.", pages)
+	}
+	if letters, _ := deadLetters.List(); len(letters) != 1 || letters[0].Item.IP != other {
+		t.Errorf("Dead letters were incorrect, got: %d, want: the other visitor's.", len(letters))
+	}
+
+	audit, err := os.ReadFile(filepath.Join(dir, constants.PRIVACY_AUDIT_FILE_NAME))
+	if err != nil || !strings.Contains(string(audit), `"deadLetters":1`) || strings.Contains(string(audit), visitor) {
+		t.Errorf("Audit log was incorrect, got: %s (%v), want: 1 dead letter and not the IP.", audit, err)
+	}
+
+	// Events that were still queued are dropped, those received after the
+	// erasure are kept
+	queued := []*ClientInfo{testEvent(visitor, "/queued", now.Add(-time.Minute)), testEvent(other, "/queued", now.Add(-time.Minute))}
+	if err := ProcessEvents("a.com", queued); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+	if pages := storedEvents(t, item); pages != "" {
+		t.Errorf("Visitor's queued events were incorrect, got: %s, want: none.", pages)
+	}
+	if pages := storedEvents(t, testEvent(other, "/", now)); pages != "a.com/ a.com/queued" {
+		t.Errorf("Other visitor's queued events were incorrect, got: %s, want: a.com/ a.com/queued.", pages)
+	}
+
+	if err := ProcessEvents("a.com", []*ClientInfo{testEvent(visitor, "/later", time.Now().UTC().Add(time.Second))}); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+	if pages := storedEvents(t, item); pages != "a.com/later" {
+		t.Errorf("Visitor's later events were incorrect, got: %s, want: a.com/later.", pages)
+	}
+}
+
+// Without a host or an archive, the ident is computed with the site's domain
+func TestEraseVisitorWithoutHost(t *testing.T) {
+	dir := setupDataFolder(t)
+	now := time.Now().UTC()
+
+	item := testEvent("203.0.113.7", "/", now.Add(-time.Hour))
+	if err := ProcessEvents("a.com", []*ClientInfo{item}); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+
+	deadLetters, err := OpenDeadLetterQueue(filepath.Join(dir, constants.EVENT_DEAD_LETTER_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := EraseVisitor(nil, deadLetters, filepath.Join(dir, constants.ARCHIVE_FOLDER_NAME), "a.com", Visitor{IP: item.IP, UserAgent: item.UserAgent}, "T-1")
+	if err != nil {
+		t.Fatalf("EraseVisitor failed: %v", err)
+	}
+	if result.UserIdents != 1 || len(result.Stores) != 1 || result.Stores[0].Sessions != 1 {
+		t.Errorf("Erasure was incorrect, got: %+v, want: 1 ident, 1 session.", result)
+	}
+	if pages := storedEvents(t, item); pages != "" {
+		t.Errorf("Visitor's events were incorrect, got: %s, want: none.", pages)
+	}
+}
+
+// An erasure with no ident to erase by fails, rather than deleting nothing
+func TestEraseVisitorWithoutIdents(t *testing.T) {
+	dir := setupDataFolder(t)
+
+	deadLetters, err := OpenDeadLetterQueue(filepath.Join(dir, constants.EVENT_DEAD_LETTER_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := eraseVisitor(nil, deadLetters, filepath.Join(dir, constants.ARCHIVE_FOLDER_NAME), "a.com", Visitor{})
+	if !errors.Is(err, ErrNoUserIdents) || result != nil {
+		t.Errorf("eraseVisitor was incorrect, got: %+v (%v), want: %v.", result, err, ErrNoUserIdents)
+	}
+	if _, err := os.Stat(filepath.Join(dir, constants.PRIVACY_ERASED_FILE_NAME)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Erased visitors file was incorrect, got: %v, want: none.", err)
+	}
+}
+
+// The erased visitors are read back after a restart, until the queue is empty
+func TestErasuresKeptAcrossRestarts(t *testing.T) {
+	setupDataFolder(t)
+	now := time.Now().UTC()
+
+	item := testEvent("203.0.113.7", "/queued", now.Add(-time.Minute))
+	if err := recordErasures("a.com", []string{GetSessionUserIdent(item)}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	erasures.loaded = false
+	if err := ProcessEvents("a.com", []*ClientInfo{item}); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+	if pages := storedEvents(t, item); pages != "" {
+		t.Errorf("Events after a restart were incorrect, got: %s, want: none.", pages)
+	}
+
+	if err := clearErasures(); err != nil {
+		t.Fatal(err)
+	}
+	erasures.loaded = false
+	if err := ProcessEvents("a.com", []*ClientInfo{item}); err != nil {
+		t.Fatalf("ProcessEvents failed: %v", err)
+	}
+	if pages := storedEvents(t, item); pages != "a.com/queued" {
+		t.Errorf("Events once cleared were incorrect, got: %s, want: a.com/queued.", pages)
+	}
+}
+
+// An erasure waits for the batches being written, so they can't write the
+// visitor's events after the stores were erased
+func TestRecordErasuresWaitsForBatches(t *testing.T) {
+	setupDataFolder(t)
+
+	release, err := holdErasures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- recordErasures("a.com", []string{"ident"}, time.Now().UTC())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("recordErasures didn't wait for the batch")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,19 +1,50 @@
 package event
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 	"tinylytics/config"
 	"tinylytics/constants"
 
 	"github.com/joncrlsn/dque"
 )
 
-type EventQueue struct {
+// Backoff between attempts at processing the same event, doubled every time.
+// Tests shorten them.
+var (
+	RETRY_BACKOFF     = 500 * time.Millisecond
+	RETRY_MAX_BACKOFF = 30 * time.Second
+)
+
+// partition is one on-disk queue, processed in order by its own worker
+type partition struct {
+	name  string
+	dir   string
 	queue *dque.DQue
 }
 
+// EventQueue spreads events over one partition per worker. Every event of a
+// visitor lands in the same partition, so each visitor's events are processed
+// in order while different visitors (and sites) are processed concurrently.
+type EventQueue struct {
+	partitions []*partition
+	// draining are partitions left over from a larger worker count, they're
+	// processed but don't receive new events
+	draining   []*partition
+	deadLetter *DeadLetterQueue
+	closing    chan struct{}
+	workers    sync.WaitGroup
+	overload   overloadState
+}
+
 // ItemBuilder creates a new item and returns a pointer to it.
 // This is used when we load a segment of the queue from disk.
 func ItemBuilder() interface{} {
@@ -21,50 +52,95 @@ func ItemBuilder() interface{} {
 }
 
 func (q *EventQueue) GetSize() int {
-	return q.queue.Size()
+	size := 0
+	for _, p := range q.all() {
+		size += p.queue.Size()
+	}
+	return size
 }
 
-func (q *EventQueue) Push(item *ClientInfo) {
-	if err := q.queue.Enqueue(item); err != nil {
-		log.Fatal("Error enqueueing item ", err)
-	}
+// DeadLetters returns the events that kept failing
+func (q *EventQueue) DeadLetters() *DeadLetterQueue {
+	return q.deadLetter
 }
 
-func (q *EventQueue) Pop() *ClientInfo {
-	var iface interface{}
-	var err interface{}
+func (q *EventQueue) all() []*partition {
+	return append(append([]*partition{}, q.partitions...), q.draining...)
+}
+
+// partitionFor picks the partition by visitor, the same way sessions are keyed
+func (q *EventQueue) partitionFor(item *ClientInfo) *partition {
+	h := fnv.New32a()
+	h.Write([]byte(GetSessionUserIdent(item)))
+	return q.partitions[h.Sum32()%uint32(len(q.partitions))]
+}
+
+func (q *EventQueue) Push(item *ClientInfo) error {
+	return q.partitionFor(item).push(item)
+}
+
+func (p *partition) push(item *ClientInfo) error {
+	if err := p.queue.Enqueue(item); err != nil {
+		return fmt.Errorf("enqueue event: %w", err)
+	}
+	return nil
+}
 
-	if iface, err = q.queue.DequeueBlock(); err != nil {
-		log.Fatal("Error dequeuing item ", err)
+func (p *partition) pop() (*ClientInfo, error) {
+	iface, err := p.queue.DequeueBlock()
+	if err != nil {
+		return nil, fmt.Errorf("dequeue event: %w", err)
 	}
 
 	// Assert type of the response to an Item pointer so we can work with it
 	item, ok := iface.(*ClientInfo)
 	if !ok {
-		log.Fatal("Dequeued object is not an Item pointer")
+		return nil, fmt.Errorf("dequeued object is not an event: %T", iface)
 	}
 
-	return item
+	return item, nil
 }
 
-func (q *EventQueue) Peek() *ClientInfo {
-	var iface interface{}
-	var err interface{}
-
-	if iface, err = q.queue.PeekBlock(); err != nil {
-		log.Fatal("Error dequeuing item ", err)
+func (p *partition) peek() (*ClientInfo, error) {
+	iface, err := p.queue.PeekBlock()
+	if err != nil {
+		return nil, fmt.Errorf("peek event: %w", err)
 	}
 
 	// Assert type of the response to an Item pointer so we can work with it
 	item, ok := iface.(*ClientInfo)
 	if !ok {
-		log.Fatal("Dequeued object is not an Item pointer")
+		return nil, fmt.Errorf("peeked object is not an event: %T", iface)
+	}
+
+	return item, nil
+}
+
+func workerCount() int {
+	if config.Config.Queue.Workers < 1 {
+		return 1
+	}
+	return config.Config.Queue.Workers
+}
+
+func batchSize() int {
+	if config.Config.Queue.BatchSize < 1 {
+		return 1
 	}
+	return config.Config.Queue.BatchSize
+}
+
+func batchWait() time.Duration {
+	return time.Duration(config.Config.Queue.BatchWait) * time.Millisecond
+}
 
-	return item
+func partitionName(i int) string {
+	return fmt.Sprintf("%s-%d", constants.EVENT_QUEUE_NAME, i)
 }
 
-// ExampleDQue shows how the queue works
+// Connect opens a partition per worker and the dead-letter queue in the data
+// folder. Partitions from a previous run that no longer have a worker (and
+// the queue from before partitioning) are kept until they're drained.
 func (q *EventQueue) Connect() {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -72,28 +148,310 @@ func (q *EventQueue) Connect() {
 	}
 	qDir := path.Join(wd, config.Config.DataFolder)
 
+	// Create the partitions with segment size of 50
 	segmentSize := 50
 
-	// Create a new queue with segment size of 50
-	s, err := dque.NewOrOpen(constants.EVENT_QUEUE_NAME, qDir, segmentSize, ItemBuilder)
+	open := func(name string) *partition {
+		s, err := dque.NewOrOpen(name, qDir, segmentSize, ItemBuilder)
+		if err != nil {
+			log.Fatal("Error creating new dque ", err)
+		}
+		return &partition{name: name, dir: path.Join(qDir, name), queue: s}
+	}
+
+	workers := workerCount()
+	current := make(map[string]bool, workers)
+	q.partitions = make([]*partition, workers)
+	for i := range q.partitions {
+		q.partitions[i] = open(partitionName(i))
+		current[q.partitions[i].name] = true
+	}
+
+	existing, err := filepath.Glob(path.Join(qDir, constants.EVENT_QUEUE_NAME+"*"))
+	if err != nil {
+		log.Fatal("Error listing queues ", err)
+	}
+
+	q.draining = nil
+	for _, dir := range existing {
+		name := filepath.Base(dir)
+		if current[name] || !isPartitionName(name) {
+			continue
+		}
+
+		p := open(name)
+		if inflight, _ := p.loadInflight(); p.queue.Size() == 0 && len(inflight) == 0 {
+			p.queue.Close()
+			os.RemoveAll(dir)
+			continue
+		}
+
+		log.Printf("[QUEUE] Draining %d events left in %s", p.queue.Size(), name)
+		q.draining = append(q.draining, p)
+	}
+
+	// No event an erasure missed is left
+	if q.empty() {
+		if err := clearErasures(); err != nil {
+			log.Printf("ERROR: [QUEUE] Couldn't forget the erased visitors: %v", err)
+		}
+	}
+
+	deadLetter, err := OpenDeadLetterQueue(path.Join(qDir, constants.EVENT_DEAD_LETTER_NAME))
 	if err != nil {
-		log.Fatal("Error creating new dque ", err)
+		log.Fatal("Error opening dead-letter queue ", err)
 	}
-	q.queue = s
+	q.deadLetter = deadLetter
+	q.closing = make(chan struct{})
 }
 
-// Listen processes events from the queue synchronously (one at a time).
-// Events are processed in order: peek, handle, pop, repeat.
-// This ensures no parallel processing of queue events.
-func (q *EventQueue) Listen(handler func(item *ClientInfo)) {
-	log.Println("Queue listener started - waiting for events...")
-	go func() {
-		for {
-			b := q.Peek()
-			log.Printf("[QUEUE] Picked up event: domain=%s page=%s IP=%s UserAgent=%s", b.Domain, b.Page, b.IP, b.UserAgent)
-			// Process event synchronously - handler must complete before next event
-			handler(b)
-			q.Pop()
+// empty tells if no partition has events queued or in flight
+func (q *EventQueue) empty() bool {
+	for _, p := range q.all() {
+		if p.queue.Size() > 0 {
+			return false
+		}
+		if inflight, err := p.loadInflight(); err != nil || len(inflight) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func isPartitionName(name string) bool {
+	if name == constants.EVENT_QUEUE_NAME {
+		return true
+	}
+
+	suffix, found := strings.CutPrefix(name, constants.EVENT_QUEUE_NAME+"-")
+	if !found || suffix == "" {
+		return false
+	}
+	for _, r := range suffix {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops the workers and waits for them to finish the event they're
+// working on. An event that was still being retried stays queued for the
+// next start.
+func (q *EventQueue) Close() error {
+	close(q.closing)
+
+	var errs []error
+	for _, p := range q.all() {
+		if err := p.queue.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+		}
+	}
+
+	q.workers.Wait()
+	return errors.Join(errs...)
+}
+
+// Handler stores a batch of events for one site
+type Handler func(domain string, items []*ClientInfo) error
+
+// Listen starts a worker per partition. Each worker takes a batch of events
+// off its partition, hands it to the handler and only then forgets it, so
+// one batch is processed at a time and in order.
+func (q *EventQueue) Listen(handler Handler) {
+	partitions := q.all()
+	log.Printf("Queue listener started with %d workers - waiting for events...", len(partitions))
+
+	for _, p := range partitions {
+		q.workers.Add(1)
+		go func(p *partition) {
+			defer q.workers.Done()
+			q.work(p, handler)
+		}(p)
+	}
+}
+
+func (q *EventQueue) work(p *partition, handler Handler) {
+	pending, err := p.loadInflight()
+	if err != nil {
+		log.Printf("ERROR: [QUEUE] %s: couldn't read in-flight events: %v", p.name, err)
+	}
+	if len(pending) > 0 {
+		log.Printf("[QUEUE] Resuming %d in-flight events: queue=%s", len(pending), p.name)
+		if !q.processBatch(pending, handler) {
+			return
+		}
+		if err := p.ack(); err != nil {
+			log.Printf("ERROR: [QUEUE] %s: %v", p.name, err)
+		}
+	}
+
+	backoff := RETRY_BACKOFF
+	for {
+		first, err := p.peek()
+		if errors.Is(err, dque.ErrQueueClosed) {
+			log.Printf("[QUEUE] Worker for %s stopped", p.name)
+			return
+		}
+		if err != nil {
+			// Whatever is at the head can't be read, so there's nothing to
+			// retry. Drop it unless the queue itself is failing.
+			log.Printf("ERROR: [QUEUE] %s: %v", p.name, err)
+			if _, err := p.pop(); err != nil {
+				log.Printf("ERROR: [QUEUE] %s: %v - retrying in %s", p.name, err, backoff)
+				time.Sleep(backoff)
+				backoff = nextBackoff(backoff)
+			}
+			continue
+		}
+		backoff = RETRY_BACKOFF
+
+		batch, err := q.collect(p, first)
+		if err != nil && !errors.Is(err, dque.ErrQueueClosed) {
+			log.Printf("ERROR: [QUEUE] %s: %v", p.name, err)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		log.Printf("[QUEUE] Picked up %d events: queue=%s", len(batch), p.name)
+		if !q.processBatch(batch, handler) {
+			// Shutting down, the batch is still in flight for the next start
+			return
+		}
+
+		if err := p.ack(); err != nil {
+			log.Printf("ERROR: [QUEUE] %s: %v", p.name, err)
+		}
+	}
+}
+
+// collect takes events off the partition until the batch is full or the
+// batch wait is over. An error ends the batch early, the events taken so far
+// are still returned.
+func (q *EventQueue) collect(p *partition, first *ClientInfo) ([]*ClientInfo, error) {
+	batch := make([]*ClientInfo, 0, batchSize())
+	if err := p.take(first); err != nil {
+		return batch, err
+	}
+	batch = append(batch, first)
+
+	deadline := time.Now().Add(batchWait())
+	for len(batch) < batchSize() {
+		iface, err := p.queue.Peek()
+		if errors.Is(err, dque.ErrEmpty) {
+			if !time.Now().Before(deadline) {
+				break
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-q.closing:
+				return batch, nil
+			}
+			continue
+		}
+		if err != nil {
+			return batch, err
+		}
+
+		item, ok := iface.(*ClientInfo)
+		if !ok {
+			// Leave it at the head, the next batch starts by dropping it
+			break
+		}
+
+		if err := p.take(item); err != nil {
+			return batch, err
+		}
+		batch = append(batch, item)
+	}
+
+	return batch, nil
+}
+
+// processBatch hands the batch to the handler one site at a time, keeping the
+// order of the events. It returns false if it was interrupted by shutdown.
+func (q *EventQueue) processBatch(batch []*ClientInfo, handler Handler) bool {
+	domains := make([]string, 0)
+	groups := make(map[string][]*ClientInfo)
+	for _, item := range batch {
+		if _, exists := groups[item.Domain]; !exists {
+			domains = append(domains, item.Domain)
+		}
+		groups[item.Domain] = append(groups[item.Domain], item)
+	}
+
+	for _, domain := range domains {
+		if !q.process(domain, groups[domain], handler) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// process runs the handler until it succeeds or runs out of attempts. A
+// failed batch is then retried one event at a time, and an event that still
+// fails goes to the dead-letter queue so it can't hold up the ones behind it.
+// It returns false if it was interrupted by shutdown.
+func (q *EventQueue) process(domain string, items []*ClientInfo, handler Handler) bool {
+	backoff := RETRY_BACKOFF
+
+	var err error
+	for attempt := 1; attempt <= constants.EVENT_MAX_ATTEMPTS; attempt++ {
+		if err = safeHandle(domain, items, handler); err == nil {
+			return true
+		}
+
+		if attempt < constants.EVENT_MAX_ATTEMPTS {
+			log.Printf("WARNING: [QUEUE] Attempt %d/%d failed for %d events of domain=%s: %v - retrying in %s", attempt, constants.EVENT_MAX_ATTEMPTS, len(items), domain, err, backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-q.closing:
+				return false
+			}
+			backoff = nextBackoff(backoff)
+		}
+	}
+
+	if len(items) > 1 {
+		log.Printf("WARNING: [QUEUE] Batch of %d events for domain=%s keeps failing: %v - retrying one by one", len(items), domain, err)
+		for _, item := range items {
+			if !q.process(domain, []*ClientInfo{item}, handler) {
+				return false
+			}
+		}
+		return true
+	}
+
+	item := items[0]
+	letter, dlErr := q.deadLetter.Add(item, err, constants.EVENT_MAX_ATTEMPTS)
+	if dlErr != nil {
+		log.Printf("ERROR: [QUEUE] Dropping event for domain=%s page=%s, couldn't dead-letter it: %v (event error: %v)", item.Domain, item.Page, dlErr, err)
+		return true
+	}
+
+	log.Printf("ERROR: [QUEUE] Event dead-lettered after %d attempts: id=%s domain=%s page=%s: %v", letter.Attempts, letter.ID, item.Domain, item.Page, err)
+	return true
+}
+
+// safeHandle turns a panic in the handler into an error, so a poisoned event
+// doesn't take the server down with it
+func safeHandle(domain string, items []*ClientInfo, handler Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
 		}
 	}()
+
+	return handler(domain, items)
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > RETRY_MAX_BACKOFF {
+		return RETRY_MAX_BACKOFF
+	}
+	return backoff
 }
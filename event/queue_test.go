@@ -0,0 +1,259 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"tinylytics/config"
+)
+
+// openTestQueue connects a queue with the given number of workers in a
+// temporary data folder, with short retry backoffs
+func openTestQueue(t *testing.T, workers int) *EventQueue {
+	t.Helper()
+
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("data", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := config.Config
+	config.Config.DataFolder = "data"
+	config.Config.Queue = config.QueueConfig{Workers: workers, BatchSize: 10, BatchWait: 50}
+
+	backoff, maxBackoff := RETRY_BACKOFF, RETRY_MAX_BACKOFF
+	RETRY_BACKOFF, RETRY_MAX_BACKOFF = time.Millisecond, 5*time.Millisecond
+
+	t.Cleanup(func() {
+		config.Config = previous
+		RETRY_BACKOFF, RETRY_MAX_BACKOFF = backoff, maxBackoff
+	})
+
+	q := &EventQueue{}
+	q.Connect()
+	return q
+}
+
+// recorder is a handler that keeps the pages it was given, in order
+type recorder struct {
+	mu    sync.Mutex
+	pages []string
+	fail  func(items []*ClientInfo) error
+}
+
+func (r *recorder) handle(domain string, items []*ClientInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fail != nil {
+		if err := r.fail(items); err != nil {
+			return err
+		}
+	}
+	for _, item := range items {
+		r.pages = append(r.pages, item.Page)
+	}
+	return nil
+}
+
+func (r *recorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.pages...)
+}
+
+// waitFor polls until the condition is true, or fails the test
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func pushPages(t *testing.T, q *EventQueue, ip string, pages ...string) {
+	t.Helper()
+
+	for _, page := range pages {
+		if err := q.Push(testEvent(ip, page, time.Now().UTC())); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A batch that fails is retried until it's written
+func TestQueueRetries(t *testing.T) {
+	q := openTestQueue(t, 1)
+
+	attempts := 0
+	r := &recorder{fail: func(items []*ClientInfo) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("database is locked")
+		}
+		return nil
+	}}
+
+	pushPages(t, q, "203.0.113.7", "/1", "/2")
+	q.Listen(r.handle)
+	waitFor(t, "the batch", func() bool { return len(r.recorded()) == 2 })
+	q.Close()
+
+	if pages := r.recorded(); pages[0] != "/1" || pages[1] != "/2" {
+		t.Errorf("Pages were incorrect, got: %v, want: [/1 /2].", pages)
+	}
+	if size := q.DeadLetters().Size(); size != 0 {
+		t.Errorf("Dead letters were incorrect, got: %d, want: 0.", size)
+	}
+}
+
+// An event that keeps failing, or panicking, goes to the dead-letter queue
+// and the events behind it are still written
+func TestQueueDeadLetters(t *testing.T) {
+	q := openTestQueue(t, 1)
+
+	attempts := make(map[string]int)
+	r := &recorder{fail: func(items []*ClientInfo) error {
+		for _, item := range items {
+			switch item.Page {
+			case "/poison":
+				attempts[item.Page]++
+				return fmt.Errorf("can't store %s", item.Page)
+			case "/panic":
+				attempts[item.Page]++
+				panic("unexpected event")
+			}
+		}
+		return nil
+	}}
+
+	pushPages(t, q, "203.0.113.7", "/1", "/poison", "/2", "/panic", "/3")
+	q.Listen(r.handle)
+	waitFor(t, "the dead letters", func() bool { return q.DeadLetters().Size() == 2 })
+	waitFor(t, "the batch", func() bool { return len(r.recorded()) == 3 })
+	q.Close()
+
+	if pages := r.recorded(); fmt.Sprint(pages) != "[/1 /2 /3]" {
+		t.Errorf("Pages were incorrect, got: %v, want: [/1 /2 /3].", pages)
+	}
+
+	letters, err := q.DeadLetters().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, letter := range letters {
+		if letter.Attempts != 5 || letter.Error == "" {
+			t.Errorf("Dead letter %s was incorrect, got: %d attempts, error: %q, want: 5 attempts and the error.", letter.Item.Page, letter.Attempts, letter.Error)
+		}
+	}
+	if letters[0].Item.Page != "/poison" || letters[1].Error != "panic: unexpected event" {
+		t.Errorf("Dead letters were incorrect, got: %s (%s), %s (%s).", letters[0].Item.Page, letters[0].Error, letters[1].Item.Page, letters[1].Error)
+	}
+}
+
+// Events taken off the queue for a batch that wasn't written are processed
+// first on the next start
+func TestQueueResumesInflight(t *testing.T) {
+	q := openTestQueue(t, 1)
+
+	pushPages(t, q, "203.0.113.7", "/1", "/2")
+	p := q.partitions[0]
+	first, err := p.peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.collect(p, first); err != nil {
+		t.Fatal(err)
+	}
+	pushPages(t, q, "203.0.113.7", "/3")
+	q.Close()
+
+	q = &EventQueue{}
+	q.Connect()
+	r := &recorder{}
+	q.Listen(r.handle)
+	waitFor(t, "the events", func() bool { return len(r.recorded()) == 3 })
+	q.Close()
+
+	if pages := r.recorded(); fmt.Sprint(pages) != "[/1 /2 /3]" {
+		t.Errorf("Pages were incorrect, got: %v, want: [/1 /2 /3].", pages)
+	}
+}
+
+// Every event of a visitor lands in the same partition, and each visitor's
+// events are processed in order while the workers run concurrently
+func TestQueuePartitions(t *testing.T) {
+	q := openTestQueue(t, 4)
+
+	visitors := []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4", "203.0.113.5", "203.0.113.6"}
+	used := make(map[*partition]bool)
+	for _, ip := range visitors {
+		p := q.partitionFor(testEvent(ip, "/", time.Now().UTC()))
+		if other := q.partitionFor(testEvent(ip, "/other", time.Now().UTC().Add(time.Hour))); other != p {
+			t.Errorf("partitionFor(%s) was incorrect, got: %s and %s, want the same partition.", ip, p.name, other.name)
+		}
+		used[p] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("partitionFor was incorrect, got: %d partitions for %d visitors, want more than 1.", len(used), len(visitors))
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, ip := range visitors {
+			pushPages(t, q, ip, fmt.Sprintf("%s/%02d", ip, i))
+		}
+	}
+
+	r := &recorder{}
+	q.Listen(r.handle)
+	waitFor(t, "the events", func() bool { return len(r.recorded()) == 20*len(visitors) })
+	q.Close()
+
+	last := make(map[string]string)
+	for _, page := range r.recorded() {
+		ip := page[:len(page)-3]
+		if page < last[ip] {
+			t.Errorf("Events of %s were out of order, got: %s after %s.", ip, page, last[ip])
+		}
+		last[ip] = page
+	}
+}
+
+// Partitions left over from a larger worker count are drained, then removed
+// on the next start
+func TestQueueDrainsLeftoverPartitions(t *testing.T) {
+	q := openTestQueue(t, 4)
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4", "203.0.113.5", "203.0.113.6"} {
+		pushPages(t, q, ip, "/"+ip)
+	}
+	q.Close()
+
+	config.Config.Queue.Workers = 2
+	q = &EventQueue{}
+	q.Connect()
+	if len(q.partitions) != 2 || len(q.draining) == 0 {
+		t.Fatalf("Connect was incorrect, got: %d partitions, %d draining, want: 2 and the leftovers.", len(q.partitions), len(q.draining))
+	}
+
+	r := &recorder{}
+	q.Listen(r.handle)
+	waitFor(t, "the events", func() bool { return len(r.recorded()) == 6 })
+	q.Close()
+
+	q = &EventQueue{}
+	q.Connect()
+	defer q.Close()
+	if len(q.draining) != 0 {
+		t.Errorf("Draining partitions were incorrect, got: %d, want: 0.", len(q.draining))
+	}
+	if _, err := os.Stat("data/events-queue-3"); !os.IsNotExist(err) {
+		t.Errorf("Leftover partition was incorrect, got: %v, want: removed.", err)
+	}
+}
@@ -0,0 +1,125 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"tinylytics/archive"
+	"tinylytics/db"
+
+	"github.com/x-way/crawlerdetect"
+)
+
+// ArchiveEvent keeps an accepted event in the archive, so it can be
+// reprocessed later
+func ArchiveEvent(a *archive.Archive, item *ClientInfo) {
+	if err := a.Write(item.Time, item); err != nil {
+		log.Printf("WARNING: [ARCHIVE] Couldn't archive event for domain=%s page=%s: %v", item.Domain, item.Page, err)
+	}
+}
+
+// Reprocess rebuilds a site's sessions that started between from and to
+// (whole UTC days, inclusive) from the archived events. Sessions that started
+// before the range are left alone, including their events inside it. Sessions
+// that run past the end of the range are rebuilt with their events from the
+// following day. The range is rebuilt in memory and replaces the stored
+// sessions in one transaction, so a run that fails leaves them as they were.
+func Reprocess(dir string, domain string, from time.Time, to time.Time) (*ReprocessResult, error) {
+	start := from.UTC().Truncate(24 * time.Hour)
+	end := to.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+
+	missing, err := archive.MissingDays(dir, start, end.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the archive has no events for %s, reprocessing would lose data", strings.Join(missing, ", "))
+	}
+
+	database, err := db.GetDatabaseByDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReprocessResult{}
+
+	result.DeletedSessions, err = database.CountSessionsStartedBetween(start, end)
+	if err != nil {
+		return nil, fmt.Errorf("count sessions: %w", err)
+	}
+
+	batch := database.NewReplacingBatch(start, end)
+
+	// The day after the range is only read for sessions that continue into it
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		items, err := readArchivedDay(dir, domain, day)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range items {
+			if item.Time.Before(start) {
+				continue
+			}
+
+			session := batch.GetUserSessionAtTime(GetSessionUserIdent(item), item.Time)
+			if session != nil && (session.SessionStart.Before(start) || !session.SessionStart.Before(end)) {
+				// Still stored with the session it belongs to
+				continue
+			}
+			if session == nil && !item.Time.Before(end) {
+				// Would start a session after the range
+				continue
+			}
+
+			if crawlerdetect.IsCrawler(item.UserAgent) {
+				result.Bots++
+				continue
+			}
+
+			processEvent(batch, GetEventId(item), item)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		return result, fmt.Errorf("write sessions: %w", err)
+	}
+	result.Events = batch.Size()
+
+	result.Sessions, err = database.CountSessionsStartedBetween(start, end)
+	return result, err
+}
+
+type ReprocessResult struct {
+	DeletedSessions int64
+	Sessions        int64
+	Events          int
+	Bots            int
+}
+
+// readArchivedDay returns the site's archived events of a day, in the order
+// they happened
+func readArchivedDay(dir string, domain string, day time.Time) ([]*ClientInfo, error) {
+	items := make([]*ClientInfo, 0)
+
+	err := archive.ReadDay(dir, day, func(record []byte) error {
+		var item ClientInfo
+		if err := json.Unmarshal(record, &item); err != nil {
+			log.Printf("WARNING: [ARCHIVE] Skipping unreadable record: %v", err)
+			return nil
+		}
+		if item.Domain == domain {
+			items = append(items, &item)
+		}
+		return nil
+	})
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Time.Before(items[j].Time)
+	})
+
+	return items, err
+}
@@ -15,3 +15,10 @@ func GetSessionId(item *ClientInfo, startTime time.Time) string {
 	nm, _ := uuid.FromBytes([]byte("6ddc50f6-86e9-4dde-a9c2-fa33f01d141d"))
 	return uuid.NewSHA1(nm, []byte(item.UserAgent+item.Domain+item.HostName+item.IP+startTime.String())).String()
 }
+
+// GetEventId is derived from the event itself, so processing the same queued
+// event twice yields the same id
+func GetEventId(item *ClientInfo) string {
+	nm, _ := uuid.FromBytes([]byte("0c2f1b8e-5d7a-4e39-9f4b-2a6c8d1e3f57"))
+	return uuid.NewSHA1(nm, []byte(item.UserAgent+item.Domain+item.HostName+item.IP+item.Name+item.Page+item.Time.UTC().Format(time.RFC3339Nano))).String()
+}
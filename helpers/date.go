@@ -1,6 +1,9 @@
 package helpers
 
 import (
+	"errors"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -9,69 +12,201 @@ import (
 	n "github.com/jinzhu/now"
 )
 
+// ErrInvalidPeriod is returned for a period that isn't a named one, a range of
+// dates or a relative one
+var ErrInvalidPeriod = errors.New("invalid period")
+
+// PERIOD_RANGE_SEPARATOR separates the first and last day of a range, as in
+// "2024-01-01..2024-03-31"
+const PERIOD_RANGE_SEPARATOR = ".."
+
+// PERIOD_DAY_FORMAT is how the days of a range are written
+const PERIOD_DAY_FORMAT = "2006-01-02"
+
+// Relative periods go back from now, e.g. "last-14d" or "last-3m"
+var relativePeriod = regexp.MustCompile(`^last-([0-9]{1,4})([hdwmy])$`)
+
+// Weeks start on Monday
+var weekConfig = &n.Config{WeekStartDay: time.Monday}
+
+// ValidTimeZone tells if tz is the IANA name of a time zone, like
+// "Europe/Paris" or "UTC"
+func ValidTimeZone(tz string) bool {
+	if tz == "" {
+		return false
+	}
+	_, err := time.LoadLocation(tz)
+	return err == nil
+}
+
+// GetTimePeriod returns the UTC start of a period in the time zone, and its
+// end if it isn't open ended. Periods should be checked with ParsePeriod
+// first, an invalid one is the last 24 hours.
 func GetTimePeriod(input string, tz string) (time.Time, *time.Time) {
-	timeRange := make([]time.Time, 0)
+	start, end, err := ParsePeriod(input, tz)
+	if err == nil {
+		return start, end
+	}
 
-	loc, _ := time.LoadLocation(tz)
-	now := time.Now().In(loc)
+	if !ValidTimeZone(tz) {
+		tz = "UTC"
+	}
+	start, end, _ = ParsePeriod(constants.DATE_RAGE_24H, tz)
+	return start, end
+}
+
+// ParsePeriod returns the UTC start of a period in the time zone, and its end
+// if it isn't open ended. A period is one of the constants.DATE_RAGE_* names,
+// a day or a range of days such as "2024-01-01..2024-03-31" (either end can
+// also be an RFC 3339 time, and a range without a last day goes on until
+// now), a relative period such as "last-14d" (h, d, w, m or y), or
+// "<start>,<end>" in Unix seconds.
+func ParsePeriod(input string, tz string) (time.Time, *time.Time, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("unknown time zone %q", tz)
+	}
+
+	start, end, err := periodAt(input, time.Now().In(loc))
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if end == nil {
+		return start.UTC(), nil, nil
+	}
+	utcEnd := end.UTC()
+	return start.UTC(), &utcEnd, nil
+}
+
+// periodAt returns the start and end of the period at now, in now's time zone
+func periodAt(input string, now time.Time) (time.Time, *time.Time, error) {
+	var start time.Time
+	var end *time.Time
+	closed := func(from time.Time, to time.Time) {
+		start, end = from, &to
+	}
 
 	switch input {
 	case constants.DATE_RAGE_TODAY:
-		beginning := n.With(now).BeginningOfDay()
-		timeRange = append(timeRange, beginning)
+		start = n.With(now).BeginningOfDay()
 	case constants.DATE_RAGE_YESTERDAY:
-		beginning := n.With(now.AddDate(0, 0, -1)).BeginningOfDay()
-		ending := n.With(now.AddDate(0, 0, -1)).EndOfDay()
-		timeRange = append(timeRange, beginning, ending)
+		yesterday := n.With(now.AddDate(0, 0, -1))
+		closed(yesterday.BeginningOfDay(), yesterday.EndOfDay())
 	case constants.DATE_RAGE_24H:
-		timeRange = append(timeRange, now.Add(time.Duration(-24)*time.Hour))
+		start = now.Add(-24 * time.Hour)
 	case constants.DATE_RAGE_WEEK:
-		beginning := n.With(now).BeginningOfWeek().AddDate(0, 0, 1)
-		timeRange = append(timeRange, beginning)
+		start = weekConfig.With(now).BeginningOfWeek()
 	case constants.DATE_RAGE_LASTWEEK:
-		beginning := n.With(now).BeginningOfWeek().AddDate(0, 0, -6)
-		ending := n.With(now).EndOfWeek().AddDate(0, 0, -6)
-		timeRange = append(timeRange, beginning, ending)
+		lastWeek := weekConfig.With(now.AddDate(0, 0, -7))
+		closed(lastWeek.BeginningOfWeek(), lastWeek.EndOfWeek())
 	case constants.DATE_RAGE_7D:
-		timeRange = append(timeRange, now.AddDate(0, 0, -7))
+		start = now.AddDate(0, 0, -7)
 	case constants.DATE_RAGE_MONTH:
-		beginning := n.With(now).BeginningOfMonth()
-		timeRange = append(timeRange, beginning)
+		start = n.With(now).BeginningOfMonth()
 	case constants.DATE_RAGE_LASTMONTH:
-		beginning := n.With(now.AddDate(0, -1, 0)).BeginningOfMonth()
-		ending := n.With(now.AddDate(0, -1, 0)).EndOfMonth()
-		timeRange = append(timeRange, beginning, ending)
+		lastMonth := n.With(n.With(now).BeginningOfMonth().AddDate(0, -1, 0))
+		closed(lastMonth.BeginningOfMonth(), lastMonth.EndOfMonth())
 	case constants.DATE_RAGE_30D:
-		timeRange = append(timeRange, now.AddDate(0, 0, -30))
+		start = now.AddDate(0, 0, -30)
 	case constants.DATE_RAGE_90D:
-		timeRange = append(timeRange, now.AddDate(0, 0, -90))
+		start = now.AddDate(0, 0, -90)
 	case constants.DATE_RAGE_YEAR:
-		beginning := n.With(now).BeginningOfYear()
-		timeRange = append(timeRange, beginning)
+		start = n.With(now).BeginningOfYear()
 	case constants.DATE_RAGE_LASTYEAR:
-		beginning := n.With(now.AddDate(-1, 0, 0)).BeginningOfYear()
-		ending := n.With(now.AddDate(-1, 0, 0)).EndOfYear()
-		timeRange = append(timeRange, beginning, ending)
+		lastYear := n.With(now.AddDate(-1, 0, 0))
+		closed(lastYear.BeginningOfYear(), lastYear.EndOfYear())
 	case constants.DATE_RAGE_ALLTIME:
-		timeRange = append(timeRange, n.With(now.AddDate(-99, 0, 0)).BeginningOfYear())
+		start = n.With(now.AddDate(-99, 0, 0)).BeginningOfYear()
 	default:
-		parts := strings.Split(input, ",")
-		start, err := strconv.ParseInt(parts[0], 10, 64)
+		return parseCustomPeriod(input, now)
+	}
+
+	return start, end, nil
+}
+
+// parseCustomPeriod parses the periods that aren't named, now is in the
+// period's time zone
+func parseCustomPeriod(input string, now time.Time) (time.Time, *time.Time, error) {
+	invalid := func(reason string) (time.Time, *time.Time, error) {
+		return time.Time{}, nil, fmt.Errorf("%w %q: %s", ErrInvalidPeriod, input, reason)
+	}
+
+	if match := relativePeriod.FindStringSubmatch(input); match != nil {
+		count, _ := strconv.Atoi(match[1])
+		if count == 0 {
+			return invalid("it must go back at least 1")
+		}
+		switch match[2] {
+		case "h":
+			return now.Add(-time.Duration(count) * time.Hour), nil, nil
+		case "d":
+			return now.AddDate(0, 0, -count), nil, nil
+		case "w":
+			return now.AddDate(0, 0, -7*count), nil, nil
+		case "m":
+			return now.AddDate(0, -count, 0), nil, nil
+		default:
+			return now.AddDate(-count, 0, 0), nil, nil
+		}
+	}
+
+	if first, last, isUnix := strings.Cut(input, ","); isUnix {
+		from, err := strconv.ParseInt(first, 10, 64)
 		if err != nil {
-			panic(err)
+			return invalid("the start isn't a Unix time")
 		}
-		end, err := strconv.ParseInt(parts[1], 10, 64)
+		to, err := strconv.ParseInt(last, 10, 64)
 		if err != nil {
-			panic(err)
+			return invalid("the end isn't a Unix time")
 		}
-		timeRange = append(timeRange, time.Unix(start, 0), time.Unix(end, 0))
+		if to < from {
+			return invalid("it ends before it starts")
+		}
+		end := time.Unix(to, 0)
+		return time.Unix(from, 0), &end, nil
 	}
 
-	if len(timeRange) == 1 {
-		return timeRange[0].UTC(), nil
+	first, last, isRange := strings.Cut(input, PERIOD_RANGE_SEPARATOR)
+	if !isRange {
+		if _, err := parsePeriodTime(input, now.Location(), false); err != nil {
+			return invalid("expected a named period, a day or a range of days such as 2024-01-01..2024-03-31, or a relative period such as last-14d")
+		}
+		last = first
 	}
 
-	end := timeRange[1].UTC()
+	start, err := parsePeriodTime(first, now.Location(), false)
+	if err != nil {
+		return invalid("the start " + err.Error())
+	}
+	if last == "" {
+		if start.After(now) {
+			return invalid("it starts in the future")
+		}
+		return start, nil, nil
+	}
+
+	end, err := parsePeriodTime(last, now.Location(), true)
+	if err != nil {
+		return invalid("the end " + err.Error())
+	}
+	if end.Before(start) {
+		return invalid("it ends before it starts")
+	}
+	return start, &end, nil
+}
 
-	return timeRange[0].UTC(), &end
+// parsePeriodTime reads a day, its first instant or with endOfDay its last
+// one, or an RFC 3339 time
+func parsePeriodTime(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if day, err := time.ParseInLocation(PERIOD_DAY_FORMAT, value, loc); err == nil {
+		if endOfDay {
+			return n.With(day).EndOfDay(), nil
+		}
+		return day, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("isn't a day (YYYY-MM-DD) or an RFC 3339 time")
 }
@@ -0,0 +1,179 @@
+package helpers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var validTimeZoneTests = []struct {
+	input    string
+	expected bool
+}{
+	{"Europe/Paris", true},
+	{"America/New_York", true},
+	{"UTC", true},
+	{"", false},
+	{"Mars/Olympus_Mons", false},
+	{"../../etc/passwd", false},
+}
+
+func TestValidTimeZone(t *testing.T) {
+	for _, test := range validTimeZoneTests {
+		result := ValidTimeZone(test.input)
+		if result != test.expected {
+			t.Errorf("ValidTimeZone(%q) was incorrect, got: %v, want: %v.", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestGetTimePeriodTimeZone(t *testing.T) {
+	for _, tz := range []string{"UTC", "Australia/Sydney", "America/Los_Angeles", "Asia/Kolkata"} {
+		loc, _ := time.LoadLocation(tz)
+		now := time.Now().In(loc)
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+		start, end := GetTimePeriod("today", tz)
+		if !start.Equal(midnight) || end != nil {
+			t.Errorf("today in %s was incorrect, got: %v, %v, want: %v, nil.", tz, start, end, midnight.UTC())
+		}
+
+		start, end = GetTimePeriod("yesterday", tz)
+		yesterday := midnight.AddDate(0, 0, -1)
+		if !start.Equal(yesterday) || end == nil || !end.Before(midnight) || end.Before(midnight.Add(-time.Second)) {
+			t.Errorf("yesterday in %s was incorrect, got: %v, %v, want: %v to %v.", tz, start, end, yesterday.UTC(), midnight.UTC())
+		}
+	}
+}
+
+var parsePeriodTests = []struct {
+	input      string
+	start, end string // RFC 3339, empty for open ended
+}{
+	{"2024-01-01", "2024-01-01T00:00:00+01:00", "2024-01-01T23:59:59.999999999+01:00"},
+	{"2024-01-01..2024-03-31", "2024-01-01T00:00:00+01:00", "2024-03-31T23:59:59.999999999+02:00"},
+	{"2024-03-01..2024-03-01", "2024-03-01T00:00:00+01:00", "2024-03-01T23:59:59.999999999+01:00"},
+	{"2024-01-01..", "2024-01-01T00:00:00+01:00", ""},
+	{"2024-01-01T10:00:00Z..2024-01-02T10:00:00Z", "2024-01-01T10:00:00Z", "2024-01-02T10:00:00Z"},
+	{"1704067200,1711929599", "2024-01-01T00:00:00Z", "2024-03-31T23:59:59Z"},
+}
+
+func TestParsePeriod(t *testing.T) {
+	for _, test := range parsePeriodTests {
+		start, end, err := ParsePeriod(test.input, "Europe/Paris")
+		if err != nil {
+			t.Errorf("ParsePeriod(%q) failed: %v", test.input, err)
+			continue
+		}
+
+		expectedStart, _ := time.Parse(time.RFC3339Nano, test.start)
+		if !start.Equal(expectedStart) {
+			t.Errorf("ParsePeriod(%q) start was incorrect, got: %v, want: %v.", test.input, start, expectedStart)
+		}
+
+		if test.end == "" {
+			if end != nil {
+				t.Errorf("ParsePeriod(%q) end was incorrect, got: %v, want: nil.", test.input, end)
+			}
+			continue
+		}
+		expectedEnd, _ := time.Parse(time.RFC3339Nano, test.end)
+		if end == nil || !end.Equal(expectedEnd) {
+			t.Errorf("ParsePeriod(%q) end was incorrect, got: %v, want: %v.", test.input, end, expectedEnd)
+		}
+	}
+}
+
+var relativePeriodTests = []struct {
+	input    string
+	expected func(now time.Time) time.Time
+}{
+	{"last-12h", func(now time.Time) time.Time { return now.Add(-12 * time.Hour) }},
+	{"last-14d", func(now time.Time) time.Time { return now.AddDate(0, 0, -14) }},
+	{"last-2w", func(now time.Time) time.Time { return now.AddDate(0, 0, -14) }},
+	{"last-3m", func(now time.Time) time.Time { return now.AddDate(0, -3, 0) }},
+	{"last-1y", func(now time.Time) time.Time { return now.AddDate(-1, 0, 0) }},
+}
+
+func TestParseRelativePeriod(t *testing.T) {
+	for _, test := range relativePeriodTests {
+		before := time.Now()
+		start, end, err := ParsePeriod(test.input, "UTC")
+		after := time.Now()
+		if err != nil {
+			t.Errorf("ParsePeriod(%q) failed: %v", test.input, err)
+			continue
+		}
+		if start.Before(test.expected(before)) || start.After(test.expected(after)) || end != nil {
+			t.Errorf("ParsePeriod(%q) was incorrect, got: %v, %v, want: %v, nil.", test.input, start, end, test.expected(before))
+		}
+	}
+}
+
+var namedPeriodTests = []struct {
+	input string
+	now   string
+	start string
+	end   string
+}{
+	// A Sunday, this week started on Monday
+	{"week", "2024-03-17T12:00:00Z", "2024-03-11T00:00:00Z", ""},
+	{"lastweek", "2024-03-17T12:00:00Z", "2024-03-04T00:00:00Z", "2024-03-10T23:59:59.999999999Z"},
+	{"lastweek", "2024-03-18T12:00:00Z", "2024-03-11T00:00:00Z", "2024-03-17T23:59:59.999999999Z"},
+	// March 31st, February is shorter
+	{"lastmonth", "2024-03-31T12:00:00Z", "2024-02-01T00:00:00Z", "2024-02-29T23:59:59.999999999Z"},
+}
+
+func TestNamedPeriods(t *testing.T) {
+	for _, test := range namedPeriodTests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		start, end, err := periodAt(test.input, now)
+		if err != nil {
+			t.Errorf("%s on %s failed: %v", test.input, test.now, err)
+			continue
+		}
+
+		expectedStart, _ := time.Parse(time.RFC3339Nano, test.start)
+		if !start.Equal(expectedStart) {
+			t.Errorf("%s on %s start was incorrect, got: %v, want: %v.", test.input, test.now, start, expectedStart)
+		}
+		if test.end == "" {
+			if end != nil {
+				t.Errorf("%s on %s end was incorrect, got: %v, want: nil.", test.input, test.now, end)
+			}
+			continue
+		}
+		expectedEnd, _ := time.Parse(time.RFC3339Nano, test.end)
+		if end == nil || !end.Equal(expectedEnd) {
+			t.Errorf("%s on %s end was incorrect, got: %v, want: %v.", test.input, test.now, end, expectedEnd)
+		}
+	}
+}
+
+var invalidPeriodTests = []string{
+	"",
+	"tomorrow",
+	"2024-13-01",
+	"2024-03-31..2024-01-01",
+	"..2024-01-01",
+	"2024-01-01..soon",
+	"3000-01-01..",
+	"last-0d",
+	"last-14x",
+	"last-99999d",
+	"1711929599,1704067200",
+	"1704067200,",
+	"abc,def",
+}
+
+func TestParseInvalidPeriod(t *testing.T) {
+	for _, input := range invalidPeriodTests {
+		if _, _, err := ParsePeriod(input, "UTC"); !errors.Is(err, ErrInvalidPeriod) {
+			t.Errorf("ParsePeriod(%q) was incorrect, got: %v, want: %v.", input, err, ErrInvalidPeriod)
+		}
+	}
+
+	if _, _, err := ParsePeriod("today", "Mars/Olympus_Mons"); err == nil {
+		t.Errorf("ParsePeriod with an unknown time zone didn't fail")
+	}
+}
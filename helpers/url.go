@@ -70,3 +70,14 @@ func CleanupUrl(input string) (string, string) {
 
 	return domain, fullUrl
 }
+
+// PagePatternToLike turns a page pattern such as "/blog/*" into a LIKE pattern
+// matching the stored "domain/path" page format. "*" matches anything and the
+// result should be used with ESCAPE '\'.
+func PagePatternToLike(domain string, pattern string) string {
+	path := strings.Trim(strings.TrimSpace(pattern), "/")
+
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%")
+
+	return replacer.Replace(strings.Trim(domain, "/") + "/" + path)
+}
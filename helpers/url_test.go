@@ -115,3 +115,26 @@ func TestCleanupUrl(t *testing.T) {
 		}
 	}
 }
+
+type addPagePatternTest struct {
+	domain, pattern, expected string
+}
+
+var pagePatternToLikeTests = []addPagePatternTest{
+	{"oldavista.com", "/", "oldavista.com/"},
+	{"oldavista.com", "", "oldavista.com/"},
+	{"oldavista.com", "/search.php", "oldavista.com/search.php"},
+	{"oldavista.com", "search.php/", "oldavista.com/search.php"},
+	{"oldavista.com", "/blog/*", "oldavista.com/blog/%"},
+	{"oldavista.com", "*", "oldavista.com/%"},
+	{"oldavista.com", "/100%_real", `oldavista.com/100\%\_real`},
+}
+
+func TestPagePatternToLike(t *testing.T) {
+	for _, test := range pagePatternToLikeTests {
+		result := PagePatternToLike(test.domain, test.pattern)
+		if result != test.expected {
+			t.Errorf("For %s Result was incorrect, got: %s, want: %s.", test.pattern, result, test.expected)
+		}
+	}
+}
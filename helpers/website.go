@@ -4,6 +4,7 @@ import (
 	"errors"
 	"path"
 	conf "tinylytics/config"
+	"tinylytics/constants"
 
 	"github.com/google/uuid"
 )
@@ -17,6 +18,16 @@ func FindWebsite(domain string) (*conf.WebsiteConfig, error) {
 	return nil, errors.New("site not found")
 }
 
+// SiteTimeZone returns the time zone a site's days are counted in, the
+// default one when it has none or it isn't a known zone
+func SiteTimeZone(domain string) string {
+	site, err := FindWebsite(domain)
+	if err != nil || !ValidTimeZone(site.TimeZone) {
+		return constants.DEFAULT_TIMEZONE
+	}
+	return site.TimeZone
+}
+
 func GetDatabaseFileName(domain string) (string, error) {
 	site, err := FindWebsite(domain)
 	if err != nil {
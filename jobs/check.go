@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"errors"
+	"log"
+	"time"
+	"tinylytics/config"
+	"tinylytics/db"
+	"tinylytics/metrics"
+)
+
+// CheckConsistency compares the SQLite and DuckDB databases of every site
+// that has both, over the last days days, and logs what differs
+func CheckConsistency(days int, repair bool) {
+	to := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	from := to.AddDate(0, 0, -days)
+
+	for _, site := range config.Config.Websites {
+		report, err := db.CheckSite(site.Domain, from, to, repair)
+		if errors.Is(err, db.ErrNoCopy) {
+			continue
+		}
+		if err != nil {
+			log.Printf("ERROR: [CHECK] %s: %v", site.Domain, err)
+			continue
+		}
+
+		for _, discrepancy := range report.Discrepancies {
+			metrics.CheckDiscrepancies.Inc(site.Domain, discrepancy.Table)
+			log.Printf("WARNING: [CHECK] %s: %s", site.Domain, discrepancy)
+		}
+		if report.RepairSkipped != "" {
+			log.Printf("WARNING: [CHECK] %s: not repaired, %s", site.Domain, report.RepairSkipped)
+		}
+		log.Printf("[CHECK] %s: %d days checked, %d with discrepancies", site.Domain, report.Days, len(report.Discrepancies))
+	}
+}
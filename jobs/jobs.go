@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Scheduler runs maintenance jobs in the background while the server is up
+type Scheduler struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{stop: make(chan struct{})}
+}
+
+// Every runs the job after the first interval and then every interval. A run
+// that's still going when the interval is up delays the next one.
+func (s *Scheduler) Every(name string, interval time.Duration, job func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				log.Printf("[JOBS] Running %s", name)
+				run(name, job)
+			}
+		}
+	}()
+}
+
+// run keeps a failing job from taking the server down
+func run(name string, job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: [JOBS] %s panicked: %v", name, r)
+		}
+	}()
+	job()
+}
+
+// Stop waits for running jobs to finish, no new runs are started
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"log"
+	"time"
+	"tinylytics/config"
+	"tinylytics/db"
+	"tinylytics/metrics"
+)
+
+// HasRetention reports whether any site has a retention period
+func HasRetention() bool {
+	for _, site := range config.Config.Websites {
+		if site.RetentionDays > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeExpired deletes the sessions and events of each site that are older
+// than its retention period. Whole UTC days are purged.
+func PurgeExpired() {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	for _, site := range config.Config.Websites {
+		if site.RetentionDays <= 0 {
+			continue
+		}
+
+		before := today.AddDate(0, 0, -site.RetentionDays)
+		results, err := db.PurgeSite(site.Domain, before, site.KeepDailyTotals)
+		for _, result := range results {
+			metrics.RetentionPurged.Add(float64(result.Sessions), site.Domain, "user_sessions")
+			metrics.RetentionPurged.Add(float64(result.Events), site.Domain, "user_events")
+			log.Printf("[RETENTION] %s (%s): purged %d sessions and %d events before %s, %d KB -> %d KB",
+				site.Domain, result.Store, result.Sessions, result.Events, before.Format(time.DateOnly), result.SizeBefore/1024, result.SizeAfter/1024)
+		}
+		if err != nil {
+			log.Printf("ERROR: [RETENTION] %s: %v", site.Domain, err)
+		}
+	}
+}
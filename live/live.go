@@ -0,0 +1,227 @@
+package live
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// WINDOW is how long a visitor counts as active after their last event
+const WINDOW = 5 * time.Minute
+
+const TOP_ITEMS = 10
+const RECENT_EVENTS = 20
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Visitor string    `json:"-"`
+	Name    string    `json:"name"`
+	Page    string    `json:"page"`
+	Referer string    `json:"referer"`
+	Country string    `json:"country"`
+	Browser string    `json:"browser"`
+}
+
+type Item struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type Snapshot struct {
+	Domain         string   `json:"domain"`
+	ActiveVisitors int      `json:"activeVisitors"`
+	TopPages       []Item   `json:"topPages"`
+	TopReferrers   []Item   `json:"topReferrers"`
+	Recent         []*Event `json:"recent"`
+}
+
+type site struct {
+	events      []*Event
+	subscribers map[chan *Snapshot]struct{}
+}
+
+// Hub keeps the last few minutes of processed events per domain in memory
+// and pushes a fresh snapshot to every subscriber when a new one arrives
+type Hub struct {
+	mu    sync.Mutex
+	sites map[string]*site
+}
+
+var hub = &Hub{
+	sites: make(map[string]*site),
+}
+
+func (h *Hub) getSite(domain string) *site {
+	s, exists := h.sites[domain]
+	if !exists {
+		s = &site{subscribers: make(map[chan *Snapshot]struct{})}
+		h.sites[domain] = s
+	}
+	return s
+}
+
+// Record adds a processed event and notifies the domain's subscribers
+func Record(domain string, event *Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	// Events replayed from a backlog aren't live anymore
+	now := time.Now().UTC()
+	if event.Time.Before(now.Add(-WINDOW)) {
+		return
+	}
+
+	s := hub.getSite(domain)
+	s.events = append(s.events, event)
+	s.prune(now)
+
+	if len(s.subscribers) == 0 {
+		return
+	}
+
+	snapshot := s.snapshot(domain, now)
+	for ch := range s.subscribers {
+		// Drop the stale snapshot a slow client hasn't read yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- snapshot
+	}
+}
+
+// GetSnapshot returns the current activity for a domain
+func GetSnapshot(domain string) *Snapshot {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	now := time.Now().UTC()
+	s := hub.getSite(domain)
+	s.prune(now)
+	return s.snapshot(domain, now)
+}
+
+// Subscribe returns a channel receiving a snapshot after every new event for
+// the domain, and a function to stop receiving them. The channel is closed
+// when the subscription ends.
+func Subscribe(domain string) (<-chan *Snapshot, func()) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ch := make(chan *Snapshot, 1)
+	hub.getSite(domain).subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+
+		s := hub.getSite(domain)
+		if _, exists := s.subscribers[ch]; exists {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription so streaming handlers can return on shutdown
+func Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, s := range hub.sites {
+		for ch := range s.subscribers {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// prune drops events that fell out of the window. The workers process
+// visitors in parallel, so events don't arrive in time order.
+func (s *site) prune(now time.Time) {
+	cutoff := now.Add(-WINDOW)
+
+	kept := make([]*Event, 0, len(s.events))
+	for _, e := range s.events {
+		if !e.Time.Before(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+
+	if len(kept) < len(s.events) {
+		s.events = kept
+	}
+}
+
+func (s *site) snapshot(domain string, now time.Time) *Snapshot {
+	cutoff := now.Add(-WINDOW)
+
+	// The last event of each visitor tells which page they're on right now
+	latest := make(map[string]*Event)
+	referrers := make(map[string]map[string]struct{})
+	active := make([]*Event, 0, len(s.events))
+
+	for _, e := range s.events {
+		if e.Time.Before(cutoff) {
+			continue
+		}
+		active = append(active, e)
+
+		if current, exists := latest[e.Visitor]; !exists || !e.Time.Before(current.Time) {
+			latest[e.Visitor] = e
+		}
+
+		if referrers[e.Referer] == nil {
+			referrers[e.Referer] = make(map[string]struct{})
+		}
+		referrers[e.Referer][e.Visitor] = struct{}{}
+	}
+
+	pages := make(map[string]int64)
+	for _, e := range latest {
+		pages[e.Page]++
+	}
+
+	referrerCounts := make(map[string]int64, len(referrers))
+	for referrer, visitors := range referrers {
+		referrerCounts[referrer] = int64(len(visitors))
+	}
+
+	// Recent events go newest first, those recorded later first if they're
+	// as old
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].Time.Before(active[j].Time)
+	})
+	recent := make([]*Event, 0, RECENT_EVENTS)
+	for i := len(active) - 1; i >= 0 && len(recent) < RECENT_EVENTS; i-- {
+		recent = append(recent, active[i])
+	}
+
+	return &Snapshot{
+		Domain:         domain,
+		ActiveVisitors: len(latest),
+		TopPages:       topItems(pages),
+		TopReferrers:   topItems(referrerCounts),
+		Recent:         recent,
+	}
+}
+
+func topItems(counts map[string]int64) []Item {
+	items := make([]Item, 0, len(counts))
+	for value, count := range counts {
+		items = append(items, Item{Value: value, Count: count})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count == items[j].Count {
+			return items[i].Value < items[j].Value
+		}
+		return items[i].Count > items[j].Count
+	})
+
+	if len(items) > TOP_ITEMS {
+		items = items[:TOP_ITEMS]
+	}
+
+	return items
+}
@@ -0,0 +1,52 @@
+package live
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordOutOfOrder(t *testing.T) {
+	domain := "out-of-order.com"
+	now := time.Now().UTC()
+
+	// An old event processed after a newer one, and one replayed from a backlog
+	Record(domain, &Event{Time: now.Add(-time.Minute), Visitor: "a", Page: "/new"})
+	Record(domain, &Event{Time: now.Add(-2 * time.Minute), Visitor: "a", Page: "/old"})
+	Record(domain, &Event{Time: now.Add(-time.Hour), Visitor: "b", Page: "/backlog"})
+	Record(domain, &Event{Time: now.Add(-30 * time.Second), Visitor: "c", Page: "/new"})
+
+	snapshot := GetSnapshot(domain)
+	if snapshot.ActiveVisitors != 2 {
+		t.Errorf("ActiveVisitors was incorrect, got: %d, want: %d.", snapshot.ActiveVisitors, 2)
+	}
+	if len(snapshot.TopPages) != 1 || snapshot.TopPages[0].Value != "/new" || snapshot.TopPages[0].Count != 2 {
+		t.Errorf("TopPages was incorrect, got: %v, want: [{/new 2}].", snapshot.TopPages)
+	}
+
+	expected := []string{"c", "a", "a"}
+	if len(snapshot.Recent) != len(expected) {
+		t.Fatalf("Recent was incorrect, got: %d events, want: %d.", len(snapshot.Recent), len(expected))
+	}
+	for i, event := range snapshot.Recent {
+		if event.Visitor != expected[i] {
+			t.Errorf("Recent[%d] was incorrect, got: %s, want: %s.", i, event.Visitor, expected[i])
+		}
+	}
+	if snapshot.Recent[1].Page != "/new" {
+		t.Errorf("Recent[1] was incorrect, got: %s, want: /new.", snapshot.Recent[1].Page)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now().UTC()
+	s := &site{events: []*Event{
+		{Time: now.Add(-time.Minute), Visitor: "a"},
+		{Time: now.Add(-10 * time.Minute), Visitor: "b"},
+		{Time: now, Visitor: "c"},
+	}}
+
+	s.prune(now)
+	if len(s.events) != 2 || s.events[0].Visitor != "a" || s.events[1].Visitor != "c" {
+		t.Errorf("Events were incorrect after prune, got: %d events.", len(s.events))
+	}
+}
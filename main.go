@@ -10,12 +10,19 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
+	"tinylytics/archive"
 	"tinylytics/config"
+	"tinylytics/constants"
 	"tinylytics/db"
 	"tinylytics/event"
 	"tinylytics/geo"
+	"tinylytics/helpers"
+	"tinylytics/jobs"
+	"tinylytics/live"
+	"tinylytics/metrics"
 	"tinylytics/routes"
 	"tinylytics/ua"
 
@@ -28,6 +35,9 @@ func initializeDatabases() {
 	domains := make([]string, 0, len(config.Config.Websites))
 	for _, element := range config.Config.Websites {
 		fmt.Println("Initializing database for domain: ", element.Domain)
+		if element.TimeZone != "" && !helpers.ValidTimeZone(element.TimeZone) {
+			log.Printf("WARNING: %s has an unknown time zone %q, using %s", element.Domain, element.TimeZone, constants.DEFAULT_TIMEZONE)
+		}
 		domains = append(domains, element.Domain)
 	}
 
@@ -61,18 +71,48 @@ func init() {
 
 	ua.Initialize()
 	geo.Initialize()
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
 
 	initializeDatabases()
 
 	eventQueue.Connect()
-}
 
-func main() {
+	var eventArchive *archive.Archive
+	if config.Config.Archive.Enabled {
+		var err error
+		eventArchive, err = archive.Open(helpers.GetDataPath(constants.ARCHIVE_FOLDER_NAME), config.Config.Archive.RetentionDays)
+		if err != nil {
+			log.Fatalf("Failed to open event archive: %v", err)
+		}
+	}
+
 	router := gin.Default()
+	router.Use(routes.Metrics())
+
+	metrics.NewGaugeFunc("tinylytics_queue_depth", "Events waiting in the queue.", func() float64 {
+		return float64(eventQueue.GetSize())
+	})
+	metrics.NewGaugeFunc("tinylytics_queue_dead_letters", "Events that failed processing and were set aside.", func() float64 {
+		return float64(eventQueue.DeadLetters().Size())
+	})
+	metrics.NewGaugeFunc("tinylytics_queue_overloaded", "Whether the queue is above a high-water mark (1) or not (0).", func() float64 {
+		if eventQueue.GetOverload().Overloaded {
+			return 1
+		}
+		return 0
+	})
 
 	// Load HTML templates with custom functions
 	router.SetFuncMap(template.FuncMap{
-		"jsonItems": routes.JSONItems,
+		"jsonItems":  routes.JSONItems,
+		"formatPage": routes.FormatPageURL,
+		"lower":      strings.ToLower,
 		"dict": func(values ...interface{}) (map[string]interface{}, error) {
 			if len(values)%2 != 0 {
 				return nil, fmt.Errorf("dict: number of arguments must be even")
@@ -103,7 +143,7 @@ func main() {
 	// API routes for event tracking
 	api := router.Group("/api")
 	{
-		api.POST("/event", routes.PostEvent(&eventQueue))
+		api.POST("/event", routes.PostEvent(&eventQueue, eventArchive))
 		api.GET("/sites", routes.GetWebsites)
 		api.GET("/:domain/summaries", routes.GetSummaries)
 		api.GET("/:domain/browsers", routes.GetBrowsers)
@@ -111,11 +151,41 @@ func main() {
 		api.GET("/:domain/countries", routes.GetCountries)
 		api.GET("/:domain/pages", routes.GetPages)
 		api.GET("/:domain/referrers", routes.GetReferrers)
+		api.GET("/:domain/flow", routes.GetFlow)
+		api.GET("/:domain/funnels", routes.GetFunnels)
+		api.POST("/:domain/funnels", routes.AdminOnly(), routes.CreateFunnel)
+		api.PUT("/:domain/funnels/:id", routes.AdminOnly(), routes.UpdateFunnel)
+		api.DELETE("/:domain/funnels/:id", routes.AdminOnly(), routes.DeleteFunnel)
+		api.GET("/:domain/funnels/:id/report", routes.GetFunnelReport)
+		api.GET("/:domain/cohorts", routes.GetCohorts)
+		api.GET("/:domain/daily-totals", routes.GetDailyTotals)
+		api.GET("/:domain/live", routes.GetLive)
+		api.GET("/:domain/live/stream", routes.GetLiveStream)
+		api.GET("/:domain/sessions", routes.GetSessions)
+		api.GET("/:domain/sessions/:id", routes.GetSessionTimeline)
+	}
+
+	// Admin routes, these need the configured credentials
+	admin := api.Group("/admin", routes.AdminOnly())
+	{
+		admin.GET("/dead-letters", routes.GetDeadLetters(&eventQueue))
+		admin.GET("/dead-letters/:id", routes.GetDeadLetter(&eventQueue))
+		admin.POST("/dead-letters/:id/replay", routes.ReplayDeadLetter(&eventQueue))
+		admin.DELETE("/dead-letters/:id", routes.DiscardDeadLetter(&eventQueue))
+		admin.POST("/backups", routes.CreateBackups)
+		admin.GET("/export/:domain", routes.ExportData)
+		admin.POST("/console/:domain", routes.RunConsoleQuery)
+		admin.GET("/console/:domain/queries", routes.GetConsoleQueries)
+		admin.POST("/console/:domain/queries", routes.SaveConsoleQuery)
+		admin.DELETE("/console/:domain/queries/:id", routes.DeleteConsoleQuery)
+		admin.POST("/privacy/:domain/access", routes.AccessVisitor)
+		admin.POST("/privacy/:domain/erase", routes.EraseVisitor(&eventQueue, eventArchive))
 	}
 
 	// HTML template routes using query params to avoid greedy route matching
 	router.GET("/", routes.GetAnalyticsPage)
 	router.GET("/analytics", routes.GetAnalyticsPage)
+	router.GET("/metrics", routes.GetMetrics)
 
 	// HTML fragment routes for HTMX (using same endpoints as API but with Accept header or query param)
 	router.GET("/summary-cards", routes.GetSummaries)
@@ -124,8 +194,29 @@ func main() {
 	router.GET("/pages-table", routes.GetPages)
 	router.GET("/referrers-table", routes.GetReferrers)
 	router.GET("/countries-table", routes.GetCountries)
+	router.GET("/flow-table", routes.GetFlow)
+	router.GET("/funnels-table", routes.GetFunnelReport)
+	router.GET("/cohorts-table", routes.GetCohorts)
+	router.GET("/sessions-table", routes.GetSessions)
+	router.GET("/session-timeline", routes.GetSessionTimeline)
+	router.GET("/queue-status", routes.GetQueueStatus(&eventQueue))
+	router.GET("/console", routes.AdminOnly(), routes.GetConsole)
 
-	eventQueue.Listen(event.ProcessEvent)
+	// Signing in only sets a cookie, the dashboard itself stays public
+	router.GET("/login", routes.AdminOnly(), routes.Login)
+	router.GET("/logout", routes.Logout)
+
+	eventQueue.Listen(event.ProcessEvents)
+
+	scheduler := jobs.NewScheduler()
+	if config.Config.Check.Enabled {
+		scheduler.Every("consistency check", time.Duration(config.Config.Check.Interval)*time.Hour, func() {
+			jobs.CheckConsistency(config.Config.Check.Days, config.Config.Check.Repair)
+		})
+	}
+	if jobs.HasRetention() {
+		scheduler.Every("retention purge", time.Duration(config.Config.Retention.Interval)*time.Hour, jobs.PurgeExpired)
+	}
 
 	// Create HTTP server
 	srv := &http.Server{
@@ -133,6 +224,9 @@ func main() {
 		Handler: router,
 	}
 
+	// Live streams never finish on their own, so end them when shutting down
+	srv.RegisterOnShutdown(live.Close)
+
 	// Start server in a goroutine
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -155,6 +249,17 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	scheduler.Stop()
+
+	// Stop the queue listener before the databases go away
+	if err := eventQueue.Close(); err != nil {
+		log.Printf("Error closing event queue: %v", err)
+	}
+
+	if err := eventArchive.Close(); err != nil {
+		log.Printf("Error closing event archive: %v", err)
+	}
+
 	// Close all database connections
 	log.Println("Closing database connections...")
 	db.CloseAll()
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterWrite(t *testing.T) {
+	c := &Counter{desc: desc{"test_total", "A test counter.", []string{"site"}}, values: make(map[string]float64)}
+	c.Inc("b.com")
+	c.Add(2, "a.com")
+	c.Inc(`quo"te`)
+
+	var out strings.Builder
+	c.write(&out)
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{site="a.com"} 2
+test_total{site="b.com"} 1
+test_total{site="quo\"te"} 1
+`
+	if out.String() != expected {
+		t.Errorf("Result was incorrect, got:\n%s\nwant:\n%s", out.String(), expected)
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := &Histogram{desc: desc{"test_seconds", "A test histogram.", []string{"db"}}, buckets: []float64{0.1, 1}, values: make(map[string]*histogramValue)}
+	h.Observe(0.05, "sqlite")
+	h.Observe(0.5, "sqlite")
+	h.Observe(5, "sqlite")
+
+	var out strings.Builder
+	h.write(&out)
+
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{db="sqlite",le="0.1"} 1
+test_seconds_bucket{db="sqlite",le="1"} 2
+test_seconds_bucket{db="sqlite",le="+Inf"} 3
+test_seconds_sum{db="sqlite"} 5.55
+test_seconds_count{db="sqlite"} 3
+`
+	if out.String() != expected {
+		t.Errorf("Result was incorrect, got:\n%s\nwant:\n%s", out.String(), expected)
+	}
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import "tinylytics/helpers"
+
+// Buckets for the time events spend waiting in the queue, in seconds
+var LagBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+var (
+	EventsAccepted  = NewCounter("tinylytics_events_accepted_total", "Events accepted by the API and queued.", "site")
+	EventsRejected  = NewCounter("tinylytics_events_rejected_total", "Events refused by the API.", "site", "reason")
+	EventsBots      = NewCounter("tinylytics_events_bot_total", "Queued events dropped because they came from a crawler.", "site")
+	EventsProcessed = NewCounter("tinylytics_events_processed_total", "Events written to the databases.", "site")
+	QueueLag        = NewHistogram("tinylytics_queue_lag_seconds", "Time between an event being received and written to the databases.", LagBuckets, "site")
+	DBWriteDuration = NewHistogram("tinylytics_db_write_duration_seconds", "Time taken to write a batch of events, per storage backend.", LatencyBuckets, "database")
+	HTTPRequests    = NewCounter("tinylytics_http_requests_total", "HTTP requests handled.", "method", "route", "status")
+	HTTPDuration    = NewHistogram("tinylytics_http_request_duration_seconds", "Time taken to handle HTTP requests.", LatencyBuckets, "method", "route")
+
+	CheckDiscrepancies = NewCounter("tinylytics_check_discrepancies_total", "Days whose rows differed between SQLite and DuckDB when checked.", "site", "table")
+	RetentionPurged    = NewCounter("tinylytics_retention_purged_total", "Rows deleted because they were older than the site's retention period.", "site", "table")
+	QueryCacheRequests = NewCounter("tinylytics_query_cache_requests_total", "Dashboard queries answered from the cache (hit) or the database (miss).", "result")
+)
+
+// Site is the label for a domain. Anything that isn't a configured site shares
+// one label, so random domains sent to the API can't create new series.
+func Site(domain string) string {
+	if _, err := helpers.FindWebsite(domain); err != nil {
+		return "(unknown)"
+	}
+	return domain
+}
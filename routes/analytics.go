@@ -8,8 +8,10 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"time"
 	"tinylytics/config"
 	"tinylytics/db"
+	"tinylytics/helpers"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,9 +23,15 @@ type TemplateData struct {
 	Websites      []config.WebsiteConfig
 	CurrentPeriod string
 	Periods       []PeriodOption
+	CustomPeriod  bool   // The period isn't one of Periods, the date picker is shown
+	PeriodFrom    string // First and last day of the period, for the date picker
+	PeriodTo      string
+	TimeZone      string // The zone the viewer picked, empty for the site's
+	TimeZones     []PeriodOption
 	ActiveFilters []ActiveFilter
 	Summary       *SummaryData
 	QueryString   string
+	Admin         bool // Signed in, admin-only windows are shown
 }
 
 type SummaryData struct {
@@ -90,8 +98,15 @@ func GetAnalyticsPage(c *gin.Context) {
 		}
 	}
 
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
 	// Build template data WITHOUT fetching database data
 	data := buildTemplateDataShell(c, domain)
+	data.CustomPeriod = !isPeriodOption(data.CurrentPeriod)
+	data.PeriodFrom, data.PeriodTo = periodDays(q)
 	c.HTML(http.StatusOK, "analytics.html", data)
 }
 
@@ -105,10 +120,16 @@ func GetSummaries(c *gin.Context) {
 		return
 	}
 
-	sessions := database.GetSessions(c)
-	pageViews := database.GetPageViews(c)
-	avgSessionDuration := database.GetAvgSessionDuration(c)
-	bounceRate := database.GetBounceRate(c)
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	sessions := database.GetSessions(ctx, q)
+	pageViews := database.GetPageViews(ctx, q)
+	avgSessionDuration := database.GetAvgSessionDuration(ctx, q)
+	bounceRate := database.GetBounceRate(ctx, q)
 
 	summary := &SummaryData{
 		Sessions:           sessions,
@@ -135,12 +156,21 @@ func GetBrowsers(c *gin.Context) {
 		return
 	}
 
-	items, err := database.GetBrowsers(c)
+	q, ok := parseBreakdownQuery(c)
+	if !ok {
+		return
+	}
+	breakdown, err := database.GetBrowsers(c.Request.Context(), q)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Couldn't get browsers")
 		return
 	}
 
+	if wantsJSON(c) {
+		writeBreakdownJSON(c, breakdown, q)
+		return
+	}
+
 	previousFilters := make([]string, 0)
 	browser, hasBrowser := c.GetQuery("b")
 	browserVersion, hasBrowserVersion := c.GetQuery("bv")
@@ -153,18 +183,19 @@ func GetBrowsers(c *gin.Context) {
 		previousFilters = append(previousFilters, bver...)
 	}
 
-	itemsWithIcons := processBrowserItems(items, browser, browserVersion, previousFilters, len(items) > 1)
+	itemsWithIcons := processBrowserItems(breakdown.Items, browser, browserVersion, previousFilters, breakdown.Rows > 1)
 
 	data := map[string]interface{}{
 		"Domain":          domain,
 		"CurrentPeriod":   c.DefaultQuery("p", "24h"),
 		"PreviousFilters": previousFilters,
 		"Items":           itemsWithIcons,
-		"QueryString":     buildQueryString(c),
+		"QueryString":     buildQueryString(c, breakdownParams...),
 		"FilterPrimary":   "b",
 		"FilterSecondary": "bv",
 	}
 
+	addBreakdownPaging(c, data, breakdown, q)
 	c.HTML(http.StatusOK, "browsers-table.html", data)
 }
 
@@ -178,12 +209,21 @@ func GetOSs(c *gin.Context) {
 		return
 	}
 
-	items, err := database.GetOSs(c)
+	q, ok := parseBreakdownQuery(c)
+	if !ok {
+		return
+	}
+	breakdown, err := database.GetOSs(c.Request.Context(), q)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Couldn't get OSs")
 		return
 	}
 
+	if wantsJSON(c) {
+		writeBreakdownJSON(c, breakdown, q)
+		return
+	}
+
 	previousFilters := make([]string, 0)
 	os, hasOs := c.GetQuery("os")
 	osVersion, hasOsVersion := c.GetQuery("osv")
@@ -196,18 +236,19 @@ func GetOSs(c *gin.Context) {
 		previousFilters = append(previousFilters, osver...)
 	}
 
-	processedItems := processOSItems(items, os, osVersion, previousFilters, len(items) > 1)
+	processedItems := processOSItems(breakdown.Items, os, osVersion, previousFilters, breakdown.Rows > 1)
 
 	data := map[string]interface{}{
 		"Domain":          domain,
 		"CurrentPeriod":   c.DefaultQuery("p", "24h"),
 		"PreviousFilters": previousFilters,
 		"Items":           processedItems,
-		"QueryString":     buildQueryString(c),
+		"QueryString":     buildQueryString(c, breakdownParams...),
 		"FilterPrimary":   "os",
 		"FilterSecondary": "osv",
 	}
 
+	addBreakdownPaging(c, data, breakdown, q)
 	c.HTML(http.StatusOK, "os-table.html", data)
 }
 
@@ -221,25 +262,36 @@ func GetCountries(c *gin.Context) {
 		return
 	}
 
-	items, err := database.GetCountries(c)
+	q, ok := parseBreakdownQuery(c)
+	if !ok {
+		return
+	}
+	breakdown, err := database.GetCountries(c.Request.Context(), q)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Couldn't get Countries")
 		return
 	}
 
+	if wantsJSON(c) {
+		writeBreakdownJSON(c, breakdown, q)
+		return
+	}
+
 	country, hasCountry := c.GetQuery("c")
 	previousFilters := make([]string, 0)
 	if hasCountry {
 		previousFilters = append(previousFilters, getCountryName(country))
 	}
 
-	// Process all items for the map
-	processedItemsAll := processCountryItems(items, country, previousFilters, len(items) > 1)
+	tableItems := processCountryItems(breakdown.Items, country, previousFilters, breakdown.Rows > 1)
 
-	// Get first 20 items for the table
-	tableItems := processedItemsAll
-	if len(tableItems) > 20 {
-		tableItems = tableItems[:20]
+	// The map shows every country, not just the table's page
+	mapQuery := q
+	mapQuery.Limit, mapQuery.Offset = COUNTRY_MAP_LIMIT, 0
+	mapBreakdown, err := database.GetCountries(c.Request.Context(), mapQuery)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get Countries")
+		return
 	}
 
 	data := map[string]interface{}{
@@ -247,11 +299,12 @@ func GetCountries(c *gin.Context) {
 		"CurrentPeriod":   c.DefaultQuery("p", "24h"),
 		"PreviousFilters": previousFilters,
 		"Items":           tableItems,
-		"MapItems":        processedItemsAll,
-		"QueryString":     buildQueryString(c),
+		"MapItems":        mapBreakdown.Items,
+		"QueryString":     buildQueryString(c, breakdownParams...),
 		"FilterPrimary":   "c",
 	}
 
+	addBreakdownPaging(c, data, breakdown, q)
 	c.HTML(http.StatusOK, "countries-table.html", data)
 }
 
@@ -265,12 +318,21 @@ func GetReferrers(c *gin.Context) {
 		return
 	}
 
-	items, err := database.GetReferrers(c)
+	q, ok := parseBreakdownQuery(c)
+	if !ok {
+		return
+	}
+	breakdown, err := database.GetReferrers(c.Request.Context(), q)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Couldn't get Referrers")
 		return
 	}
 
+	if wantsJSON(c) {
+		writeBreakdownJSON(c, breakdown, q)
+		return
+	}
+
 	referrer, hasReferrer := c.GetQuery("r")
 	previousFilters := make([]string, 0)
 	if hasReferrer {
@@ -278,18 +340,19 @@ func GetReferrers(c *gin.Context) {
 	}
 
 	referrerPath := c.Query("rfp")
-	processedItems := processReferrerItems(items, referrer, referrerPath, previousFilters, len(items) > 1)
+	processedItems := processReferrerItems(breakdown.Items, referrer, referrerPath, previousFilters, breakdown.Rows > 1)
 
 	data := map[string]interface{}{
 		"Domain":          domain,
 		"CurrentPeriod":   c.DefaultQuery("p", "24h"),
 		"PreviousFilters": previousFilters,
 		"Items":           processedItems,
-		"QueryString":     buildQueryString(c),
+		"QueryString":     buildQueryString(c, breakdownParams...),
 		"FilterPrimary":   "r",
 		"FilterSecondary": "rfp",
 	}
 
+	addBreakdownPaging(c, data, breakdown, q)
 	c.HTML(http.StatusOK, "referrers-table.html", data)
 }
 
@@ -303,29 +366,39 @@ func GetPages(c *gin.Context) {
 		return
 	}
 
-	items, err := database.GetPages(c)
+	q, ok := parseBreakdownQuery(c)
+	if !ok {
+		return
+	}
+	breakdown, err := database.GetPages(c.Request.Context(), q)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Couldn't get Pages")
 		return
 	}
 
+	if wantsJSON(c) {
+		writeBreakdownJSON(c, breakdown, q)
+		return
+	}
+
 	path, hasPath := c.GetQuery("pg")
 	previousFilters := make([]string, 0)
 	if hasPath {
 		previousFilters = append(previousFilters, path)
 	}
 
-	processedItems := processPageItems(items, path, previousFilters, len(items) > 1)
+	processedItems := processPageItems(breakdown.Items, path, previousFilters, breakdown.Rows > 1)
 
 	data := map[string]interface{}{
 		"Domain":          domain,
 		"CurrentPeriod":   c.DefaultQuery("p", "24h"),
 		"PreviousFilters": previousFilters,
 		"Items":           processedItems,
-		"QueryString":     buildQueryString(c),
+		"QueryString":     buildQueryString(c, breakdownParams...),
 		"FilterPrimary":   "pg",
 	}
 
+	addBreakdownPaging(c, data, breakdown, q)
 	c.HTML(http.StatusOK, "pages-table.html", data)
 }
 
@@ -343,15 +416,21 @@ func buildTemplateDataShell(c *gin.Context, domain string) *TemplateData {
 		Websites:      config.Config.Websites,
 		CurrentPeriod: c.DefaultQuery("p", "24h"),
 		Periods:       getPeriodOptions(),
+		TimeZone:      pickedTimeZone(c),
+		TimeZones:     getTimeZoneOptions(c, domain),
 		ActiveFilters: buildActiveFilters(c),
 		QueryString:   buildQueryString(c),
+		Admin:         isAdmin(c),
 	}
 }
 
-func buildQueryString(c *gin.Context) string {
+func buildQueryString(c *gin.Context, exclude ...string) string {
 	query := c.Request.URL.Query()
 	query.Del("site")
 	query.Del("p")
+	for _, key := range exclude {
+		query.Del(key)
+	}
 	if len(query) == 0 {
 		return ""
 	}
@@ -511,8 +590,11 @@ func getPeriodOptions() []PeriodOption {
 		{"7d", "Last 7 Days"},
 		{"week", "This Week"},
 		{"lastweek", "Last Week"},
+		{"last-14d", "Last 14 Days"},
 		{"30d", "Last 30 Days"},
 		{"90d", "Last 90 Days"},
+		{"last-6m", "Last 6 Months"},
+		{"last-12m", "Last 12 Months"},
 		{"month", "This Month"},
 		{"lastmonth", "Last Month"},
 		{"year", "This Year"},
@@ -521,6 +603,41 @@ func getPeriodOptions() []PeriodOption {
 	}
 }
 
+func isPeriodOption(period string) bool {
+	for _, option := range getPeriodOptions() {
+		if option.Value == period {
+			return true
+		}
+	}
+	return false
+}
+
+// periodDays returns the first and last day of the query's period in its
+// time zone, as the date picker shows them
+func periodDays(q db.Query) (string, string) {
+	loc := q.Location()
+	start, end := q.TimeRange()
+	last := time.Now()
+	if end != nil {
+		last = *end
+	}
+	return start.In(loc).Format(helpers.PERIOD_DAY_FORMAT), last.In(loc).Format(helpers.PERIOD_DAY_FORMAT)
+}
+
+// getTimeZoneOptions lists the site's time zone, UTC and the browser's, which
+// the page looks up when it's picked, and the one the viewer picked before
+func getTimeZoneOptions(c *gin.Context, domain string) []PeriodOption {
+	options := []PeriodOption{
+		{"", "Site Time (" + helpers.SiteTimeZone(domain) + ")"},
+		{"UTC", "UTC"},
+		{"browser", "Browser Time"},
+	}
+	if picked := pickedTimeZone(c); picked != "" && picked != "UTC" {
+		options = append(options, PeriodOption{picked, picked})
+	}
+	return options
+}
+
 func getDefaultDomain() string {
 	if len(config.Config.Websites) > 0 {
 		return config.Config.Websites[0].Domain
@@ -589,7 +706,7 @@ func processPageItems(items []*db.AnalyticsItem, page string, previousFilters []
 	result := make([]*AnalyticsItemWithIcon, len(items))
 	for i, item := range items {
 		label := getLabel(item, "", previousFilters, true)
-		formatted := formatPageURL(item.Value)
+		formatted := FormatPageURL(item.Value)
 		isClickable := item.Drillable > 0 || hasMultipleItems
 
 		result[i] = &AnalyticsItemWithIcon{
@@ -735,7 +852,7 @@ func getFilterValue(item *db.AnalyticsItem, secondaryFilter string, previousFilt
 	return item.Value
 }
 
-func formatPageURL(input string) string {
+func FormatPageURL(input string) string {
 	if input == "" {
 		return input
 	}
@@ -0,0 +1,78 @@
+package routes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"tinylytics/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ADMIN_COOKIE = "tinylytics_admin"
+
+// adminToken is what the admin cookie holds. It's derived from the configured
+// credentials, so changing the password logs everyone out.
+func adminToken() string {
+	mac := hmac.New(sha256.New, []byte(config.Config.User.Password))
+	mac.Write([]byte(config.Config.User.Username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validCredentials(username string, password string) bool {
+	user := config.Config.User
+	if user.Username == "" || user.Password == "" {
+		return false
+	}
+
+	validUser := subtle.ConstantTimeCompare([]byte(username), []byte(user.Username)) == 1
+	validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) == 1
+	return validUser && validPassword
+}
+
+// isAdmin reports whether the request carries the configured credentials,
+// either as basic auth or through the cookie set by Login
+func isAdmin(c *gin.Context) bool {
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		return validCredentials(username, password)
+	}
+
+	if config.Config.User.Username == "" || config.Config.User.Password == "" {
+		return false
+	}
+
+	cookie, err := c.Cookie(ADMIN_COOKIE)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(cookie), []byte(adminToken()))
+}
+
+// AdminOnly rejects requests that don't come from the configured user
+func AdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			c.Header("WWW-Authenticate", `Basic realm="Tinylytics"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Login - asks the browser for the admin credentials and remembers them in a cookie
+func Login(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(ADMIN_COOKIE, adminToken(), 60*60*24*30, "/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Logout - forgets the admin cookie
+func Logout(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(ADMIN_COOKIE, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, "/")
+}
@@ -0,0 +1,43 @@
+package routes
+
+import (
+	"log"
+	"net/http"
+	"tinylytics/config"
+	"tinylytics/constants"
+	"tinylytics/db"
+	"tinylytics/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateBackups - takes a snapshot of the site given with ?site=, or of every
+// site, into the data folder's backups
+func CreateBackups(c *gin.Context) {
+	domains := make([]string, 0, len(config.Config.Websites))
+	if site := c.Query("site"); site != "" {
+		if _, err := helpers.FindWebsite(site); err != nil {
+			c.String(http.StatusNotFound, "Site not found")
+			return
+		}
+		domains = append(domains, site)
+	} else {
+		for _, website := range config.Config.Websites {
+			domains = append(domains, website.Domain)
+		}
+	}
+
+	manifests := make([]*db.BackupManifest, 0, len(domains))
+	for _, domain := range domains {
+		manifest, err := db.BackupSite(domain, helpers.GetDataPath(constants.BACKUP_FOLDER_NAME))
+		if err != nil {
+			log.Printf("ERROR: [BACKUP] %s: %v", domain, err)
+			c.String(http.StatusInternalServerError, "Couldn't back up "+domain)
+			return
+		}
+		log.Printf("[BACKUP] %s: saved to %s", domain, manifest.Path)
+		manifests = append(manifests, manifest)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"backups": manifests})
+}
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BREAKDOWN_MAX_LIMIT is the most rows a breakdown table can show at once
+const BREAKDOWN_MAX_LIMIT = 500
+
+// COUNTRY_MAP_LIMIT is how many countries the map shows, all of them
+const COUNTRY_MAP_LIMIT = 300
+
+// breakdownParams are the paging params of the breakdown tables, kept out of
+// the links that filter the dashboard
+var breakdownParams = []string{"limit", "offset", "other"}
+
+// parseBreakdownQuery reads the dashboard's query, and the page of rows a
+// breakdown table asked for with ?limit= and ?offset=
+func parseBreakdownQuery(c *gin.Context) (db.Query, bool) {
+	q, ok := parseQuery(c)
+	q.Limit = getIntQuery(c, "limit", db.BREAKDOWN_LIMIT, 1, BREAKDOWN_MAX_LIMIT)
+	q.Offset = getIntQuery(c, "offset", 0, 0, int(^uint(0)>>1))
+	return q, ok
+}
+
+// wantsOther tells if the rows after the page should be summed up in an
+// "Other" row, with ?other=true
+func wantsOther(c *gin.Context) bool {
+	other, _ := strconv.ParseBool(c.Query("other"))
+	return other
+}
+
+// writeBreakdownJSON answers a breakdown request that asked for JSON
+func writeBreakdownJSON(c *gin.Context, breakdown *db.Breakdown, q db.Query) {
+	response := gin.H{
+		"rows":   breakdown.Rows,
+		"limit":  q.Limit,
+		"offset": q.Offset,
+		"items":  breakdown.Items,
+	}
+	if wantsOther(c) && breakdown.Other != nil {
+		response["other"] = breakdown.Other
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// addBreakdownPaging adds the Other row and the "Show more" link of a
+// breakdown table to its template data. Showing more loads the table again
+// with another page of rows, so Other stays the last row.
+func addBreakdownPaging(c *gin.Context, data map[string]interface{}, breakdown *db.Breakdown, q db.Query) {
+	if wantsOther(c) {
+		data["Other"] = breakdown.Other
+	}
+
+	limit := q.Limit + db.BREAKDOWN_LIMIT
+	if !breakdown.HasMore() || limit > BREAKDOWN_MAX_LIMIT {
+		return
+	}
+
+	values := c.Request.URL.Query()
+	values.Set("limit", strconv.Itoa(limit))
+	data["MoreURL"] = c.Request.URL.Path + "?" + values.Encode()
+}
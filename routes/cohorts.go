@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CohortCell struct {
+	Text  string
+	Alpha string
+}
+
+type CohortRow struct {
+	Label    string
+	Visitors int64
+	Cells    []CohortCell
+}
+
+// GetCohorts - returns the retention table for visitors grouped by their first visit
+func GetCohorts(c *gin.Context) {
+	domain := c.Query("site")
+	c.Params = append(c.Params, gin.Param{Key: "domain", Value: domain})
+
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	granularity := c.DefaultQuery("g", db.COHORT_WEEK)
+	periods := getIntQuery(c, "n", 8, 2, 24)
+
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	report, err := database.GetCohorts(c.Request.Context(), q, granularity, periods)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get cohorts")
+		return
+	}
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	labelFormat := "2 Jan 2006"
+	if report.Granularity == db.COHORT_MONTH {
+		labelFormat = "Jan 2006"
+	}
+
+	rows := make([]*CohortRow, len(report.Cohorts))
+	for i, cohort := range report.Cohorts {
+		cells := make([]CohortCell, len(cohort.Retention))
+		for j, retention := range cohort.Retention {
+			cells[j] = CohortCell{
+				Text:  fmt.Sprintf("%.0f%%", retention),
+				Alpha: fmt.Sprintf("%.2f", retention/100),
+			}
+		}
+
+		rows[i] = &CohortRow{
+			Label:    cohort.Period.Format(labelFormat),
+			Visitors: cohort.Visitors,
+			Cells:    cells,
+		}
+	}
+
+	data := map[string]interface{}{
+		"Domain":        domain,
+		"CurrentPeriod": c.DefaultQuery("p", "24h"),
+		"QueryString":   buildQueryString(c, "g", "n"),
+		"Granularity":   report.Granularity,
+		"Periods":       report.Periods,
+		"Rows":          rows,
+	}
+
+	c.HTML(http.StatusOK, "cohorts-table.html", data)
+}
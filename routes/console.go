@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"tinylytics/config"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type consoleInput struct {
+	Name  string `json:"name" form:"name"`
+	Query string `json:"query" form:"query"`
+}
+
+// formatConsoleValue shows a result value in the console table and CSV files
+func formatConsoleValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// renderConsole shows the console window, with the saved query whose id is
+// saved loaded, otherwise query
+func renderConsole(c *gin.Context, database *db.Database, domain string, saved string, query string, message string) {
+	queries, err := database.GetConsoleQueries()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get saved queries")
+		return
+	}
+
+	var selected *db.ConsoleQuery
+	for _, candidate := range queries {
+		if candidate.ID == saved {
+			selected = candidate
+		}
+	}
+
+	if selected != nil {
+		query = selected.Query
+	}
+
+	c.HTML(http.StatusOK, "console.html", gin.H{
+		"Domain":   domain,
+		"Queries":  queries,
+		"Selected": selected,
+		"Query":    query,
+		"Message":  message,
+		"Tables":   strings.Join(db.ConsoleTables, ", "),
+		"MaxRows":  config.Config.Console.MaxRows,
+		"Timeout":  config.Config.Console.Timeout,
+	})
+}
+
+// GetConsole - the SQL console window of the dashboard, ?saved= loads a
+// saved query
+func GetConsole(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	domain, _ := c.Params.Get("domain")
+	renderConsole(c, database, domain, c.Query("saved"), "", "")
+}
+
+// RunConsoleQuery - runs a SELECT on a site's database and returns the rows
+// as JSON, CSV with ?format=csv, or a table for the console window
+func RunConsoleQuery(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	var input consoleInput
+	if err := c.ShouldBind(&input); err != nil {
+		c.String(http.StatusBadRequest, "There's an issue with the query data")
+		return
+	}
+
+	timeout := time.Duration(config.Config.Console.Timeout) * time.Second
+	result, err := database.RunConsoleQuery(c.Request.Context(), input.Query, config.Config.Console.MaxRows, timeout)
+
+	if c.Query("format") == "csv" || c.PostForm("format") == "csv" {
+		if err != nil {
+			consoleError(c, err)
+			return
+		}
+		writeConsoleCSV(c, result)
+		return
+	}
+
+	if wantsJSON(c) {
+		if err != nil {
+			consoleError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	// Errors are shown in the window, htmx doesn't swap in error responses
+	data := gin.H{"MaxRows": config.Config.Console.MaxRows}
+	if err != nil {
+		if !errors.Is(err, db.ErrConsoleQuery) {
+			log.Printf("ERROR: [CONSOLE] Query failed: %v", err)
+		}
+		data["Error"] = err.Error()
+	} else {
+		rows := make([][]string, 0, len(result.Rows))
+		for _, row := range result.Rows {
+			cells := make([]string, 0, len(row))
+			for _, value := range row {
+				cells = append(cells, formatConsoleValue(value))
+			}
+			rows = append(rows, cells)
+		}
+		data["Columns"] = result.Columns
+		data["Rows"] = rows
+		data["Truncated"] = result.Truncated
+		data["Duration"] = fmt.Sprintf("%.3fs", result.Duration)
+	}
+	c.HTML(http.StatusOK, "console-results.html", data)
+}
+
+func consoleError(c *gin.Context, err error) {
+	if errors.Is(err, db.ErrConsoleQuery) {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("ERROR: [CONSOLE] Query failed: %v", err)
+	c.String(http.StatusInternalServerError, "Couldn't run the query")
+}
+
+func writeConsoleCSV(c *gin.Context, result *db.ConsoleResult) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="query.csv"`)
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(result.Columns)
+	for _, row := range result.Rows {
+		cells := make([]string, 0, len(row))
+		for _, value := range row {
+			cells = append(cells, formatConsoleValue(value))
+		}
+		writer.Write(cells)
+	}
+	writer.Flush()
+}
+
+// GetConsoleQueries - lists the queries saved from the console
+func GetConsoleQueries(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	queries, err := database.GetConsoleQueries()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get saved queries")
+		return
+	}
+
+	c.JSON(http.StatusOK, queries)
+}
+
+// SaveConsoleQuery - saves a console query under a name, replacing the query
+// saved under that name if there is one
+func SaveConsoleQuery(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	var input consoleInput
+	if err := c.ShouldBind(&input); err != nil {
+		c.String(http.StatusBadRequest, "There's an issue with the query data")
+		return
+	}
+
+	query := db.ConsoleQuery{
+		ID:    uuid.NewString(),
+		Name:  strings.TrimSpace(input.Name),
+		Query: input.Query,
+	}
+
+	if err := query.Validate(); err != nil {
+		if wantsJSON(c) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		domain, _ := c.Params.Get("domain")
+		renderConsole(c, database, domain, "", input.Query, err.Error())
+		return
+	}
+
+	if err := database.SaveConsoleQuery(&query); err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't save query")
+		return
+	}
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusCreated, &query)
+		return
+	}
+
+	domain, _ := c.Params.Get("domain")
+	renderConsole(c, database, domain, query.ID, "", "Saved "+query.Name)
+}
+
+// DeleteConsoleQuery - removes a saved console query
+func DeleteConsoleQuery(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	if err := database.DeleteConsoleQuery(c.Param("id")); err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't delete query")
+		return
+	}
+
+	if wantsJSON(c) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	domain, _ := c.Params.Get("domain")
+	renderConsole(c, database, domain, "", "", "")
+}
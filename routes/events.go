@@ -2,14 +2,19 @@ package routes
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
+	"tinylytics/archive"
+	"tinylytics/config"
 	"tinylytics/event"
+	"tinylytics/metrics"
 
 	"github.com/gin-gonic/gin"
 )
 
-func PostEvent(eventQueue *event.EventQueue) func(c *gin.Context) {
+func PostEvent(eventQueue *event.EventQueue, eventArchive *archive.Archive) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		uagent := c.Request.Header.Get("User-Agent")
 		chUa := c.Request.Header.Get("Sec-CH-UA")
@@ -26,25 +31,46 @@ func PostEvent(eventQueue *event.EventQueue) func(c *gin.Context) {
 		err := json.NewDecoder(c.Request.Body).Decode(&ed)
 
 		if err != nil {
+			metrics.EventsRejected.Inc(metrics.Site(""), "invalid")
 			c.String(http.StatusBadRequest, "There's an issue with the event data")
 			return
 		}
 
+		site := metrics.Site(ed.Domain)
+
 		if ed.Name != "pageview" {
+			metrics.EventsRejected.Inc(site, "invalid")
 			c.String(http.StatusBadRequest, "Only the 'pageview' event is supported at the moment")
 			return
 		}
 
 		if ed.Domain == "" {
+			metrics.EventsRejected.Inc(site, "invalid")
 			c.String(http.StatusBadRequest, "No domain was set")
 			return
 		}
 
 		if ed.Page == "" {
+			metrics.EventsRejected.Inc(site, "invalid")
 			c.String(http.StatusBadRequest, "No page was set")
 			return
 		}
 
+		admitted, overload := eventQueue.Admit()
+		if !admitted {
+			if overload.Mode == event.OVERLOAD_SAMPLE {
+				// Left out of the sample, there's nothing for the client to retry
+				metrics.EventsRejected.Inc(site, "sampled")
+				c.String(http.StatusOK, "ok")
+				return
+			}
+
+			metrics.EventsRejected.Inc(site, "overloaded")
+			c.Header("Retry-After", strconv.Itoa(config.Config.Queue.RetryAfter))
+			c.String(http.StatusServiceUnavailable, "Too many events are waiting to be processed, try again later")
+			return
+		}
+
 		info := &event.ClientInfo{
 			Name:                      ed.Name,
 			UserAgent:                 uagent,
@@ -62,7 +88,15 @@ func PostEvent(eventQueue *event.EventQueue) func(c *gin.Context) {
 			ScreenWidth:               ed.ScreenWidth,
 		}
 
-		eventQueue.Push(info)
+		if err := eventQueue.Push(info); err != nil {
+			log.Printf("ERROR: [QUEUE] %v", err)
+			metrics.EventsRejected.Inc(site, "queue")
+			c.String(http.StatusServiceUnavailable, "The event couldn't be queued")
+			return
+		}
+
+		metrics.EventsAccepted.Inc(site)
+		event.ArchiveEvent(eventArchive, info)
 
 		c.String(http.StatusOK, "ok")
 	}
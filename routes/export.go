@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportData - downloads a site's raw sessions or events as Parquet or CSV.
+// ?table= and ?format= pick what to export, ?columns= a comma separated
+// list of columns, and the period and filters are the dashboard's.
+func ExportData(c *gin.Context) {
+	domain := c.Param("domain")
+	database, err := db.GetDatabaseByDomain(domain)
+	if err != nil {
+		c.String(http.StatusNotFound, "Site not found")
+		return
+	}
+
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	export := db.Export{
+		Table:  c.DefaultQuery("table", db.EXPORT_SESSIONS),
+		Format: c.DefaultQuery("format", db.EXPORT_PARQUET),
+		Query:  q,
+	}
+	if columns := c.Query("columns"); columns != "" {
+		export.Columns = strings.Split(columns, ",")
+	}
+
+	// Written to a temporary file first, then streamed from disk
+	dir, err := os.MkdirTemp("", "tinylytics-export-")
+	if err != nil {
+		log.Printf("ERROR: [EXPORT] %s: %v", domain, err)
+		c.String(http.StatusInternalServerError, "Couldn't export the data")
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := db.ExportFileName(domain, export)
+	file := filepath.Join(dir, name)
+	rows, err := database.Export(c.Request.Context(), export, file)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidExport) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("ERROR: [EXPORT] %s: %v", domain, err)
+		c.String(http.StatusInternalServerError, "Couldn't export the data")
+		return
+	}
+
+	log.Printf("[EXPORT] %s: %d %s rows as %s", domain, rows, export.Table, export.Format)
+	c.FileAttachment(file, name)
+}
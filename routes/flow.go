@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"net/http"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetFlow - shows the most common pages before and after the selected page
+func GetFlow(c *gin.Context) {
+	domain := c.Query("site")
+	c.Params = append(c.Params, gin.Param{Key: "domain", Value: domain})
+
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	page := c.Query("pg")
+	depth := getIntQuery(c, "d", 3, 1, 10)
+
+	data := map[string]interface{}{
+		"Domain":        domain,
+		"CurrentPeriod": c.DefaultQuery("p", "24h"),
+		"QueryString":   buildQueryString(c),
+		"Page":          page,
+		"Depth":         depth,
+	}
+
+	if page == "" {
+		if wantsJSON(c) {
+			c.String(http.StatusBadRequest, "A page (pg) is required")
+			return
+		}
+		c.HTML(http.StatusOK, "flow-table.html", data)
+		return
+	}
+
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+	q.Limit = db.FLOW_LIMIT
+
+	flow, err := database.GetFlow(c.Request.Context(), q, page, depth)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get user flow")
+		return
+	}
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, flow)
+		return
+	}
+
+	data["Flow"] = flow
+	data["FormattedPage"] = FormatPageURL(page)
+
+	c.HTML(http.StatusOK, "flow-table.html", data)
+}
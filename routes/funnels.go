@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type FunnelStepRow struct {
+	Label      string
+	Sessions   int64
+	Conversion string
+	Overall    string
+	MedianTime string
+}
+
+func funnelStepLabel(step db.FunnelStep) string {
+	if step.Type == db.FUNNEL_STEP_EVENT {
+		return "Event: " + step.Match
+	}
+	return "Page: " + step.Match
+}
+
+// GetFunnels - lists the funnels defined for a site
+func GetFunnels(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	funnels, err := database.GetFunnels()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get funnels")
+		return
+	}
+
+	c.JSON(http.StatusOK, funnels)
+}
+
+// CreateFunnel - adds a new funnel definition to a site
+func CreateFunnel(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	var input db.Funnel
+	if err := json.NewDecoder(c.Request.Body).Decode(&input); err != nil {
+		c.String(http.StatusBadRequest, "There's an issue with the funnel data")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	funnel := db.Funnel{
+		ID:    uuid.NewString(),
+		Name:  input.Name,
+		Steps: input.Steps,
+	}
+
+	if err := database.SaveFunnel(&funnel); err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't save funnel")
+		return
+	}
+
+	c.JSON(http.StatusCreated, &funnel)
+}
+
+// UpdateFunnel - replaces the name and steps of an existing funnel
+func UpdateFunnel(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	existing, err := database.GetFunnel(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get funnel")
+		return
+	}
+	if existing == nil {
+		c.String(http.StatusNotFound, "Funnel not found")
+		return
+	}
+
+	var funnel db.Funnel
+	if err := json.NewDecoder(c.Request.Body).Decode(&funnel); err != nil {
+		c.String(http.StatusBadRequest, "There's an issue with the funnel data")
+		return
+	}
+
+	if err := funnel.Validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	existing.Name = funnel.Name
+	existing.Steps = funnel.Steps
+
+	if err := database.SaveFunnel(existing); err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't save funnel")
+		return
+	}
+
+	c.JSON(http.StatusOK, existing)
+}
+
+// DeleteFunnel - removes a funnel definition
+func DeleteFunnel(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	if err := database.DeleteFunnel(c.Param("id")); err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't delete funnel")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetFunnelReport - shows how many sessions made it through each funnel step.
+// The funnel comes from the :id route param or the "f" query param, falling
+// back to the first funnel of the site.
+func GetFunnelReport(c *gin.Context) {
+	domain := c.Query("site")
+	c.Params = append(c.Params, gin.Param{Key: "domain", Value: domain})
+
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	domain, _ = c.Params.Get("domain")
+
+	funnels, err := database.GetFunnels()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get funnels")
+		return
+	}
+
+	funnelID := c.Param("id")
+	if funnelID == "" {
+		funnelID = c.Query("f")
+	}
+
+	var funnel *db.Funnel
+	for _, f := range funnels {
+		if f.ID == funnelID || (funnelID == "" && funnel == nil) {
+			funnel = f
+		}
+	}
+
+	if funnel == nil && (funnelID != "" || wantsJSON(c)) {
+		c.String(http.StatusNotFound, "Funnel not found")
+		return
+	}
+
+	data := map[string]interface{}{
+		"Domain":        domain,
+		"CurrentPeriod": c.DefaultQuery("p", "24h"),
+		"QueryString":   buildQueryString(c, "f"),
+		"Funnels":       funnels,
+		"Funnel":        funnel,
+	}
+
+	if funnel == nil {
+		c.HTML(http.StatusOK, "funnels-table.html", data)
+		return
+	}
+
+	// Funnels saved before steps were capped
+	if len(funnel.Steps) > db.MAX_FUNNEL_STEPS {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Funnel has more than %d steps", db.MAX_FUNNEL_STEPS))
+		return
+	}
+
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	report, err := database.GetFunnelReport(c.Request.Context(), q, funnel, domain)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get funnel report")
+		return
+	}
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	rows := make([]*FunnelStepRow, len(report.Steps))
+	for i, step := range report.Steps {
+		row := &FunnelStepRow{
+			Label:      funnelStepLabel(step.FunnelStep),
+			Sessions:   step.Sessions,
+			Conversion: fmt.Sprintf("%.1f%%", step.Conversion),
+			Overall:    fmt.Sprintf("%.1f%%", step.OverallConversion),
+		}
+		if step.MedianSeconds != nil {
+			row.MedianTime = formatDuration(*step.MedianSeconds)
+		}
+		rows[i] = row
+	}
+
+	data["Steps"] = rows
+
+	c.HTML(http.StatusOK, "funnels-table.html", data)
+}
@@ -2,6 +2,9 @@ package routes
 
 import (
 	"html/template"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
 )
 
 // LoadTemplates loads all HTML templates
@@ -10,3 +13,23 @@ func LoadTemplates() *template.Template {
 	return tmpl
 }
 
+// wantsJSON reports whether the client asked for JSON rather than an HTML fragment
+func wantsJSON(c *gin.Context) bool {
+	return c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON
+}
+
+// getIntQuery reads an integer query param, falling back to def when it is
+// missing or invalid and clamping it to [min, max]
+func getIntQuery(c *gin.Context, key string, def, min, max int) int {
+	value, err := strconv.Atoi(c.Query(key))
+	if err != nil {
+		return def
+	}
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
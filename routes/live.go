@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"io"
+	"net/http"
+	"time"
+	"tinylytics/helpers"
+	"tinylytics/live"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getLiveDomain(c *gin.Context) string {
+	domain := c.Query("site")
+	if domain == "" {
+		domain = c.Param("domain")
+	}
+
+	if _, err := helpers.FindWebsite(domain); err != nil {
+		c.String(http.StatusNotFound, "Site not found")
+		return ""
+	}
+
+	return domain
+}
+
+// GetLive - returns the visitors active in the last few minutes
+func GetLive(c *gin.Context) {
+	domain := getLiveDomain(c)
+	if domain == "" {
+		return
+	}
+
+	c.JSON(http.StatusOK, live.GetSnapshot(domain))
+}
+
+// GetLiveStream - pushes a snapshot over server-sent events every time an
+// event for the site is processed. A snapshot is also sent periodically so
+// visitors drop off the counter when the site goes quiet.
+func GetLiveStream(c *gin.Context) {
+	domain := getLiveDomain(c)
+	if domain == "" {
+		return
+	}
+
+	updates, unsubscribe := live.Subscribe(domain)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("snapshot", live.GetSnapshot(domain))
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case snapshot, ok := <-updates:
+			if !ok {
+				return false
+			}
+			c.SSEvent("snapshot", snapshot)
+		case <-ticker.C:
+			c.SSEvent("snapshot", live.GetSnapshot(domain))
+		}
+		return true
+	})
+}
@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"tinylytics/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics counts and times every request by its route pattern
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "(unmatched)"
+		}
+
+		metrics.HTTPRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route)
+	}
+}
+
+// GetMetrics - exposes the metrics in the Prometheus text format
+func GetMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	metrics.WriteTo(c.Writer)
+}
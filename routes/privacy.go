@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"tinylytics/archive"
+	"tinylytics/constants"
+	"tinylytics/event"
+	"tinylytics/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+type privacyInput struct {
+	event.Visitor
+	Reference string `json:"reference" form:"reference"`
+}
+
+// bindPrivacyRequest reads the site and visitor of an access or erasure
+// request, answering it when they're missing
+func bindPrivacyRequest(c *gin.Context) (string, *privacyInput) {
+	domain := c.Param("domain")
+	if _, err := helpers.FindWebsite(domain); err != nil {
+		c.String(http.StatusNotFound, "Site not found")
+		return "", nil
+	}
+
+	var input privacyInput
+	if err := c.ShouldBind(&input); err != nil {
+		c.String(http.StatusBadRequest, "There's an issue with the request data")
+		return "", nil
+	}
+	if err := input.Validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return "", nil
+	}
+
+	return domain, &input
+}
+
+// AccessVisitor - returns everything a site keeps about a visitor, given by
+// user ident or by IP address and user agent
+func AccessVisitor(c *gin.Context) {
+	domain, input := bindPrivacyRequest(c)
+	if input == nil {
+		return
+	}
+
+	report, err := event.AccessVisitor(helpers.GetDataPath(constants.ARCHIVE_FOLDER_NAME), domain, input.Visitor, input.Reference)
+	if err != nil {
+		log.Printf("ERROR: [PRIVACY] Access request for %s failed: %v", domain, err)
+		c.String(http.StatusInternalServerError, "Couldn't find the visitor's data")
+		return
+	}
+
+	log.Printf("[PRIVACY] Access request for %s: %d sessions, %d events, %d archived events", domain, len(report.Sessions), len(report.Events), len(report.Archived))
+	c.JSON(http.StatusOK, report)
+}
+
+// EraseVisitor - deletes everything a site keeps about a visitor, from its
+// databases, rollups, the event archive and the dead letters
+func EraseVisitor(eventQueue *event.EventQueue, eventArchive *archive.Archive) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		domain, input := bindPrivacyRequest(c)
+		if input == nil {
+			return
+		}
+
+		result, err := event.EraseVisitor(eventArchive, eventQueue.DeadLetters(), helpers.GetDataPath(constants.ARCHIVE_FOLDER_NAME), domain, input.Visitor, input.Reference)
+		if errors.Is(err, event.ErrNoUserIdents) {
+			c.String(http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: [PRIVACY] Erasure request for %s failed: %v", domain, err)
+			c.String(http.StatusInternalServerError, "Couldn't erase the visitor's data")
+			return
+		}
+
+		log.Printf("[PRIVACY] Erasure request for %s: %d identities, %d archived events, %d dead letters", domain, result.UserIdents, result.Archived, result.DeadLetters)
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"tinylytics/constants"
+	"tinylytics/db"
+	"tinylytics/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TIMEZONE_COOKIE keeps the time zone the viewer picked, the filter bar sets it
+const TIMEZONE_COOKIE = "tinylytics_tz"
+
+// filterValue reads a filter query param. The dashboard sends "null" for
+// sessions without a value.
+func filterValue(values url.Values, key string) *string {
+	if !values.Has(key) {
+		return nil
+	}
+	value := values.Get(key)
+	if value == "null" {
+		value = ""
+	}
+	return &value
+}
+
+// versionFilter reads a version query param, its parts separated by "/"
+func versionFilter(values url.Values, key string) []string {
+	if !values.Has(key) {
+		return nil
+	}
+	value := values.Get(key)
+
+	parts := strings.Split(value, "/")
+	for i, part := range parts {
+		if part == "null" {
+			parts[i] = ""
+		}
+	}
+	return parts
+}
+
+// parseQuery reads the dashboard's period and filters from the query string,
+// counted in the viewer's time zone. Handlers set the limit, offset and sort
+// they support themselves. An invalid period is answered with a 400, and
+// false is returned.
+func parseQuery(c *gin.Context) (db.Query, bool) {
+	q := QueryFromValues(c.Request.URL.Query())
+	if q.TimeZone == "" {
+		q.TimeZone = viewerTimeZone(c)
+	}
+
+	if err := q.Validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return q, false
+	}
+	return q, true
+}
+
+// pickedTimeZone returns the time zone the viewer picked, kept in a cookie,
+// overridden by the tz query param. It's empty when they didn't pick one.
+func pickedTimeZone(c *gin.Context) string {
+	if tz := c.Query("tz"); helpers.ValidTimeZone(tz) {
+		return tz
+	}
+	if tz, err := c.Cookie(TIMEZONE_COOKIE); err == nil && helpers.ValidTimeZone(tz) {
+		return tz
+	}
+	return ""
+}
+
+// viewerTimeZone returns the time zone the viewer picked, or the site's
+func viewerTimeZone(c *gin.Context) string {
+	if tz := pickedTimeZone(c); tz != "" {
+		return tz
+	}
+
+	domain := c.Query("site")
+	if domain == "" {
+		domain = c.Param("domain")
+	}
+	return helpers.SiteTimeZone(domain)
+}
+
+// QueryFromValues reads a period and filters given the way the dashboard
+// sends them, e.g. p=30d&b=Chrome&bv=120. The time zone is tz's when it's a
+// valid one, the caller picks it otherwise.
+func QueryFromValues(values url.Values) db.Query {
+	filters := db.Filters{
+		Browser:         filterValue(values, "b"),
+		OS:              filterValue(values, "os"),
+		Country:         filterValue(values, "c"),
+		Referer:         filterValue(values, "r"),
+		RefererFullPath: filterValue(values, "rfp"),
+	}
+	if filters.Browser != nil {
+		filters.BrowserVersion = versionFilter(values, "bv")
+	}
+	if filters.OS != nil {
+		filters.OSVersion = versionFilter(values, "osv")
+	}
+	if values.Has("pg") {
+		page := values.Get("pg")
+		filters.Page = &page
+	}
+
+	period := values.Get("p")
+	if period == "" {
+		period = constants.DATE_RAGE_24H
+	}
+
+	timeZone := values.Get("tz")
+	if !helpers.ValidTimeZone(timeZone) {
+		timeZone = ""
+	}
+
+	return db.Query{
+		Period:   period,
+		TimeZone: timeZone,
+		Filters:  filters,
+	}
+}
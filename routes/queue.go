@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"tinylytics/event"
+
+	"github.com/gin-gonic/gin"
+)
+
+func deadLetterError(c *gin.Context, err error) {
+	if errors.Is(err, event.ErrDeadLetterNotFound) {
+		c.String(http.StatusNotFound, "Dead letter not found")
+		return
+	}
+
+	log.Printf("ERROR: [QUEUE] Dead letter request failed: %v", err)
+	c.String(http.StatusInternalServerError, "Couldn't access the dead-letter queue")
+}
+
+// GetDeadLetters - lists the events that failed processing, oldest first
+func GetDeadLetters(eventQueue *event.EventQueue) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		letters, err := eventQueue.DeadLetters().List()
+		if err != nil {
+			deadLetterError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"queueSize":   eventQueue.GetSize(),
+			"deadLetters": letters,
+		})
+	}
+}
+
+// GetDeadLetter - shows a single failed event
+func GetDeadLetter(eventQueue *event.EventQueue) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		letter, err := eventQueue.DeadLetters().Get(c.Param("id"))
+		if err != nil {
+			deadLetterError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, letter)
+	}
+}
+
+// ReplayDeadLetter - puts a failed event back at the end of the event queue
+func ReplayDeadLetter(eventQueue *event.EventQueue) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := eventQueue.DeadLetters().Replay(c.Param("id"), eventQueue); err != nil {
+			deadLetterError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// DiscardDeadLetter - deletes a failed event for good
+func DiscardDeadLetter(eventQueue *event.EventQueue) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := eventQueue.DeadLetters().Remove(c.Param("id")); err != nil {
+			deadLetterError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// GetQueueStatus - tells whether ingestion is overloaded, the dashboard shows
+// a banner when it is
+func GetQueueStatus(eventQueue *event.EventQueue) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		overload := eventQueue.GetOverload()
+
+		if wantsJSON(c) {
+			c.JSON(http.StatusOK, overload)
+			return
+		}
+
+		c.HTML(http.StatusOK, "queue-status.html", overload)
+	}
+}
@@ -0,0 +1,218 @@
+package routes
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"tinylytics/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SessionRow struct {
+	ID              string    `json:"id"`
+	UserIdent       string    `json:"userIdent"`
+	Browser         string    `json:"browser"`
+	OS              string    `json:"os"`
+	Country         string    `json:"country"`
+	CountryName     string    `json:"countryName"`
+	Referer         string    `json:"referer"`
+	RefererFullPath string    `json:"refererFullPath"`
+	UserAgent       string    `json:"userAgent"`
+	ScreenWidth     int64     `json:"screenWidth"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Duration        string    `json:"-"`
+	Events          int64     `json:"events"`
+}
+
+type TimelineRow struct {
+	Name   string    `json:"name"`
+	Page   string    `json:"page"`
+	Time   time.Time `json:"time"`
+	Offset string    `json:"-"`
+}
+
+// maskIdentifier keeps just enough of a hash to tell rows apart
+func maskIdentifier(value string) string {
+	if len(value) <= 8 {
+		return value
+	}
+	return value[:8] + "…"
+}
+
+func joinVersion(name string, parts ...string) string {
+	version := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part == "" {
+			break
+		}
+		version = append(version, part)
+	}
+
+	if name == "" {
+		name = "(unknown)"
+	}
+	if len(version) == 0 {
+		return name
+	}
+	return name + " " + strings.Join(version, ".")
+}
+
+// buildSessionRow flattens a session for display, with its times in the
+// viewer's time zone. The user agent and visitor identifier can point back to
+// a person, so only admins get to see them.
+func buildSessionRow(session *db.UserSessionDuckDB, admin bool, loc *time.Location) *SessionRow {
+	duration := session.SessionEnd.Sub(session.SessionStart).Seconds()
+
+	row := &SessionRow{
+		ID:              session.ID,
+		UserIdent:       session.UserIdent,
+		Browser:         joinVersion(session.Browser, session.BrowserMajor, session.BrowserMinor, session.BrowserPatch),
+		OS:              joinVersion(session.OS, session.OSMajor, session.OSMinor, session.OSPatch),
+		Country:         session.Country,
+		CountryName:     getCountryName(session.Country),
+		Referer:         session.Referer,
+		RefererFullPath: session.RefererFullPath,
+		UserAgent:       session.UserAgent,
+		ScreenWidth:     session.ScreenWidth,
+		Start:           session.SessionStart.In(loc),
+		End:             session.SessionEnd.In(loc),
+		DurationSeconds: duration,
+		Duration:        formatDuration(duration),
+		Events:          session.Events,
+	}
+
+	if !admin {
+		row.UserIdent = maskIdentifier(row.UserIdent)
+		row.UserAgent = "(hidden)"
+	}
+
+	return row
+}
+
+// GetSessions - lists the sessions matching the current filters, one page at a time
+func GetSessions(c *gin.Context) {
+	domain := c.Query("site")
+	c.Params = append(c.Params, gin.Param{Key: "domain", Value: domain})
+
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	sort := c.DefaultQuery("sort", "newest")
+	limit := getIntQuery(c, "limit", db.SESSION_LIST_LIMIT, 1, 100)
+	offset := getIntQuery(c, "offset", 0, 0, int(^uint(0)>>1))
+
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+	q.Sort, q.Limit, q.Offset = sort, limit, offset
+
+	sessions, total, err := database.GetSessionList(c.Request.Context(), q)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get sessions")
+		return
+	}
+
+	admin, loc := isAdmin(c), q.Location()
+	rows := make([]*SessionRow, len(sessions))
+	for i, session := range sessions {
+		rows[i] = buildSessionRow(session, admin, loc)
+	}
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{
+			"total":    total,
+			"limit":    limit,
+			"offset":   offset,
+			"sessions": rows,
+		})
+		return
+	}
+
+	previousOffset := offset - limit
+	if previousOffset < 0 {
+		previousOffset = 0
+	}
+
+	data := map[string]interface{}{
+		"Domain":         domain,
+		"CurrentPeriod":  c.DefaultQuery("p", "24h"),
+		"QueryString":    buildQueryString(c, "sort", "offset"),
+		"Sort":           sort,
+		"Rows":           rows,
+		"Total":          total,
+		"From":           offset + 1,
+		"To":             offset + len(rows),
+		"HasPrevious":    offset > 0,
+		"HasNext":        int64(offset+limit) < total,
+		"PreviousOffset": previousOffset,
+		"NextOffset":     offset + limit,
+	}
+
+	c.HTML(http.StatusOK, "sessions-table.html", data)
+}
+
+// GetSessionTimeline - shows every event of a single session in order
+func GetSessionTimeline(c *gin.Context) {
+	domain := c.Query("site")
+	c.Params = append(c.Params, gin.Param{Key: "domain", Value: domain})
+
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	id := c.Param("id")
+	if id == "" {
+		id = c.Query("id")
+	}
+
+	session, err := database.GetSession(id)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get session")
+		return
+	}
+	if session == nil {
+		c.String(http.StatusNotFound, "Session not found")
+		return
+	}
+
+	events, err := database.GetSessionEvents(id)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get session events")
+		return
+	}
+
+	// The zone is always a valid one
+	loc, _ := time.LoadLocation(viewerTimeZone(c))
+
+	timeline := make([]*TimelineRow, len(events))
+	for i, event := range events {
+		timeline[i] = &TimelineRow{
+			Name:   event.Name,
+			Page:   FormatPageURL(event.Page),
+			Time:   event.EventTime.In(loc),
+			Offset: formatDuration(event.EventTime.Sub(session.SessionStart).Seconds()),
+		}
+	}
+
+	row := buildSessionRow(session, isAdmin(c), loc)
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{
+			"session": row,
+			"events":  timeline,
+		})
+		return
+	}
+
+	c.HTML(http.StatusOK, "session-timeline.html", map[string]interface{}{
+		"Session":  row,
+		"Timeline": timeline,
+	})
+}
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetDailyTotals - returns the saved totals of the site's purged days in the
+// period, see keep-daily-totals
+func GetDailyTotals(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	from, to := q.TimeRange()
+	if to == nil {
+		now := time.Now().UTC()
+		to = &now
+	}
+
+	totals, err := database.GetDailyTotals(from, *to)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Couldn't get daily totals")
+		return
+	}
+
+	c.JSON(http.StatusOK, totals)
+}
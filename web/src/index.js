@@ -1,2 +1,3 @@
 import './world-map.js';
-import './app-window.js';
\ No newline at end of file
+import './app-window.js';
+import './live-visitors.js';
\ No newline at end of file
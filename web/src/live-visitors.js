@@ -0,0 +1,91 @@
+// Live Visitors Web Component
+// Subscribes to the server-sent events stream of a site and shows the
+// visitors active in the last few minutes, where they are and a ticker of
+// the latest events.
+// Usage:
+//   <live-visitors src="/api/example.com/live/stream"></live-visitors>
+
+(function () {
+  'use strict';
+
+  class LiveVisitors extends HTMLElement {
+    connectedCallback() {
+      this.innerHTML = `
+        <div class="live-row">
+          <div class="sunken-panel live-summary">
+            <div class="summary-card live-count">0</div>
+            <div class="live-label">visitors in the last 5 minutes</div>
+            <ul class="live-ticker"></ul>
+          </div>
+          <div class="sunken-panel">
+            <table>
+              <thead><tr><th>Current Page</th><th>Visitors</th></tr></thead>
+              <tbody class="live-pages"></tbody>
+            </table>
+          </div>
+          <div class="sunken-panel">
+            <table>
+              <thead><tr><th>Referrer</th><th>Visitors</th></tr></thead>
+              <tbody class="live-referrers"></tbody>
+            </table>
+          </div>
+        </div>
+      `;
+
+      this._count = this.querySelector('.live-count');
+      this._ticker = this.querySelector('.live-ticker');
+      this._pages = this.querySelector('.live-pages');
+      this._referrers = this.querySelector('.live-referrers');
+
+      const src = this.getAttribute('src');
+      if (!src) return;
+
+      this._source = new EventSource(src);
+      this._source.addEventListener('snapshot', (event) => {
+        this._render(JSON.parse(event.data));
+      });
+    }
+
+    disconnectedCallback() {
+      if (this._source) this._source.close();
+    }
+
+    _render(snapshot) {
+      this._count.textContent = snapshot.activeVisitors;
+      this._renderItems(this._pages, snapshot.topPages, (value) => this._formatPage(value));
+      this._renderItems(this._referrers, snapshot.topReferrers, (value) => value);
+
+      this._ticker.replaceChildren(
+        ...(snapshot.recent || []).map((event) => {
+          const li = document.createElement('li');
+          const time = new Date(event.time).toLocaleTimeString();
+          li.textContent = `${time} ${this._formatPage(event.page)} (${event.browser || 'unknown'}, ${event.country || '??'})`;
+          return li;
+        })
+      );
+    }
+
+    _renderItems(tbody, items, format) {
+      tbody.replaceChildren(
+        ...(items || []).map((item) => {
+          const tr = document.createElement('tr');
+          const name = document.createElement('td');
+          const count = document.createElement('td');
+          name.textContent = format(item.value);
+          count.textContent = item.count;
+          count.style.textAlign = 'right';
+          count.style.width = '50px';
+          tr.append(name, count);
+          return tr;
+        })
+      );
+    }
+
+    _formatPage(page) {
+      const slash = (page || '').indexOf('/');
+      return slash === -1 ? page : page.substring(slash);
+    }
+  }
+
+  customElements.define('live-visitors', LiveVisitors);
+})();